@@ -15,31 +15,75 @@ type Agent struct {
 	soCName      string
 	MemTable     *sharedmem.MemTable
 	MemManager   *MemoryManager
+	Compactor    *Compactor
+	Tracker      *sharedmem.TaskMemoryTracker
+	Tasks        *TaskMemoryManager
+	Reaper       *Reaper
+	Heartbeat    *Heartbeat
+	Pressure     *PressureMonitor
 	rpcClients   map[string]*nrpc.Client
 	pythonClient *PythonClient
+	ready        chan struct{} // closed once Run has connected to the other SoCs
 }
 
 func NewAgent(cfg config.SoCConfig, memTable *sharedmem.MemTable) *Agent {
 
 	ramBytes := cfg.MemoryMB * 1024 * 1024
 	memManager := NewMemoryManager(cfg.Name, memTable, ramBytes, cfg.Name)
+	tracker := sharedmem.NewTaskMemoryTracker(memTable)
 	return &Agent{
 		soCName:    cfg.Name,
 		MemTable:   memTable,
 		MemManager: memManager,
+		Compactor:  NewCompactor(memManager),
+		Tracker:    tracker,
+		Tasks:      NewTaskMemoryManager(memManager, tracker),
+		Reaper:     NewReaper(memManager, tracker),
+		Pressure:   NewPressureMonitor(memManager),
 		rpcClients: make(map[string]*nrpc.Client),
+		ready:      make(chan struct{}),
 	}
 }
 
 func (a *Agent) StartRPCServer(address string) {
 	go func() {
-		err := rpc.StartRPCServer(a.MemManager, address)
+		err := rpc.StartRPCServer(a.MemManager, a.Tasks, address)
 		if err != nil {
 			log.Fatalf("RPC server error: %v", err)
 		}
 	}()
 }
 
+// StartJSONRPCServer serves the RPC handlers as JSON-RPC for Python tasks.
+func (a *Agent) StartJSONRPCServer(address string) {
+	go func() {
+		err := rpc.StartJSONRPCServer(a.MemManager, a.Tasks, address)
+		if err != nil {
+			log.Fatalf("JSON-RPC server error: %v", err)
+		}
+	}()
+}
+
+// StartNBDServer exports a zeroed VMem of `size` bytes, striped over
+// `owners`, as the NBD export `name` on `address`. The VMem is allocated once
+// Run has connected to the other SoCs.
+func (a *Agent) StartNBDServer(address string, name string, size uint64, owners []string) {
+	go func() {
+		<-a.ready
+		v, err := sharedmem.NewStriped(size, a.MemManager, owners)
+		if err != nil {
+			log.Fatalf("NBD export allocation failed: %v", err)
+		}
+		log.Printf("[NBD] Exporting %q: %d bytes at 0x%x striped over %v", name, v.Size, v.StartAddr, owners)
+
+		server := NewNBDServer()
+		server.Export(name, v)
+		if err := server.ListenAndServe(address); err != nil {
+			log.Fatalf("NBD server error: %v", err)
+		}
+	}()
+}
+
 // StartPythonClient connects to the persistent Python interpreter on the big SoC.
 func (a *Agent) StartPythonClient(cfg config.SoCConfig) error {
 	if cfg.PythonPort == 0 {
@@ -50,6 +94,7 @@ func (a *Agent) StartPythonClient(cfg config.SoCConfig) error {
 		return err
 	}
 	a.pythonClient = cli
+	a.Tasks.Runner = cli
 	return nil
 }
 
@@ -65,6 +110,20 @@ func (a *Agent) Run(allConfigs []config.SoCConfig, rpcListenAddr string) {
 		log.Printf("Error connecting RPC clients: %v", err)
 	}
 	a.rpcClients = clients
+	for name, client := range clients {
+		a.MemManager.RegisterRPCClient(name, client)
+	}
+	// Clients still connecting, and SoCs that restart, are dialled again on demand
+	for _, c := range allConfigs {
+		if c.Name == a.soCName {
+			continue
+		}
+		addr := c.Address
+		a.MemManager.RegisterRPCDialer(c.Name, func() (*nrpc.Client, error) {
+			return nrpc.Dial("tcp", addr)
+		})
+	}
+	close(a.ready)
 
 	// Find big SoC and connect Python client (if this is NOT the big, this is just client)
 	var bigSoC *config.SoCConfig
@@ -85,9 +144,33 @@ func (a *Agent) Run(allConfigs []config.SoCConfig, rpcListenAddr string) {
 		log.Println("No big SoC with python port configured")
 	}
 
+	// SoCs that stop answering are declared dead so the reaper frees their leases
+	var peers []string
+	for _, c := range allConfigs {
+		if c.Name != a.soCName {
+			peers = append(peers, c.Name)
+		}
+	}
+	a.Heartbeat = NewHeartbeat(a.Reaper, peers, func(soc string) error {
+		return a.MemManager.Ping(soc, 2*time.Second)
+	})
+
+	a.Compactor.Start()
+	a.Reaper.Start()
+	a.Heartbeat.Start()
+	a.Pressure.Start()
+
 	// Main event loop
 	for {
 		time.Sleep(10 * time.Second)
+		a.verifyMemTable()
 		// TODO: health checks, listen for tasks, etc.
 	}
 }
+
+// verifyMemTable checks the MemTable for drift and logs what it finds.
+func (a *Agent) verifyMemTable() {
+	for _, problem := range a.MemManager.VerifyTable() {
+		log.Printf("[Verify] %s", problem)
+	}
+}
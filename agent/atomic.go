@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"bigLITTLE/rpc"
+)
+
+// CompareAndSwap atomically replaces the 8-byte little-endian word at `addr`
+// with `new` if it holds `old`. The word is changed on the SoC holding it,
+// so the operation is atomic against every other access going through its
+// agent. `addr` must be 8-byte aligned.
+func (m *MemoryManager) CompareAndSwap(ctx context.Context, addr uint64, old uint64, new uint64) (bool, error) {
+	resp, err := m.atomic(addr, rpc.AtomicRequest{Op: rpc.AtomicCAS, Old: old, New: new})
+	return resp.Swapped, err
+}
+
+// FetchAdd atomically adds `delta` to the 8-byte little-endian word at `addr`
+// and returns its previous value. Subtract by adding the two's complement.
+// `addr` must be 8-byte aligned.
+func (m *MemoryManager) FetchAdd(ctx context.Context, addr uint64, delta uint64) (uint64, error) {
+	resp, err := m.atomic(addr, rpc.AtomicRequest{Op: rpc.AtomicAdd, Delta: delta})
+	return resp.Value, err
+}
+
+// atomic resolves the word at `addr` and runs `req` on the SoC holding it.
+func (m *MemoryManager) atomic(addr uint64, req rpc.AtomicRequest) (rpc.AtomicResponse, error) {
+	if addr%8 != 0 {
+		return rpc.AtomicResponse{}, fmt.Errorf("atomic operation on unaligned address 0x%x", addr)
+	}
+	m.pageLock.RLock()
+	defer m.pageLock.RUnlock()
+
+	segs, err := m.Table.TranslateRange(addr, 8)
+	if err != nil {
+		return rpc.AtomicResponse{}, err
+	}
+	if len(segs) != 1 {
+		return rpc.AtomicResponse{}, fmt.Errorf("word at 0x%x is not physically contiguous", addr)
+	}
+	req.Offset = segs[0].Offset
+
+	if segs[0].SoC == m.LocalSoCName {
+		return m.AtomicPhys(req)
+	}
+	client, ok := m.client(segs[0].SoC)
+	if !ok {
+		return rpc.AtomicResponse{}, fmt.Errorf("no RPC client for SoC %s", segs[0].SoC)
+	}
+	resp := rpc.AtomicResponse{}
+	if err := client.Call("RPCServer.AtomicPhys", &req, &resp); err != nil {
+		return rpc.AtomicResponse{}, fmt.Errorf("RPC atomic operation failed: %w", err)
+	}
+	return resp, nil
+}
+
+// AtomicPhys runs an atomic operation on the word at `req.Offset` in local
+// memory, without translation.
+func (m *MemoryManager) AtomicPhys(req rpc.AtomicRequest) (rpc.AtomicResponse, error) {
+	m.ramLock.Lock()
+	defer m.ramLock.Unlock()
+
+	if req.Offset+8 > uint64(len(m.localRAM)) {
+		return rpc.AtomicResponse{}, errors.New("atomic operation out of bounds")
+	}
+	word := m.localRAM[req.Offset : req.Offset+8]
+	current := binary.LittleEndian.Uint64(word)
+
+	resp := rpc.AtomicResponse{Value: current}
+	switch req.Op {
+	case rpc.AtomicCAS:
+		if current == req.Old {
+			binary.LittleEndian.PutUint64(word, req.New)
+			resp.Swapped = true
+		}
+	case rpc.AtomicAdd:
+		binary.LittleEndian.PutUint64(word, current+req.Delta)
+	default:
+		return rpc.AtomicResponse{}, fmt.Errorf("unknown atomic operation %d", req.Op)
+	}
+	return resp, nil
+}
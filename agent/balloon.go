@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+)
+
+// Lend gives `size` bytes of this SoC's free memory to `borrower`. The loan
+// is recorded in this table and in the borrower's, which then allocates from
+// it like its own memory.
+func (m *MemoryManager) Lend(borrower string, size uint64) (sharedmem.Loan, error) {
+	loan, err := m.Table.Lend(m.LocalSoCName, borrower, size)
+	if err != nil {
+		return sharedmem.Loan{}, err
+	}
+
+	client, ok := m.client(borrower)
+	if !ok {
+		// Borrower shares this table, as in single-process setups
+		return loan, nil
+	}
+	req := &rpc.LoanRequest{Loan: loan}
+	resp := &rpc.MemoryResponse{}
+	if err := client.Call("RPCServer.AcceptLoan", req, resp); err != nil {
+		m.Table.Reclaim(loan.Region.StartAddr, m.copyRegion)
+		return sharedmem.Loan{}, fmt.Errorf("RPC loan to %s failed: %w", borrower, err)
+	}
+	log.Printf("[Balloon] Lent 0x%x+%d to %s", loan.Region.StartAddr, loan.Region.Length, borrower)
+	return loan, nil
+}
+
+// AcceptLoan records memory another SoC lent to this one.
+func (m *MemoryManager) AcceptLoan(loan sharedmem.Loan) error {
+	return m.Table.AcceptLoan(loan)
+}
+
+// ReturnLoan gives back the loan starting at `addr`, moving this SoC's
+// allocations out of it first. Called on the borrower.
+func (m *MemoryManager) ReturnLoan(addr uint64) error {
+	return m.Table.Reclaim(addr, m.copyRegion)
+}
+
+// Reclaim takes back the loan starting at `addr`. The lender asks the
+// borrower to evacuate and return it, then ends the loan in its own table.
+func (m *MemoryManager) Reclaim(addr uint64) error {
+	loan, ok := m.Table.LoanAt(addr)
+	if !ok || loan.Region.StartAddr != addr {
+		return fmt.Errorf("no loan at address 0x%x", addr)
+	}
+	if loan.Lender != m.LocalSoCName {
+		return m.ReturnLoan(addr)
+	}
+
+	if client, ok := m.client(loan.Region.Owner); ok {
+		req := &rpc.ReclaimRequest{Address: addr}
+		resp := &rpc.MemoryResponse{}
+		if err := client.Call("RPCServer.ReturnLoan", req, resp); err != nil {
+			return fmt.Errorf("RPC reclaim from %s failed: %w", loan.Region.Owner, err)
+		}
+	}
+	return m.Table.Reclaim(addr, m.copyRegion)
+}
+
+// reclaimLoans takes back everything this SoC lent. Started when the SoC
+// comes under critical pressure; loans that cannot be reclaimed are logged
+// and left for the next attempt.
+func (m *MemoryManager) reclaimLoans() {
+	if !m.reclaiming.CompareAndSwap(false, true) {
+		return
+	}
+	defer m.reclaiming.Store(false)
+
+	for _, loan := range m.Table.Loans() {
+		if loan.Lender != m.LocalSoCName {
+			continue
+		}
+		if err := m.Reclaim(loan.Region.StartAddr); err != nil {
+			log.Printf("[Balloon] Reclaiming 0x%x from %s failed: %v", loan.Region.StartAddr, loan.Region.Owner, err)
+			continue
+		}
+		log.Printf("[Balloon] Reclaimed 0x%x+%d from %s", loan.Region.StartAddr, loan.Region.Length, loan.Region.Owner)
+	}
+}
+
+// borrowed reports whether `addr` lies in memory this SoC borrowed from
+// `owner`. The lender's table does not track the borrower's allocations
+// there, so accesses must go to the lender's physical memory instead of
+// through its address translation.
+func (m *MemoryManager) borrowed(addr uint64, owner string) bool {
+	loan, ok := m.Table.LoanAt(addr)
+	return ok && loan.Lender == owner && loan.Region.Owner == m.LocalSoCName
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Compactor periodically defragments the local SoC's part of the global
+// address space by sliding movable allocations together.
+type Compactor struct {
+	mem *MemoryManager
+
+	Interval     time.Duration // time between passes
+	BytesPerTick uint64        // rate limit: max bytes copied per pass
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewCompactor(mem *MemoryManager) *Compactor {
+	return &Compactor{
+		mem:          mem,
+		Interval:     5 * time.Second,
+		BytesPerTick: 4 * 1024 * 1024, // 4MB per pass
+	}
+}
+
+// Start runs compaction passes in the background until Stop is called.
+func (c *Compactor) Start() {
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.RunOnce()
+			}
+		}
+	}()
+}
+
+// Stop halts the background loop and waits for a running pass to finish.
+func (c *Compactor) Stop() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	c.wg.Wait()
+	c.stop = nil
+}
+
+// RunOnce performs a single rate-limited compaction pass and returns the number of bytes moved.
+func (c *Compactor) RunOnce() uint64 {
+	owner := c.mem.LocalSoCName
+
+	// Nothing to gain if all free space is already one region
+	if c.mem.Table.LargestFreeRegion(owner) == c.mem.Table.FreeBytes(owner) {
+		return 0
+	}
+
+	moved, err := c.mem.Table.Compact(owner, c.BytesPerTick, c.mem.moveLocal)
+	if err != nil {
+		log.Printf("[Compactor] Pass failed after moving %d bytes: %v", moved, err)
+		return moved
+	}
+	if moved > 0 {
+		log.Printf("[Compactor] Moved %d bytes, largest free region is now %d bytes",
+			moved, c.mem.Table.LargestFreeRegion(owner))
+	}
+	return moved
+}
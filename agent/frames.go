@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"sync"
+
+	"bigLITTLE/sharedmem"
+)
+
+// frameGate serialises physical writes to this SoC's memory with moves of
+// the pages it holds. Writers enter the frames they write; a move holds the
+// frame it copies from, waiting for the writers inside and keeping new ones
+// out until the page is placed elsewhere.
+type frameGate struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	writers map[uint64]int      // frame number -> writers inside
+	held    map[uint64]struct{} // frames being moved
+}
+
+func newFrameGate() *frameGate {
+	g := &frameGate{
+		writers: make(map[uint64]int),
+		held:    make(map[uint64]struct{}),
+	}
+	g.changed = sync.NewCond(&g.lock)
+	return g
+}
+
+// frameSpan returns the frame numbers covering [offset, offset+length).
+func frameSpan(offset uint64, length uint64) (uint64, uint64) {
+	if length == 0 {
+		return 1, 0
+	}
+	return offset / sharedmem.PageSize, (offset + length - 1) / sharedmem.PageSize
+}
+
+// enter waits until no frame of [offset, offset+length) is held, then
+// counts the caller as a writer of them until leave.
+func (g *frameGate) enter(offset uint64, length uint64) {
+	first, last := frameSpan(offset, length)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for g.anyHeld(first, last) {
+		g.changed.Wait()
+	}
+	for f := first; f <= last; f++ {
+		g.writers[f]++
+	}
+}
+
+// leave ends a write begun with enter.
+func (g *frameGate) leave(offset uint64, length uint64) {
+	first, last := frameSpan(offset, length)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for f := first; f <= last; f++ {
+		if g.writers[f]--; g.writers[f] == 0 {
+			delete(g.writers, f)
+		}
+	}
+	g.changed.Broadcast()
+}
+
+// hold waits for the writers of frame to leave and keeps new ones out until
+// release.
+func (g *frameGate) hold(frame uint64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for {
+		_, held := g.held[frame]
+		if !held && g.writers[frame] == 0 {
+			break
+		}
+		g.changed.Wait()
+	}
+	g.held[frame] = struct{}{}
+}
+
+// release lets writers back onto a frame taken with hold.
+func (g *frameGate) release(frame uint64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.held, frame)
+	g.changed.Broadcast()
+}
+
+// anyHeld reports whether a frame in [first, last] is held.
+// Do not call without holding the lock.
+func (g *frameGate) anyHeld(first uint64, last uint64) bool {
+	if len(g.held) == 0 {
+		return false
+	}
+	for f := first; f <= last; f++ {
+		if _, ok := g.held[f]; ok {
+			return true
+		}
+	}
+	return false
+}
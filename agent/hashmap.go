@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+)
+
+// HashMapCreate creates a HashMap in global memory and returns its address.
+// The buckets are striped over `req.Owners`, or kept on this SoC if empty.
+func (m *MemoryManager) HashMapCreate(req rpc.HashMapCreateRequest) (uint64, error) {
+	owners := req.Owners
+	if len(owners) == 0 {
+		owners = []string{m.LocalSoCName}
+	}
+	hm, err := sharedmem.NewHashMap(m, sharedmem.HashMapConfig{
+		KeySize:   req.KeySize,
+		ValueSize: req.ValueSize,
+		Buckets:   req.Buckets,
+		Owners:    owners,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return hm.Addr(), nil
+}
+
+// HashMapGet looks `key` up in the HashMap at `mapAddr`.
+func (m *MemoryManager) HashMapGet(ctx context.Context, mapAddr uint64, key []byte) ([]byte, bool, error) {
+	hm, err := sharedmem.OpenHashMap(m, mapAddr)
+	if err != nil {
+		return nil, false, err
+	}
+	return hm.Get(ctx, key)
+}
+
+// HashMapPut stores `value` under `key` in the HashMap at `mapAddr`.
+func (m *MemoryManager) HashMapPut(ctx context.Context, mapAddr uint64, key []byte, value []byte) error {
+	hm, err := sharedmem.OpenHashMap(m, mapAddr)
+	if err != nil {
+		return err
+	}
+	return hm.Put(ctx, key, value)
+}
+
+// HashMapDelete removes `key` from the HashMap at `mapAddr`.
+func (m *MemoryManager) HashMapDelete(ctx context.Context, mapAddr uint64, key []byte) (bool, error) {
+	hm, err := sharedmem.OpenHashMap(m, mapAddr)
+	if err != nil {
+		return false, err
+	}
+	return hm.Delete(ctx, key)
+}
+
+// HashMapLen returns the number of entries of the HashMap at `mapAddr`.
+func (m *MemoryManager) HashMapLen(ctx context.Context, mapAddr uint64) (uint64, error) {
+	hm, err := sharedmem.OpenHashMap(m, mapAddr)
+	if err != nil {
+		return 0, err
+	}
+	return hm.Len(ctx)
+}
+
+// HashMapFree releases the HashMap at `mapAddr`.
+func (m *MemoryManager) HashMapFree(mapAddr uint64) error {
+	hm, err := sharedmem.OpenHashMap(m, mapAddr)
+	if err != nil {
+		return err
+	}
+	return hm.Free()
+}
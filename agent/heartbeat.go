@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Heartbeat pings the other SoCs and declares a SoC dead to the reaper once
+// it has missed MissLimit pings in a row. Only SoCs that answered at least once
+// are declared dead, a peer that is still being dialled is not. A dead SoC that
+// answers again is revived, so leases it still holds stop being reclaimable.
+type Heartbeat struct {
+	reaper *Reaper
+	peers  []string
+	ping   func(soc string) error
+
+	Interval  time.Duration
+	MissLimit int // consecutive failed pings before a SoC is declared dead
+
+	lock   sync.Mutex
+	misses map[string]int
+	seen   map[string]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewHeartbeat watches `peers` with `ping`, which should fail when the SoC
+// cannot be reached.
+func NewHeartbeat(reaper *Reaper, peers []string, ping func(soc string) error) *Heartbeat {
+	return &Heartbeat{
+		reaper:    reaper,
+		peers:     peers,
+		ping:      ping,
+		Interval:  5 * time.Second,
+		MissLimit: 3,
+		misses:    make(map[string]int),
+		seen:      make(map[string]bool),
+	}
+}
+
+// Start runs the heartbeat in the background until Stop is called.
+func (h *Heartbeat) Start() {
+	if h.stop != nil {
+		return
+	}
+	h.stop = make(chan struct{})
+	h.wg.Add(1)
+
+	go func() {
+		defer h.wg.Done()
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+				h.RunOnce()
+			}
+		}
+	}()
+}
+
+// Stop halts the background loop.
+func (h *Heartbeat) Stop() {
+	if h.stop == nil {
+		return
+	}
+	close(h.stop)
+	h.wg.Wait()
+	h.stop = nil
+}
+
+// RunOnce pings every peer once and updates the reaper's view of which SoCs are dead.
+func (h *Heartbeat) RunOnce() {
+	for _, soc := range h.peers {
+		err := h.ping(soc)
+
+		h.lock.Lock()
+		if err == nil {
+			wasDead := h.misses[soc] >= h.MissLimit
+			h.misses[soc] = 0
+			h.seen[soc] = true
+			h.lock.Unlock()
+			if wasDead {
+				log.Printf("[Heartbeat] SoC %s is reachable again", soc)
+				h.reaper.Revive(soc)
+			}
+			continue
+		}
+
+		if !h.seen[soc] {
+			h.lock.Unlock()
+			continue
+		}
+		h.misses[soc]++
+		missed := h.misses[soc]
+		h.lock.Unlock()
+		if missed == h.MissLimit {
+			log.Printf("[Heartbeat] SoC %s missed %d pings: %v", soc, missed, err)
+			h.reaper.DeclareDead(soc)
+		}
+	}
+}
@@ -29,6 +29,37 @@ func RegisterGobTypes() {
 	gob.Register(&rpc.MemoryRequest{})
 	gob.Register(&rpc.MemoryWriteRequest{})
 	gob.Register(&rpc.MemoryResponse{})
+	gob.Register(&rpc.LeaseRequest{})
+	gob.Register(&rpc.LeaseResponse{})
+	gob.Register(&rpc.LeaseAllocRequest{})
+	gob.Register(&rpc.LeaseAllocResponse{})
+	gob.Register(&rpc.PressureRequest{})
+	gob.Register(&rpc.PressureResponse{})
+	gob.Register(&rpc.VerifyRequest{})
+	gob.Register(&rpc.VerifyResponse{})
+	gob.Register(&rpc.PhysRequest{})
+	gob.Register(&rpc.PhysWriteRequest{})
+	gob.Register(&rpc.PhysCopyRequest{})
+	gob.Register(&rpc.PageMoveRequest{})
+	gob.Register(&rpc.RegionMirrorRequest{})
+	gob.Register(&rpc.FrameRequest{})
+	gob.Register(&rpc.AtomicRequest{})
+	gob.Register(&rpc.AtomicResponse{})
+	gob.Register(&rpc.QueueRequest{})
+	gob.Register(&rpc.QueueResponse{})
+	gob.Register(&rpc.HashMapCreateRequest{})
+	gob.Register(&rpc.HashMapRequest{})
+	gob.Register(&rpc.HashMapResponse{})
+	gob.Register(&rpc.LoanRequest{})
+	gob.Register(&rpc.ReclaimRequest{})
+	gob.Register(&rpc.AllocQueryRequest{})
+	gob.Register(&rpc.AllocQueryResponse{})
+	gob.Register(&rpc.TaskAllocRequest{})
+	gob.Register(&rpc.TaskAllocResponse{})
+	gob.Register(&rpc.TaskMemoryRequest{})
+	gob.Register(&rpc.TaskWriteRequest{})
+	gob.Register(&rpc.TaskShareRequest{})
+	gob.Register(&rpc.TaskShareResponse{})
 	gob.Register(&rpc.TaskRequest{})
 	gob.Register(&rpc.TaskResponse{})
 
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"bigLITTLE/rpc"
 	"bigLITTLE/sharedmem"
@@ -18,38 +20,138 @@ type MemoryManager struct {
 	Self       string
 	Table      *sharedmem.MemTable
 	rpcClients map[string]*nrpc.Client
+	dialers    map[string]func() (*nrpc.Client, error) // reconnect to a SoC whose client was shut down
+	clientLock sync.RWMutex                            // guards rpcClients and dialers
 	localRAM   []byte
 	ramLock    sync.RWMutex
+	pageLock   sync.RWMutex // shared by writers, held exclusively while MovePage copies a page
+	frameGate  *frameGate   // keeps physical writes off frames being moved
 
 	LocalSoCName string
 
 	usage     uint64 // bytes currently used on this SoC (allocated locally)
 	SoftLimit uint64 // max allowed bytes before overflow
+
+	Thresholds PressureThresholds
+	pressure   *pressureState
+	reclaiming atomic.Bool // a pressure-driven reclaim of lent memory is running
+
+	queueSignals *queueSignals // RingBuffer notifications served by this SoC
+
+	Slab *sharedmem.SlabAllocator // small-object allocator over Table
+
+	Master        *rpc.MasterClient       // names segments cluster-wide; nil when they are named in Table
+	mirrors       map[uint64]int          // segment ID -> references held here to segments created elsewhere
+	regionMirrors map[uint64]regionMirror // allocation start -> allocation published by another SoC
+	mirrorLock    sync.Mutex
+
+	published   map[uint64]int // allocation start -> publications of an allocation made here
+	publishLock sync.Mutex     // held while peers are told, so they hear in order
 }
 
 func NewMemoryManager(self string, table *sharedmem.MemTable, ramBytes uint64, localSoCName string) *MemoryManager {
 	return &MemoryManager{
-		Self:         self,
-		Table:        table,
-		rpcClients:   make(map[string]*nrpc.Client),
-		localRAM:     make([]byte, ramBytes),
-		LocalSoCName: localSoCName,
-		usage:        0,
-		SoftLimit:    uint64(float64(ramBytes) * 0.9),
+		Self:          self,
+		Table:         table,
+		rpcClients:    make(map[string]*nrpc.Client),
+		dialers:       make(map[string]func() (*nrpc.Client, error)),
+		localRAM:      make([]byte, ramBytes),
+		LocalSoCName:  localSoCName,
+		usage:         0,
+		SoftLimit:     uint64(float64(ramBytes) * 0.9),
+		Thresholds:    DefaultPressureThresholds,
+		pressure:      newPressureState(localSoCName),
+		queueSignals:  newQueueSignals(),
+		frameGate:     newFrameGate(),
+		Slab:          sharedmem.NewSlabAllocator(table, localSoCName),
+		mirrors:       make(map[uint64]int),
+		regionMirrors: make(map[uint64]regionMirror),
+		published:     make(map[uint64]int),
 	}
 }
 
 func (m *MemoryManager) RegisterRPCClient(soCName string, client *nrpc.Client) {
+	m.clientLock.Lock()
+	defer m.clientLock.Unlock()
 	m.rpcClients[soCName] = client
 }
 
+// RegisterRPCDialer lets the manager connect to `soCName` with `dial` when it
+// has no client for it yet, or its connection was shut down because the SoC
+// went away.
+func (m *MemoryManager) RegisterRPCDialer(soCName string, dial func() (*nrpc.Client, error)) {
+	m.clientLock.Lock()
+	defer m.clientLock.Unlock()
+	m.dialers[soCName] = dial
+}
+
+// client returns the RPC client of SoC `soc`.
+func (m *MemoryManager) client(soc string) (*nrpc.Client, bool) {
+	m.clientLock.RLock()
+	defer m.clientLock.RUnlock()
+	client, ok := m.rpcClients[soc]
+	return client, ok
+}
+
+// knownSoC reports whether soc has a slot in the table.
+func (m *MemoryManager) knownSoC(soc string) bool {
+	for _, slot := range m.Table.Slots {
+		if slot.Owner == soc {
+			return true
+		}
+	}
+	return false
+}
+
+// redial connects to `soc` again, replacing `stale`, the client that was
+// shut down. If another caller replaced it meanwhile, that client is used.
+func (m *MemoryManager) redial(soc string, stale *nrpc.Client) (*nrpc.Client, error) {
+	m.clientLock.Lock()
+	defer m.clientLock.Unlock()
+
+	if client, ok := m.rpcClients[soc]; ok && client != stale {
+		return client, nil
+	}
+	dial, ok := m.dialers[soc]
+	if !ok {
+		return nil, fmt.Errorf("no RPC client for SoC %s", soc)
+	}
+	client, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("reconnecting to SoC %s failed: %w", soc, err)
+	}
+	if stale != nil {
+		stale.Close()
+	}
+	m.rpcClients[soc] = client
+	log.Printf("[RPC] Reconnected to %s", soc)
+	return client, nil
+}
+
 // Read reads `size` bytes from global memory at `addr`.
+// The range is resolved through the page table and may span several SoCs.
 func (m *MemoryManager) Read(ctx context.Context, addr uint64, size uint64) ([]byte, error) {
-	owner, offset, err := m.Table.TranslateAddr(addr)
+	segs, err := m.Table.TranslateRange(addr, size)
 	if err != nil {
 		return nil, err
 	}
+	if len(segs) == 1 {
+		return m.readSegment(segs[0].VAddr, segs[0].SoC, segs[0].Offset, size)
+	}
+
+	data := make([]byte, 0, size)
+	for _, seg := range segs {
+		part, err := m.readSegment(seg.VAddr, seg.SoC, seg.Offset, seg.Length)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, part...)
+	}
+	return data, nil
+}
 
+// readSegment reads one physically contiguous piece of a range.
+func (m *MemoryManager) readSegment(addr uint64, owner string, offset uint64, size uint64) ([]byte, error) {
 	if owner == m.LocalSoCName {
 		m.ramLock.RLock()
 		defer m.ramLock.RUnlock()
@@ -62,15 +164,19 @@ func (m *MemoryManager) Read(ctx context.Context, addr uint64, size uint64) ([]b
 		return data, nil
 	}
 
+	if m.borrowed(addr, owner) {
+		return m.readPhysOn(owner, offset, size)
+	}
+
 	// Remote read via RPC
-	client, ok := m.rpcClients[owner]
+	client, ok := m.client(owner)
 	if !ok {
 		return nil, fmt.Errorf("no RPC client for SoC %s", owner)
 	}
 
 	req := &rpc.MemoryRequest{Address: addr, Size: size}
 	resp := &rpc.MemoryResponse{}
-	err = client.Call("RPCServer.ReadMemory", req, resp)
+	err := client.Call("RPCServer.ReadMemory", req, resp)
 	if err != nil {
 		return nil, fmt.Errorf("RPC read failed: %w", err)
 	}
@@ -78,12 +184,51 @@ func (m *MemoryManager) Read(ctx context.Context, addr uint64, size uint64) ([]b
 }
 
 // Write writes `data` bytes to global memory at `addr`.
+// The range is resolved through the page table and may span several SoCs.
+// Pieces held here are written while no page can move off this SoC; the
+// others are sent by address to their SoC, which resolves them again.
 func (m *MemoryManager) Write(ctx context.Context, addr uint64, data []byte) error {
-	owner, offset, err := m.Table.TranslateAddr(addr)
+	remote, err := m.writeHeld(addr, data)
 	if err != nil {
 		return err
 	}
+	for _, seg := range remote {
+		part := data[seg.VAddr-addr : seg.VAddr-addr+seg.Length]
+		if err := m.writeSegment(seg.VAddr, seg.SoC, seg.Offset, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHeld writes the pieces of a range that live on this SoC and returns
+// the rest. A page being migrated must not change between its copy and its
+// placement, so pages stay put meanwhile.
+func (m *MemoryManager) writeHeld(addr uint64, data []byte) ([]sharedmem.Segment, error) {
+	m.pageLock.RLock()
+	defer m.pageLock.RUnlock()
+
+	segs, err := m.Table.TranslateRange(addr, uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var remote []sharedmem.Segment
+	for _, seg := range segs {
+		if seg.SoC != m.LocalSoCName {
+			remote = append(remote, seg)
+			continue
+		}
+		part := data[seg.VAddr-addr : seg.VAddr-addr+seg.Length]
+		if err := m.writeSegment(seg.VAddr, seg.SoC, seg.Offset, part); err != nil {
+			return nil, err
+		}
+	}
+	return remote, nil
+}
 
+// writeSegment writes one physically contiguous piece of a range.
+func (m *MemoryManager) writeSegment(addr uint64, owner string, offset uint64, data []byte) error {
+	var err error
 	if owner == m.LocalSoCName {
 		m.ramLock.Lock()
 		defer m.ramLock.Unlock()
@@ -125,7 +270,7 @@ func (m *MemoryManager) Write(ctx context.Context, addr uint64, data []byte) err
 			return fmt.Errorf("failed to update ownership for overflow region: %w", err)
 		}
 
-		client, ok := m.rpcClients[targetSoC]
+		client, ok := m.client(targetSoC)
 		if !ok {
 			return fmt.Errorf("no RPC client for SoC %s", targetSoC)
 		}
@@ -147,8 +292,12 @@ func (m *MemoryManager) Write(ctx context.Context, addr uint64, data []byte) err
 		return nil
 	}
 
+	if m.borrowed(addr, owner) {
+		return m.writePhysOn(owner, offset, data)
+	}
+
 	// Remote write via RPC
-	client, ok := m.rpcClients[owner]
+	client, ok := m.client(owner)
 	if !ok {
 		return fmt.Errorf("no RPC client for SoC %s", owner)
 	}
@@ -161,50 +310,248 @@ func (m *MemoryManager) Write(ctx context.Context, addr uint64, data []byte) err
 	return nil
 }
 
-// UpdateOwnership updates the ownership of a memory range [addr, addr+size) to newOwner.
-// This involves freeing any previous allocations and reallocating with the new owner.
-func (m *MemoryManager) UpdateOwnership(addr uint64, size uint64, newOwner string) error {
-	// This is tricky because we need to free previous allocation(s) covering the range,
-	// then add a free region owned by newOwner, then allocate for newOwner.
+// ReadPhys reads `size` bytes at `offset` in local memory, without translation.
+func (m *MemoryManager) ReadPhys(offset uint64, size uint64) ([]byte, error) {
+	m.ramLock.RLock()
+	defer m.ramLock.RUnlock()
+
+	if offset+size > uint64(len(m.localRAM)) {
+		return nil, errors.New("read out of bounds")
+	}
+	data := make([]byte, size)
+	copy(data, m.localRAM[offset:offset+size])
+	return data, nil
+}
 
-	// For simplicity: assume the entire range corresponds to exactly one allocated region.
+// WritePhys writes `data` at `offset` in local memory, without translation.
+func (m *MemoryManager) WritePhys(offset uint64, data []byte) error {
+	m.ramLock.Lock()
+	defer m.ramLock.Unlock()
 
-	// Find allocated region at addr
-	m.Table.OwnershipLock.Lock()
-	defer m.Table.OwnershipLock.Unlock()
+	if offset+uint64(len(data)) > uint64(len(m.localRAM)) {
+		return errors.New("write out of bounds")
+	}
+	copy(m.localRAM[offset:], data)
+	return nil
+}
 
-	allocRegion, ok := m.Table.Allocations[addr]
+// CheckPhys checks that [offset, offset+length) of local memory backs
+// allocated memory, for physical accesses coming from other SoCs.
+func (m *MemoryManager) CheckPhys(offset uint64, length uint64) error {
+	return m.Table.PhysBacked(m.LocalSoCName, offset, length)
+}
+
+// EnterPhys keeps the frames of [offset, offset+length) from being moved
+// off this SoC until the returned function is called, so a CheckPhys and the
+// write after it see the same pages.
+func (m *MemoryManager) EnterPhys(offset uint64, length uint64) func() {
+	m.frameGate.enter(offset, length)
+	return func() { m.frameGate.leave(offset, length) }
+}
+
+// CopyPhys copies `length` bytes between two offsets of local memory. The
+// ranges may overlap.
+func (m *MemoryManager) CopyPhys(srcOffset uint64, dstOffset uint64, length uint64) error {
+	return m.moveLocal(m.LocalSoCName, srcOffset, dstOffset, length)
+}
+
+// readPhysOn reads `size` bytes at `offset` in the local memory of `soc`.
+func (m *MemoryManager) readPhysOn(soc string, offset uint64, size uint64) ([]byte, error) {
+	if soc == m.LocalSoCName {
+		return m.ReadPhys(offset, size)
+	}
+	client, ok := m.client(soc)
+	if !ok {
+		return nil, fmt.Errorf("no RPC client for SoC %s", soc)
+	}
+	req := &rpc.PhysRequest{Offset: offset, Size: size}
+	resp := &rpc.MemoryResponse{}
+	if err := client.Call("RPCServer.ReadPhys", req, resp); err != nil {
+		return nil, fmt.Errorf("RPC physical read failed: %w", err)
+	}
+	return resp.Data, nil
+}
+
+// writePhysOn writes `data` at `offset` in the local memory of `soc`.
+func (m *MemoryManager) writePhysOn(soc string, offset uint64, data []byte) error {
+	if soc == m.LocalSoCName {
+		return m.WritePhys(offset, data)
+	}
+	client, ok := m.client(soc)
 	if !ok {
-		return fmt.Errorf("no allocated region at address 0x%x to update ownership", addr)
+		return fmt.Errorf("no RPC client for SoC %s", soc)
 	}
+	req := &rpc.PhysWriteRequest{Offset: offset, Data: data}
+	resp := &rpc.MemoryResponse{}
+	if err := client.Call("RPCServer.WritePhys", req, resp); err != nil {
+		return fmt.Errorf("RPC physical write failed: %w", err)
+	}
+	return nil
+}
 
-	if allocRegion.Length < size {
-		return fmt.Errorf("allocated region too small for requested ownership update")
+// copyPhysOn copies between two offsets in the local memory of `soc`, on
+// that SoC, so the data never crosses the network.
+func (m *MemoryManager) copyPhysOn(soc string, srcOffset uint64, dstOffset uint64, length uint64) error {
+	if soc == m.LocalSoCName {
+		return m.CopyPhys(srcOffset, dstOffset, length)
+	}
+	client, ok := m.client(soc)
+	if !ok {
+		return fmt.Errorf("no RPC client for SoC %s", soc)
+	}
+	req := &rpc.PhysCopyRequest{SrcOffset: srcOffset, DstOffset: dstOffset, Length: length}
+	resp := &rpc.MemoryResponse{}
+	if err := client.Call("RPCServer.CopyPhys", req, resp); err != nil {
+		return fmt.Errorf("RPC physical copy failed: %w", err)
 	}
+	return nil
+}
 
-	// Remove allocation from allocations and allocated regions list
-	delete(m.Table.Allocations, addr)
-	for i, r := range m.Table.Regions {
-		if r.StartAddr == addr {
-			m.Table.Regions = append(m.Table.Regions[:i], m.Table.Regions[i+1:]...)
-			break
+// copyRegion is the CopyFunc used by Realloc. Pieces whose source and
+// destination live on the same SoC are copied there; the rest is read from
+// one SoC and written to the other.
+func (m *MemoryManager) copyRegion(src sharedmem.MemRegion, dst sharedmem.MemRegion, length uint64) error {
+	srcSegs, err := m.Table.TranslateRange(src.StartAddr, length)
+	if err != nil {
+		return err
+	}
+	dstSegs, err := m.Table.TranslateRange(dst.StartAddr, length)
+	if err != nil {
+		return err
+	}
+
+	for len(srcSegs) > 0 && len(dstSegs) > 0 {
+		s, d := &srcSegs[0], &dstSegs[0]
+		n := min(s.Length, d.Length)
+
+		if s.SoC == d.SoC {
+			err = m.copyPhysOn(s.SoC, s.Offset, d.Offset, n)
+		} else {
+			var data []byte
+			data, err = m.readPhysOn(s.SoC, s.Offset, n)
+			if err == nil {
+				err = m.writePhysOn(d.SoC, d.Offset, data)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, seg := range []*sharedmem.Segment{s, d} {
+			seg.VAddr += n
+			seg.Offset += n
+			seg.Length -= n
+		}
+		if s.Length == 0 {
+			srcSegs = srcSegs[1:]
+		}
+		if d.Length == 0 {
+			dstSegs = dstSegs[1:]
 		}
 	}
+	return nil
+}
 
-	// Add new free region with newOwner
-	newFreeRegion := sharedmem.MemRegion{
-		StartAddr: addr,
-		Length:    size,
-		Owner:     newOwner,
+// Realloc resizes the allocation at `addr`, moving it if it cannot grow in
+// place. Returns the resulting region.
+func (m *MemoryManager) Realloc(ctx context.Context, addr uint64, newSize uint64) (sharedmem.MemRegion, error) {
+	return m.Table.Realloc(addr, newSize, m.copyRegion)
+}
+
+// MovePage migrates the page containing `vaddr` to a free frame on `toSoC`.
+// The page keeps its virtual address; only its backing frame changes. The
+// move runs on the SoC holding the page, which alone can keep writers off
+// the old frame.
+func (m *MemoryManager) MovePage(ctx context.Context, vaddr uint64, toSoC string) error {
+	from, err := m.Table.Placement(vaddr)
+	if err != nil {
+		return err
 	}
-	m.Table.FreeRegions = append(m.Table.FreeRegions, newFreeRegion)
+	if from.SoC == toSoC {
+		return nil
+	}
+	if from.SoC == m.LocalSoCName {
+		return m.MoveHeldPage(ctx, vaddr, toSoC)
+	}
+
+	client, ok := m.client(from.SoC)
+	if !ok {
+		return fmt.Errorf("no RPC client for SoC %s", from.SoC)
+	}
+	req := &rpc.PageMoveRequest{VAddr: vaddr, ToSoC: toSoC}
+	if err := client.Call("RPCServer.MovePage", req, &rpc.MemoryResponse{}); err != nil {
+		return fmt.Errorf("RPC page migration on %s failed: %w", from.SoC, err)
+	}
+	return nil
+}
+
+// MoveHeldPage moves the page containing `vaddr`, backed by a frame of this
+// SoC, to a frame on `toSoC`. Writes through this SoC wait until the page is
+// placed, physical writes to the old frame until it has been released; the
+// home frame is free for other pages afterwards.
+func (m *MemoryManager) MoveHeldPage(ctx context.Context, vaddr uint64, toSoC string) error {
+	m.pageLock.Lock()
+	defer m.pageLock.Unlock()
 
-	// Merge free regions to keep consistency
-	m.Table.MergeFreeRegions()
+	from, err := m.Table.Placement(vaddr)
+	if err != nil {
+		return err
+	}
+	if from.SoC != m.LocalSoCName {
+		return fmt.Errorf("page 0x%x is held by %s, not %s", vaddr, from.SoC, m.LocalSoCName)
+	}
+	if from.SoC == toSoC {
+		return nil
+	}
+	m.frameGate.hold(from.Number)
+	defer m.frameGate.release(from.Number)
 
+	to, err := m.Table.FrameFor(vaddr, toSoC)
+	if err != nil {
+		return err
+	}
+	// Peers with their own table learn about moves of published pages; the
+	// destination checks the copy against its table, so it hears first
+	shared := m.sharedIn(vaddr)
+	reserved := len(shared) > 0 && to.SoC != m.LocalSoCName
+	if reserved {
+		err = m.callPeer(to.SoC, "RPCServer.ReserveFrame", &rpc.FrameRequest{Frame: to})
+	}
+	var data []byte
+	if err == nil {
+		data, err = m.ReadPhys(from.Offset(), sharedmem.PageSize)
+	}
+	if err == nil {
+		err = m.writePhysOn(to.SoC, to.Offset(), data)
+	}
+	if err == nil {
+		err = m.Table.PlacePage(vaddr, to)
+	}
+	if err != nil {
+		m.Table.ReleaseFrame(to)
+		if reserved {
+			m.callPeer(to.SoC, "RPCServer.ReleaseFrame", &rpc.FrameRequest{Frame: to})
+		}
+		return fmt.Errorf("page migration failed: %w", err)
+	}
+	if len(shared) > 0 {
+		if err := m.mirrorMove(shared, vaddr, to); err != nil {
+			return fmt.Errorf("page 0x%x moved, but not every peer heard: %w", vaddr, err)
+		}
+	}
 	return nil
 }
 
+// UpdateOwnership updates the ownership of a memory range [addr, addr+size) to newOwner.
+// The range must start an allocation; it is released as free memory of
+// newOwner, and the rest of the allocation stays with its owner.
+func (m *MemoryManager) UpdateOwnership(addr uint64, size uint64, newOwner string) error {
+	m.Table.OwnershipLock.Lock()
+	defer m.Table.OwnershipLock.Unlock()
+
+	return m.Table.TransferRange(addr, size, newOwner)
+}
+
 func (m *MemoryManager) AllocRegion(size uint64, owner string) (sharedmem.MemRegion, error) {
 	m.Table.OwnershipLock.Lock()
 	defer m.Table.OwnershipLock.Unlock()
@@ -217,9 +564,237 @@ func (m *MemoryManager) AllocRegion(size uint64, owner string) (sharedmem.MemReg
 	return region, nil
 }
 
+// Malloc allocates `size` bytes on `owner` from the slab allocator of this
+// SoC, which is returned as the object's creator.
+func (m *MemoryManager) Malloc(size uint64, owner string) (uint64, string, error) {
+	addr, err := m.Slab.MallocOn(owner, size)
+	return addr, m.LocalSoCName, err
+}
+
+// FreeSmall releases an object allocated with Malloc on `creator`. Objects
+// of other SoCs are freed by their creator, which holds the slab.
+func (m *MemoryManager) FreeSmall(creator string, addr uint64) error {
+	if creator == m.LocalSoCName {
+		return m.Slab.Free(addr)
+	}
+	client, ok := m.client(creator)
+	if !ok {
+		return fmt.Errorf("no RPC client for SoC %s to free slab object 0x%x", creator, addr)
+	}
+	if err := client.Call("RPCServer.FreeSlabObject", &rpc.MemoryRequest{Address: addr}, &rpc.MemoryResponse{}); err != nil {
+		return fmt.Errorf("RPC free of slab object 0x%x on %s failed: %w", addr, creator, err)
+	}
+	return nil
+}
+
+// FreeSlabObject frees an object of this SoC's slab for the SoC that dropped it.
+func (m *MemoryManager) FreeSlabObject(addr uint64) error {
+	return m.Slab.Free(addr)
+}
+
+// AllocLabeled allocates a region carrying `label`. The creator defaults to this SoC.
+func (m *MemoryManager) AllocLabeled(size uint64, owner string, label sharedmem.Label) (sharedmem.MemRegion, error) {
+	m.Table.OwnershipLock.Lock()
+	defer m.Table.OwnershipLock.Unlock()
+
+	if label.Creator == "" {
+		label.Creator = m.Self
+	}
+	return m.Table.Alloc(sharedmem.AllocRequest{Size: size, Owner: owner, OwnerOnly: true, Label: &label})
+}
+
+// QueryAllocations lists the allocations matching `q` with their labels.
+func (m *MemoryManager) QueryAllocations(q rpc.AllocQueryRequest) []rpc.AllocationInfo {
+	matches := m.Table.QueryAllocations(sharedmem.AllocQuery{
+		Owner:   q.Owner,
+		Tag:     q.Tag,
+		TaskID:  q.TaskID,
+		MinSize: q.MinSize,
+		MaxSize: q.MaxSize,
+	})
+
+	out := make([]rpc.AllocationInfo, 0, len(matches))
+	for _, lr := range matches {
+		out = append(out, rpc.AllocationInfo{
+			StartAddr: lr.Region.StartAddr,
+			Length:    lr.Region.Length,
+			Owner:     lr.Region.Owner,
+			Name:      lr.Label.Name,
+			TaskID:    lr.Label.TaskID,
+			Creator:   lr.Label.Creator,
+			Created:   lr.Label.Created,
+			Tags:      lr.Label.Tags,
+		})
+	}
+	return out
+}
+
 func (m *MemoryManager) FreeRegion(startAddr uint64) error {
 	m.Table.OwnershipLock.Lock()
 	defer m.Table.OwnershipLock.Unlock()
 
 	return m.Table.FreeRegion(startAddr)
 }
+
+// moveLocal copies `length` bytes between two offsets of localRAM. The ranges
+// may overlap. It is the MoveFunc used by the compactor.
+func (m *MemoryManager) moveLocal(owner string, srcOffset uint64, dstOffset uint64, length uint64) error {
+	if owner != m.LocalSoCName {
+		return fmt.Errorf("cannot move memory of remote SoC %s", owner)
+	}
+
+	m.ramLock.Lock()
+	defer m.ramLock.Unlock()
+
+	if srcOffset+length > uint64(len(m.localRAM)) || dstOffset+length > uint64(len(m.localRAM)) {
+		return errors.New("move out of bounds")
+	}
+	copy(m.localRAM[dstOffset:dstOffset+length], m.localRAM[srcOffset:srcOffset+length])
+	return nil
+}
+
+// AllocMovable allocates a relocatable block and returns its handle.
+func (m *MemoryManager) AllocMovable(size uint64, owner string) (sharedmem.Handle, error) {
+	return m.Table.AllocMovable(size, owner)
+}
+
+// ReadHandle reads `size` bytes at `offset` inside the block behind `h`.
+func (m *MemoryManager) ReadHandle(ctx context.Context, h sharedmem.Handle, offset uint64, size uint64) ([]byte, error) {
+	var data []byte
+	err := m.Table.WithHandle(h, func(region sharedmem.MemRegion) error {
+		if offset+size > region.Length {
+			return errors.New("read out of bounds")
+		}
+		var err error
+		data, err = m.Read(ctx, region.StartAddr+offset, size)
+		return err
+	})
+	return data, err
+}
+
+// WriteHandle writes `data` at `offset` inside the block behind `h`.
+func (m *MemoryManager) WriteHandle(ctx context.Context, h sharedmem.Handle, offset uint64, data []byte) error {
+	return m.Table.WithHandle(h, func(region sharedmem.MemRegion) error {
+		if offset+uint64(len(data)) > region.Length {
+			return errors.New("write out of bounds")
+		}
+		return m.Write(ctx, region.StartAddr+offset, data)
+	})
+}
+
+// FreeHandle frees the block behind `h`.
+func (m *MemoryManager) FreeHandle(h sharedmem.Handle) error {
+	return m.Table.FreeHandle(h)
+}
+
+// AllocLeased allocates a region that is reclaimed unless `holder` renews it within `ttl`.
+func (m *MemoryManager) AllocLeased(size uint64, owner string, holder string, taskID string, ttl time.Duration) (sharedmem.MemRegion, error) {
+	region, err := m.AllocRegion(size, owner)
+	if err != nil {
+		return sharedmem.MemRegion{}, err
+	}
+	if _, err := m.Table.SetLease(region.StartAddr, holder, taskID, ttl); err != nil {
+		m.FreeRegion(region.StartAddr)
+		return sharedmem.MemRegion{}, err
+	}
+	return region, nil
+}
+
+// RenewLease renews a lease held in this SoC's table.
+func (m *MemoryManager) RenewLease(addr uint64, holder string) (time.Time, error) {
+	lease, err := m.Table.RenewLease(addr, holder)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lease.Expires, nil
+}
+
+// RenewRemoteLease asks SoC `soc` to renew the lease this SoC holds on `addr`.
+func (m *MemoryManager) RenewRemoteLease(soc string, addr uint64) (time.Time, error) {
+	if soc == m.LocalSoCName {
+		return m.RenewLease(addr, m.Self)
+	}
+
+	client, ok := m.client(soc)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no RPC client for SoC %s", soc)
+	}
+	req := &rpc.LeaseRequest{Address: addr, Holder: m.Self}
+	resp := &rpc.LeaseResponse{}
+	if err := client.Call("RPCServer.RenewLease", req, resp); err != nil {
+		return time.Time{}, fmt.Errorf("RPC lease renewal failed: %w", err)
+	}
+	return resp.Expires, nil
+}
+
+// AllocRemoteLeased asks SoC `soc` to allocate a region in its table,
+// leased to this SoC for `ttl`. This SoC renews it with RenewRemoteLease; if
+// it dies, the reaper on `soc` frees the region.
+func (m *MemoryManager) AllocRemoteLeased(soc string, size uint64, owner string, taskID string, ttl time.Duration) (sharedmem.MemRegion, error) {
+	if soc == m.LocalSoCName {
+		return m.AllocLeased(size, owner, m.Self, taskID, ttl)
+	}
+
+	client, ok := m.client(soc)
+	if !ok {
+		return sharedmem.MemRegion{}, fmt.Errorf("no RPC client for SoC %s", soc)
+	}
+	req := &rpc.LeaseAllocRequest{Size: size, Owner: owner, Holder: m.Self, TaskID: taskID, TTLMs: ttl.Milliseconds()}
+	resp := &rpc.LeaseAllocResponse{}
+	if err := client.Call("RPCServer.AllocLeased", req, resp); err != nil {
+		return sharedmem.MemRegion{}, fmt.Errorf("RPC leased allocation failed: %w", err)
+	}
+	return resp.Region, nil
+}
+
+// Ping checks that SoC `soc` answers RPCs within `timeout`. A SoC that
+// restarted is dialled again, since its old connection never recovers.
+func (m *MemoryManager) Ping(soc string, timeout time.Duration) error {
+	client, ok := m.client(soc)
+	if !ok {
+		var err error
+		if client, err = m.redial(soc, nil); err != nil {
+			return err
+		}
+	}
+	err := ping(client, m.LocalSoCName, soc, timeout)
+	if !errors.Is(err, nrpc.ErrShutdown) {
+		return err
+	}
+	if client, err = m.redial(soc, client); err != nil {
+		return err
+	}
+	return ping(client, m.LocalSoCName, soc, timeout)
+}
+
+// ping makes one Ping call on behalf of `from`.
+func ping(client *nrpc.Client, from string, soc string, timeout time.Duration) error {
+	call := client.Go("RPCServer.Ping", &rpc.PingRequest{From: from}, &rpc.PingResponse{}, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return fmt.Errorf("RPC ping failed: %w", call.Error)
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("ping of SoC %s timed out after %v", soc, timeout)
+	}
+}
+
+// VerifyTable runs MemTable.Verify and returns the problems found, if any.
+func (m *MemoryManager) VerifyTable() []string {
+	err := m.Table.Verify()
+	if err == nil {
+		return nil
+	}
+	var verr *sharedmem.VerifyError
+	if errors.As(err, &verr) {
+		return verr.Problems
+	}
+	return []string{err.Error()}
+}
+
+// MemTable returns the table backing this manager, for VMem page bookkeeping.
+func (m *MemoryManager) MemTable() *sharedmem.MemTable {
+	return m.Table
+}
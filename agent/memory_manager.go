@@ -2,23 +2,41 @@ package agent
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"bigLITTLE/sharedmem"
 )
 
+// TaskRunner executes the code of a task, such as the persistent Python
+// interpreter reached through PythonClient.
+type TaskRunner interface {
+	Exec(code string) (string, error)
+}
+
 type TaskMemoryManager struct {
 	memMgr  *MemoryManager
 	tracker *sharedmem.TaskMemoryTracker
+	Runner  TaskRunner // executes RunTask code; nil until an interpreter is connected
 
-	lock sync.Mutex
+	lock    sync.Mutex
+	runLock sync.Mutex // one task at a time on the runner, which shares its globals
+
+	tokenLock sync.Mutex
+	tokens    map[string]string // task token -> task ID, while the task runs
 }
 
 func NewTaskMemoryManager(memMgr *MemoryManager, tracker *sharedmem.TaskMemoryTracker) *TaskMemoryManager {
 	return &TaskMemoryManager{
 		memMgr:  memMgr,
 		tracker: tracker,
+		tokens:  make(map[string]string),
 	}
 }
 
@@ -27,7 +45,7 @@ func (t *TaskMemoryManager) Alloc(taskID string, size uint64, owner string) (sha
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	region, err := t.memMgr.Table.AllocRegion(size, owner)
+	region, err := t.memMgr.AllocLabeled(size, owner, sharedmem.Label{TaskID: taskID})
 	if err != nil {
 		return sharedmem.MemRegion{}, fmt.Errorf("alloc failed: %w", err)
 	}
@@ -39,32 +57,261 @@ func (t *TaskMemoryManager) Alloc(taskID string, size uint64, owner string) (sha
 	return region, nil
 }
 
-// FreeTask frees all pages allocated to a task.
-func (t *TaskMemoryManager) FreeTask(taskID string) error {
+// AllocLeased is Alloc with a lease held by this SoC. If the lease is not
+// renewed within ttl the reaper frees the region and drops it from the task.
+func (t *TaskMemoryManager) AllocLeased(taskID string, size uint64, owner string, ttl time.Duration) (sharedmem.MemRegion, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
+	region, err := t.memMgr.AllocLeased(size, owner, t.memMgr.Self, taskID, ttl)
+	if err != nil {
+		return sharedmem.MemRegion{}, fmt.Errorf("alloc failed: %w", err)
+	}
 	t.tracker.AllocLock.Lock()
-	regions, ok := t.tracker.TaskAllocations[taskID]
+	t.tracker.TaskAllocations[taskID] = append(t.tracker.TaskAllocations[taskID], region)
 	t.tracker.AllocLock.Unlock()
+
+	return region, nil
+}
+
+// FreeTask frees all pages allocated to a task, and the hash maps it created.
+func (t *TaskMemoryManager) FreeTask(taskID string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, addr := range t.tracker.Objects(taskID) {
+		if err := t.freeTaskMap(taskID, addr); err != nil {
+			return err
+		}
+	}
+	return t.tracker.FreeTaskWith(taskID, t.memMgr.FreeRegion)
+}
+
+// Share makes one of taskID's allocations shareable with other tasks.
+func (t *TaskMemoryManager) Share(taskID string, startAddr uint64) (sharedmem.SharedHandle, error) {
+	return t.tracker.Share(taskID, startAddr)
+}
+
+// Attach gives taskID a reference to a shared region.
+func (t *TaskMemoryManager) Attach(taskID string, h sharedmem.SharedHandle) (sharedmem.MemRegion, error) {
+	return t.tracker.Attach(taskID, h)
+}
+
+// Detach drops one of taskID's references to a shared region, freeing the
+// region when it was the last one.
+func (t *TaskMemoryManager) Detach(taskID string, h sharedmem.SharedHandle) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	region, last, err := t.tracker.Detach(taskID, h)
+	if err != nil {
+		return err
+	}
+	if last {
+		if err := t.memMgr.FreeRegion(region.StartAddr); err != nil {
+			return fmt.Errorf("failed freeing shared region 0x%x: %w", region.StartAddr, err)
+		}
+	}
+	return nil
+}
+
+// OpenSpace gives taskID its own address space. Memory allocated through
+// AllocTask is only reachable through it.
+func (t *TaskMemoryManager) OpenSpace(taskID string) {
+	t.tracker.OpenSpace(taskID)
+}
+
+// AllocTask allocates size bytes for taskID and returns the task address.
+// An empty owner allocates on this SoC.
+func (t *TaskMemoryManager) AllocTask(taskID string, size uint64, owner string) (uint64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if owner == "" {
+		owner = t.memMgr.LocalSoCName
+	}
+	return t.tracker.AllocForTask(taskID, size, owner)
+}
+
+// FreeTaskAddr unmaps the region at a task address, freeing it unless other
+// tasks still map it.
+func (t *TaskMemoryManager) FreeTaskAddr(taskID string, addr uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tracker.FreeForTask(taskID, addr)
+}
+
+// ShareTask makes the region at a task address mappable by other tasks.
+func (t *TaskMemoryManager) ShareTask(taskID string, addr uint64) (sharedmem.SharedHandle, error) {
+	return t.tracker.ShareForTask(taskID, addr)
+}
+
+// MapShared maps a shared region into taskID's address space.
+func (t *TaskMemoryManager) MapShared(taskID string, h sharedmem.SharedHandle) (uint64, error) {
+	return t.tracker.MapShared(taskID, h)
+}
+
+// ReadTask reads `size` bytes at a task address of taskID.
+func (t *TaskMemoryManager) ReadTask(ctx context.Context, taskID string, addr uint64, size uint64) ([]byte, error) {
+	as, ok := t.tracker.Space(taskID)
 	if !ok {
-		return fmt.Errorf("no allocations for task %s", taskID)
+		return nil, fmt.Errorf("task %s has no address space", taskID)
+	}
+	extents, err := as.Resolve(addr, size)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, r := range regions {
-		err := t.memMgr.FreeRegion(r.StartAddr)
+	data := make([]byte, 0, size)
+	for _, ext := range extents {
+		part, err := t.memMgr.Read(ctx, ext.Global, ext.Length)
 		if err != nil {
-			return fmt.Errorf("failed freeing region 0x%x: %w", r.StartAddr, err)
+			return nil, err
 		}
+		data = append(data, part...)
 	}
+	return data, nil
+}
 
-	t.tracker.AllocLock.Lock()
-	delete(t.tracker.TaskAllocations, taskID)
-	t.tracker.AllocLock.Unlock()
+// WriteTask writes `data` at a task address of taskID.
+func (t *TaskMemoryManager) WriteTask(ctx context.Context, taskID string, addr uint64, data []byte) error {
+	as, ok := t.tracker.Space(taskID)
+	if !ok {
+		return fmt.Errorf("task %s has no address space", taskID)
+	}
+	extents, err := as.Resolve(addr, uint64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	for _, ext := range extents {
+		part := data[ext.TaskAddr-addr : ext.TaskAddr-addr+ext.Length]
+		if err := t.memMgr.Write(ctx, ext.Global, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateTaskMap creates a HashMap for taskID and returns the task address
+// naming it. Owners must be SoCs of the table; none means this SoC. The map
+// is freed with the task unless the task frees it first.
+func (t *TaskMemoryManager) CreateTaskMap(taskID string, cfg sharedmem.HashMapConfig) (uint64, error) {
+	if len(cfg.Owners) == 0 {
+		cfg.Owners = []string{t.memMgr.LocalSoCName}
+	}
+	for _, owner := range cfg.Owners {
+		if !t.memMgr.knownSoC(owner) {
+			return 0, fmt.Errorf("unknown SoC %q", owner)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	hm, err := sharedmem.NewHashMap(t.memMgr, cfg)
+	if err != nil {
+		return 0, err
+	}
+	addr, err := t.tracker.MapObject(taskID, hm.Addr())
+	if err != nil {
+		hm.Free()
+		return 0, err
+	}
+	return addr, nil
+}
+
+// TaskMap returns the global address of the HashMap a task address of
+// taskID names.
+func (t *TaskMemoryManager) TaskMap(taskID string, addr uint64) (uint64, error) {
+	return t.tracker.Object(taskID, addr)
+}
 
+// FreeTaskMap frees the HashMap a task address of taskID names.
+func (t *TaskMemoryManager) FreeTaskMap(taskID string, addr uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.freeTaskMap(taskID, addr)
+}
+
+// freeTaskMap is FreeTaskMap without locking.
+func (t *TaskMemoryManager) freeTaskMap(taskID string, addr uint64) error {
+	global, err := t.tracker.UnmapObject(taskID, addr)
+	if err != nil {
+		return err
+	}
+	if err := t.memMgr.HashMapFree(global); err != nil {
+		return fmt.Errorf("failed freeing hash map of task %s: %w", taskID, err)
+	}
 	return nil
 }
 
+// IssueToken returns a fresh token naming taskID to the JSON-RPC task API,
+// valid until revoked.
+func (t *TaskMemoryManager) IssueToken(taskID string) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to issue token for task %s: %w", taskID, err)
+	}
+	token := hex.EncodeToString(b[:])
+	t.tokenLock.Lock()
+	t.tokens[token] = taskID
+	t.tokenLock.Unlock()
+	return token, nil
+}
+
+// RevokeToken stops token from naming its task.
+func (t *TaskMemoryManager) RevokeToken(token string) {
+	t.tokenLock.Lock()
+	delete(t.tokens, token)
+	t.tokenLock.Unlock()
+}
+
+// TaskForToken returns the task a live token was issued to.
+func (t *TaskMemoryManager) TaskForToken(token string) (string, bool) {
+	t.tokenLock.Lock()
+	defer t.tokenLock.Unlock()
+	taskID, ok := t.tokens[token]
+	return taskID, ok
+}
+
+// RunTask runs Python code for taskID inside a fresh address space. The code
+// sees it as `task`, a TaskMemory holding a token issued for this run, and
+// reaches memory only through task addresses. The token is revoked, and the
+// space and all memory left in it are freed, when the code returns. Returns
+// the interpreter's reply.
+func (t *TaskMemoryManager) RunTask(ctx context.Context, taskID string, codeType string, code string) (string, error) {
+	if codeType != "python" {
+		return "", fmt.Errorf("unsupported task type %q", codeType)
+	}
+	if t.Runner == nil {
+		return "", errors.New("no task runner connected")
+	}
+	t.runLock.Lock()
+	defer t.runLock.Unlock()
+
+	token, err := t.IssueToken(taskID)
+	if err != nil {
+		return "", err
+	}
+	t.OpenSpace(taskID)
+	// The code is passed as one quoted line, since the interpreter reads a line per call
+	result, err := t.Runner.Exec(fmt.Sprintf("task = TaskMemory(agent, %s); exec(%s)",
+		strconv.Quote(token), strconv.Quote(code)))
+	t.RevokeToken(token)
+	if freeErr := t.FreeTask(taskID); freeErr != nil && err == nil {
+		err = fmt.Errorf("task %s ran but its memory was not freed: %w", taskID, freeErr)
+	}
+	if err != nil {
+		return "", err
+	}
+	result = strings.TrimSpace(result)
+	if msg, failed := strings.CutPrefix(result, "ERROR: "); failed {
+		return "", fmt.Errorf("task %s failed: %s", taskID, msg)
+	}
+	return result, nil
+}
+
 // Read, Write, etc can just delegate to underlying MemoryManager
 func (t *TaskMemoryManager) Read(ctx context.Context, addr uint64, size uint64) ([]byte, error) {
 	return t.memMgr.Read(ctx, addr, size)
@@ -0,0 +1,405 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"bigLITTLE/sharedmem"
+)
+
+// Network Block Device export
+//
+// NBDServer serves VMems to NBD clients such as the Linux nbd-client, so a
+// filesystem can live in cluster memory. Only the fixed newstyle handshake is
+// spoken, with the EXPORT_NAME, LIST, INFO, GO and ABORT options. In
+// transmission READ, WRITE, FLUSH, TRIM and DISC are supported, with simple
+// replies. All I/O goes through the VMem and thus the MemoryManager, which
+// completes writes before replying, so FLUSH has nothing left to do and TRIM
+// zeroes the range. Requests on one connection are served in order.
+
+const (
+	nbdMagic        = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptMagic     = 0x49484156454f5054 // "IHAVEOPT"
+	nbdRepMagic     = 0x0003e889045565a9
+	nbdRequestMagic = 0x25609513
+	nbdReplyMagic   = 0x67446698
+
+	// Handshake flags, server and client
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	// Options
+	nbdOptExportName = 1
+	nbdOptAbort      = 2
+	nbdOptList       = 3
+	nbdOptInfo       = 6
+	nbdOptGo         = 7
+
+	// Option replies
+	nbdRepAck        = 1
+	nbdRepServer     = 2
+	nbdRepInfo       = 3
+	nbdRepErrUnsup   = 1<<31 + 1
+	nbdRepErrInvalid = 1<<31 + 3
+	nbdRepErrUnknown = 1<<31 + 6
+
+	nbdInfoExport = 0
+
+	// Transmission flags
+	nbdFlagHasFlags  = 1 << 0
+	nbdFlagReadOnly  = 1 << 1
+	nbdFlagSendFlush = 1 << 2
+	nbdFlagSendTrim  = 1 << 5
+
+	// Commands
+	nbdCmdRead  = 0
+	nbdCmdWrite = 1
+	nbdCmdDisc  = 2
+	nbdCmdFlush = 3
+	nbdCmdTrim  = 4
+
+	// Errors, as errno values
+	nbdEPERM  = 1
+	nbdEIO    = 5
+	nbdEINVAL = 22
+	nbdENOSPC = 28
+
+	nbdMaxOption  = 64 << 10 // longest option payload accepted
+	nbdMaxRequest = 32 << 20 // longest READ or WRITE accepted
+)
+
+// NBDServer serves named VMems over the NBD protocol.
+type NBDServer struct {
+	lock    sync.RWMutex
+	exports map[string]*sharedmem.VMem
+}
+
+func NewNBDServer() *NBDServer {
+	return &NBDServer{exports: make(map[string]*sharedmem.VMem)}
+}
+
+// Export makes `v` available as `name`. Read-only VMems are exported
+// read-only. A client asking for the empty name gets the only export, if
+// there is just one.
+func (s *NBDServer) Export(name string, v *sharedmem.VMem) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.exports[name] = v
+}
+
+// ListenAndServe serves NBD clients on the given address (e.g. "127.0.0.1:10809").
+func (s *NBDServer) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	log.Printf("NBD server listening on %s", address)
+	return s.Serve(listener)
+}
+
+// Serve serves NBD clients on listener until it fails.
+func (s *NBDServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *NBDServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	v, err := s.negotiate(r, w)
+	if err != nil {
+		log.Printf("[NBD] Handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if v == nil {
+		return
+	}
+	if err := s.transmit(r, w, v); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("[NBD] Connection from %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// lookup returns the export called name.
+func (s *NBDServer) lookup(name string) (*sharedmem.VMem, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if v, ok := s.exports[name]; ok {
+		return v, true
+	}
+	if name == "" && len(s.exports) == 1 {
+		for _, v := range s.exports {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// names returns the export names in order.
+func (s *NBDServer) names() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	out := make([]string, 0, len(s.exports))
+	for name := range s.exports {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// negotiate runs the fixed newstyle handshake. Returns the export chosen by
+// the client, or nil if the client aborted.
+func (s *NBDServer) negotiate(r *bufio.Reader, w *bufio.Writer) (*sharedmem.VMem, error) {
+	var greeting [18]byte
+	binary.BigEndian.PutUint64(greeting[0:], nbdMagic)
+	binary.BigEndian.PutUint64(greeting[8:], nbdOptMagic)
+	binary.BigEndian.PutUint16(greeting[16:], nbdFlagFixedNewstyle|nbdFlagNoZeroes)
+	w.Write(greeting[:])
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(r, binary.BigEndian, &clientFlags); err != nil {
+		return nil, err
+	}
+	if clientFlags&nbdFlagFixedNewstyle == 0 {
+		return nil, errors.New("client does not speak fixed newstyle")
+	}
+	noZeroes := clientFlags&nbdFlagNoZeroes != 0
+
+	for {
+		var hdr [16]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint64(hdr[0:]) != nbdOptMagic {
+			return nil, errors.New("bad option magic")
+		}
+		opt := binary.BigEndian.Uint32(hdr[8:])
+		length := binary.BigEndian.Uint32(hdr[12:])
+		if length > nbdMaxOption {
+			return nil, fmt.Errorf("option %d of %d bytes is too long", opt, length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		var err error
+		switch opt {
+		case nbdOptExportName:
+			// No way to report an error but hanging up
+			v, ok := s.lookup(string(data))
+			if !ok {
+				return nil, fmt.Errorf("unknown export %q", data)
+			}
+			var reply [10 + 124]byte
+			binary.BigEndian.PutUint64(reply[0:], v.Size)
+			binary.BigEndian.PutUint16(reply[8:], nbdTransmissionFlags(v))
+			if noZeroes {
+				w.Write(reply[:10])
+			} else {
+				w.Write(reply[:])
+			}
+			return v, w.Flush()
+
+		case nbdOptAbort:
+			nbdOptReply(w, opt, nbdRepAck, nil)
+			w.Flush()
+			return nil, nil
+
+		case nbdOptList:
+			if length != 0 {
+				err = nbdOptReply(w, opt, nbdRepErrInvalid, nil)
+				break
+			}
+			for _, name := range s.names() {
+				entry := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+				if err = nbdOptReply(w, opt, nbdRepServer, append(entry, name...)); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = nbdOptReply(w, opt, nbdRepAck, nil)
+			}
+
+		case nbdOptInfo, nbdOptGo:
+			name, ok := nbdParseInfo(data)
+			if !ok {
+				err = nbdOptReply(w, opt, nbdRepErrInvalid, nil)
+				break
+			}
+			v, ok := s.lookup(name)
+			if !ok {
+				err = nbdOptReply(w, opt, nbdRepErrUnknown, []byte("unknown export"))
+				break
+			}
+			info := binary.BigEndian.AppendUint16(nil, nbdInfoExport)
+			info = binary.BigEndian.AppendUint64(info, v.Size)
+			info = binary.BigEndian.AppendUint16(info, nbdTransmissionFlags(v))
+			if err = nbdOptReply(w, opt, nbdRepInfo, info); err == nil {
+				err = nbdOptReply(w, opt, nbdRepAck, nil)
+			}
+			if err == nil && opt == nbdOptGo {
+				return v, w.Flush()
+			}
+
+		default:
+			err = nbdOptReply(w, opt, nbdRepErrUnsup, nil)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nbdParseInfo returns the export name of an INFO or GO option. The
+// information requests that follow it are ignored; the export size and flags
+// are always sent.
+func nbdParseInfo(data []byte) (string, bool) {
+	if len(data) < 6 {
+		return "", false
+	}
+	nameLen := uint64(binary.BigEndian.Uint32(data))
+	if nameLen > uint64(len(data))-6 {
+		return "", false
+	}
+	nreqs := uint64(binary.BigEndian.Uint16(data[4+nameLen:]))
+	if uint64(len(data)) != 6+nameLen+2*nreqs {
+		return "", false
+	}
+	return string(data[4 : 4+nameLen]), true
+}
+
+func nbdOptReply(w *bufio.Writer, opt uint32, reply uint32, data []byte) error {
+	var hdr [20]byte
+	binary.BigEndian.PutUint64(hdr[0:], nbdRepMagic)
+	binary.BigEndian.PutUint32(hdr[8:], opt)
+	binary.BigEndian.PutUint32(hdr[12:], reply)
+	binary.BigEndian.PutUint32(hdr[16:], uint32(len(data)))
+	w.Write(hdr[:])
+	_, err := w.Write(data)
+	return err
+}
+
+func nbdTransmissionFlags(v *sharedmem.VMem) uint16 {
+	flags := uint16(nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendTrim)
+	if v.IsReadOnly() {
+		flags |= nbdFlagReadOnly
+	}
+	return flags
+}
+
+// transmit serves requests on `v` until the client disconnects.
+func (s *NBDServer) transmit(r *bufio.Reader, w *bufio.Writer, v *sharedmem.VMem) error {
+	var zeroes []byte
+	for {
+		var req [28]byte
+		if _, err := io.ReadFull(r, req[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(req[0:]) != nbdRequestMagic {
+			return errors.New("bad request magic")
+		}
+		cmd := binary.BigEndian.Uint16(req[6:])
+		handle := binary.BigEndian.Uint64(req[8:])
+		offset := binary.BigEndian.Uint64(req[16:])
+		length := uint64(binary.BigEndian.Uint32(req[24:]))
+		inBounds := offset <= v.Size && length <= v.Size-offset
+
+		var errno uint32
+		var data []byte
+		switch cmd {
+		case nbdCmdRead:
+			switch {
+			case length > nbdMaxRequest:
+				errno = nbdEINVAL
+			case !inBounds:
+				errno = nbdEINVAL
+			default:
+				data = make([]byte, length)
+				if _, err := v.ReadAt(data, int64(offset)); err != nil {
+					log.Printf("[NBD] Read of %d bytes at %d failed: %v", length, offset, err)
+					data, errno = nil, nbdEIO
+				}
+			}
+
+		case nbdCmdWrite:
+			if length > nbdMaxRequest {
+				// The payload cannot be skipped safely
+				return fmt.Errorf("write of %d bytes is too long", length)
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			switch {
+			case v.IsReadOnly():
+				errno = nbdEPERM
+			case !inBounds:
+				errno = nbdENOSPC
+			default:
+				if _, err := v.WriteAt(payload, int64(offset)); err != nil {
+					log.Printf("[NBD] Write of %d bytes at %d failed: %v", length, offset, err)
+					errno = nbdEIO
+				}
+			}
+
+		case nbdCmdFlush:
+			// Writes are complete when they are acknowledged
+
+		case nbdCmdTrim:
+			switch {
+			case v.IsReadOnly():
+				errno = nbdEPERM
+			case !inBounds:
+				errno = nbdEINVAL
+			default:
+				if zeroes == nil {
+					zeroes = make([]byte, sharedmem.IOChunkSize)
+				}
+				for done := uint64(0); done < length && errno == 0; {
+					n := min(length-done, uint64(len(zeroes)))
+					if _, err := v.WriteAt(zeroes[:n], int64(offset+done)); err != nil {
+						log.Printf("[NBD] Trim of %d bytes at %d failed: %v", length, offset, err)
+						errno = nbdEIO
+					}
+					done += n
+				}
+			}
+
+		case nbdCmdDisc:
+			return nil
+
+		default:
+			errno = nbdEINVAL
+		}
+
+		var reply [16]byte
+		binary.BigEndian.PutUint32(reply[0:], nbdReplyMagic)
+		binary.BigEndian.PutUint32(reply[4:], errno)
+		binary.BigEndian.PutUint64(reply[8:], handle)
+		w.Write(reply[:])
+		w.Write(data)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"bigLITTLE/rpc"
+)
+
+// PressureLevel grades how close a SoC is to running out of memory.
+type PressureLevel int
+
+const (
+	PressureNormal PressureLevel = iota
+	PressureWarning
+	PressureCritical
+)
+
+func (l PressureLevel) String() string {
+	switch l {
+	case PressureNormal:
+		return "normal"
+	case PressureWarning:
+		return "warning"
+	case PressureCritical:
+		return "critical"
+	}
+	return fmt.Sprintf("PressureLevel(%d)", int(l))
+}
+
+// PressureEvent is published whenever a SoC's pressure level changes.
+type PressureEvent struct {
+	SoC          string
+	Seq          uint64 // increases with every published event
+	Level        PressureLevel
+	Usage        uint64 // bytes allocated on this SoC
+	SoftLimit    uint64
+	ClusterFree  uint64 // free bytes across the cluster
+	ClusterTotal uint64
+	Time         time.Time
+}
+
+// PressureThresholds decide the pressure level. Local thresholds are fractions
+// of SoftLimit in use, cluster thresholds are fractions of capacity still free.
+// The higher of the two levels wins. A level is only left downwards once the
+// figures are Hysteresis clear of its threshold, so usage hovering around a
+// threshold does not flap.
+type PressureThresholds struct {
+	LocalWarning    float64
+	LocalCritical   float64
+	ClusterWarning  float64
+	ClusterCritical float64
+	Hysteresis      float64
+}
+
+var DefaultPressureThresholds = PressureThresholds{
+	LocalWarning:    0.75,
+	LocalCritical:   0.95,
+	ClusterWarning:  0.20,
+	ClusterCritical: 0.05,
+	Hysteresis:      0.05,
+}
+
+// level grades `used` (fraction of the soft limit) and `free` (fraction of the
+// cluster capacity) with every threshold moved `margin` towards safety.
+func (th PressureThresholds) level(used float64, free float64, margin float64) PressureLevel {
+	level := PressureNormal
+	switch {
+	case used >= th.LocalCritical-margin:
+		level = PressureCritical
+	case used >= th.LocalWarning-margin:
+		level = PressureWarning
+	}
+	switch {
+	case free <= th.ClusterCritical+margin:
+		level = PressureCritical
+	case free <= th.ClusterWarning+margin && level < PressureWarning:
+		level = PressureWarning
+	}
+	return level
+}
+
+// next returns the level following prev for the given figures.
+func (th PressureThresholds) next(prev PressureLevel, used float64, free float64) PressureLevel {
+	level := th.level(used, free, 0)
+	if level < prev {
+		// Only step down as far as the hysteresis margin allows
+		level = max(level, min(prev, th.level(used, free, th.Hysteresis)))
+	}
+	return level
+}
+
+// PressureSource supplies the figures the pressure level is computed from.
+// *sharedmem.MemTable implements it.
+type PressureSource interface {
+	AllocatedBytes(owner string) uint64
+	TotalFreeBytes() uint64
+	Capacity() uint64
+}
+
+// pressureState holds the last published event and the local subscribers.
+type pressureState struct {
+	lock    sync.Mutex
+	current PressureEvent
+	changed chan struct{} // closed and replaced on every new event
+	subs    map[int]chan PressureEvent
+	nextSub int
+}
+
+func newPressureState(soc string) *pressureState {
+	return &pressureState{
+		current: PressureEvent{SoC: soc, Level: PressureNormal, Time: time.Now()},
+		changed: make(chan struct{}),
+		subs:    make(map[int]chan PressureEvent),
+	}
+}
+
+// Pressure returns the most recently published pressure event.
+func (m *MemoryManager) Pressure() PressureEvent {
+	m.pressure.lock.Lock()
+	defer m.pressure.lock.Unlock()
+	return m.pressure.current
+}
+
+// Subscribe returns a channel receiving every pressure level change, starting
+// with the current state. Slow receivers only see the latest event. Call the
+// returned function to unsubscribe.
+func (m *MemoryManager) Subscribe() (<-chan PressureEvent, func()) {
+	p := m.pressure
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ch := make(chan PressureEvent, 1)
+	ch <- p.current
+	id := p.nextSub
+	p.nextSub++
+	p.subs[id] = ch
+
+	return ch, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if _, ok := p.subs[id]; ok {
+			delete(p.subs, id)
+			close(ch)
+		}
+	}
+}
+
+// WaitPressure blocks until an event newer than afterSeq is published or ctx ends.
+// On timeout it returns the current event without error.
+func (m *MemoryManager) WaitPressure(ctx context.Context, afterSeq uint64) (PressureEvent, error) {
+	for {
+		m.pressure.lock.Lock()
+		current := m.pressure.current
+		changed := m.pressure.changed
+		m.pressure.lock.Unlock()
+
+		if current.Seq > afterSeq {
+			return current, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return current, nil
+			}
+			return current, ctx.Err()
+		}
+	}
+}
+
+// PressureSince is WaitPressure in wire format, for the RPC server.
+func (m *MemoryManager) PressureSince(ctx context.Context, afterSeq uint64) (rpc.PressureResponse, error) {
+	ev, err := m.WaitPressure(ctx, afterSeq)
+	if err != nil {
+		return rpc.PressureResponse{}, err
+	}
+	return rpc.PressureResponse{
+		SoC:          ev.SoC,
+		Seq:          ev.Seq,
+		Level:        int(ev.Level),
+		Usage:        ev.Usage,
+		SoftLimit:    ev.SoftLimit,
+		ClusterFree:  ev.ClusterFree,
+		ClusterTotal: ev.ClusterTotal,
+		Time:         ev.Time,
+	}, nil
+}
+
+// SubscribeRemote streams pressure events of a remote SoC until ctx ends.
+// It long-polls the SoC's WaitPressure RPC.
+func (m *MemoryManager) SubscribeRemote(ctx context.Context, soc string) (<-chan PressureEvent, error) {
+	client, ok := m.client(soc)
+	if !ok {
+		return nil, fmt.Errorf("no RPC client for SoC %s", soc)
+	}
+
+	ch := make(chan PressureEvent, 1)
+	go func() {
+		defer close(ch)
+		var seq uint64
+
+		for {
+			req := &rpc.PressureRequest{AfterSeq: seq, TimeoutMs: 30000}
+			resp := &rpc.PressureResponse{}
+			call := client.Go("RPCServer.WaitPressure", req, resp, nil)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-call.Done:
+			}
+			if call.Error != nil {
+				log.Printf("[Pressure] Subscription to %s failed: %v", soc, call.Error)
+				return
+			}
+			if resp.Seq <= seq {
+				continue
+			}
+			seq = resp.Seq
+
+			ev := PressureEvent{
+				SoC:          resp.SoC,
+				Seq:          resp.Seq,
+				Level:        PressureLevel(resp.Level),
+				Usage:        resp.Usage,
+				SoftLimit:    resp.SoftLimit,
+				ClusterFree:  resp.ClusterFree,
+				ClusterTotal: resp.ClusterTotal,
+				Time:         resp.Time,
+			}
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// PressureMonitor re-evaluates the pressure level of the local SoC on a timer.
+// Reading the figures walks the table, so it is kept off the allocation and
+// write paths.
+type PressureMonitor struct {
+	mem *MemoryManager
+
+	Source   PressureSource
+	Interval time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewPressureMonitor(mem *MemoryManager) *PressureMonitor {
+	return &PressureMonitor{
+		mem:      mem,
+		Source:   mem.Table,
+		Interval: time.Second,
+	}
+}
+
+// Start runs the monitor in the background until Stop is called.
+func (pm *PressureMonitor) Start() {
+	if pm.stop != nil {
+		return
+	}
+	pm.stop = make(chan struct{})
+	pm.wg.Add(1)
+
+	go func() {
+		defer pm.wg.Done()
+		ticker := time.NewTicker(pm.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-pm.stop:
+				return
+			case <-ticker.C:
+				pm.RunOnce()
+			}
+		}
+	}()
+}
+
+// Stop halts the background loop.
+func (pm *PressureMonitor) Stop() {
+	if pm.stop == nil {
+		return
+	}
+	close(pm.stop)
+	pm.wg.Wait()
+	pm.stop = nil
+}
+
+// RunOnce evaluates the pressure level once, publishing an event if it
+// changed, and returns the current level.
+func (pm *PressureMonitor) RunOnce() PressureLevel {
+	return pm.mem.evaluatePressure(pm.Source)
+}
+
+// evaluatePressure recomputes the pressure level from src and publishes an
+// event if it changed. Returns the current level.
+func (m *MemoryManager) evaluatePressure(src PressureSource) PressureLevel {
+	usage := src.AllocatedBytes(m.LocalSoCName)
+	clusterFree := src.TotalFreeBytes()
+	clusterTotal := src.Capacity()
+
+	used, free := 0.0, 1.0
+	if m.SoftLimit > 0 {
+		used = float64(usage) / float64(m.SoftLimit)
+	}
+	if clusterTotal > 0 {
+		free = float64(clusterFree) / float64(clusterTotal)
+	}
+
+	p := m.pressure
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	level := m.Thresholds.next(p.current.Level, used, free)
+	if level == p.current.Level {
+		return level
+	}
+
+	p.current = PressureEvent{
+		SoC:          m.LocalSoCName,
+		Seq:          p.current.Seq + 1,
+		Level:        level,
+		Usage:        usage,
+		SoftLimit:    m.SoftLimit,
+		ClusterFree:  clusterFree,
+		ClusterTotal: clusterTotal,
+		Time:         time.Now(),
+	}
+	log.Printf("[Pressure] %s is now %s (usage %d/%d, cluster free %d/%d)",
+		m.LocalSoCName, level, usage, m.SoftLimit, clusterFree, clusterTotal)
+
+	close(p.changed)
+	p.changed = make(chan struct{})
+
+	// Take lent memory back before running out
+	if level == PressureCritical {
+		go m.reclaimLoans()
+	}
+
+	for _, ch := range p.subs {
+		// Keep only the latest event for slow subscribers
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- p.current
+	}
+	return level
+}
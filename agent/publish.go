@@ -0,0 +1,245 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+)
+
+// Allocations other SoCs reach by address, like the memory of hash maps and
+// ring buffers, are published: every peer records them in its own table,
+// with the placements of their pages, until the publisher drops them. Moves
+// of their pages are sent along the same way.
+
+// regionMirror is an allocation another SoC published to this one.
+type regionMirror struct {
+	publisher string
+	recorded  bool // carved into this table, rather than found there already
+}
+
+// peers returns the SoCs this manager has RPC clients for.
+func (m *MemoryManager) peers() []string {
+	m.clientLock.RLock()
+	defer m.clientLock.RUnlock()
+
+	names := make([]string, 0, len(m.rpcClients))
+	for name := range m.rpcClients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// callPeer calls an RPC method answering with a MemoryResponse on soc.
+func (m *MemoryManager) callPeer(soc string, method string, req any) error {
+	client, ok := m.client(soc)
+	if !ok {
+		return fmt.Errorf("no RPC client for SoC %s", soc)
+	}
+	if err := client.Call(method, req, &rpc.MemoryResponse{}); err != nil {
+		return fmt.Errorf("RPC %s on %s failed: %w", method, soc, err)
+	}
+	return nil
+}
+
+// PublishRegion records the allocation holding addr, made in this table, in
+// the table of every peer. Publications are counted; peers keep the
+// allocation until the last one is dropped.
+func (m *MemoryManager) PublishRegion(addr uint64) error {
+	// No page moves between reading the placements and sending them
+	m.pageLock.RLock()
+	defer m.pageLock.RUnlock()
+	m.publishLock.Lock()
+	defer m.publishLock.Unlock()
+
+	region := m.Table.FindRegion(addr)
+	if region == nil {
+		return fmt.Errorf("no allocation holds address 0x%x", addr)
+	}
+	if m.published[region.StartAddr] > 0 {
+		m.published[region.StartAddr]++
+		return nil
+	}
+
+	req := &rpc.RegionMirrorRequest{Publisher: m.LocalSoCName, Region: *region, Placements: m.Table.Placements(*region)}
+	var told []string
+	for _, peer := range m.peers() {
+		if err := m.callPeer(peer, "RPCServer.MirrorRegion", req); err != nil {
+			for _, p := range told {
+				m.callPeer(p, "RPCServer.UnmirrorRegion", req)
+			}
+			return fmt.Errorf("publishing region 0x%x failed: %w", region.StartAddr, err)
+		}
+		told = append(told, peer)
+	}
+	m.published[region.StartAddr] = 1
+	return nil
+}
+
+// UnpublishRegion drops one publication of the allocation holding addr;
+// peers drop the allocation with the last one. A SoC mirroring it asks the
+// publisher.
+func (m *MemoryManager) UnpublishRegion(addr uint64) error {
+	region := m.Table.FindRegion(addr)
+	if region == nil {
+		return fmt.Errorf("no allocation holds address 0x%x", addr)
+	}
+	if publisher, ok := m.mirroredBy(region.StartAddr); ok {
+		return m.callPeer(publisher, "RPCServer.UnpublishRegion", &rpc.MemoryRequest{Address: addr})
+	}
+
+	m.publishLock.Lock()
+	defer m.publishLock.Unlock()
+
+	switch m.published[region.StartAddr] {
+	case 0:
+		return nil
+	case 1:
+		delete(m.published, region.StartAddr)
+		return m.unmirrorPeers(*region)
+	default:
+		m.published[region.StartAddr]--
+		return nil
+	}
+}
+
+// FreePublished frees the region at addr after dropping it from the table
+// of every peer. A SoC mirroring it asks the publisher.
+func (m *MemoryManager) FreePublished(addr uint64) error {
+	if publisher, ok := m.mirroredBy(addr); ok {
+		return m.callPeer(publisher, "RPCServer.FreePublished", &rpc.MemoryRequest{Address: addr})
+	}
+
+	m.publishLock.Lock()
+	defer m.publishLock.Unlock()
+
+	var err error
+	if _, ok := m.published[addr]; ok {
+		delete(m.published, addr)
+		if region := m.Table.FindRegion(addr); region != nil {
+			err = m.unmirrorPeers(*region)
+		}
+	}
+	if ferr := m.FreeRegion(addr); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// unmirrorPeers tells every peer to drop region. Returns the first failure.
+func (m *MemoryManager) unmirrorPeers(region sharedmem.MemRegion) error {
+	req := &rpc.RegionMirrorRequest{Publisher: m.LocalSoCName, Region: region}
+	var first error
+	for _, peer := range m.peers() {
+		if err := m.callPeer(peer, "RPCServer.UnmirrorRegion", req); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// mirroredBy returns the publisher of the allocation at start if this SoC
+// mirrors it.
+func (m *MemoryManager) mirroredBy(start uint64) (string, bool) {
+	m.mirrorLock.Lock()
+	defer m.mirrorLock.Unlock()
+	mirror, ok := m.regionMirrors[start]
+	return mirror.publisher, ok
+}
+
+// MirrorRegion records an allocation published by another SoC in this table.
+// Publishing it again only refreshes the placements of its pages.
+func (m *MemoryManager) MirrorRegion(publisher string, region sharedmem.MemRegion, placements []sharedmem.PagePlacement) error {
+	m.mirrorLock.Lock()
+	defer m.mirrorLock.Unlock()
+
+	if _, ok := m.regionMirrors[region.StartAddr]; ok {
+		return m.Table.MirrorPlacements(region, placements)
+	}
+	m.Table.OwnershipLock.Lock()
+	recorded, err := m.Table.MirrorRegion(region, publisher, placements)
+	m.Table.OwnershipLock.Unlock()
+	if err != nil {
+		return err
+	}
+	m.regionMirrors[region.StartAddr] = regionMirror{publisher: publisher, recorded: recorded}
+	return nil
+}
+
+// UnmirrorRegion drops an allocation MirrorRegion recorded.
+func (m *MemoryManager) UnmirrorRegion(region sharedmem.MemRegion) error {
+	m.mirrorLock.Lock()
+	defer m.mirrorLock.Unlock()
+
+	mirror, ok := m.regionMirrors[region.StartAddr]
+	if !ok {
+		return nil
+	}
+	delete(m.regionMirrors, region.StartAddr)
+	if !mirror.recorded {
+		return nil
+	}
+	return m.FreeRegion(region.StartAddr)
+}
+
+// MirrorPlacements places pages of a published allocation the way the SoC
+// that moved them did.
+func (m *MemoryManager) MirrorPlacements(region sharedmem.MemRegion, placements []sharedmem.PagePlacement) error {
+	return m.Table.MirrorPlacements(region, placements)
+}
+
+// ReserveFrame keeps a frame of this SoC that another SoC's table handed out
+// from being handed out here, and lets physical writes reach it.
+func (m *MemoryManager) ReserveFrame(frame sharedmem.Frame) error {
+	return m.Table.ReserveFrame(frame)
+}
+
+// ReleaseFrame gives back a frame reserved with ReserveFrame that backs nothing.
+func (m *MemoryManager) ReleaseFrame(frame sharedmem.Frame) {
+	m.Table.ReleaseFrame(frame)
+}
+
+// sharedIn returns the published or mirrored allocations the page containing
+// vaddr belongs to.
+func (m *MemoryManager) sharedIn(vaddr uint64) []sharedmem.MemRegion {
+	page := vaddr &^ (sharedmem.PageSize - 1)
+	allocs := m.Table.AllocationsIn(page, sharedmem.PageSize)
+	if len(allocs) == 0 {
+		return nil
+	}
+
+	var shared []sharedmem.MemRegion
+	m.publishLock.Lock()
+	for _, r := range allocs {
+		if m.published[r.StartAddr] > 0 {
+			shared = append(shared, r)
+		}
+	}
+	m.publishLock.Unlock()
+	m.mirrorLock.Lock()
+	for _, r := range allocs {
+		if _, ok := m.regionMirrors[r.StartAddr]; ok {
+			shared = append(shared, r)
+		}
+	}
+	m.mirrorLock.Unlock()
+	return shared
+}
+
+// mirrorMove tells every peer that the page containing vaddr, part of the
+// shared allocations, now lives on frame.
+func (m *MemoryManager) mirrorMove(shared []sharedmem.MemRegion, vaddr uint64, frame sharedmem.Frame) error {
+	placement := []sharedmem.PagePlacement{{VAddr: vaddr &^ (sharedmem.PageSize - 1), Frame: frame}}
+	var first error
+	for _, region := range shared {
+		req := &rpc.RegionMirrorRequest{Publisher: m.LocalSoCName, Region: region, Placements: placement}
+		for _, peer := range m.peers() {
+			if err := m.callPeer(peer, "RPCServer.MirrorPlacements", req); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
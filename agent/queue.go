@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"bigLITTLE/rpc"
+)
+
+// queueSignals holds the notification generation of every RingBuffer whose
+// callers sleep on this SoC.
+type queueSignals struct {
+	lock   sync.Mutex
+	queues map[uint64]*queueSignal
+}
+
+type queueSignal struct {
+	gen     uint64
+	changed chan struct{} // closed and replaced on every notification
+}
+
+func newQueueSignals() *queueSignals {
+	return &queueSignals{queues: make(map[uint64]*queueSignal)}
+}
+
+// get returns the signal of `queue`, creating it if needed.
+// Do not call without holding the lock.
+func (s *queueSignals) get(queue uint64) *queueSignal {
+	sig, ok := s.queues[queue]
+	if !ok {
+		sig = &queueSignal{changed: make(chan struct{})}
+		s.queues[queue] = sig
+	}
+	return sig
+}
+
+// NotifyQueue wakes the callers of the RingBuffer at `queue` sleeping on
+// `home`.
+func (m *MemoryManager) NotifyQueue(ctx context.Context, home string, queue uint64) error {
+	if home == m.LocalSoCName {
+		m.SignalQueue(queue)
+		return nil
+	}
+	client, ok := m.client(home)
+	if !ok {
+		return fmt.Errorf("no RPC client for SoC %s", home)
+	}
+	req := &rpc.QueueRequest{Queue: queue}
+	resp := &rpc.QueueResponse{}
+	if err := client.Call("RPCServer.NotifyQueue", req, resp); err != nil {
+		return fmt.Errorf("RPC queue notification to %s failed: %w", home, err)
+	}
+	return nil
+}
+
+// WaitQueue blocks until the notification generation of the RingBuffer at
+// `queue`, kept on `home`, differs from `seen`, and returns it. Remote waits
+// are long polls of the home SoC; when one times out the unchanged
+// generation is returned and the caller checks the queue again.
+func (m *MemoryManager) WaitQueue(ctx context.Context, home string, queue uint64, seen uint64) (uint64, error) {
+	if home == m.LocalSoCName {
+		return m.AwaitQueue(ctx, queue, seen)
+	}
+	client, ok := m.client(home)
+	if !ok {
+		return 0, fmt.Errorf("no RPC client for SoC %s", home)
+	}
+	req := &rpc.QueueRequest{Queue: queue, Seen: seen, TimeoutMs: 30000}
+	resp := &rpc.QueueResponse{}
+	call := client.Go("RPCServer.WaitQueue", req, resp, nil)
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-call.Done:
+	}
+	if call.Error != nil {
+		return 0, fmt.Errorf("RPC queue wait on %s failed: %w", home, call.Error)
+	}
+	return resp.Generation, nil
+}
+
+// SignalQueue advances the notification generation of `queue` on this SoC
+// and wakes its local waiters. Returns the new generation.
+func (m *MemoryManager) SignalQueue(queue uint64) uint64 {
+	s := m.queueSignals
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sig := s.get(queue)
+	sig.gen++
+	close(sig.changed)
+	sig.changed = make(chan struct{})
+	return sig.gen
+}
+
+// AwaitQueue blocks until the notification generation of `queue` on this SoC
+// differs from `seen` or ctx ends, in which case ctx's error is returned.
+func (m *MemoryManager) AwaitQueue(ctx context.Context, queue uint64, seen uint64) (uint64, error) {
+	s := m.queueSignals
+	for {
+		s.lock.Lock()
+		sig := s.get(queue)
+		gen, changed := sig.gen, sig.changed
+		s.lock.Unlock()
+
+		if gen != seen {
+			return gen, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return gen, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"bigLITTLE/sharedmem"
+)
+
+// Reaper frees leased allocations whose lease expired or whose holder SoC has
+// been declared dead, and drops them from the task tracker.
+type Reaper struct {
+	mem     *MemoryManager
+	tracker *sharedmem.TaskMemoryTracker
+
+	Interval time.Duration
+
+	deadLock sync.Mutex
+	dead     map[string]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewReaper(mem *MemoryManager, tracker *sharedmem.TaskMemoryTracker) *Reaper {
+	return &Reaper{
+		mem:      mem,
+		tracker:  tracker,
+		Interval: 5 * time.Second,
+		dead:     make(map[string]bool),
+	}
+}
+
+// DeclareDead marks a SoC as dead; all leases it holds become reclaimable.
+func (r *Reaper) DeclareDead(soc string) {
+	r.deadLock.Lock()
+	defer r.deadLock.Unlock()
+	r.dead[soc] = true
+	log.Printf("[Reaper] SoC %s declared dead", soc)
+}
+
+// Revive clears a previous DeclareDead.
+func (r *Reaper) Revive(soc string) {
+	r.deadLock.Lock()
+	defer r.deadLock.Unlock()
+	delete(r.dead, soc)
+}
+
+// IsDead reports whether soc is currently declared dead.
+func (r *Reaper) IsDead(soc string) bool {
+	r.deadLock.Lock()
+	defer r.deadLock.Unlock()
+	return r.dead[soc]
+}
+
+// Start runs the reaper in the background until Stop is called.
+func (r *Reaper) Start() {
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.RunOnce()
+			}
+		}
+	}()
+}
+
+// Stop halts the background loop.
+func (r *Reaper) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	r.wg.Wait()
+	r.stop = nil
+}
+
+// RunOnce reclaims everything currently eligible and returns what was freed.
+func (r *Reaper) RunOnce() []sharedmem.LeasedRegion {
+	r.deadLock.Lock()
+	dead := make(map[string]bool, len(r.dead))
+	for soc := range r.dead {
+		dead[soc] = true
+	}
+	r.deadLock.Unlock()
+
+	var reclaimed []sharedmem.LeasedRegion
+	for _, lr := range r.mem.Table.ExpiredLeases(time.Now(), dead) {
+		if err := r.mem.FreeRegion(lr.Region.StartAddr); err != nil {
+			log.Printf("[Reaper] Failed to reclaim 0x%x: %v", lr.Region.StartAddr, err)
+			continue
+		}
+		if r.tracker != nil {
+			r.tracker.ForgetRegion(lr.Region.StartAddr)
+		}
+
+		log.Printf("[Reaper] Reclaimed 0x%x (%d bytes, owner %s, holder %s, task %q): %s",
+			lr.Region.StartAddr, lr.Region.Length, lr.Region.Owner, lr.Lease.Holder, lr.Lease.TaskID, lr.Reason)
+		reclaimed = append(reclaimed, lr)
+	}
+	return reclaimed
+}
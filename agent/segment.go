@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"fmt"
+	"slices"
+
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+)
+
+// SegmentRegistry returns where this SoC names its segments: the master's
+// registry if a master is set, else the table.
+func (m *MemoryManager) SegmentRegistry() sharedmem.SegmentRegistry {
+	if m.Master == nil {
+		return m.Table
+	}
+	return masterSegments{m}
+}
+
+// FreeSegment frees the allocation of a segment created on this SoC, once
+// the SoC that dropped its last reference says so. Only segment allocations
+// are freed this way.
+func (m *MemoryManager) FreeSegment(region sharedmem.MemRegion) error {
+	label, ok := m.Table.GetLabel(region.StartAddr)
+	if !ok || !slices.Contains(label.Tags, "segment") {
+		return fmt.Errorf("no segment allocation at address 0x%x", region.StartAddr)
+	}
+	return m.FreeRegion(region.StartAddr)
+}
+
+// masterSegments names segments in the master's registry. A segment's
+// allocation stays in its creator's table; other SoCs mirror it in theirs
+// while they hold references, and ask the creator to free it when they drop
+// the last one.
+type masterSegments struct {
+	m *MemoryManager
+}
+
+func (s masterSegments) CreateSegment(name string, region sharedmem.MemRegion, size uint64, perm sharedmem.SegmentPerm) (sharedmem.NamedSegment, error) {
+	m := s.m
+	if err := m.Table.SetLabel(region.StartAddr, sharedmem.Label{Name: name, Tags: []string{"segment"}}); err != nil {
+		return sharedmem.NamedSegment{}, err
+	}
+	req := &rpc.SegmentRequest{From: m.LocalSoCName, Name: name, Region: region, Size: size, Perm: perm}
+	resp, err := m.Master.Segment("CreateSegment", req)
+	return resp.Segment, err
+}
+
+func (s masterSegments) OpenSegment(name string, access sharedmem.SegmentPerm, minSize uint64) (sharedmem.NamedSegment, error) {
+	m := s.m
+	req := &rpc.SegmentRequest{From: m.LocalSoCName, Name: name, Size: minSize, Perm: access}
+	resp, err := m.Master.Segment("OpenSegment", req)
+	if err != nil {
+		return sharedmem.NamedSegment{}, err
+	}
+	seg := resp.Segment
+	if seg.Creator == m.LocalSoCName {
+		return seg, nil
+	}
+	if err := m.mirrorSegment(seg); err != nil {
+		s.CloseSegment(seg.ID)
+		return sharedmem.NamedSegment{}, err
+	}
+	return seg, nil
+}
+
+func (s masterSegments) CloseSegment(id uint64) (sharedmem.MemRegion, bool, error) {
+	m := s.m
+	resp, err := m.Master.Segment("CloseSegment", &rpc.SegmentRequest{From: m.LocalSoCName, ID: id})
+	if err != nil {
+		return sharedmem.MemRegion{}, false, err
+	}
+	seg := resp.Segment
+	if seg.Creator == m.LocalSoCName {
+		return seg.Region, resp.Last, nil
+	}
+	if err := m.unmirrorSegment(seg); err != nil {
+		return seg.Region, false, err
+	}
+	if resp.Last {
+		return seg.Region, false, m.freeSegmentOn(seg)
+	}
+	return seg.Region, false, nil
+}
+
+func (s masterSegments) UnlinkSegment(name string) (sharedmem.MemRegion, bool, error) {
+	m := s.m
+	resp, err := m.Master.Segment("UnlinkSegment", &rpc.SegmentRequest{From: m.LocalSoCName, Name: name})
+	if err != nil {
+		return sharedmem.MemRegion{}, false, err
+	}
+	seg := resp.Segment
+	if seg.Creator == m.LocalSoCName {
+		return seg.Region, resp.Last, nil
+	}
+	if resp.Last {
+		return seg.Region, false, m.freeSegmentOn(seg)
+	}
+	return seg.Region, false, nil
+}
+
+// mirrorSegment records a reference to a segment created on another SoC,
+// recording its allocation in this table on the first one.
+func (m *MemoryManager) mirrorSegment(seg sharedmem.NamedSegment) error {
+	m.mirrorLock.Lock()
+	defer m.mirrorLock.Unlock()
+
+	if m.mirrors[seg.ID] == 0 {
+		m.Table.OwnershipLock.Lock()
+		err := m.Table.MirrorSegment(seg)
+		m.Table.OwnershipLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	m.mirrors[seg.ID]++
+	return nil
+}
+
+// unmirrorSegment drops a reference mirrorSegment recorded, dropping the
+// allocation from this table with the last one.
+func (m *MemoryManager) unmirrorSegment(seg sharedmem.NamedSegment) error {
+	m.mirrorLock.Lock()
+	defer m.mirrorLock.Unlock()
+
+	if m.mirrors[seg.ID] == 0 {
+		return nil
+	}
+	m.mirrors[seg.ID]--
+	if m.mirrors[seg.ID] > 0 {
+		return nil
+	}
+	delete(m.mirrors, seg.ID)
+	return m.FreeRegion(seg.Region.StartAddr)
+}
+
+// freeSegmentOn asks the creator of a segment to free its allocation.
+func (m *MemoryManager) freeSegmentOn(seg sharedmem.NamedSegment) error {
+	client, ok := m.client(seg.Creator)
+	if !ok {
+		return fmt.Errorf("no RPC client for SoC %s to free segment %q", seg.Creator, seg.Name)
+	}
+	req := &rpc.SegmentFreeRequest{Region: seg.Region}
+	if err := client.Call("RPCServer.FreeSegment", req, &rpc.MemoryResponse{}); err != nil {
+		return fmt.Errorf("RPC free of segment %q on %s failed: %w", seg.Name, seg.Creator, err)
+	}
+	return nil
+}
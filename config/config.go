@@ -8,15 +8,17 @@ import (
 )
 
 type SoCConfig struct {
-	Name       string `json:"name"`
-	CPUClass   string `json:"cpu_class"` // "big" or "little"
-	MemoryMB   uint64 `json:"memory_mb"`
-	Address    string `json:"address"`     // e.g., "192.168.1.101:8080"
-	PythonPort int    `json:"python_port"` // port python_exec.py listens on, if big core
+	Name       string  `json:"name"`
+	CPUClass   string  `json:"cpu_class"` // "big" or "little"
+	MemoryMB   uint64  `json:"memory_mb"`
+	Address    string  `json:"address"`             // e.g., "192.168.1.101:8080"
+	PythonPort int     `json:"python_port"`         // port python_exec.py listens on, if big core
+	BaseAddr   *uint64 `json:"base_addr,omitempty"` // fixed start in global memory, instead of a layout slot
 }
 
 type ClusterConfig struct {
-	SoCs []SoCConfig `json:"socs"`
+	SoCs          []SoCConfig `json:"socs"`
+	MasterAddress string      `json:"master_address,omitempty"` // e.g., "192.168.1.100:8070"; agents fetch the layout from it, or lay it out themselves when empty
 }
 
 var GlobalConfig ClusterConfig
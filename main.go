@@ -4,8 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	nrpc "net/rpc"
 	"os"
+	"strings"
 	"time"
 
 	"bigLITTLE/agent"
@@ -15,9 +17,26 @@ import (
 )
 
 var (
-	mode       = flag.String("mode", "master", "Mode: master or agent")
+	mode       = flag.String("mode", "master", "Mode: master, agent, nbd or query")
 	configPath = flag.String("config", "config/socs.json", "Path to SoC config JSON")
 	rpcPort    = flag.Int("rpc-port", 8080, "RPC server port to listen on (agent mode)")
+	jsonPort   = flag.Int("json-rpc-port", 0, "JSON-RPC port for Python tasks (agent mode); 0 disables it")
+	pageAlloc  = flag.String("page-backend", "region", "Page allocator backend: region or buddy (agent mode)")
+	layoutPath = flag.String("layout", "config/layout.json", "Path to the persisted address layout (master mode, or agent mode without a master)")
+
+	// NBD mode: an agent that also exports cluster memory as a block device
+	nbdAddr   = flag.String("nbd-addr", "127.0.0.1:10809", "Address to serve the NBD export on (nbd mode)")
+	nbdName   = flag.String("nbd-name", "cluster", "NBD export name (nbd mode)")
+	nbdSize   = flag.Uint64("nbd-size", 64<<20, "Size of the NBD export in bytes (nbd mode)")
+	nbdOwners = flag.String("nbd-owners", "", "Comma-separated SoCs to stripe the NBD export over (nbd mode); defaults to this SoC")
+
+	// Query mode filters
+	querySoC   = flag.String("soc", "", "SoC to query (query mode); defaults to the first SoC")
+	queryOwner = flag.String("owner", "", "Only list allocations owned by this SoC (query mode)")
+	queryTag   = flag.String("tag", "", "Only list allocations carrying this tag (query mode)")
+	queryTask  = flag.String("task", "", "Only list allocations of this task (query mode)")
+	queryMin   = flag.Uint64("min-size", 0, "Only list allocations of at least this many bytes (query mode)")
+	queryMax   = flag.Uint64("max-size", 0, "Only list allocations of at most this many bytes (query mode)")
 )
 
 func main() {
@@ -28,15 +47,45 @@ func main() {
 	config.LoadConfig(*configPath)
 	socs := config.GlobalConfig.SoCs
 
-	// Build mem regions & MemTable
+	switch *mode {
+	case "agent", "nbd":
+		runAgent(socs)
+	case "master":
+		runMaster(socs)
+	case "query":
+		runQuery(socs)
+	default:
+		log.Fatalf("Unknown mode: %s", *mode)
+	}
+}
+
+// socMemInfos returns the memory configuration of every SoC.
+func socMemInfos(socs []config.SoCConfig) []sharedmem.SoCMemInfo {
 	var memInfos []sharedmem.SoCMemInfo
 	for _, s := range socs {
-		memInfos = append(memInfos, sharedmem.SoCMemInfo{Name: s.Name, MemoryMB: s.MemoryMB})
+		memInfos = append(memInfos, sharedmem.SoCMemInfo{Name: s.Name, MemoryMB: s.MemoryMB, BaseAddr: s.BaseAddr})
 	}
+	return memInfos
+}
 
-	regions, err := sharedmem.AllocateRegions(memInfos)
-	if err != nil {
-		log.Fatalf("Failed to allocate memory regions: %v", err)
+// buildMemTable fetches the region of every SoC from the master and builds
+// the table over them. The master owns the layout, so all agents agree on it;
+// an agent whose configuration disagrees with it refuses to start. Without a
+// master the agent lays out the address space itself, from its own persisted
+// layout.
+func buildMemTable(socs []config.SoCConfig, self string) *sharedmem.MemTable {
+	var regions []sharedmem.MemRegion
+	if config.GlobalConfig.MasterAddress == "" {
+		regions = assignLayout(socs)
+	} else {
+		var err error
+		regions, err = rpc.FetchLayout(config.GlobalConfig.MasterAddress, self)
+		if err != nil {
+			log.Fatalf("Failed to fetch the address layout: %v", err)
+		}
+		if err := sharedmem.CheckLayout(regions, socMemInfos(socs)); err != nil {
+			log.Fatalf("Configuration disagrees with the master's layout: %v", err)
+		}
 	}
 
 	memTable, err := sharedmem.NewMemTable(regions)
@@ -44,17 +93,34 @@ func main() {
 		log.Fatalf("Failed to create MemTable: %v", err)
 	}
 
-	switch *mode {
-	case "agent":
-		runAgent(socs, memTable)
-	case "master":
-		runMaster(socs, memTable)
+	switch *pageAlloc {
+	case "region":
+	case "buddy":
+		memTable.SetPageBackend(sharedmem.PageBackendBuddy)
 	default:
-		log.Fatalf("Unknown mode: %s", *mode)
+		log.Fatalf("Unknown page backend: %s", *pageAlloc)
 	}
+	return memTable
 }
 
-func runAgent(socs []config.SoCConfig, memTable *sharedmem.MemTable) {
+// assignLayout gives every SoC its region from the layout persisted at
+// layoutPath, keeping slots across runs, and saves the result.
+func assignLayout(socs []config.SoCConfig) []sharedmem.MemRegion {
+	layout, err := sharedmem.LoadLayout(*layoutPath)
+	if err != nil {
+		log.Fatalf("Failed to load address layout: %v", err)
+	}
+	regions, err := layout.Assign(socMemInfos(socs))
+	if err != nil {
+		log.Fatalf("Failed to allocate memory regions: %v", err)
+	}
+	if err := layout.Save(*layoutPath); err != nil {
+		log.Fatalf("Failed to save address layout: %v", err)
+	}
+	return regions
+}
+
+func runAgent(socs []config.SoCConfig) {
 	// Find config for this agent by env var or hostname
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -72,17 +138,51 @@ func runAgent(socs []config.SoCConfig, memTable *sharedmem.MemTable) {
 		log.Fatalf("Agent config for hostname %s not found", hostname)
 	}
 
-	agentInstance := agent.NewAgent(*thisCfg, memTable)
+	agentInstance := agent.NewAgent(*thisCfg, buildMemTable(socs, thisCfg.Name))
+	// Each agent has its own table, so segments are named at the master if there is one
+	if config.GlobalConfig.MasterAddress != "" {
+		agentInstance.MemManager.Master = rpc.NewMasterClient(config.GlobalConfig.MasterAddress)
+	}
+	if *jsonPort != 0 {
+		agentInstance.StartJSONRPCServer(fmt.Sprintf(":%d", *jsonPort))
+	}
+	if *mode == "nbd" {
+		owners := []string{thisCfg.Name}
+		if *nbdOwners != "" {
+			owners = strings.Split(*nbdOwners, ",")
+		}
+		agentInstance.StartNBDServer(*nbdAddr, *nbdName, *nbdSize, owners)
+	}
 	rpcAddr := fmt.Sprintf(":%d", *rpcPort)
 	agentInstance.Run(socs, rpcAddr)
 
 	select {} // block forever
 }
 
-func runMaster(socs []config.SoCConfig, memTable *sharedmem.MemTable) {
+func runMaster(socs []config.SoCConfig) {
 	log.Println("Running in master mode")
 
-	// Connect to big SoC python RPC client
+	// The master owns the layout and the segment names. Slots are kept across
+	// runs so adding a SoC does not move the others, and agents fetch their
+	// regions from here.
+	if config.GlobalConfig.MasterAddress == "" {
+		log.Println("No master_address configured, agents lay out the address space themselves")
+	} else {
+		regions := assignLayout(socs)
+		_, port, err := net.SplitHostPort(config.GlobalConfig.MasterAddress)
+		if err != nil {
+			log.Fatalf("Invalid master_address %q: %v", config.GlobalConfig.MasterAddress, err)
+		}
+		go func() {
+			master := &rpc.MasterServer{Regions: regions, Segments: sharedmem.NewSegmentDirectory()}
+			if err := rpc.StartMasterServer(master, ":"+port); err != nil {
+				log.Fatalf("Master RPC server error: %v", err)
+			}
+		}()
+	}
+
+	// Connect to big SoC python RPC client. The agents may still be waiting
+	// for the layout, so the master keeps serving it if this fails.
 	var bigSoC *config.SoCConfig
 	for _, c := range socs {
 		if c.CPUClass == "big" && c.PythonPort != 0 {
@@ -91,12 +191,14 @@ func runMaster(socs []config.SoCConfig, memTable *sharedmem.MemTable) {
 		}
 	}
 	if bigSoC == nil {
-		log.Fatal("No big SoC with python port configured")
+		log.Println("No big SoC with python port configured")
+		select {}
 	}
 
 	client, err := nrpc.DialHTTP("tcp", bigSoC.Address)
 	if err != nil {
-		log.Fatalf("Failed to connect to big SoC RPC at %s: %v", bigSoC.Address, err)
+		log.Printf("Failed to connect to big SoC RPC at %s: %v", bigSoC.Address, err)
+		select {}
 	}
 	log.Printf("Connected to big SoC RPC at %s", bigSoC.Address)
 
@@ -118,10 +220,8 @@ print(f"Counter is now {shared_counter}")
 	var taskResp rpc.TaskResponse
 	err = client.Call("RPCServer.RunTask", taskReq, &taskResp)
 	if err != nil {
-		log.Fatalf("Task RPC call failed: %v", err)
-	}
-
-	if taskResp.Error != "" {
+		log.Printf("Task RPC call failed: %v", err)
+	} else if taskResp.Error != "" {
 		log.Printf("Task error: %s", taskResp.Error)
 	} else {
 		log.Printf("Task result: %s", taskResp.Result)
@@ -132,3 +232,61 @@ print(f"Counter is now {shared_counter}")
 		time.Sleep(30 * time.Second)
 	}
 }
+
+// runQuery lists the allocations of one SoC with their labels.
+func runQuery(socs []config.SoCConfig) {
+	if len(socs) == 0 {
+		log.Fatal("No SoCs configured")
+	}
+	target := socs[0]
+	if *querySoC != "" {
+		found := false
+		for _, c := range socs {
+			if c.Name == *querySoC {
+				target, found = c, true
+				break
+			}
+		}
+		if !found {
+			log.Fatalf("Unknown SoC: %s", *querySoC)
+		}
+	}
+
+	client, err := nrpc.DialHTTP("tcp", target.Address)
+	if err != nil {
+		log.Fatalf("Failed to connect to %s at %s: %v", target.Name, target.Address, err)
+	}
+	defer client.Close()
+
+	req := &rpc.AllocQueryRequest{
+		Owner:   *queryOwner,
+		Tag:     *queryTag,
+		TaskID:  *queryTask,
+		MinSize: *queryMin,
+		MaxSize: *queryMax,
+	}
+	var resp rpc.AllocQueryResponse
+	if err := client.Call("RPCServer.QueryAllocations", req, &resp); err != nil {
+		log.Fatalf("Query RPC call failed: %v", err)
+	}
+
+	var total uint64
+	fmt.Printf("%-18s %12s %-10s %-16s %-12s %-10s %-20s %s\n", "ADDRESS", "LENGTH", "OWNER", "NAME", "TASK", "CREATOR", "CREATED", "TAGS")
+	for _, a := range resp.Allocations {
+		created := "-"
+		if !a.Created.IsZero() {
+			created = a.Created.Format(time.DateTime)
+		}
+		fmt.Printf("0x%016x %12d %-10s %-16s %-12s %-10s %-20s %s\n",
+			a.StartAddr, a.Length, a.Owner, orDash(a.Name), orDash(a.TaskID), orDash(a.Creator), created, strings.Join(a.Tags, ","))
+		total += a.Length
+	}
+	fmt.Printf("%d allocations, %d bytes\n", len(resp.Allocations), total)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
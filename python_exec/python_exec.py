@@ -1,24 +1,34 @@
 import socketserver
 
+from sharedmap import AgentClient, SharedMap, TaskMemory
+
 # Persistent global namespace for exec/eval
 global_namespace = {}
 
 class PythonExecHandler(socketserver.StreamRequestHandler):
     def handle(self):
-        code = self.rfile.readline().strip().decode("utf-8")
-        try:
-            exec(code, global_namespace)
-            self.wfile.write(b"OK\n")
-        except Exception as e:
-            self.wfile.write(f"ERROR: {e}\n".encode())
+        # The agent keeps one connection open and sends a line per task
+        for line in self.rfile:
+            code = line.strip().decode("utf-8")
+            try:
+                exec(code, global_namespace)
+                self.wfile.write(b"OK\n")
+            except Exception as e:
+                self.wfile.write(f"ERROR: {e}\n".encode())
 
 if __name__ == "__main__":
     import argparse
 
     parser = argparse.ArgumentParser(description="Persistent Python Exec Server")
     parser.add_argument("--port", type=int, default=9000, help="TCP port to listen on")
+    parser.add_argument("--agent-port", type=int, default=0, help="agent JSON-RPC port; 0 disables SharedMap")
     args = parser.parse_args()
 
+    if args.agent_port:
+        global_namespace["agent"] = AgentClient(port=args.agent_port)
+    global_namespace["SharedMap"] = SharedMap
+    global_namespace["TaskMemory"] = TaskMemory
+
     server = socketserver.TCPServer(("0.0.0.0", args.port), PythonExecHandler)
     print(f"Python exec server running on port {args.port}")
     server.serve_forever()
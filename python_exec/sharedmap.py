@@ -0,0 +1,130 @@
+import base64
+import itertools
+import json
+import socket
+import threading
+
+
+class AgentClient:
+    """JSON-RPC 1.0 client for an agent started with -json-rpc-port."""
+
+    def __init__(self, host="127.0.0.1", port=8081):
+        self.sock = socket.create_connection((host, port))
+        self.file = self.sock.makefile("rb")
+        self.ids = itertools.count()
+        self.lock = threading.Lock()
+
+    def call(self, method, params):
+        with self.lock:
+            req = {"method": "RPCServer." + method, "params": [params], "id": next(self.ids)}
+            self.sock.sendall(json.dumps(req).encode() + b"\n")
+            resp = json.loads(self.file.readline())
+        if resp.get("error"):
+            raise RuntimeError(resp["error"])
+        return resp["result"]
+
+    def close(self):
+        self.file.close()
+        self.sock.close()
+
+
+def _b64(data):
+    if isinstance(data, str):
+        data = data.encode("utf-8")
+    return base64.b64encode(data).decode("ascii")
+
+
+class SharedMap:
+    """A hash map in the cluster's global memory, created by a task. Its
+    address is a task address of that task, and the map is freed when the
+    task ends. Keys and values are bytes (str is UTF-8 encoded)."""
+
+    def __init__(self, task, addr):
+        self.task = task
+        self.addr = addr
+
+    @classmethod
+    def create(cls, task, key_size, value_size, buckets=0, owners=None):
+        resp = task.client.call("HashMapCreate", {
+            "Token": task.token,
+            "KeySize": key_size,
+            "ValueSize": value_size,
+            "Buckets": buckets,
+            "Owners": owners or [],
+        })
+        return cls(task, resp["Map"])
+
+    def _call(self, method, key=b"", value=b""):
+        return self.task.client.call(method, {
+            "Token": self.task.token,
+            "Map": self.addr,
+            "Key": _b64(key),
+            "Value": _b64(value),
+        })
+
+    def get(self, key, default=None):
+        resp = self._call("HashMapGet", key)
+        if not resp["Found"]:
+            return default
+        return base64.b64decode(resp["Value"] or "")
+
+    def put(self, key, value):
+        self._call("HashMapPut", key, value)
+
+    def delete(self, key):
+        return self._call("HashMapDelete", key)["Found"]
+
+    def free(self):
+        self._call("HashMapFree")
+
+    def __getitem__(self, key):
+        resp = self._call("HashMapGet", key)
+        if not resp["Found"]:
+            raise KeyError(key)
+        return base64.b64decode(resp["Value"] or "")
+
+    def __setitem__(self, key, value):
+        self.put(key, value)
+
+    def __delitem__(self, key):
+        if not self.delete(key):
+            raise KeyError(key)
+
+    def __contains__(self, key):
+        return self._call("HashMapGet", key)["Found"]
+
+    def __len__(self):
+        return self._call("HashMapLen")["Len"]
+
+
+class TaskMemory:
+    """The address space of one task. Addresses are task addresses: they only
+    reach memory allocated or mapped for this task, and mean nothing to other
+    tasks. Tasks started with RunTask find theirs bound to `task`, holding the
+    token the agent issued for the run."""
+
+    def __init__(self, client, token):
+        self.client = client
+        self.token = token
+
+    def alloc(self, size, owner=""):
+        resp = self.client.call("TaskAlloc", {"Token": self.token, "Size": size, "Owner": owner})
+        return resp["Address"]
+
+    def free(self, addr):
+        self.client.call("TaskFree", {"Token": self.token, "Address": addr})
+
+    def read(self, addr, size):
+        resp = self.client.call("TaskRead", {"Token": self.token, "Address": addr, "Size": size})
+        return base64.b64decode(resp["Data"] or "")
+
+    def write(self, addr, data):
+        self.client.call("TaskWrite", {"Token": self.token, "Address": addr, "Data": _b64(data)})
+
+    def share(self, addr):
+        """Returns a handle other tasks can pass to map_shared."""
+        return self.client.call("TaskShare", {"Token": self.token, "Address": addr})["Handle"]
+
+    def map_shared(self, handle):
+        resp = self.client.call("TaskMapShared", {"Token": self.token, "Handle": handle})
+        return resp["Address"]
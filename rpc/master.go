@@ -0,0 +1,181 @@
+package rpc
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"bigLITTLE/sharedmem"
+)
+
+// MasterServer is the RPC handler of the master. It owns the state all agents
+// have to agree on, and hands it out instead of letting each agent derive
+// its own.
+type MasterServer struct {
+	Regions  []sharedmem.MemRegion       // region of every SoC, sorted by StartAddr
+	Segments *sharedmem.SegmentDirectory // named segments of the whole cluster
+}
+
+// Layout RPC handler, called by agents before they build their table.
+func (m *MasterServer) Layout(req *LayoutRequest, resp *LayoutResponse) error {
+	for _, r := range m.Regions {
+		if r.Owner == req.From {
+			resp.Regions = append([]sharedmem.MemRegion(nil), m.Regions...)
+			return nil
+		}
+	}
+	return fmt.Errorf("SoC %s is not in the master's layout", req.From)
+}
+
+// CreateSegment RPC handler, registers a segment allocated by req.From.
+func (m *MasterServer) CreateSegment(req *SegmentRequest, resp *SegmentResponse) error {
+	seg, err := m.Segments.CreateSegment(req.Name, req.Region, req.Size, req.Perm, req.From)
+	if err != nil {
+		return err
+	}
+	resp.Segment = seg
+	return nil
+}
+
+// OpenSegment RPC handler, adds a reference to a segment.
+func (m *MasterServer) OpenSegment(req *SegmentRequest, resp *SegmentResponse) error {
+	seg, err := m.Segments.OpenSegment(req.Name, req.Perm, req.Size)
+	if err != nil {
+		return err
+	}
+	resp.Segment = seg
+	return nil
+}
+
+// CloseSegment RPC handler, drops a reference to a segment.
+func (m *MasterServer) CloseSegment(req *SegmentRequest, resp *SegmentResponse) error {
+	seg, last, err := m.Segments.CloseSegment(req.ID)
+	if err != nil {
+		return err
+	}
+	resp.Segment, resp.Last = seg, last
+	return nil
+}
+
+// UnlinkSegment RPC handler, removes the name of a segment.
+func (m *MasterServer) UnlinkSegment(req *SegmentRequest, resp *SegmentResponse) error {
+	seg, last, err := m.Segments.UnlinkSegment(req.Name)
+	if err != nil {
+		return err
+	}
+	resp.Segment, resp.Last = seg, last
+	return nil
+}
+
+// StartMasterServer serves the master's RPC handlers on address.
+func StartMasterServer(master *MasterServer, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	log.Printf("Master RPC server listening on %s", address)
+	return ServeMaster(listener, master)
+}
+
+// ServeMaster serves the master's RPC handlers over HTTP on listener until it
+// fails. Clients connect with rpc.DialHTTP.
+func ServeMaster(listener net.Listener, master *MasterServer) error {
+	server := rpc.NewServer()
+	if err := server.Register(master); err != nil {
+		return fmt.Errorf("failed to register master server: %w", err)
+	}
+	return http.Serve(listener, server)
+}
+
+// FetchLayout asks the master at address for the region of every SoC, on
+// behalf of self. The master may still be starting, so the call is retried
+// for a while before giving up.
+func FetchLayout(address string, self string) ([]sharedmem.MemRegion, error) {
+	maxRetries := 20
+	retryDelay := time.Second
+
+	var err error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		var client *rpc.Client
+		client, err = rpc.DialHTTP("tcp", address)
+		if err == nil {
+			resp := &LayoutResponse{}
+			err = client.Call("MasterServer.Layout", &LayoutRequest{From: self}, resp)
+			client.Close()
+			if err == nil {
+				return resp.Regions, nil
+			}
+			if _, refused := err.(rpc.ServerError); refused {
+				return nil, err
+			}
+		}
+
+		log.Printf("[RPC] Retry %d: failed to fetch the layout from the master (%s): %v", attempt, address, err)
+		time.Sleep(retryDelay)
+		if retryDelay < 10*time.Second {
+			retryDelay *= 2
+		}
+	}
+	return nil, fmt.Errorf("no layout from the master at %s after %d attempts: %w", address, maxRetries, err)
+}
+
+// MasterClient calls the master's handlers over one connection, dialled on
+// first use and again after the master went away.
+type MasterClient struct {
+	Address string
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+// NewMasterClient returns a client of the master at address.
+func NewMasterClient(address string) *MasterClient {
+	return &MasterClient{Address: address}
+}
+
+// Segment calls the segment handler method ("CreateSegment", "OpenSegment",
+// "CloseSegment" or "UnlinkSegment") of the master. Segment errors come back
+// wrapping sharedmem.ErrSegmentNotFound and sharedmem.ErrSegmentExists, as
+// they would from a local registry.
+func (c *MasterClient) Segment(method string, req *SegmentRequest) (SegmentResponse, error) {
+	var resp SegmentResponse
+	err := c.call("MasterServer."+method, req, &resp)
+	if serr, ok := err.(rpc.ServerError); ok {
+		for _, known := range []error{sharedmem.ErrSegmentNotFound, sharedmem.ErrSegmentExists} {
+			if rest, found := strings.CutPrefix(string(serr), known.Error()); found {
+				return resp, fmt.Errorf("%w%s", known, rest)
+			}
+		}
+	}
+	return resp, err
+}
+
+// call makes one call, dialling the master if there is no connection.
+func (c *MasterClient) call(method string, args any, reply any) error {
+	c.mu.Lock()
+	if c.client == nil {
+		client, err := rpc.DialHTTP("tcp", c.Address)
+		if err != nil {
+			c.mu.Unlock()
+			return fmt.Errorf("cannot reach the master at %s: %w", c.Address, err)
+		}
+		c.client = client
+	}
+	client := c.client
+	c.mu.Unlock()
+
+	err := client.Call(method, args, reply)
+	if err == rpc.ErrShutdown {
+		c.mu.Lock()
+		if c.client == client {
+			c.client = nil
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
@@ -1,5 +1,11 @@
 package rpc
 
+import (
+	"time"
+
+	"bigLITTLE/sharedmem"
+)
+
 // MemoryRequest for reading memory.
 type MemoryRequest struct {
 	Address uint64
@@ -37,3 +43,283 @@ type AgentClient interface {
 	WriteMemory(req *MemoryWriteRequest) (*MemoryResponse, error)
 	RunTask(req *TaskRequest) (*TaskResponse, error)
 }
+
+// PingRequest is the heartbeat one SoC sends another.
+type PingRequest struct {
+	From string
+}
+
+// PingResponse answers a heartbeat.
+type PingResponse struct{}
+
+// LayoutRequest asks the master for the address layout, on behalf of From.
+type LayoutRequest struct {
+	From string
+}
+
+// LayoutResponse carries the region of every SoC, sorted by StartAddr.
+type LayoutResponse struct {
+	Regions []sharedmem.MemRegion
+}
+
+// SegmentRequest asks the master to create, open, close or unlink a named
+// segment on behalf of From.
+type SegmentRequest struct {
+	From   string
+	Name   string
+	ID     uint64                // segment to close
+	Region sharedmem.MemRegion   // allocation of a new segment, in From's table
+	Size   uint64                // size of a new segment, or least size to open
+	Perm   sharedmem.SegmentPerm // permissions of a new segment, or access to open with
+}
+
+// SegmentResponse carries the segment as the master recorded it. Last is set
+// when the last reference of an unlinked segment is gone and its allocation
+// has to be freed.
+type SegmentResponse struct {
+	Segment sharedmem.NamedSegment
+	Last    bool
+}
+
+// SegmentFreeRequest asks the SoC holding a segment's allocation to free it
+// once the master has forgotten the segment.
+type SegmentFreeRequest struct {
+	Region sharedmem.MemRegion
+}
+
+// RegionMirrorRequest tells a SoC about an allocation Publisher made in its
+// table, or about new placements of its pages.
+type RegionMirrorRequest struct {
+	Publisher  string
+	Region     sharedmem.MemRegion
+	Placements []sharedmem.PagePlacement
+}
+
+// FrameRequest asks a SoC to reserve, or give back, a frame another SoC's
+// table handed out.
+type FrameRequest struct {
+	Frame sharedmem.Frame
+}
+
+// LeaseAllocRequest asks a SoC to allocate a region in its table, leased to
+// Holder.
+type LeaseAllocRequest struct {
+	Size   uint64
+	Owner  string // SoC whose memory backs the region
+	Holder string // SoC name of the lease holder
+	TaskID string
+	TTLMs  int64
+}
+
+// LeaseAllocResponse carries the leased region.
+type LeaseAllocResponse struct {
+	Region sharedmem.MemRegion
+}
+
+// LeaseRequest renews the lease on the allocation at Address.
+type LeaseRequest struct {
+	Address uint64
+	Holder  string // SoC name of the lease holder
+}
+
+// LeaseResponse carries the new expiry of a renewed lease.
+type LeaseResponse struct {
+	Expires time.Time
+}
+
+// PressureRequest waits for a memory pressure event newer than AfterSeq.
+type PressureRequest struct {
+	AfterSeq  uint64
+	TimeoutMs int64 // how long the server may hold the call; 0 returns immediately
+}
+
+// PressureResponse describes the memory pressure of one SoC.
+type PressureResponse struct {
+	SoC          string
+	Seq          uint64
+	Level        int // 0 normal, 1 warning, 2 critical
+	Usage        uint64
+	SoftLimit    uint64
+	ClusterFree  uint64
+	ClusterTotal uint64
+	Time         time.Time
+}
+
+// VerifyRequest asks a SoC to check its MemTable for inconsistencies.
+type VerifyRequest struct{}
+
+// VerifyResponse lists the inconsistencies found; empty means the table is consistent.
+type VerifyResponse struct {
+	Problems []string
+}
+
+// PhysRequest reads Size bytes at Offset in a SoC's local memory, bypassing
+// address translation. Used to move pages between frames.
+type PhysRequest struct {
+	Offset uint64
+	Size   uint64
+}
+
+// PhysWriteRequest writes Data at Offset in a SoC's local memory.
+type PhysWriteRequest struct {
+	Offset uint64
+	Data   []byte
+}
+
+// PageMoveRequest asks the SoC holding the page at VAddr to move it to a
+// frame on ToSoC.
+type PageMoveRequest struct {
+	VAddr uint64
+	ToSoC string
+}
+
+// PhysCopyRequest copies Length bytes between two offsets of a SoC's local
+// memory on that SoC.
+type PhysCopyRequest struct {
+	SrcOffset uint64
+	DstOffset uint64
+	Length    uint64
+}
+
+// Atomic operations for AtomicRequest.Op.
+const (
+	AtomicCAS = iota // compare Old, swap in New
+	AtomicAdd        // add Delta
+)
+
+// AtomicRequest runs an atomic operation on the 8-byte little-endian word at
+// Offset in a SoC's local memory.
+type AtomicRequest struct {
+	Offset uint64
+	Op     int
+	Old    uint64
+	New    uint64
+	Delta  uint64
+}
+
+// AtomicResponse carries the word's value before the operation, and for
+// AtomicCAS whether it was swapped.
+type AtomicResponse struct {
+	Value   uint64
+	Swapped bool
+}
+
+// QueueRequest notifies, or waits for a notification of, the RingBuffer at
+// Queue. Waits return once the generation differs from Seen.
+type QueueRequest struct {
+	Queue     uint64
+	Seen      uint64
+	TimeoutMs int64 // how long the server may hold a wait; 0 returns immediately
+}
+
+// QueueResponse carries a RingBuffer's notification generation.
+type QueueResponse struct {
+	Generation uint64
+}
+
+// HashMapCreateRequest creates a HashMap. Owners are the SoCs its buckets
+// are striped over; empty means the serving SoC.
+type HashMapCreateRequest struct {
+	KeySize   uint32
+	ValueSize uint32
+	Buckets   uint64
+	Owners    []string
+	Token     string // names the task over JSON-RPC
+}
+
+// HashMapRequest operates on the HashMap at Map. Value is only used by puts.
+type HashMapRequest struct {
+	Map   uint64
+	Key   []byte
+	Value []byte
+	Token string // names the task over JSON-RPC, whose Map is a task address
+}
+
+// HashMapResponse carries the result of a HashMap operation.
+type HashMapResponse struct {
+	Map   uint64
+	Value []byte
+	Found bool
+	Len   uint64
+}
+
+// LoanRequest tells a borrower about memory lent to it.
+type LoanRequest struct {
+	Loan sharedmem.Loan
+}
+
+// ReclaimRequest asks a borrower to give back the loan starting at Address.
+type ReclaimRequest struct {
+	Address uint64
+}
+
+// TaskAllocRequest allocates memory in a task's address space.
+type TaskAllocRequest struct {
+	TaskID string
+	Token  string // names the task over JSON-RPC, which ignores TaskID
+	Size   uint64
+	Owner  string // SoC to allocate on; empty for the serving SoC
+}
+
+// TaskAllocResponse carries the task address of a new allocation.
+type TaskAllocResponse struct {
+	Address uint64
+}
+
+// TaskMemoryRequest reads, or frees, at a task address.
+type TaskMemoryRequest struct {
+	TaskID  string
+	Token   string // names the task over JSON-RPC, which ignores TaskID
+	Address uint64
+	Size    uint64
+}
+
+// TaskWriteRequest writes at a task address.
+type TaskWriteRequest struct {
+	TaskID  string
+	Token   string // names the task over JSON-RPC, which ignores TaskID
+	Address uint64
+	Data    []byte
+}
+
+// TaskShareRequest shares the region at Address, or maps the shared region
+// Handle into the task's address space.
+type TaskShareRequest struct {
+	TaskID  string
+	Token   string // names the task over JSON-RPC, which ignores TaskID
+	Address uint64
+	Handle  uint64
+}
+
+// TaskShareResponse carries a shared region handle and its task address.
+type TaskShareResponse struct {
+	Handle  uint64
+	Address uint64
+}
+
+// AllocQueryRequest selects allocations by owner, tag, task or size range.
+// Empty fields match everything.
+type AllocQueryRequest struct {
+	Owner   string
+	Tag     string
+	TaskID  string
+	MinSize uint64
+	MaxSize uint64 // 0 means no upper bound
+}
+
+// AllocationInfo is an allocation with its label.
+type AllocationInfo struct {
+	StartAddr uint64
+	Length    uint64
+	Owner     string
+	Name      string
+	TaskID    string
+	Creator   string
+	Created   time.Time
+	Tags      []string
+}
+
+// AllocQueryResponse lists the matching allocations in address order.
+type AllocQueryResponse struct {
+	Allocations []AllocationInfo
+}
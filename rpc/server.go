@@ -4,22 +4,143 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"net/rpc/jsonrpc"
+	"reflect"
+	"time"
+
+	"bigLITTLE/sharedmem"
 )
 
 // MemoryManagerIface defines only the methods RPCServer needs from MemoryManager.
+// Handlers of the other features assert the memory manager to the small
+// interface of their feature, and fail if it does not implement it.
 type MemoryManagerIface interface {
 	Read(ctx context.Context, addr uint64, size uint64) ([]byte, error)
 	Write(ctx context.Context, addr uint64, data []byte) error
 }
 
+// LeaseHolder is served by memory managers whose allocations can be leased.
+type LeaseHolder interface {
+	AllocLeased(size uint64, owner string, holder string, taskID string, ttl time.Duration) (sharedmem.MemRegion, error)
+	RenewLease(addr uint64, holder string) (time.Time, error)
+}
+
+// PressurePublisher is served by memory managers that publish pressure levels.
+type PressurePublisher interface {
+	PressureSince(ctx context.Context, afterSeq uint64) (PressureResponse, error)
+}
+
+// TableInspector is served by memory managers that expose their table for
+// debugging and queries.
+type TableInspector interface {
+	VerifyTable() []string
+	QueryAllocations(q AllocQueryRequest) []AllocationInfo
+}
+
+// PhysMemory is served by memory managers that let peers reach the physical
+// memory backing allocated pages. EnterPhys keeps a range from moving off
+// the SoC until the returned function is called, so the memory a write was
+// checked against is the memory it lands on.
+type PhysMemory interface {
+	ReadPhys(offset uint64, size uint64) ([]byte, error)
+	WritePhys(offset uint64, data []byte) error
+	CopyPhys(srcOffset uint64, dstOffset uint64, length uint64) error
+	CheckPhys(offset uint64, length uint64) error
+	EnterPhys(offset uint64, length uint64) func()
+	AtomicPhys(req AtomicRequest) (AtomicResponse, error)
+}
+
+// PageHolder is served by memory managers that move the pages their frames
+// hold on behalf of other SoCs.
+type PageHolder interface {
+	MoveHeldPage(ctx context.Context, vaddr uint64, toSoC string) error
+}
+
+// QueueHome is served by memory managers that deliver RingBuffer wakeups.
+type QueueHome interface {
+	SignalQueue(queue uint64) uint64
+	AwaitQueue(ctx context.Context, queue uint64, seen uint64) (uint64, error)
+}
+
+// HashMapHost is served by memory managers that run hash map operations for
+// callers without a memory manager of their own.
+type HashMapHost interface {
+	HashMapCreate(req HashMapCreateRequest) (uint64, error)
+	HashMapGet(ctx context.Context, mapAddr uint64, key []byte) ([]byte, bool, error)
+	HashMapPut(ctx context.Context, mapAddr uint64, key []byte, value []byte) error
+	HashMapDelete(ctx context.Context, mapAddr uint64, key []byte) (bool, error)
+	HashMapLen(ctx context.Context, mapAddr uint64) (uint64, error)
+	HashMapFree(mapAddr uint64) error
+}
+
+// LoanTaker is served by memory managers that can borrow memory.
+type LoanTaker interface {
+	AcceptLoan(loan sharedmem.Loan) error
+	ReturnLoan(addr uint64) error
+}
+
+// SegmentHolder is served by memory managers that hold segment allocations
+// for the cluster.
+type SegmentHolder interface {
+	FreeSegment(region sharedmem.MemRegion) error
+}
+
+// SlabHolder is served by memory managers whose slabs hold objects that
+// other SoCs may free.
+type SlabHolder interface {
+	FreeSlabObject(addr uint64) error
+}
+
+// RegionMirror is served by memory managers that keep their own table and
+// record the allocations other SoCs publish in theirs, with the placements
+// of their pages. Frames are reserved on the SoC holding them before a page
+// is copied there. Unpublishing and freeing are forwarded to the publisher.
+type RegionMirror interface {
+	MirrorRegion(publisher string, region sharedmem.MemRegion, placements []sharedmem.PagePlacement) error
+	UnmirrorRegion(region sharedmem.MemRegion) error
+	MirrorPlacements(region sharedmem.MemRegion, placements []sharedmem.PagePlacement) error
+	ReserveFrame(frame sharedmem.Frame) error
+	ReleaseFrame(frame sharedmem.Frame)
+	UnpublishRegion(addr uint64) error
+	FreePublished(addr uint64) error
+}
+
+// TaskManagerIface defines the per-task address space methods RPCServer needs.
+type TaskManagerIface interface {
+	OpenSpace(taskID string)
+	FreeTask(taskID string) error
+	AllocTask(taskID string, size uint64, owner string) (uint64, error)
+	FreeTaskAddr(taskID string, addr uint64) error
+	ReadTask(ctx context.Context, taskID string, addr uint64, size uint64) ([]byte, error)
+	WriteTask(ctx context.Context, taskID string, addr uint64, data []byte) error
+	ShareTask(taskID string, addr uint64) (sharedmem.SharedHandle, error)
+	MapShared(taskID string, h sharedmem.SharedHandle) (uint64, error)
+	RunTask(ctx context.Context, taskID string, codeType string, code string) (string, error)
+	TaskForToken(token string) (string, bool)
+	CreateTaskMap(taskID string, cfg sharedmem.HashMapConfig) (uint64, error)
+	TaskMap(taskID string, addr uint64) (uint64, error)
+	FreeTaskMap(taskID string, addr uint64) error
+}
+
 // RPCServer is the RPC handler struct.
 type RPCServer struct {
 	MemManager MemoryManagerIface
+	Tasks      TaskManagerIface
+}
+
+// feature returns the memory manager as the interface of an optional feature.
+func feature[T any](s *RPCServer) (T, error) {
+	f, ok := s.MemManager.(T)
+	if !ok {
+		return f, fmt.Errorf("this SoC does not serve %s", reflect.TypeFor[T]().Name())
+	}
+	return f, nil
 }
 
 // ReadMemory RPC handler
@@ -46,17 +167,634 @@ func (s *RPCServer) WriteMemory(req *MemoryWriteRequest, resp *MemoryResponse) e
 	return nil
 }
 
-// RunTask RPC handler
+// Ping RPC handler. Answering is all there is to it, the caller only
+// checks that the call went through.
+func (s *RPCServer) Ping(req *PingRequest, resp *PingResponse) error {
+	return nil
+}
+
+// AllocLeased RPC handler, called by a remote holder taking a lease on this
+// SoC. The reaper here frees the region if the holder stops renewing it.
+func (s *RPCServer) AllocLeased(req *LeaseAllocRequest, resp *LeaseAllocResponse) error {
+	lh, err := feature[LeaseHolder](s)
+	if err != nil {
+		return err
+	}
+	region, err := lh.AllocLeased(req.Size, req.Owner, req.Holder, req.TaskID, time.Duration(req.TTLMs)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	resp.Region = region
+	return nil
+}
+
+// RenewLease RPC handler
+func (s *RPCServer) RenewLease(req *LeaseRequest, resp *LeaseResponse) error {
+	lh, err := feature[LeaseHolder](s)
+	if err != nil {
+		return err
+	}
+	expires, err := lh.RenewLease(req.Address, req.Holder)
+	if err != nil {
+		return err
+	}
+	resp.Expires = expires
+	return nil
+}
+
+// WaitPressure RPC handler. It blocks until the SoC's pressure level changes
+// after req.AfterSeq or the timeout passes, and returns the current state.
+// Remote subscribers call it in a loop to get a stream of events.
+func (s *RPCServer) WaitPressure(req *PressureRequest, resp *PressureResponse) error {
+	pp, err := feature[PressurePublisher](s)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.TimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	ev, err := pp.PressureSince(ctx, req.AfterSeq)
+	if err != nil {
+		return err
+	}
+	*resp = ev
+	return nil
+}
+
+// VerifyMemTable debug RPC handler
+func (s *RPCServer) VerifyMemTable(req *VerifyRequest, resp *VerifyResponse) error {
+	ti, err := feature[TableInspector](s)
+	if err != nil {
+		return err
+	}
+	resp.Problems = ti.VerifyTable()
+	return nil
+}
+
+// QueryAllocations RPC handler
+func (s *RPCServer) QueryAllocations(req *AllocQueryRequest, resp *AllocQueryResponse) error {
+	ti, err := feature[TableInspector](s)
+	if err != nil {
+		return err
+	}
+	resp.Allocations = ti.QueryAllocations(*req)
+	return nil
+}
+
+// ReadPhys RPC handler. Only memory backing allocated pages can be read.
+func (s *RPCServer) ReadPhys(req *PhysRequest, resp *MemoryResponse) error {
+	pm, err := feature[PhysMemory](s)
+	if err != nil {
+		return err
+	}
+	if err := pm.CheckPhys(req.Offset, req.Size); err != nil {
+		return err
+	}
+	data, err := pm.ReadPhys(req.Offset, req.Size)
+	if err != nil {
+		return err
+	}
+	resp.Data = data
+	return nil
+}
+
+// WritePhys RPC handler. Only memory backing allocated pages can be written.
+func (s *RPCServer) WritePhys(req *PhysWriteRequest, resp *MemoryResponse) error {
+	pm, err := feature[PhysMemory](s)
+	if err != nil {
+		return err
+	}
+	defer pm.EnterPhys(req.Offset, uint64(len(req.Data)))()
+	if err := pm.CheckPhys(req.Offset, uint64(len(req.Data))); err != nil {
+		return err
+	}
+	return pm.WritePhys(req.Offset, req.Data)
+}
+
+// RunTask RPC handler. The task runs in its own address space, which is
+// released with its memory when the task finishes. Failures of the task
+// itself are reported in resp.Error.
 func (s *RPCServer) RunTask(req *TaskRequest, resp *TaskResponse) error {
-	// Placeholder
-	resp.Result = fmt.Sprintf("Task %s executed (stub)", req.ID)
+	if s.Tasks == nil {
+		return errors.New("no task manager on this SoC")
+	}
+	result, err := s.Tasks.RunTask(context.Background(), req.ID, req.CodeType, req.Code)
+	if err != nil {
+		resp.Error = err.Error()
+		return nil
+	}
+	resp.Result = result
+	return nil
+}
+
+// CopyPhys RPC handler. Both ranges must back allocated pages.
+func (s *RPCServer) CopyPhys(req *PhysCopyRequest, resp *MemoryResponse) error {
+	pm, err := feature[PhysMemory](s)
+	if err != nil {
+		return err
+	}
+	defer pm.EnterPhys(req.DstOffset, req.Length)()
+	if err := pm.CheckPhys(req.SrcOffset, req.Length); err != nil {
+		return err
+	}
+	if err := pm.CheckPhys(req.DstOffset, req.Length); err != nil {
+		return err
+	}
+	return pm.CopyPhys(req.SrcOffset, req.DstOffset, req.Length)
+}
+
+// MovePage RPC handler, called on the SoC holding a page by the SoC that
+// wants it moved
+func (s *RPCServer) MovePage(req *PageMoveRequest, resp *MemoryResponse) error {
+	ph, err := feature[PageHolder](s)
+	if err != nil {
+		return err
+	}
+	return ph.MoveHeldPage(context.Background(), req.VAddr, req.ToSoC)
+}
+
+// AtomicPhys RPC handler
+func (s *RPCServer) AtomicPhys(req *AtomicRequest, resp *AtomicResponse) error {
+	pm, err := feature[PhysMemory](s)
+	if err != nil {
+		return err
+	}
+	defer pm.EnterPhys(req.Offset, 8)()
+	if err := pm.CheckPhys(req.Offset, 8); err != nil {
+		return err
+	}
+	result, err := pm.AtomicPhys(*req)
+	if err != nil {
+		return err
+	}
+	*resp = result
+	return nil
+}
+
+// NotifyQueue RPC handler, called by agents that moved an item through a
+// RingBuffer homed on this SoC
+func (s *RPCServer) NotifyQueue(req *QueueRequest, resp *QueueResponse) error {
+	qh, err := feature[QueueHome](s)
+	if err != nil {
+		return err
+	}
+	resp.Generation = qh.SignalQueue(req.Queue)
+	return nil
+}
+
+// WaitQueue RPC handler. It blocks until the RingBuffer's notification
+// generation differs from req.Seen or the timeout passes. The end of the long
+// poll is not an error: the unchanged generation is returned.
+func (s *RPCServer) WaitQueue(req *QueueRequest, resp *QueueResponse) error {
+	qh, err := feature[QueueHome](s)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.TimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	gen, err := qh.AwaitQueue(ctx, req.Queue, req.Seen)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	resp.Generation = gen
+	return nil
+}
+
+// HashMapCreate RPC handler
+func (s *RPCServer) HashMapCreate(req *HashMapCreateRequest, resp *HashMapResponse) error {
+	hm, err := feature[HashMapHost](s)
+	if err != nil {
+		return err
+	}
+	addr, err := hm.HashMapCreate(*req)
+	if err != nil {
+		return err
+	}
+	resp.Map = addr
+	return nil
+}
+
+// HashMapGet RPC handler
+func (s *RPCServer) HashMapGet(req *HashMapRequest, resp *HashMapResponse) error {
+	hm, err := feature[HashMapHost](s)
+	if err != nil {
+		return err
+	}
+	value, found, err := hm.HashMapGet(context.Background(), req.Map, req.Key)
+	if err != nil {
+		return err
+	}
+	resp.Map, resp.Value, resp.Found = req.Map, value, found
+	return nil
+}
+
+// HashMapPut RPC handler
+func (s *RPCServer) HashMapPut(req *HashMapRequest, resp *HashMapResponse) error {
+	hm, err := feature[HashMapHost](s)
+	if err != nil {
+		return err
+	}
+	resp.Map = req.Map
+	return hm.HashMapPut(context.Background(), req.Map, req.Key, req.Value)
+}
+
+// HashMapDelete RPC handler
+func (s *RPCServer) HashMapDelete(req *HashMapRequest, resp *HashMapResponse) error {
+	hm, err := feature[HashMapHost](s)
+	if err != nil {
+		return err
+	}
+	found, err := hm.HashMapDelete(context.Background(), req.Map, req.Key)
+	if err != nil {
+		return err
+	}
+	resp.Map, resp.Found = req.Map, found
+	return nil
+}
+
+// HashMapLen RPC handler
+func (s *RPCServer) HashMapLen(req *HashMapRequest, resp *HashMapResponse) error {
+	hm, err := feature[HashMapHost](s)
+	if err != nil {
+		return err
+	}
+	n, err := hm.HashMapLen(context.Background(), req.Map)
+	if err != nil {
+		return err
+	}
+	resp.Map, resp.Len = req.Map, n
+	return nil
+}
+
+// HashMapFree RPC handler
+func (s *RPCServer) HashMapFree(req *HashMapRequest, resp *HashMapResponse) error {
+	hm, err := feature[HashMapHost](s)
+	if err != nil {
+		return err
+	}
+	return hm.HashMapFree(req.Map)
+}
+
+// AcceptLoan RPC handler, called by a lender on the borrower
+func (s *RPCServer) AcceptLoan(req *LoanRequest, resp *MemoryResponse) error {
+	lt, err := feature[LoanTaker](s)
+	if err != nil {
+		return err
+	}
+	return lt.AcceptLoan(req.Loan)
+}
+
+// ReturnLoan RPC handler, called by a lender on the borrower to reclaim a loan
+func (s *RPCServer) ReturnLoan(req *ReclaimRequest, resp *MemoryResponse) error {
+	lt, err := feature[LoanTaker](s)
+	if err != nil {
+		return err
+	}
+	return lt.ReturnLoan(req.Address)
+}
+
+// FreeSegment RPC handler, called on the SoC holding a segment's allocation
+// by whoever dropped the segment's last reference
+func (s *RPCServer) FreeSegment(req *SegmentFreeRequest, resp *MemoryResponse) error {
+	sh, err := feature[SegmentHolder](s)
+	if err != nil {
+		return err
+	}
+	return sh.FreeSegment(req.Region)
+}
+
+// FreeSlabObject RPC handler, called on the SoC whose slab holds an object
+// by whoever frees it
+func (s *RPCServer) FreeSlabObject(req *MemoryRequest, resp *MemoryResponse) error {
+	sh, err := feature[SlabHolder](s)
+	if err != nil {
+		return err
+	}
+	return sh.FreeSlabObject(req.Address)
+}
+
+// MirrorRegion RPC handler, called by the SoC publishing an allocation
+func (s *RPCServer) MirrorRegion(req *RegionMirrorRequest, resp *MemoryResponse) error {
+	rm, err := feature[RegionMirror](s)
+	if err != nil {
+		return err
+	}
+	return rm.MirrorRegion(req.Publisher, req.Region, req.Placements)
+}
+
+// UnmirrorRegion RPC handler, called by the publisher of an allocation when
+// it is dropped
+func (s *RPCServer) UnmirrorRegion(req *RegionMirrorRequest, resp *MemoryResponse) error {
+	rm, err := feature[RegionMirror](s)
+	if err != nil {
+		return err
+	}
+	return rm.UnmirrorRegion(req.Region)
+}
+
+// MirrorPlacements RPC handler, called by the SoC that moved a page of a
+// published allocation
+func (s *RPCServer) MirrorPlacements(req *RegionMirrorRequest, resp *MemoryResponse) error {
+	rm, err := feature[RegionMirror](s)
+	if err != nil {
+		return err
+	}
+	return rm.MirrorPlacements(req.Region, req.Placements)
+}
+
+// ReserveFrame RPC handler, called on the SoC a page of a published
+// allocation is about to be copied to
+func (s *RPCServer) ReserveFrame(req *FrameRequest, resp *MemoryResponse) error {
+	rm, err := feature[RegionMirror](s)
+	if err != nil {
+		return err
+	}
+	return rm.ReserveFrame(req.Frame)
+}
+
+// ReleaseFrame RPC handler, called when a page was not copied after all
+func (s *RPCServer) ReleaseFrame(req *FrameRequest, resp *MemoryResponse) error {
+	rm, err := feature[RegionMirror](s)
+	if err != nil {
+		return err
+	}
+	rm.ReleaseFrame(req.Frame)
+	return nil
+}
+
+// UnpublishRegion RPC handler, called on the publisher of an allocation
+func (s *RPCServer) UnpublishRegion(req *MemoryRequest, resp *MemoryResponse) error {
+	rm, err := feature[RegionMirror](s)
+	if err != nil {
+		return err
+	}
+	return rm.UnpublishRegion(req.Address)
+}
+
+// FreePublished RPC handler, called on the publisher of an allocation
+func (s *RPCServer) FreePublished(req *MemoryRequest, resp *MemoryResponse) error {
+	rm, err := feature[RegionMirror](s)
+	if err != nil {
+		return err
+	}
+	return rm.FreePublished(req.Address)
+}
+
+// TaskAlloc RPC handler
+func (s *RPCServer) TaskAlloc(req *TaskAllocRequest, resp *TaskAllocResponse) error {
+	addr, err := s.Tasks.AllocTask(req.TaskID, req.Size, req.Owner)
+	if err != nil {
+		return err
+	}
+	resp.Address = addr
 	return nil
 }
 
+// TaskFree RPC handler
+func (s *RPCServer) TaskFree(req *TaskMemoryRequest, resp *MemoryResponse) error {
+	return s.Tasks.FreeTaskAddr(req.TaskID, req.Address)
+}
+
+// TaskRead RPC handler
+func (s *RPCServer) TaskRead(req *TaskMemoryRequest, resp *MemoryResponse) error {
+	data, err := s.Tasks.ReadTask(context.Background(), req.TaskID, req.Address, req.Size)
+	if err != nil {
+		return err
+	}
+	resp.Data = data
+	return nil
+}
+
+// TaskWrite RPC handler
+func (s *RPCServer) TaskWrite(req *TaskWriteRequest, resp *MemoryResponse) error {
+	return s.Tasks.WriteTask(context.Background(), req.TaskID, req.Address, req.Data)
+}
+
+// TaskShare RPC handler
+func (s *RPCServer) TaskShare(req *TaskShareRequest, resp *TaskShareResponse) error {
+	h, err := s.Tasks.ShareTask(req.TaskID, req.Address)
+	if err != nil {
+		return err
+	}
+	resp.Handle = uint64(h)
+	resp.Address = req.Address
+	return nil
+}
+
+// TaskMapShared RPC handler
+func (s *RPCServer) TaskMapShared(req *TaskShareRequest, resp *TaskShareResponse) error {
+	addr, err := s.Tasks.MapShared(req.TaskID, sharedmem.SharedHandle(req.Handle))
+	if err != nil {
+		return err
+	}
+	resp.Handle = req.Handle
+	resp.Address = addr
+	return nil
+}
+
+// TaskRPCServer is the part of RPCServer served to Python tasks: shared hash
+// maps, and memory at task addresses. Global addresses and the physical
+// memory of the SoC cannot be reached through it, so a task only touches what
+// is mapped into its own address space. Tasks are named by the token RunTask
+// gave them, not by a TaskID the caller could pick.
+type TaskRPCServer struct {
+	s *RPCServer
+}
+
+// task returns the ID of the running task token was issued to.
+func (t *TaskRPCServer) task(token string) (string, error) {
+	if t.s.Tasks == nil {
+		return "", errors.New("no task manager on this SoC")
+	}
+	taskID, ok := t.s.Tasks.TaskForToken(token)
+	if !ok {
+		return "", errors.New("unknown or expired task token")
+	}
+	return taskID, nil
+}
+
+// taskMap returns req with Map translated from a task address of the task
+// its token names to the map's global address.
+func (t *TaskRPCServer) taskMap(req *HashMapRequest) (*HashMapRequest, error) {
+	taskID, err := t.task(req.Token)
+	if err != nil {
+		return nil, err
+	}
+	global, err := t.s.Tasks.TaskMap(taskID, req.Map)
+	if err != nil {
+		return nil, err
+	}
+	bound := *req
+	bound.Map = global
+	return &bound, nil
+}
+
+// HashMapCreate RPC handler. Map is returned as a task address, and the map
+// is freed with the task.
+func (t *TaskRPCServer) HashMapCreate(req *HashMapCreateRequest, resp *HashMapResponse) error {
+	taskID, err := t.task(req.Token)
+	if err != nil {
+		return err
+	}
+	addr, err := t.s.Tasks.CreateTaskMap(taskID, sharedmem.HashMapConfig{
+		KeySize:   req.KeySize,
+		ValueSize: req.ValueSize,
+		Buckets:   req.Buckets,
+		Owners:    req.Owners,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Map = addr
+	return nil
+}
+
+// HashMapGet RPC handler
+func (t *TaskRPCServer) HashMapGet(req *HashMapRequest, resp *HashMapResponse) error {
+	bound, err := t.taskMap(req)
+	if err != nil {
+		return err
+	}
+	return t.s.HashMapGet(bound, resp)
+}
+
+// HashMapPut RPC handler
+func (t *TaskRPCServer) HashMapPut(req *HashMapRequest, resp *HashMapResponse) error {
+	bound, err := t.taskMap(req)
+	if err != nil {
+		return err
+	}
+	return t.s.HashMapPut(bound, resp)
+}
+
+// HashMapDelete RPC handler
+func (t *TaskRPCServer) HashMapDelete(req *HashMapRequest, resp *HashMapResponse) error {
+	bound, err := t.taskMap(req)
+	if err != nil {
+		return err
+	}
+	return t.s.HashMapDelete(bound, resp)
+}
+
+// HashMapLen RPC handler
+func (t *TaskRPCServer) HashMapLen(req *HashMapRequest, resp *HashMapResponse) error {
+	bound, err := t.taskMap(req)
+	if err != nil {
+		return err
+	}
+	return t.s.HashMapLen(bound, resp)
+}
+
+// HashMapFree RPC handler
+func (t *TaskRPCServer) HashMapFree(req *HashMapRequest, resp *HashMapResponse) error {
+	taskID, err := t.task(req.Token)
+	if err != nil {
+		return err
+	}
+	return t.s.Tasks.FreeTaskMap(taskID, req.Map)
+}
+
+// TaskAlloc RPC handler
+func (t *TaskRPCServer) TaskAlloc(req *TaskAllocRequest, resp *TaskAllocResponse) error {
+	taskID, err := t.task(req.Token)
+	if err != nil {
+		return err
+	}
+	bound := *req
+	bound.TaskID = taskID
+	return t.s.TaskAlloc(&bound, resp)
+}
+
+// TaskFree RPC handler
+func (t *TaskRPCServer) TaskFree(req *TaskMemoryRequest, resp *MemoryResponse) error {
+	taskID, err := t.task(req.Token)
+	if err != nil {
+		return err
+	}
+	bound := *req
+	bound.TaskID = taskID
+	return t.s.TaskFree(&bound, resp)
+}
+
+// TaskRead RPC handler
+func (t *TaskRPCServer) TaskRead(req *TaskMemoryRequest, resp *MemoryResponse) error {
+	taskID, err := t.task(req.Token)
+	if err != nil {
+		return err
+	}
+	bound := *req
+	bound.TaskID = taskID
+	return t.s.TaskRead(&bound, resp)
+}
+
+// TaskWrite RPC handler
+func (t *TaskRPCServer) TaskWrite(req *TaskWriteRequest, resp *MemoryResponse) error {
+	taskID, err := t.task(req.Token)
+	if err != nil {
+		return err
+	}
+	bound := *req
+	bound.TaskID = taskID
+	return t.s.TaskWrite(&bound, resp)
+}
+
+// TaskShare RPC handler
+func (t *TaskRPCServer) TaskShare(req *TaskShareRequest, resp *TaskShareResponse) error {
+	taskID, err := t.task(req.Token)
+	if err != nil {
+		return err
+	}
+	bound := *req
+	bound.TaskID = taskID
+	return t.s.TaskShare(&bound, resp)
+}
+
+// TaskMapShared RPC handler
+func (t *TaskRPCServer) TaskMapShared(req *TaskShareRequest, resp *TaskShareResponse) error {
+	taskID, err := t.task(req.Token)
+	if err != nil {
+		return err
+	}
+	bound := *req
+	bound.TaskID = taskID
+	return t.s.TaskMapShared(&bound, resp)
+}
+
+// StartJSONRPCServer serves the TaskRPCServer handlers as JSON-RPC 1.0 on the
+// given address, for Python tasks.
+func StartJSONRPCServer(memManager MemoryManagerIface, tasks TaskManagerIface, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	log.Printf("JSON-RPC server listening on %s", address)
+	return ServeJSONRPC(listener, memManager, tasks)
+}
+
+// ServeJSONRPC serves the TaskRPCServer handlers as JSON-RPC 1.0 on listener
+// until it fails. They keep the RPCServer name, so clients call them as
+// "RPCServer.<Method>". Byte slices travel as base64 strings.
+func ServeJSONRPC(listener net.Listener, memManager MemoryManagerIface, tasks TaskManagerIface) error {
+	server := rpc.NewServer()
+	handlers := &TaskRPCServer{s: &RPCServer{MemManager: memManager, Tasks: tasks}}
+	if err := server.RegisterName("RPCServer", handlers); err != nil {
+		return fmt.Errorf("failed to register JSON-RPC server: %w", err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
 // StartRPCServer starts the RPC server on given address (e.g. ":8080").
-func StartRPCServer(memManager MemoryManagerIface, address string) error {
+func StartRPCServer(memManager MemoryManagerIface, tasks TaskManagerIface, address string) error {
 	server := &RPCServer{
 		MemManager: memManager,
+		Tasks:      tasks,
 	}
 
 	err := rpc.Register(server)
@@ -0,0 +1,452 @@
+package sharedmem
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// TaskBase is the first address handed out in a task's address space. Page
+// zero stays unmapped so a zero address always faults.
+const TaskBase = PageSize
+
+// Mapping is a global region mapped into a task's address space.
+type Mapping struct {
+	TaskAddr uint64       // where the task sees the region
+	Global   uint64       // global start address of the region
+	Length   uint64       // length of the region in bytes
+	Shared   SharedHandle // handle if the region is shared, 0 if private
+}
+
+// Extent is a piece of a task range backed by contiguous global addresses.
+type Extent struct {
+	TaskAddr uint64
+	Global   uint64
+	Length   uint64
+}
+
+// AddressSpace is the private view of memory of one task. Task addresses go
+// through the task's page table to global pages, and from there through the
+// MemTable to frames. Only mapped regions are reachable, so a task cannot
+// touch another task's memory unless it was shared with it.
+type AddressSpace struct {
+	TaskID string
+	mt     *MemTable
+
+	lock     sync.RWMutex
+	pages    radix[uint64]       // task page -> global page
+	regions  *RegionIndex        // mapped task ranges, for bounds and placement
+	mappings map[uint64]*Mapping // task start -> mapping
+	objects  map[uint64]uint64   // task address -> global address of a named object
+}
+
+func newAddressSpace(taskID string, mt *MemTable) *AddressSpace {
+	return &AddressSpace{
+		TaskID:   taskID,
+		mt:       mt,
+		pages:    newRadix[uint64](),
+		regions:  NewRegionIndex(),
+		mappings: make(map[uint64]*Mapping),
+		objects:  make(map[uint64]uint64),
+	}
+}
+
+// Resolve splits the task range [addr, addr+size) into extents of contiguous
+// global addresses. Every byte of the range must be mapped.
+func (as *AddressSpace) Resolve(addr uint64, size uint64) ([]Extent, error) {
+	as.lock.RLock()
+	defer as.lock.RUnlock()
+
+	var extents []Extent
+	end := addr + size
+	for cur := addr; cur < end || (size == 0 && cur == addr); {
+		r, ok := as.regions.Find(cur)
+		if !ok {
+			return nil, fmt.Errorf("task %s: page fault at 0x%x", as.TaskID, cur)
+		}
+		if size == 0 {
+			global, _ := as.pages.get(cur)
+			return []Extent{{TaskAddr: cur, Global: global + cur&pageOffsMask}}, nil
+		}
+
+		stop := min(end, r.StartAddr+r.Length)
+		for cur < stop {
+			n := min(stop-cur, PageSize-cur&pageOffsMask)
+			page, ok := as.pages.get(cur)
+			if !ok {
+				return nil, fmt.Errorf("task %s: page fault at 0x%x", as.TaskID, cur)
+			}
+			global := page + cur&pageOffsMask
+
+			last := len(extents) - 1
+			if last >= 0 && extents[last].TaskAddr+extents[last].Length == cur &&
+				extents[last].Global+extents[last].Length == global {
+				extents[last].Length += n
+			} else {
+				extents = append(extents, Extent{TaskAddr: cur, Global: global, Length: n})
+			}
+			cur += n
+		}
+	}
+	return extents, nil
+}
+
+// Translate resolves a task range all the way down to physically contiguous
+// segments. Segment.VAddr holds the global address of each piece.
+func (as *AddressSpace) Translate(addr uint64, size uint64) ([]Segment, error) {
+	extents, err := as.Resolve(addr, size)
+	if err != nil {
+		return nil, err
+	}
+	var segs []Segment
+	for _, ext := range extents {
+		s, err := as.mt.TranslateRange(ext.Global, ext.Length)
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, s...)
+	}
+	return segs, nil
+}
+
+// Mappings returns the regions mapped into the space in task address order.
+func (as *AddressSpace) Mappings() []Mapping {
+	as.lock.RLock()
+	defer as.lock.RUnlock()
+
+	out := make([]Mapping, 0, len(as.mappings))
+	as.regions.Ascend(func(r MemRegion) bool {
+		if m, ok := as.mappings[r.StartAddr]; ok {
+			out = append(out, *m)
+		}
+		return true
+	})
+	return out
+}
+
+// Lookup returns the mapping containing the task address addr.
+func (as *AddressSpace) Lookup(addr uint64) (Mapping, bool) {
+	as.lock.RLock()
+	defer as.lock.RUnlock()
+
+	r, ok := as.regions.Find(addr)
+	if !ok {
+		return Mapping{}, false
+	}
+	m, ok := as.mappings[r.StartAddr]
+	if !ok {
+		return Mapping{}, false
+	}
+	return *m, true
+}
+
+// mapRegion maps a global region at the lowest free task address. The
+// region's offset within its first page is kept, so page-aligned regions
+// land on page-aligned task addresses.
+func (as *AddressSpace) mapRegion(region MemRegion, shared SharedHandle) (uint64, error) {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	first := region.StartAddr &^ pageOffsMask
+	span := (region.StartAddr+region.Length+pageOffsMask)&^pageOffsMask - first
+	base, err := as.place(span)
+	if err != nil {
+		return 0, err
+	}
+
+	for off := uint64(0); off < span; off += PageSize {
+		if err := as.pages.set(base+off, first+off); err != nil {
+			return 0, err
+		}
+	}
+	taskAddr := base + region.StartAddr&pageOffsMask
+	as.regions.Insert(MemRegion{StartAddr: taskAddr, Length: region.Length, Owner: region.Owner})
+	as.mappings[taskAddr] = &Mapping{
+		TaskAddr: taskAddr,
+		Global:   region.StartAddr,
+		Length:   region.Length,
+		Shared:   shared,
+	}
+	return taskAddr, nil
+}
+
+// place returns the lowest page-aligned task address with span free bytes,
+// first fit over the gaps between existing mappings.
+// Do not call without holding lock.
+func (as *AddressSpace) place(span uint64) (uint64, error) {
+	base := uint64(TaskBase)
+	as.regions.Ascend(func(r MemRegion) bool {
+		if r.StartAddr&^pageOffsMask >= base+span {
+			return false
+		}
+		base = (r.StartAddr + r.Length + pageOffsMask) &^ pageOffsMask
+		return true
+	})
+	if base+span > MaxVirtAddr {
+		return 0, fmt.Errorf("task %s: address space exhausted", as.TaskID)
+	}
+	return base, nil
+}
+
+// mapObject gives the global object at global a page of task addresses.
+// Nothing is mapped behind it, so reads and writes there fault; the task
+// can only hand the address back to name the object.
+func (as *AddressSpace) mapObject(global uint64) (uint64, error) {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	taskAddr, err := as.place(PageSize)
+	if err != nil {
+		return 0, err
+	}
+	as.regions.Insert(MemRegion{StartAddr: taskAddr, Length: PageSize})
+	as.objects[taskAddr] = global
+	return taskAddr, nil
+}
+
+// object returns the global address of the object named by taskAddr.
+func (as *AddressSpace) object(taskAddr uint64) (uint64, bool) {
+	as.lock.RLock()
+	defer as.lock.RUnlock()
+	global, ok := as.objects[taskAddr]
+	return global, ok
+}
+
+// unmapObject drops the object named by taskAddr and returns its global address.
+func (as *AddressSpace) unmapObject(taskAddr uint64) (uint64, bool) {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	global, ok := as.objects[taskAddr]
+	if !ok {
+		return 0, false
+	}
+	as.regions.Delete(taskAddr)
+	delete(as.objects, taskAddr)
+	return global, true
+}
+
+// unmap removes the mapping starting at taskAddr.
+func (as *AddressSpace) unmap(taskAddr uint64) (Mapping, error) {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	m, ok := as.mappings[taskAddr]
+	if !ok {
+		return Mapping{}, fmt.Errorf("task %s: nothing mapped at 0x%x", as.TaskID, taskAddr)
+	}
+	first := taskAddr &^ pageOffsMask
+	for page := first; page < taskAddr+m.Length; page += PageSize {
+		as.pages.remove(page)
+	}
+	as.regions.Delete(taskAddr)
+	delete(as.mappings, taskAddr)
+	return *m, nil
+}
+
+// unmapGlobal removes the mapping of the global region starting at global.
+func (as *AddressSpace) unmapGlobal(global uint64) bool {
+	as.lock.RLock()
+	var taskAddr uint64
+	found := false
+	for addr, m := range as.mappings {
+		if m.Global == global {
+			taskAddr, found = addr, true
+			break
+		}
+	}
+	as.lock.RUnlock()
+
+	if !found {
+		return false
+	}
+	_, err := as.unmap(taskAddr)
+	return err == nil
+}
+
+// markShared records that the mapping of the global region starting at
+// global is now shared through h.
+func (as *AddressSpace) markShared(global uint64, h SharedHandle) {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+	for _, m := range as.mappings {
+		if m.Global == global {
+			m.Shared = h
+		}
+	}
+}
+
+// OpenSpace returns taskID's address space, creating an empty one on first use.
+func (t *TaskMemoryTracker) OpenSpace(taskID string) *AddressSpace {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+	return t.openSpace(taskID)
+}
+
+// Space returns taskID's address space, if it has one.
+func (t *TaskMemoryTracker) Space(taskID string) (*AddressSpace, bool) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+	as, ok := t.Spaces[taskID]
+	return as, ok
+}
+
+// openSpace is OpenSpace without locking.
+func (t *TaskMemoryTracker) openSpace(taskID string) *AddressSpace {
+	as, ok := t.Spaces[taskID]
+	if !ok {
+		as = newAddressSpace(taskID, t.mt)
+		t.Spaces[taskID] = as
+	}
+	return as
+}
+
+// AllocForTask allocates size bytes on owner and maps them into taskID's
+// address space. The region is rounded up to whole pages so no other data
+// shares its pages. Returns the task address of the region.
+func (t *TaskMemoryTracker) AllocForTask(taskID string, size uint64, owner string) (uint64, error) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+
+	region, err := t.mt.Alloc(AllocRequest{
+		Size:      (size + pageOffsMask) &^ pageOffsMask,
+		Align:     PageSize,
+		Owner:     owner,
+		OwnerOnly: true,
+		Label:     &Label{TaskID: taskID},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("allocation failed: %w", err)
+	}
+
+	addr, err := t.openSpace(taskID).mapRegion(region, 0)
+	if err != nil {
+		t.mt.FreeRegion(region.StartAddr)
+		return 0, err
+	}
+	t.TaskAllocations[taskID] = append(t.TaskAllocations[taskID], region)
+	return addr, nil
+}
+
+// FreeForTask unmaps the region at taskAddr from taskID's address space.
+// Private regions are freed; shared ones lose the task's references and are
+// freed with the last one.
+func (t *TaskMemoryTracker) FreeForTask(taskID string, taskAddr uint64) error {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+
+	as, ok := t.Spaces[taskID]
+	if !ok {
+		return fmt.Errorf("task %s has no address space", taskID)
+	}
+	m, err := as.unmap(taskAddr)
+	if err != nil {
+		return err
+	}
+
+	if m.Shared != 0 {
+		region, last, err := t.detach(taskID, m.Shared, true)
+		if err != nil {
+			return err
+		}
+		if last {
+			return t.mt.FreeRegion(region.StartAddr)
+		}
+		return nil
+	}
+
+	t.removeTaskRegion(taskID, m.Global)
+	return t.mt.FreeRegion(m.Global)
+}
+
+// ShareForTask makes the private region mapped at taskAddr shareable and
+// returns its handle. Other tasks map it with MapShared.
+func (t *TaskMemoryTracker) ShareForTask(taskID string, taskAddr uint64) (SharedHandle, error) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+
+	as, ok := t.Spaces[taskID]
+	if !ok {
+		return 0, fmt.Errorf("task %s has no address space", taskID)
+	}
+	m, ok := as.Lookup(taskAddr)
+	if !ok || m.TaskAddr != taskAddr {
+		return 0, fmt.Errorf("task %s: nothing mapped at 0x%x", taskID, taskAddr)
+	}
+	if m.Shared != 0 {
+		return m.Shared, nil
+	}
+	return t.share(taskID, m.Global)
+}
+
+// MapShared gives taskID a reference to a shared region and maps it into the
+// task's address space. Returns the task address of the mapping.
+func (t *TaskMemoryTracker) MapShared(taskID string, h SharedHandle) (uint64, error) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+
+	region, err := t.attach(taskID, h)
+	if err != nil {
+		return 0, err
+	}
+	addr, err := t.openSpace(taskID).mapRegion(region, h)
+	if err != nil {
+		t.detach(taskID, h, false)
+		return 0, err
+	}
+	return addr, nil
+}
+
+// MapObject names the global object at global, such as a hash map, by a task
+// address of taskID. The task reaches the object only through calls that
+// take the address back; no memory is mapped behind it.
+func (t *TaskMemoryTracker) MapObject(taskID string, global uint64) (uint64, error) {
+	as, ok := t.Space(taskID)
+	if !ok {
+		return 0, fmt.Errorf("task %s has no address space", taskID)
+	}
+	return as.mapObject(global)
+}
+
+// Object returns the global address of the object taskAddr names for taskID.
+func (t *TaskMemoryTracker) Object(taskID string, taskAddr uint64) (uint64, error) {
+	as, ok := t.Space(taskID)
+	if !ok {
+		return 0, fmt.Errorf("task %s has no address space", taskID)
+	}
+	global, ok := as.object(taskAddr)
+	if !ok {
+		return 0, fmt.Errorf("task %s: no object at 0x%x", taskID, taskAddr)
+	}
+	return global, nil
+}
+
+// UnmapObject drops the task address naming an object of taskID and returns
+// the object's global address. The object itself is left alone.
+func (t *TaskMemoryTracker) UnmapObject(taskID string, taskAddr uint64) (uint64, error) {
+	as, ok := t.Space(taskID)
+	if !ok {
+		return 0, fmt.Errorf("task %s has no address space", taskID)
+	}
+	global, ok := as.unmapObject(taskAddr)
+	if !ok {
+		return 0, fmt.Errorf("task %s: no object at 0x%x", taskID, taskAddr)
+	}
+	return global, nil
+}
+
+// Objects returns the task addresses naming objects of taskID.
+func (t *TaskMemoryTracker) Objects(taskID string) []uint64 {
+	as, ok := t.Space(taskID)
+	if !ok {
+		return nil
+	}
+	as.lock.RLock()
+	defer as.lock.RUnlock()
+	addrs := make([]uint64, 0, len(as.objects))
+	for addr := range as.objects {
+		addrs = append(addrs, addr)
+	}
+	slices.Sort(addrs)
+	return addrs
+}
@@ -0,0 +1,136 @@
+package sharedmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// FitStrategy picks among the free regions that can satisfy a request.
+type FitStrategy int
+
+const (
+	FirstFit FitStrategy = iota // lowest address
+	BestFit                     // smallest free region that fits
+	WorstFit                    // largest free region
+)
+
+// AllocRequest describes a constrained allocation for MemTable.Alloc.
+type AllocRequest struct {
+	Size      uint64
+	Align     uint64 // power of two; 0 or 1 means no alignment
+	MinAddr   uint64 // the block must start at or above MinAddr
+	MaxAddr   uint64 // the block must end at or below MaxAddr; 0 means no limit
+	Owner     string // preferred owner; empty means any SoC
+	OwnerOnly bool   // fail instead of falling back to other owners
+	Fit       FitStrategy
+	Label     *Label // attached to the block if set
+}
+
+// Alloc allocates a block satisfying req. The preferred owner is tried first;
+// unless OwnerOnly is set any other SoC may serve the request after that.
+// Alignment padding stays free on both sides of the block.
+func (mt *MemTable) Alloc(req AllocRequest) (MemRegion, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	region, err := mt.carve(req)
+	if err != nil {
+		return MemRegion{}, err
+	}
+	mt.insertAlloc(region)
+	if req.Label != nil {
+		mt.setLabel(region.StartAddr, *req.Label)
+	}
+	return region, nil
+}
+
+// carve takes a block satisfying req out of the free regions without
+// recording it as an allocation.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) carve(req AllocRequest) (MemRegion, error) {
+	if req.Size == 0 {
+		return MemRegion{}, errors.New("cannot allocate zero bytes")
+	}
+	if req.Align > 1 && req.Align&(req.Align-1) != 0 {
+		return MemRegion{}, fmt.Errorf("alignment %d is not a power of two", req.Align)
+	}
+
+	free, start, ok := mt.pickFree(req, req.Owner)
+	if !ok && req.Owner != "" && !req.OwnerOnly {
+		free, start, ok = mt.pickFree(req, "")
+	}
+	if !ok {
+		if req.Owner != "" {
+			return MemRegion{}, errors.New("no free region large enough to allocate for owner " + req.Owner)
+		}
+		return MemRegion{}, errors.New("no free region large enough to allocate")
+	}
+
+	// Split, leaving the head padding and the tail free
+	mt.FreeRegions.Delete(free.StartAddr)
+	if start > free.StartAddr {
+		mt.FreeRegions.Insert(MemRegion{StartAddr: free.StartAddr, Length: start - free.StartAddr, Owner: free.Owner})
+	}
+	end := start + req.Size
+	if freeEnd := free.StartAddr + free.Length; end < freeEnd {
+		mt.FreeRegions.Insert(MemRegion{StartAddr: end, Length: freeEnd - end, Owner: free.Owner})
+	}
+
+	return MemRegion{StartAddr: start, Length: req.Size, Owner: free.Owner}, nil
+}
+
+// pickFree chooses a free region for req among those owned by owner (any
+// owner if empty). Returns the region and the aligned start inside it.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) pickFree(req AllocRequest, owner string) (MemRegion, uint64, bool) {
+	var best MemRegion
+	var bestStart uint64
+	found := false
+
+	// Free regions starting below MinAddr may still reach past it
+	from := req.MinAddr
+	if r, ok := mt.FreeRegions.Floor(req.MinAddr); ok {
+		from = r.StartAddr
+	}
+
+	mt.FreeRegions.AscendFrom(from, func(r MemRegion) bool {
+		if owner != "" && r.Owner != owner {
+			return true
+		}
+		if req.MaxAddr != 0 && r.StartAddr >= req.MaxAddr {
+			return false
+		}
+
+		start, ok := fitIn(r, req)
+		if !ok {
+			return true
+		}
+		switch {
+		case !found:
+		case req.Fit == BestFit && r.Length < best.Length:
+		case req.Fit == WorstFit && r.Length > best.Length:
+		default:
+			return true
+		}
+		best, bestStart, found = r, start, true
+		return req.Fit != FirstFit
+	})
+
+	return best, bestStart, found
+}
+
+// fitIn returns where a block for req would start inside free region r.
+func fitIn(r MemRegion, req AllocRequest) (uint64, bool) {
+	start := max(r.StartAddr, req.MinAddr)
+	if req.Align > 1 {
+		start = (start + req.Align - 1) &^ (req.Align - 1)
+	}
+	end := start + req.Size
+	if end < start || start < r.StartAddr || end > r.StartAddr+r.Length {
+		return 0, false
+	}
+	if req.MaxAddr != 0 && end > req.MaxAddr {
+		return 0, false
+	}
+	return start, true
+}
@@ -1,44 +1,16 @@
 package sharedmem
 
-import (
-	"errors"
-	"sort"
-)
-
-// AllocateRegions takes a list of SoCs (name + RAM size in MB) and
-// returns a slice of MemRegions, each assigned a contiguous block,
-// starting from address 0x0 upwards.
+// AllocateRegions takes a list of SoCs (name + RAM size in MB) and returns a
+// slice of MemRegions in the sparse layout, sorted by StartAddr. SoCs with a
+// BaseAddr start there; the others get a SlotSize-aligned slot each, in name
+// order. Use a persisted Layout to keep slots stable across membership changes.
 func AllocateRegions(socs []SoCMemInfo) ([]MemRegion, error) {
-	// Sort SoCs by name or some stable order to keep allocation deterministic
-	sort.SliceStable(socs, func(i, j int) bool {
-		return socs[i].Name < socs[j].Name
-	})
-
-	var regions []MemRegion
-	var currentAddr uint64 = 0
-
-	for _, soc := range socs {
-		length := soc.MemoryMB * 1024 * 1024 // Convert MB to bytes
-
-		// Simple check: don't allocate zero memory
-		if length == 0 {
-			return nil, errors.New("SoC " + soc.Name + " has zero memory size")
-		}
-
-		region := MemRegion{
-			StartAddr: currentAddr,
-			Length:    length,
-			Owner:     soc.Name,
-		}
-		regions = append(regions, region)
-		currentAddr += length
-	}
-
-	return regions, nil
+	return NewLayout().Assign(socs)
 }
 
 // SoCMemInfo describes a SoC's memory capacity.
 type SoCMemInfo struct {
 	Name     string
 	MemoryMB uint64
+	BaseAddr *uint64 // fixed start address, if configured
 }
@@ -0,0 +1,284 @@
+package sharedmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Loan is a range of a SoC's memory lent to another SoC (ballooning). The
+// borrower owns the range in FreeRegions and allocates from it like its own
+// memory, but the bytes stay in the lender's RAM.
+type Loan struct {
+	Region MemRegion // Owner is the borrower
+	Lender string
+}
+
+// Lend hands a page-aligned free range of at least size bytes from lender's
+// slot to borrower. Only the lender's own slot memory can be lent.
+func (mt *MemTable) Lend(lender string, borrower string, size uint64) (Loan, error) {
+	if lender == borrower {
+		return Loan{}, errors.New("a SoC cannot lend memory to itself")
+	}
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	var slot MemRegion
+	for _, s := range mt.Slots {
+		if s.Owner == lender {
+			slot = s
+		}
+	}
+	if slot.Length == 0 {
+		return Loan{}, fmt.Errorf("SoC %s has no slot to lend from", lender)
+	}
+
+	region, err := mt.carve(AllocRequest{
+		Size:      roundUpPage(size),
+		Align:     PageSize,
+		MinAddr:   slot.StartAddr,
+		MaxAddr:   slot.StartAddr + slot.Length,
+		Owner:     lender,
+		OwnerOnly: true,
+	})
+	if err != nil {
+		return Loan{}, fmt.Errorf("lending %d bytes of %s failed: %w", size, lender, err)
+	}
+	region.Owner = borrower
+	loan := Loan{Region: region, Lender: lender}
+	mt.insertLoan(loan)
+	mt.insertFree(region)
+	return loan, nil
+}
+
+// AcceptLoan records a loan made in another SoC's table, so this table agrees
+// on who owns the range. The range must be free and owned by the lender here.
+func (mt *MemTable) AcceptLoan(loan Loan) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	if _, ok := mt.loans[loan.Region.StartAddr]; ok {
+		return fmt.Errorf("loan at 0x%x already recorded", loan.Region.StartAddr)
+	}
+	region, err := mt.carve(AllocRequest{
+		Size:      loan.Region.Length,
+		MinAddr:   loan.Region.StartAddr,
+		MaxAddr:   loan.Region.StartAddr + loan.Region.Length,
+		Owner:     loan.Lender,
+		OwnerOnly: true,
+	})
+	if err != nil {
+		return fmt.Errorf("range 0x%x+%d is not free memory of %s: %w", loan.Region.StartAddr, loan.Region.Length, loan.Lender, err)
+	}
+	region.Owner = loan.Region.Owner
+	mt.insertLoan(Loan{Region: region, Lender: loan.Lender})
+	mt.insertFree(region)
+	return nil
+}
+
+// Reclaim ends the loan starting at addr and gives the range back to its
+// lender. Borrower allocations inside the range are moved elsewhere,
+// preferably to the borrower's own memory, with copyFn; handles, leases and
+// labels follow them. Copy-on-write images, reservations and buddy arenas
+// inside the range cannot be moved and make Reclaim fail. A failed Reclaim
+// keeps the loan and can be retried; whatever was already handed back stays
+// with the lender.
+func (mt *MemTable) Reclaim(addr uint64, copyFn CopyFunc) error {
+	// Keep the compactor and handle users out while blocks move
+	mt.moveLock.Lock()
+	defer mt.moveLock.Unlock()
+
+	mt.Mu.Lock()
+	loan, ok := mt.loans[addr]
+	if !ok {
+		mt.Mu.Unlock()
+		return fmt.Errorf("no loan at address 0x%x", addr)
+	}
+	if err := mt.pinnedIn(loan.Region); err != nil {
+		mt.Mu.Unlock()
+		return fmt.Errorf("cannot reclaim loan at 0x%x: %w", addr, err)
+	}
+
+	// Free memory goes back first, so the borrower stops allocating there
+	mt.returnFree(loan)
+	allocs := overlappingIn(mt.Regions, loan.Region.StartAddr, loan.Region.Length)
+	mt.Mu.Unlock()
+
+	for _, old := range allocs {
+		if err := mt.evacuate(loan, old, copyFn); err != nil {
+			return fmt.Errorf("cannot reclaim loan at 0x%x: %w", addr, err)
+		}
+	}
+
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+	if left := overlappingIn(mt.Regions, loan.Region.StartAddr, loan.Region.Length); len(left) > 0 {
+		return fmt.Errorf("cannot reclaim loan at 0x%x: 0x%x was allocated meanwhile, retry", addr, left[0].StartAddr)
+	}
+	mt.returnFree(loan)
+	mt.removeLoan(addr)
+	return nil
+}
+
+// insertLoan records a loan.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) insertLoan(loan Loan) {
+	mt.loans[loan.Region.StartAddr] = loan
+	mt.loanRanges.Insert(loan.Region)
+}
+
+// removeLoan drops the loan starting at startAddr from the map and the index.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) removeLoan(startAddr uint64) {
+	delete(mt.loans, startAddr)
+	mt.loanRanges.Delete(startAddr)
+}
+
+// Loans returns the recorded loans in address order.
+func (mt *MemTable) Loans() []Loan {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	return mt.sortedLoans()
+}
+
+// LoanAt returns the loan containing addr, if any.
+func (mt *MemTable) LoanAt(addr uint64) (Loan, bool) {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	r, ok := mt.loanRanges.Find(addr)
+	if !ok {
+		return Loan{}, false
+	}
+	return mt.loans[r.StartAddr], true
+}
+
+// sortedLoans returns the loans in address order.
+// Do not call without holding the mu lock.
+func (mt *MemTable) sortedLoans() []Loan {
+	out := make([]Loan, 0, mt.loanRanges.Len())
+	mt.loanRanges.Ascend(func(r MemRegion) bool {
+		out = append(out, mt.loans[r.StartAddr])
+		return true
+	})
+	return out
+}
+
+// evacuate moves the allocation old out of the lent range, the same way
+// Realloc moves a block. It stays on the borrower's or the lender's memory,
+// never on a third SoC.
+func (mt *MemTable) evacuate(loan Loan, old MemRegion, copyFn CopyFunc) error {
+	// The borrower's own memory first, then the lender's above or below the loan
+	tries := []AllocRequest{
+		{Size: old.Length, Owner: loan.Region.Owner, OwnerOnly: true},
+		{Size: old.Length, Owner: loan.Lender, OwnerOnly: true, MinAddr: loan.Region.StartAddr + loan.Region.Length},
+	}
+	if loan.Region.StartAddr > 0 {
+		tries = append(tries, AllocRequest{Size: old.Length, Owner: loan.Lender, OwnerOnly: true, MaxAddr: loan.Region.StartAddr})
+	}
+	mt.Mu.Lock()
+	var region MemRegion
+	err := errors.New("no room outside the loan")
+	for _, req := range tries {
+		if region, err = mt.carve(req); err == nil {
+			mt.insertAlloc(region)
+			break
+		}
+	}
+	mt.Mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("moving 0x%x failed: %w", old.StartAddr, err)
+	}
+
+	// The copy may go through RPC, so it runs without the table lock
+	if err := copyFn(old, region, old.Length); err != nil {
+		mt.Mu.Lock()
+		mt.removeAlloc(region.StartAddr)
+		mt.insertFree(region)
+		mt.Mu.Unlock()
+		return fmt.Errorf("copy from 0x%x failed: %w", old.StartAddr, err)
+	}
+
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	mt.removeAlloc(region.StartAddr)
+	if cur, ok := mt.Allocations[old.StartAddr]; !ok || cur != old {
+		// Freed or resized by raw address while we were copying, nothing to
+		// publish; Reclaim finds whatever is still in the loan
+		mt.insertFree(region)
+		return nil
+	}
+	mt.relocate(old.StartAddr, region.StartAddr)
+	mt.insertAlloc(region)
+	mt.unplaceRange(old)
+	// The block may stick out of the loan into the borrower's own memory
+	mt.release(old)
+	mt.returnFree(loan)
+	return nil
+}
+
+// returnFree hands the free memory inside the loan's range back to the lender.
+// Do not call without holding the mu lock.
+func (mt *MemTable) returnFree(loan Loan) {
+	start, end := loan.Region.StartAddr, loan.Region.StartAddr+loan.Region.Length
+	for _, free := range overlappingIn(mt.FreeRegions, start, end-start) {
+		if free.Owner != loan.Region.Owner {
+			// Handed back by an earlier attempt
+			continue
+		}
+		mt.FreeRegions.Delete(free.StartAddr)
+		lo, hi := max(free.StartAddr, start), min(free.StartAddr+free.Length, end)
+		if free.StartAddr < lo {
+			mt.FreeRegions.Insert(MemRegion{StartAddr: free.StartAddr, Length: lo - free.StartAddr, Owner: free.Owner})
+		}
+		if freeEnd := free.StartAddr + free.Length; freeEnd > hi {
+			mt.FreeRegions.Insert(MemRegion{StartAddr: hi, Length: freeEnd - hi, Owner: free.Owner})
+		}
+		mt.insertFree(MemRegion{StartAddr: lo, Length: hi - lo, Owner: loan.Lender})
+	}
+}
+
+// overlappingIn returns the regions of idx overlapping [start, start+length)
+// in address order.
+// Do not call without holding the mu lock.
+func overlappingIn(idx *RegionIndex, start uint64, length uint64) []MemRegion {
+	var out []MemRegion
+	if first, ok := idx.Floor(start); ok && first.StartAddr+first.Length > start {
+		out = append(out, first)
+	}
+	idx.AscendFrom(start, func(r MemRegion) bool {
+		if r.StartAddr >= start+length {
+			return false
+		}
+		if len(out) == 0 || out[len(out)-1].StartAddr != r.StartAddr {
+			out = append(out, r)
+		}
+		return true
+	})
+	return out
+}
+
+// pinnedIn returns an error if r holds memory that cannot be moved: a
+// reservation, a buddy arena or a copy-on-write image.
+// Do not call without holding the mu lock.
+func (mt *MemTable) pinnedIn(r MemRegion) error {
+	if res, ok := mt.reservations.Overlapping(r.StartAddr, r.Length); ok {
+		return fmt.Errorf("reservation at 0x%x", res.StartAddr)
+	}
+	for _, ba := range mt.buddies {
+		for _, arena := range ba.arenas {
+			if overlaps(r, MemRegion{StartAddr: arena.base, Length: arena.size()}) {
+				return fmt.Errorf("buddy arena at 0x%x", arena.base)
+			}
+		}
+	}
+	for _, image := range mt.cowRegions() {
+		if overlaps(r, image) {
+			return fmt.Errorf("copy-on-write image at 0x%x", image.StartAddr)
+		}
+	}
+	return nil
+}
+
+func overlaps(a MemRegion, b MemRegion) bool {
+	return a.StartAddr < b.StartAddr+b.Length && b.StartAddr < a.StartAddr+a.Length
+}
@@ -0,0 +1,258 @@
+package sharedmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PageBackend selects how AllocPages carves pages out of the address space.
+type PageBackend int
+
+const (
+	// PageBackendRegion allocates a region and registers every page separately.
+	PageBackendRegion PageBackend = iota
+	// PageBackendBuddy hands out power-of-two page blocks from per-owner buddy arenas.
+	PageBackendBuddy
+)
+
+// BuddyArenaOrder is the default arena size for the buddy backend as a page
+// order: 2^10 pages = 4MB. Larger requests get a dedicated arena.
+const BuddyArenaOrder = 10
+
+// SetPageBackend selects the page allocator. Switch before pages are allocated;
+// pages are always freed by the backend that allocated them.
+func (mt *MemTable) SetPageBackend(backend PageBackend) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+	mt.pageBackend = backend
+}
+
+// buddyAllocator manages the buddy arenas of one owner.
+type buddyAllocator struct {
+	owner  string
+	arenas []*buddyArena
+}
+
+// buddyArena is a 2^order page block taken out of the free list. Block offsets
+// are relative to base, so blocks are naturally aligned within the arena.
+type buddyArena struct {
+	base      uint64
+	order     int
+	free      []map[uint64]struct{}  // per order: offsets of free blocks
+	allocated map[uint64]*buddyBlock // offset -> block in use
+}
+
+// buddyBlock is a block handed out by AllocPages. Pages tracks which of the
+// requested pages have not been freed yet.
+type buddyBlock struct {
+	order int
+	pages []bool
+	live  int
+}
+
+func newBuddyArena(base uint64, order int) *buddyArena {
+	a := &buddyArena{
+		base:      base,
+		order:     order,
+		free:      make([]map[uint64]struct{}, order+1),
+		allocated: make(map[uint64]*buddyBlock),
+	}
+	for i := range a.free {
+		a.free[i] = make(map[uint64]struct{})
+	}
+	a.free[order][0] = struct{}{}
+	return a
+}
+
+func (a *buddyArena) size() uint64 {
+	return PageSize << a.order
+}
+
+func (a *buddyArena) contains(addr uint64) bool {
+	return addr >= a.base && addr < a.base+a.size()
+}
+
+// alloc takes a block of 2^order pages, splitting larger blocks as needed.
+// Returns the block's offset in the arena.
+func (a *buddyArena) alloc(order int) (uint64, bool) {
+	for j := order; j <= a.order; j++ {
+		for off := range a.free[j] {
+			delete(a.free[j], off)
+			// Split down, returning upper halves to the free lists
+			for j > order {
+				j--
+				a.free[j][off+(PageSize<<j)] = struct{}{}
+			}
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// release returns the block at off and coalesces it with free buddies.
+func (a *buddyArena) release(off uint64, order int) {
+	for order < a.order {
+		buddy := off ^ (PageSize << order)
+		if _, ok := a.free[order][buddy]; !ok {
+			break
+		}
+		delete(a.free[order], buddy)
+		off = min(off, buddy)
+		order++
+	}
+	a.free[order][off] = struct{}{}
+}
+
+// empty reports whether the arena is one free block again.
+func (a *buddyArena) empty() bool {
+	_, ok := a.free[a.order][0]
+	return ok
+}
+
+// pageOrder returns the smallest order whose block holds numPages pages.
+func pageOrder(numPages uint64) int {
+	order := 0
+	for uint64(1)<<order < numPages {
+		order++
+	}
+	return order
+}
+
+// allocBuddyPages allocates numPages pages for owner from its buddy arenas.
+// The block is registered as a single allocation; the returned pages are views
+// into it.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) allocBuddyPages(numPages uint64, owner string) ([]MemRegion, error) {
+	if numPages == 0 {
+		return nil, errors.New("cannot allocate zero pages")
+	}
+	order := pageOrder(numPages)
+
+	ba, ok := mt.buddies[owner]
+	if !ok {
+		ba = &buddyAllocator{owner: owner}
+		mt.buddies[owner] = ba
+	}
+
+	var arena *buddyArena
+	var off uint64
+	for _, a := range ba.arenas {
+		if a.order < order {
+			continue
+		}
+		if o, ok := a.alloc(order); ok {
+			arena, off = a, o
+			break
+		}
+	}
+
+	if arena == nil {
+		var err error
+		arena, err = mt.newArena(owner, max(order, BuddyArenaOrder), order)
+		if err != nil {
+			return nil, err
+		}
+		ba.arenas = append(ba.arenas, arena)
+		off, _ = arena.alloc(order)
+	}
+
+	block := &buddyBlock{order: order, pages: make([]bool, numPages), live: int(numPages)}
+	for i := range block.pages {
+		block.pages[i] = true
+	}
+	arena.allocated[off] = block
+
+	start := arena.base + off
+	mt.insertAlloc(MemRegion{StartAddr: start, Length: PageSize << order, Owner: owner})
+
+	pages := make([]MemRegion, numPages)
+	for i := range pages {
+		pages[i] = MemRegion{StartAddr: start + uint64(i)*PageSize, Length: PageSize, Owner: owner}
+	}
+	return pages, nil
+}
+
+// newArena carves an arena out of owner's free regions. It tries an arena of
+// `order` first and falls back to the smallest one that fits `need`.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) newArena(owner string, order int, need int) (*buddyArena, error) {
+	for o := order; o >= need; o-- {
+		region, err := mt.carve(AllocRequest{
+			Size:      uint64(PageSize) << o,
+			Align:     PageSize,
+			Owner:     owner,
+			OwnerOnly: true,
+		})
+		if err == nil {
+			return newBuddyArena(region.StartAddr, o), nil
+		}
+	}
+	return nil, errors.New("no free region large enough for a buddy arena for owner " + owner)
+}
+
+// freeBuddyPage frees one page of a buddy block. Returns false if addr is not
+// inside a buddy arena. The block goes back to the arena once all of its pages
+// are freed, and an empty arena goes back to the free list.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) freeBuddyPage(addr uint64) (bool, error) {
+	for _, ba := range mt.buddies {
+		for i, arena := range ba.arenas {
+			if !arena.contains(addr) {
+				continue
+			}
+
+			region, ok := mt.Regions.Find(addr)
+			if !ok {
+				return true, fmt.Errorf("page at 0x%x not allocated", addr)
+			}
+			off := region.StartAddr - arena.base
+			block, ok := arena.allocated[off]
+			if !ok {
+				return true, fmt.Errorf("page at 0x%x not allocated", addr)
+			}
+
+			page := (addr - region.StartAddr) / PageSize
+			if page >= uint64(len(block.pages)) || !block.pages[page] {
+				return true, fmt.Errorf("page at 0x%x not allocated", addr)
+			}
+			block.pages[page] = false
+			block.live--
+			if block.live > 0 {
+				return true, nil
+			}
+
+			delete(arena.allocated, off)
+			mt.removeAlloc(region.StartAddr)
+			mt.forget(region)
+			arena.release(off, block.order)
+
+			if arena.empty() {
+				ba.arenas = append(ba.arenas[:i], ba.arenas[i+1:]...)
+				mt.insertFree(MemRegion{StartAddr: arena.base, Length: arena.size(), Owner: ba.owner})
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// buddyFreeRanges returns the free blocks held inside buddy arenas. They are
+// neither in FreeRegions nor allocated.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) buddyFreeRanges() []MemRegion {
+	var ranges []MemRegion
+	for _, ba := range mt.buddies {
+		for _, arena := range ba.arenas {
+			for order, offs := range arena.free {
+				for off := range offs {
+					ranges = append(ranges, MemRegion{
+						StartAddr: arena.base + off,
+						Length:    PageSize << order,
+						Owner:     ba.owner,
+					})
+				}
+			}
+		}
+	}
+	return ranges
+}
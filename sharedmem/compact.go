@@ -0,0 +1,266 @@
+package sharedmem
+
+import (
+	"fmt"
+)
+
+// Handle is a stable reference to a movable allocation. Unlike a raw address it
+// stays valid when the compactor relocates the block.
+type Handle uint64
+
+// MoveFunc copies `length` bytes from srcOffset to dstOffset inside the owner's
+// local memory. The ranges may overlap.
+type MoveFunc func(owner string, srcOffset uint64, dstOffset uint64, length uint64) error
+
+// AllocMovable allocates `size` bytes for `owner` and returns a handle to it.
+// Only handle-backed allocations are relocated by Compact; blocks handed out as
+// raw addresses are treated as pinned.
+func (mt *MemTable) AllocMovable(size uint64, owner string) (Handle, error) {
+	region, err := mt.AllocRegion(size, owner)
+	if err != nil {
+		return 0, err
+	}
+
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	mt.nextHandle++
+	h := mt.nextHandle
+	mt.handles[h] = region.StartAddr
+	mt.handleAddrs[region.StartAddr] = h
+	return h, nil
+}
+
+// Resolve returns the region a handle currently points to.
+// The result is only stable while no compaction runs, use WithHandle to pin it.
+func (mt *MemTable) Resolve(h Handle) (MemRegion, error) {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	return mt.resolve(h)
+}
+
+// resolve is Resolve without locking.
+func (mt *MemTable) resolve(h Handle) (MemRegion, error) {
+	addr, ok := mt.handles[h]
+	if !ok {
+		return MemRegion{}, fmt.Errorf("unknown handle %d", h)
+	}
+	region, ok := mt.Allocations[addr]
+	if !ok {
+		return MemRegion{}, fmt.Errorf("handle %d points to unallocated address 0x%x", h, addr)
+	}
+	return region, nil
+}
+
+// WithHandle resolves `h` and runs fn with the region pinned, so the compactor
+// cannot move it until fn returns.
+func (mt *MemTable) WithHandle(h Handle, fn func(region MemRegion) error) error {
+	mt.moveLock.RLock()
+	defer mt.moveLock.RUnlock()
+
+	region, err := mt.Resolve(h)
+	if err != nil {
+		return err
+	}
+	return fn(region)
+}
+
+// FreeHandle frees the allocation behind `h`. The handle is forgotten with it.
+func (mt *MemTable) FreeHandle(h Handle) error {
+	mt.moveLock.RLock()
+	defer mt.moveLock.RUnlock()
+
+	region, err := mt.Resolve(h)
+	if err != nil {
+		return err
+	}
+	return mt.FreeRegion(region.StartAddr)
+}
+
+// Compact slides movable allocations of `owner` down into the free gap directly
+// below them, so free space collects into larger regions at the top of the
+// owner's range. At most `budget` bytes are moved per call, blocks that would
+// overshoot it are left for a later pass; move performs the actual data copy.
+// Returns the number of bytes moved.
+//
+// The table lock is only held to pick a block and to publish its new address.
+// The copy itself runs without it, so allocations are not stalled by a pass.
+func (mt *MemTable) Compact(owner string, budget uint64, move MoveFunc) (uint64, error) {
+	mt.moveLock.Lock()
+	defer mt.moveLock.Unlock()
+
+	var moved uint64
+	for moved < budget {
+		mt.Mu.Lock()
+		gap, alloc, ok := mt.nextCompaction(owner, budget-moved)
+		if !ok {
+			mt.Mu.Unlock()
+			break
+		}
+		_, srcOff := mt.physAddr(alloc.StartAddr, alloc)
+		_, dstOff := mt.physAddr(gap.StartAddr, gap)
+
+		// Hold the gap as an allocation so nothing is carved out of it during the copy
+		mt.FreeRegions.Delete(gap.StartAddr)
+		mt.insertAlloc(gap)
+		mt.Mu.Unlock()
+
+		err := move(owner, srcOff, dstOff, alloc.Length)
+
+		mt.Mu.Lock()
+		mt.removeAlloc(gap.StartAddr)
+		if err != nil {
+			mt.insertFree(gap)
+			mt.Mu.Unlock()
+			return moved, fmt.Errorf("failed to move region 0x%x: %w", alloc.StartAddr, err)
+		}
+		if cur, ok := mt.Allocations[alloc.StartAddr]; !ok || cur != alloc {
+			// Freed by raw address while we were copying, nothing to publish
+			mt.insertFree(gap)
+			mt.Mu.Unlock()
+			continue
+		}
+
+		oldAddr := alloc.StartAddr
+		newAddr := gap.StartAddr
+		mt.relocate(oldAddr, newAddr)
+
+		// The gap now sits above the moved block and merges with whatever was there
+		gap.StartAddr = newAddr + alloc.Length
+		mt.insertFree(gap)
+		mt.Mu.Unlock()
+
+		moved += alloc.Length
+	}
+
+	return moved, nil
+}
+
+// nextCompaction finds a free region of `owner` immediately followed by a
+// movable allocation of the same owner of at most maxLen bytes.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) nextCompaction(owner string, maxLen uint64) (MemRegion, MemRegion, bool) {
+	var gap, alloc MemRegion
+	found := false
+	mt.FreeRegions.Ascend(func(free MemRegion) bool {
+		if free.Owner != owner {
+			return true
+		}
+		next, ok := mt.Allocations[free.StartAddr+free.Length]
+		if !ok || next.Owner != owner || next.Length > maxLen {
+			return true
+		}
+		if _, movable := mt.handleAddrs[next.StartAddr]; !movable {
+			return true
+		}
+		// Only blocks sitting in the owner's own memory can be moved with a local copy
+		if mt.placedIn(next) || !mt.isHome(owner, free) || !mt.isHome(owner, next) {
+			return true
+		}
+		gap, alloc, found = free, next, true
+		return false
+	})
+	return gap, alloc, found
+}
+
+// relocate moves all bookkeeping for the allocation at oldAddr to newAddr.
+// Anything keyed by start address has to be rekeyed here.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) relocate(oldAddr uint64, newAddr uint64) {
+	region := mt.Allocations[oldAddr]
+	mt.removeAlloc(oldAddr)
+	region.StartAddr = newAddr
+	mt.insertAlloc(region)
+
+	if h, ok := mt.handleAddrs[oldAddr]; ok {
+		delete(mt.handleAddrs, oldAddr)
+		mt.handleAddrs[newAddr] = h
+		mt.handles[h] = newAddr
+	}
+
+	if lease, ok := mt.leases[oldAddr]; ok {
+		delete(mt.leases, oldAddr)
+		mt.leases[newAddr] = lease
+	}
+
+	if label, ok := mt.labels[oldAddr]; ok {
+		delete(mt.labels, oldAddr)
+		mt.labels[newAddr] = label
+	}
+
+	if seg, ok := mt.segmentAt(oldAddr); ok {
+		seg.Region.StartAddr = newAddr
+	}
+}
+
+// isHome reports whether region lies in the home slot of owner.
+// Do not call without holding the mu lock.
+func (mt *MemTable) isHome(owner string, region MemRegion) bool {
+	frame, ok := mt.homeFrame(region.StartAddr)
+	return ok && frame.SoC == owner
+}
+
+// forget drops all per-allocation bookkeeping for a freed block.
+// Called whenever an allocation is freed.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) forget(region MemRegion) {
+	addr := region.StartAddr
+	mt.unplaceRange(region)
+	if h, ok := mt.handleAddrs[addr]; ok {
+		delete(mt.handleAddrs, addr)
+		delete(mt.handles, h)
+	}
+	delete(mt.leases, addr)
+	delete(mt.labels, addr)
+	if seg, ok := mt.segmentAt(addr); ok {
+		// Freed behind the registry's back
+		delete(mt.segments, seg.ID)
+		if !seg.Unlinked {
+			delete(mt.segmentNames, seg.Name)
+		}
+	}
+}
+
+// FreeBytes returns the total number of free bytes owned by `owner`.
+func (mt *MemTable) FreeBytes(owner string) uint64 {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	var total uint64
+	mt.FreeRegions.Ascend(func(free MemRegion) bool {
+		if free.Owner == owner {
+			total += free.Length
+		}
+		return true
+	})
+	return total
+}
+
+// AllocatedBytes returns the total number of allocated bytes owned by `owner`.
+func (mt *MemTable) AllocatedBytes(owner string) uint64 {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	var total uint64
+	for _, alloc := range mt.Allocations {
+		if alloc.Owner == owner {
+			total += alloc.Length
+		}
+	}
+	return total
+}
+
+// LargestFreeRegion returns the size of the largest free region owned by `owner`.
+func (mt *MemTable) LargestFreeRegion(owner string) uint64 {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	var largest uint64
+	mt.FreeRegions.Ascend(func(free MemRegion) bool {
+		if free.Owner == owner && free.Length > largest {
+			largest = free.Length
+		}
+		return true
+	})
+	return largest
+}
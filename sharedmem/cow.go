@@ -0,0 +1,116 @@
+package sharedmem
+
+import "sort"
+
+// cowImage tracks a block of pages shared copy-on-write between VMems.
+// A page is still shared while more VMems map the image than have copied
+// that page away (Refs - Diverged[page] > 1).
+type cowImage struct {
+	Region   MemRegion
+	Refs     int            // VMems mapping the image
+	Diverged map[uint64]int // page index -> VMems holding a private copy
+}
+
+// cowRetain adds a reference to the image starting at region.StartAddr,
+// creating it (with the caller's own reference) if needed.
+// Do not call without locking the cowLock, there is no safeguards.
+func (mt *MemTable) cowRetain(region MemRegion) *cowImage {
+	img, ok := mt.cow[region.StartAddr]
+	if !ok {
+		img = &cowImage{
+			Region:   region,
+			Refs:     1,
+			Diverged: make(map[uint64]int),
+		}
+		mt.cow[region.StartAddr] = img
+	}
+	img.Refs++
+	return img
+}
+
+// cowShared reports whether page of the image is mapped by more than one VMem.
+// Do not call without locking the cowLock, there is no safeguards.
+func (mt *MemTable) cowShared(image uint64, page uint64) bool {
+	img, ok := mt.cow[image]
+	if !ok {
+		return false
+	}
+	return img.Refs-img.Diverged[page] > 1
+}
+
+// cowDiverge records that one VMem stopped using page of the image.
+// Do not call without locking the cowLock, there is no safeguards.
+func (mt *MemTable) cowDiverge(image uint64, page uint64) {
+	if img, ok := mt.cow[image]; ok {
+		img.Diverged[page]++
+	}
+}
+
+// cowRelease drops a VMem's reference to the image. diverged lists the pages
+// that VMem had copied away. Returns true when this was the last reference and
+// the image region can be freed.
+// Do not call without locking the cowLock, there is no safeguards.
+func (mt *MemTable) cowRelease(image uint64, diverged []uint64) bool {
+	img, ok := mt.cow[image]
+	if !ok {
+		return true
+	}
+
+	img.Refs--
+	for _, page := range diverged {
+		img.Diverged[page]--
+		if img.Diverged[page] <= 0 {
+			delete(img.Diverged, page)
+		}
+	}
+	if img.Refs > 0 {
+		return false
+	}
+
+	delete(mt.cow, image)
+	return true
+}
+
+// CowRefs returns how many VMems map the copy-on-write image starting at
+// `image`, or 0 if it is not shared. Intended for tests and debugging.
+func (mt *MemTable) CowRefs(image uint64) int {
+	mt.cowLock.Lock()
+	defer mt.cowLock.Unlock()
+
+	if img, ok := mt.cow[image]; ok {
+		return img.Refs
+	}
+	return 0
+}
+
+// cowRegions returns the region of every copy-on-write image. Like cowStates,
+// it only holds the cowLock for the copy.
+func (mt *MemTable) cowRegions() []MemRegion {
+	mt.cowLock.Lock()
+	defer mt.cowLock.Unlock()
+
+	out := make([]MemRegion, 0, len(mt.cow))
+	for _, img := range mt.cow {
+		out = append(out, img.Region)
+	}
+	return out
+}
+
+// cowStates returns a copy of every copy-on-write image, ordered by address.
+// The cowLock is only held for the copy; it is a leaf lock, so callers may
+// hold Mu, but must not expect the images to stay as returned.
+func (mt *MemTable) cowStates() []CowState {
+	mt.cowLock.Lock()
+	defer mt.cowLock.Unlock()
+
+	out := make([]CowState, 0, len(mt.cow))
+	for _, img := range mt.cow {
+		diverged := make(map[uint64]int, len(img.Diverged))
+		for page, n := range img.Diverged {
+			diverged[page] = n
+		}
+		out = append(out, CowState{Region: img.Region, Refs: img.Refs, Diverged: diverged})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Region.StartAddr < out[j].Region.StartAddr })
+	return out
+}
@@ -0,0 +1,387 @@
+package sharedmem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// MemTable encoding
+//
+// A MemTable is persisted as a TableSnapshot: the slots it was built from and
+// every piece of bookkeeping on top of them, as sorted lists. Locks and derived
+// indexes are not part of it; they are rebuilt on decode.
+//
+// Binary form (MarshalBinary):
+//
+//	offset  size  field
+//	0       4     magic "SMTB"
+//	4       2     format version, little endian
+//	6       ...   gob encoding of TableSnapshot
+//
+// JSON form (MarshalJSON): the TableSnapshot as a JSON object, with the
+// format version in "Version". Field names are the Go field names.
+//
+// Decoders accept versions MinTableFormatVersion through TableFormatVersion
+// and reject anything newer. A decoded table must pass Verify.
+//
+// Versions:
+//
+//	1  initial format
+//	2  adds Labels; version 1 tables load without labels
+//	3  adds Reservations
+//	4  adds Loans
+//	5  adds Segments
+const (
+	TableFormatVersion    = 5
+	MinTableFormatVersion = 1
+)
+
+var tableMagic = [4]byte{'S', 'M', 'T', 'B'}
+
+// ErrTableVersion is returned when an encoded table has a version this build
+// cannot read.
+var ErrTableVersion = errors.New("unsupported MemTable format version")
+
+// TableSnapshot is the encoded state of a MemTable.
+type TableSnapshot struct {
+	Version      int
+	Slots        []MemRegion
+	Added        []MemRegion `json:",omitempty"`
+	Allocations  []MemRegion
+	Free         []MemRegion
+	Reservations []MemRegion `json:",omitempty"`
+	Loans        []Loan      `json:",omitempty"`
+	PageBackend  PageBackend
+	NextHandle   Handle
+	Handles      []HandleState     `json:",omitempty"`
+	Leases       []LeaseState      `json:",omitempty"`
+	Labels       []LabelState      `json:",omitempty"`
+	Segments     []NamedSegment    `json:",omitempty"`
+	NextSegment  uint64            `json:",omitempty"`
+	Cow          []CowState        `json:",omitempty"`
+	Buddies      []BuddyArenaState `json:",omitempty"`
+	Pages        []PageState       `json:",omitempty"`
+	Frames       []FrameState      `json:",omitempty"`
+}
+
+// HandleState is a movable handle and the address it points to.
+type HandleState struct {
+	Handle Handle
+	Addr   uint64
+}
+
+// LeaseState is the lease on the allocation at Addr.
+type LeaseState struct {
+	Addr  uint64
+	Lease Lease
+}
+
+// LabelState is the label of the allocation at Addr.
+type LabelState struct {
+	Addr  uint64
+	Label Label
+}
+
+// CowState is a copy-on-write image. Diverged maps page index to the number
+// of VMems holding a private copy of the page.
+type CowState struct {
+	Region   MemRegion
+	Refs     int
+	Diverged map[uint64]int `json:",omitempty"`
+}
+
+// BuddyArenaState is one buddy arena with its free and allocated blocks.
+// Block offsets are relative to Base.
+type BuddyArenaState struct {
+	Owner     string
+	Base      uint64
+	Order     int
+	Free      []BuddyBlockState
+	Allocated []BuddyBlockState `json:",omitempty"`
+}
+
+// BuddyBlockState is a buddy block. Pages is set for allocated blocks and
+// lists which of the requested pages are still in use.
+type BuddyBlockState struct {
+	Offset uint64
+	Order  int
+	Pages  []bool `json:",omitempty"`
+}
+
+// PageState is an explicit placement of the virtual page at VAddr.
+type PageState struct {
+	VAddr uint64
+	Frame Frame
+}
+
+// FrameState is a frame handed out by AllocFrame and its slot page.
+type FrameState struct {
+	Frame Frame
+	Addr  uint64
+}
+
+// Snapshot returns the current state of the table in its encoded form.
+func (mt *MemTable) Snapshot() TableSnapshot {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	s := TableSnapshot{
+		Version:      TableFormatVersion,
+		Slots:        append([]MemRegion(nil), mt.Slots...),
+		Added:        append([]MemRegion(nil), mt.added...),
+		Allocations:  mt.Regions.Slice(),
+		Free:         mt.FreeRegions.Slice(),
+		Reservations: mt.reservations.Slice(),
+		Loans:        mt.sortedLoans(),
+		PageBackend:  mt.pageBackend,
+		NextHandle:   mt.nextHandle,
+		Segments:     mt.sortedSegments(),
+		NextSegment:  mt.nextSegment,
+	}
+
+	for h, addr := range mt.handles {
+		s.Handles = append(s.Handles, HandleState{Handle: h, Addr: addr})
+	}
+	sort.Slice(s.Handles, func(i, j int) bool { return s.Handles[i].Handle < s.Handles[j].Handle })
+
+	for addr, lease := range mt.leases {
+		s.Leases = append(s.Leases, LeaseState{Addr: addr, Lease: lease})
+	}
+	sort.Slice(s.Leases, func(i, j int) bool { return s.Leases[i].Addr < s.Leases[j].Addr })
+
+	for addr, label := range mt.labels {
+		label.Tags = slices.Clone(label.Tags)
+		s.Labels = append(s.Labels, LabelState{Addr: addr, Label: label})
+	}
+	sort.Slice(s.Labels, func(i, j int) bool { return s.Labels[i].Addr < s.Labels[j].Addr })
+
+	// cowLock is a leaf lock, so it is only held for the copy, not the whole snapshot
+	if cow := mt.cowStates(); len(cow) > 0 {
+		s.Cow = cow
+	}
+
+	for _, ba := range mt.buddies {
+		for _, arena := range ba.arenas {
+			as := BuddyArenaState{Owner: ba.owner, Base: arena.base, Order: arena.order}
+			for order, offs := range arena.free {
+				for off := range offs {
+					as.Free = append(as.Free, BuddyBlockState{Offset: off, Order: order})
+				}
+			}
+			for off, block := range arena.allocated {
+				as.Allocated = append(as.Allocated, BuddyBlockState{
+					Offset: off,
+					Order:  block.order,
+					Pages:  append([]bool(nil), block.pages...),
+				})
+			}
+			sort.Slice(as.Free, func(i, j int) bool { return as.Free[i].Offset < as.Free[j].Offset })
+			sort.Slice(as.Allocated, func(i, j int) bool { return as.Allocated[i].Offset < as.Allocated[j].Offset })
+			s.Buddies = append(s.Buddies, as)
+		}
+	}
+	sort.Slice(s.Buddies, func(i, j int) bool { return s.Buddies[i].Base < s.Buddies[j].Base })
+
+	mt.Pages.Walk(func(vaddr uint64, frame Frame) bool {
+		s.Pages = append(s.Pages, PageState{VAddr: vaddr, Frame: frame})
+		return true
+	})
+	for frame, addr := range mt.frames {
+		s.Frames = append(s.Frames, FrameState{Frame: frame, Addr: addr})
+	}
+	sort.Slice(s.Frames, func(i, j int) bool { return s.Frames[i].Addr < s.Frames[j].Addr })
+
+	return s
+}
+
+// TableFromSnapshot builds a MemTable from a snapshot. The result must pass
+// Verify, so a damaged snapshot is rejected instead of loaded.
+func TableFromSnapshot(s TableSnapshot) (*MemTable, error) {
+	if s.Version < MinTableFormatVersion || s.Version > TableFormatVersion {
+		return nil, fmt.Errorf("%w %d (supported %d-%d)", ErrTableVersion, s.Version, MinTableFormatVersion, TableFormatVersion)
+	}
+
+	mt, err := NewMemTable(s.Slots)
+	if err != nil {
+		return nil, err
+	}
+	mt.added = append(mt.added, s.Added...)
+	mt.Regions = NewRegionIndex(s.Allocations...)
+	mt.FreeRegions = NewRegionIndex(s.Free...)
+	mt.reservations = NewRegionIndex(s.Reservations...)
+	for _, loan := range s.Loans {
+		mt.insertLoan(loan)
+	}
+	for _, r := range s.Allocations {
+		mt.Allocations[r.StartAddr] = r
+	}
+	mt.pageBackend = s.PageBackend
+	mt.nextHandle = s.NextHandle
+
+	for _, h := range s.Handles {
+		mt.handles[h.Handle] = h.Addr
+		mt.handleAddrs[h.Addr] = h.Handle
+	}
+	for _, l := range s.Leases {
+		mt.leases[l.Addr] = l.Lease
+	}
+	for _, l := range s.Labels {
+		mt.labels[l.Addr] = l.Label
+	}
+	for _, seg := range s.Segments {
+		if _, ok := mt.segments[seg.ID]; ok {
+			return nil, fmt.Errorf("segment %d appears twice", seg.ID)
+		}
+		mt.segments[seg.ID] = &seg
+		if !seg.Unlinked {
+			if _, ok := mt.segmentNames[seg.Name]; ok {
+				return nil, fmt.Errorf("segment name %q appears twice", seg.Name)
+			}
+			mt.segmentNames[seg.Name] = seg.ID
+		}
+	}
+	mt.nextSegment = s.NextSegment
+	for _, c := range s.Cow {
+		diverged := make(map[uint64]int, len(c.Diverged))
+		for page, n := range c.Diverged {
+			diverged[page] = n
+		}
+		mt.cow[c.Region.StartAddr] = &cowImage{Region: c.Region, Refs: c.Refs, Diverged: diverged}
+	}
+
+	for _, as := range s.Buddies {
+		if as.Order < 0 || as.Order > 40 {
+			return nil, fmt.Errorf("buddy arena at 0x%x has invalid order %d", as.Base, as.Order)
+		}
+		arena := newBuddyArena(as.Base, as.Order)
+		delete(arena.free[as.Order], 0)
+		for _, b := range as.Free {
+			if b.Order < 0 || b.Order > as.Order {
+				return nil, fmt.Errorf("buddy block at 0x%x has invalid order %d", as.Base+b.Offset, b.Order)
+			}
+			arena.free[b.Order][b.Offset] = struct{}{}
+		}
+		for _, b := range as.Allocated {
+			block := &buddyBlock{order: b.Order, pages: append([]bool(nil), b.Pages...)}
+			for _, live := range b.Pages {
+				if live {
+					block.live++
+				}
+			}
+			arena.allocated[b.Offset] = block
+		}
+
+		ba, ok := mt.buddies[as.Owner]
+		if !ok {
+			ba = &buddyAllocator{owner: as.Owner}
+			mt.buddies[as.Owner] = ba
+		}
+		ba.arenas = append(ba.arenas, arena)
+	}
+
+	for _, p := range s.Pages {
+		if err := mt.Pages.Map(p.VAddr, p.Frame); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range s.Frames {
+		mt.frames[f.Frame] = f.Addr
+	}
+
+	if err := mt.Verify(); err != nil {
+		return nil, fmt.Errorf("snapshot is inconsistent: %w", err)
+	}
+	return mt, nil
+}
+
+// adopt replaces the state of mt with that of src, which must not be used afterwards.
+func (mt *MemTable) adopt(src *MemTable) {
+	mt.OwnershipLock.Lock()
+	defer mt.OwnershipLock.Unlock()
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+	mt.cowLock.Lock()
+	defer mt.cowLock.Unlock()
+
+	mt.Regions = src.Regions
+	mt.FreeRegions = src.FreeRegions
+	mt.reservations = src.reservations
+	mt.loans = src.loans
+	mt.loanRanges = src.loanRanges
+	mt.Allocations = src.Allocations
+	mt.Slots = src.Slots
+	mt.added = src.added
+	mt.handles = src.handles
+	mt.handleAddrs = src.handleAddrs
+	mt.nextHandle = src.nextHandle
+	mt.leases = src.leases
+	mt.labels = src.labels
+	mt.segments = src.segments
+	mt.segmentNames = src.segmentNames
+	mt.nextSegment = src.nextSegment
+	mt.cow = src.cow
+	mt.pageBackend = src.pageBackend
+	mt.buddies = src.buddies
+	mt.Pages = src.Pages
+	mt.frames = src.frames
+}
+
+// MarshalBinary encodes the table in the versioned binary form.
+func (mt *MemTable) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(tableMagic[:])
+	binary.Write(&buf, binary.LittleEndian, uint16(TableFormatVersion))
+	if err := gob.NewEncoder(&buf).Encode(mt.Snapshot()); err != nil {
+		return nil, fmt.Errorf("encoding MemTable: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the table's state with a MarshalBinary encoding.
+func (mt *MemTable) UnmarshalBinary(data []byte) error {
+	if len(data) < 6 || !bytes.Equal(data[:4], tableMagic[:]) {
+		return errors.New("not an encoded MemTable")
+	}
+	version := int(binary.LittleEndian.Uint16(data[4:6]))
+	if version < MinTableFormatVersion || version > TableFormatVersion {
+		return fmt.Errorf("%w %d (supported %d-%d)", ErrTableVersion, version, MinTableFormatVersion, TableFormatVersion)
+	}
+
+	var s TableSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data[6:])).Decode(&s); err != nil {
+		return fmt.Errorf("decoding MemTable: %w", err)
+	}
+	if s.Version != version {
+		return fmt.Errorf("MemTable header version %d does not match payload version %d", version, s.Version)
+	}
+	return mt.restore(s)
+}
+
+// MarshalJSON encodes the table as a JSON TableSnapshot.
+func (mt *MemTable) MarshalJSON() ([]byte, error) {
+	return json.Marshal(mt.Snapshot())
+}
+
+// UnmarshalJSON replaces the table's state with a MarshalJSON encoding.
+func (mt *MemTable) UnmarshalJSON(data []byte) error {
+	var s TableSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return mt.restore(s)
+}
+
+func (mt *MemTable) restore(s TableSnapshot) error {
+	src, err := TableFromSnapshot(s)
+	if err != nil {
+		return err
+	}
+	mt.adopt(src)
+	return nil
+}
@@ -0,0 +1,718 @@
+package sharedmem
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// HashMap layout
+//
+// A HashMap lives entirely in global memory, so any agent holding its address
+// can use it. The header is a mapHeader at an 8-byte aligned address, which
+// is the map's address. The buckets are an array in a striped VMem, after an
+// 8-byte link word:
+//
+//	bucket  = lock word (8 bytes) + Slots slots
+//	slot    = used (1) + pad (1) + key length (2) + value length (4)
+//	          + KeySize key bytes + ValueSize value bytes
+//
+// Buckets are locked one at a time with a compare-and-swap on their lock
+// word. A full bucket, or a map three quarters full, makes the next writer
+// grow the map: it takes the resize lock, locks every bucket, rehashes into a
+// bucket array twice the size, publishes it in the header and sets the old
+// lock words to bucketMoved, which sends waiting callers to the new array.
+// Retired bucket arrays are kept until the map is freed, so callers that
+// read the header before a growth always find valid lock words. They are
+// chained through their link words, newest first; together they take less
+// memory than the current array.
+//
+// Where agents keep their own tables, the header's allocation and every
+// bucket array are published when made, so each table records them and the
+// pages striped onto other SoCs.
+
+const (
+	hashMapMagic = 0x504d485341484d53 // "SMHASHMP" little endian
+
+	bucketFree   = 0
+	bucketLocked = 1
+	bucketMoved  = 2
+
+	slotHeaderSize = 8
+
+	// Header word offsets
+	hdrResizeLock = 8
+	hdrCount      = 16
+	hdrGeneration = 24
+)
+
+// HashMapConfig describes a new HashMap.
+type HashMapConfig struct {
+	KeySize   uint32   // maximum key length in bytes
+	ValueSize uint32   // maximum value length in bytes
+	Buckets   uint64   // initial bucket count, rounded up to a power of two
+	Slots     uint32   // slots per bucket; 0 means 4
+	Owners    []string // SoCs the buckets are striped over
+}
+
+// mapHeader is the header of a HashMap in global memory.
+type mapHeader struct {
+	Magic      uint64
+	ResizeLock uint64
+	Count      uint64
+	Generation uint64
+	Buckets    uint64 // 8-byte aligned address of the bucket array
+	NBuckets   uint64
+	Region     uint64 // allocation holding the bucket array
+	Retired    uint64 // allocation of the newest retired bucket array
+	HasRetired uint64 // 1 if Retired is set
+	Self       uint64 // allocation holding this header
+	KeySize    uint32
+	ValueSize  uint32
+	Slots      uint32
+	OwnersLen  uint32
+	Owners     [192]byte // comma-separated SoCs the buckets are striped over
+	Creator    [64]byte  // agent whose slab holds the header; empty if it has its own region
+}
+
+var mapHeaderSize = uint64(binary.Size(mapHeader{}))
+
+// HashMap is a concurrent hash map in global memory with byte string keys
+// and values of bounded length.
+type HashMap struct {
+	mem  MemoryManagerIface
+	at   Atomics
+	addr uint64
+}
+
+// NewHashMap allocates an empty HashMap.
+func NewHashMap(mem MemoryManagerIface, cfg HashMapConfig) (*HashMap, error) {
+	at, ok := mem.(Atomics)
+	if !ok {
+		return nil, errors.New("memory manager does not support atomic operations")
+	}
+	if cfg.KeySize == 0 || cfg.KeySize > 0xffff {
+		return nil, fmt.Errorf("key size %d out of range 1-65535", cfg.KeySize)
+	}
+	if len(cfg.Owners) == 0 {
+		return nil, errors.New("no owners for the buckets")
+	}
+	owners := strings.Join(cfg.Owners, ",")
+	if len(owners) > len(mapHeader{}.Owners) {
+		return nil, errors.New("owner list too long")
+	}
+	if cfg.Slots == 0 {
+		cfg.Slots = 4
+	}
+	nBuckets := uint64(1) << bits.Len64(max(cfg.Buckets, 1)-1)
+
+	hdr := mapHeader{
+		Magic:     hashMapMagic,
+		NBuckets:  nBuckets,
+		KeySize:   cfg.KeySize,
+		ValueSize: cfg.ValueSize,
+		Slots:     cfg.Slots,
+		OwnersLen: uint32(len(owners)),
+	}
+	copy(hdr.Owners[:], owners)
+
+	region, creator, addr, err := allocAligned(mem, mapHeaderSize, cfg.Owners[0])
+	if err != nil {
+		return nil, err
+	}
+	hdr.Self = region
+	if err := nameField(hdr.Creator[:], creator); err != nil {
+		freeAligned(mem, creator, region)
+		return nil, err
+	}
+	hdr.Region, hdr.Buckets, err = hdr.allocBuckets(mem, nBuckets)
+	if err != nil {
+		freeAligned(mem, creator, region)
+		return nil, err
+	}
+	m := &HashMap{mem: mem, at: at, addr: addr}
+	if err := m.writeHeader(hdr); err != nil {
+		freeShared(mem, hdr.Region)
+		freeAligned(mem, creator, region)
+		return nil, err
+	}
+	return m, nil
+}
+
+// OpenHashMap attaches to the HashMap at addr, created by any agent.
+func OpenHashMap(mem MemoryManagerIface, addr uint64) (*HashMap, error) {
+	at, ok := mem.(Atomics)
+	if !ok {
+		return nil, errors.New("memory manager does not support atomic operations")
+	}
+	m := &HashMap{mem: mem, at: at, addr: addr}
+	if _, err := m.header(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Addr returns the address other agents open the map with.
+func (m *HashMap) Addr() uint64 {
+	return m.addr
+}
+
+// Len returns the number of entries.
+func (m *HashMap) Len(ctx context.Context) (uint64, error) {
+	return m.at.FetchAdd(ctx, m.addr+hdrCount, 0)
+}
+
+// Get returns the value stored under key.
+func (m *HashMap) Get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	var value []byte
+	var found bool
+	err := m.withBucket(ctx, key, func(b *bucket) error {
+		if i := b.find(key); i >= 0 {
+			value, found = b.value(i), true
+		}
+		return nil
+	})
+	return value, found, err
+}
+
+// Put stores value under key, replacing any previous value.
+func (m *HashMap) Put(ctx context.Context, key []byte, value []byte) error {
+	for {
+		hdr, err := m.header()
+		if err != nil {
+			return err
+		}
+		if uint64(len(key)) > uint64(hdr.KeySize) || len(key) == 0 {
+			return fmt.Errorf("key length %d out of range 1-%d", len(key), hdr.KeySize)
+		}
+		if uint64(len(value)) > uint64(hdr.ValueSize) {
+			return fmt.Errorf("value length %d exceeds %d", len(value), hdr.ValueSize)
+		}
+
+		full, added := false, false
+		err = m.withBucket(ctx, key, func(b *bucket) error {
+			i := b.find(key)
+			if i < 0 {
+				if i = b.free(); i < 0 {
+					full = true
+					return nil
+				}
+				added = true
+			}
+			return b.store(i, key, value)
+		})
+		if err != nil {
+			return err
+		}
+		if full {
+			if err := m.grow(ctx, hdr.Generation); err != nil {
+				return err
+			}
+			continue
+		}
+		if !added {
+			return nil
+		}
+
+		count, err := m.at.FetchAdd(ctx, m.addr+hdrCount, 1)
+		if err != nil {
+			return err
+		}
+		if (count+1)*4 > hdr.NBuckets*uint64(hdr.Slots)*3 {
+			return m.grow(ctx, hdr.Generation)
+		}
+		return nil
+	}
+}
+
+// Delete removes key. Returns whether it was present.
+func (m *HashMap) Delete(ctx context.Context, key []byte) (bool, error) {
+	found := false
+	err := m.withBucket(ctx, key, func(b *bucket) error {
+		i := b.find(key)
+		if i < 0 {
+			return nil
+		}
+		found = true
+		return b.clear(i)
+	})
+	if err != nil || !found {
+		return found, err
+	}
+	_, err = m.at.FetchAdd(ctx, m.addr+hdrCount, ^uint64(0))
+	return true, err
+}
+
+// Free releases the map's memory. No agent may use the map afterwards.
+func (m *HashMap) Free() error {
+	hdr, err := m.header()
+	if err != nil {
+		return err
+	}
+	for retired, ok := hdr.Retired, hdr.HasRetired != 0; ok; {
+		link, err := m.at.FetchAdd(context.Background(), alignWord(retired), 0)
+		if err != nil {
+			return err
+		}
+		if err := freeShared(m.mem, retired); err != nil {
+			return err
+		}
+		retired, ok = link-1, link != 0
+	}
+	if err := freeShared(m.mem, hdr.Region); err != nil {
+		return err
+	}
+	// The header may stay readable in a cached slab, so stale opens must fail
+	if err := m.mem.Write(context.Background(), m.addr, make([]byte, 8)); err != nil {
+		return err
+	}
+	return freeAligned(m.mem, fieldName(hdr.Creator[:]), hdr.Self)
+}
+
+// withBucket locks the bucket of key and calls fn with it, retrying when the
+// map grows underneath.
+func (m *HashMap) withBucket(ctx context.Context, key []byte, fn func(b *bucket) error) error {
+	for {
+		hdr, err := m.header()
+		if err != nil {
+			return err
+		}
+		addr := hdr.Buckets + (hashKey(key)&(hdr.NBuckets-1))*hdr.bucketSize()
+		moved, err := m.lock(ctx, addr)
+		if err != nil {
+			return err
+		}
+		if moved {
+			continue
+		}
+
+		b, err := m.readBucket(hdr, addr)
+		if err == nil {
+			err = fn(b)
+		}
+		if uerr := m.unlock(ctx, addr, bucketFree); err == nil {
+			err = uerr
+		}
+		return err
+	}
+}
+
+// lock spins on the lock word at addr. Returns moved if the bucket was
+// rehashed into a newer array.
+func (m *HashMap) lock(ctx context.Context, addr uint64) (moved bool, err error) {
+	for spin := 0; ; spin++ {
+		ok, err := m.at.CompareAndSwap(ctx, addr, bucketFree, bucketLocked)
+		if err != nil || ok {
+			return false, err
+		}
+		state, err := m.at.FetchAdd(ctx, addr, 0)
+		if err != nil {
+			return false, err
+		}
+		if state == bucketMoved {
+			return true, nil
+		}
+		if err := backoff(ctx, spin); err != nil {
+			return false, err
+		}
+	}
+}
+
+// unlock releases the lock word at addr, leaving it in state.
+func (m *HashMap) unlock(ctx context.Context, addr uint64, state uint64) error {
+	ok, err := m.at.CompareAndSwap(ctx, addr, bucketLocked, state)
+	if err == nil && !ok {
+		err = fmt.Errorf("bucket lock at 0x%x was not held", addr)
+	}
+	return err
+}
+
+// grow doubles the bucket array, unless another agent already grew the map
+// past generation gen.
+func (m *HashMap) grow(ctx context.Context, gen uint64) error {
+	lockAddr := m.addr + hdrResizeLock
+	for spin := 0; ; spin++ {
+		ok, err := m.at.CompareAndSwap(ctx, lockAddr, 0, 1)
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		// Someone else is growing; wait for them to finish
+		current, err := m.at.FetchAdd(ctx, m.addr+hdrGeneration, 0)
+		if err != nil || current != gen {
+			return err
+		}
+		if err := backoff(ctx, spin); err != nil {
+			return err
+		}
+	}
+	defer m.at.CompareAndSwap(ctx, lockAddr, 1, 0)
+
+	hdr, err := m.header()
+	if err != nil || hdr.Generation != gen {
+		return err
+	}
+
+	// Stop all traffic on the old array
+	size := hdr.bucketSize()
+	for b := uint64(0); b < hdr.NBuckets; b++ {
+		if _, err := m.lock(ctx, hdr.Buckets+b*size); err != nil {
+			m.unlockFirst(ctx, hdr, b, bucketFree)
+			return err
+		}
+	}
+
+	next := hdr
+	for factor := uint64(2); ; factor *= 2 {
+		next.NBuckets = hdr.NBuckets * factor
+		next.Region, next.Buckets, err = next.allocBuckets(m.mem, next.NBuckets)
+		if err == nil {
+			var overflow bool
+			overflow, err = m.rehash(hdr, next)
+			if err == nil && !overflow {
+				break
+			}
+			freeShared(m.mem, next.Region)
+		}
+		if err != nil {
+			m.unlockFirst(ctx, hdr, hdr.NBuckets, bucketFree)
+			return fmt.Errorf("growing hash map at 0x%x failed: %w", m.addr, err)
+		}
+	}
+
+	// Chain the old array to the retired ones, publish the new array, then
+	// turn the old one away
+	var link uint64
+	if hdr.HasRetired != 0 {
+		link = hdr.Retired + 1
+	}
+	if _, err := m.at.FetchAdd(ctx, alignWord(hdr.Region), link); err != nil {
+		freeShared(m.mem, next.Region)
+		m.unlockFirst(ctx, hdr, hdr.NBuckets, bucketFree)
+		return err
+	}
+	next.Retired, next.HasRetired = hdr.Region, 1
+	next.Generation = hdr.Generation + 1
+	if err := m.writeLayout(next); err != nil {
+		freeShared(m.mem, next.Region)
+		m.unlockFirst(ctx, hdr, hdr.NBuckets, bucketFree)
+		return err
+	}
+	return m.unlockFirst(ctx, hdr, hdr.NBuckets, bucketMoved)
+}
+
+// rehash copies every entry of the locked array of hdr into the empty array
+// of next. Returns overflow if a bucket of next ran out of slots.
+func (m *HashMap) rehash(hdr mapHeader, next mapHeader) (overflow bool, err error) {
+	used := make([]uint32, next.NBuckets)
+	size := hdr.bucketSize()
+	for b := uint64(0); b < hdr.NBuckets; b++ {
+		old, err := m.readBucket(hdr, hdr.Buckets+b*size)
+		if err != nil {
+			return false, err
+		}
+		for i := 0; i < int(hdr.Slots); i++ {
+			if !old.used(i) {
+				continue
+			}
+			key := old.key(i)
+			nb := hashKey(key) & (next.NBuckets - 1)
+			if used[nb] == next.Slots {
+				return true, nil
+			}
+			slot := next.Buckets + nb*next.bucketSize() + 8 + uint64(used[nb])*next.slotSize()
+			if err := m.mem.Write(context.Background(), slot, old.slot(i)); err != nil {
+				return false, err
+			}
+			used[nb]++
+		}
+	}
+	return false, nil
+}
+
+// unlockFirst releases the first n buckets of hdr's array into state.
+func (m *HashMap) unlockFirst(ctx context.Context, hdr mapHeader, n uint64, state uint64) error {
+	var first error
+	for b := uint64(0); b < n; b++ {
+		if err := m.unlock(ctx, hdr.Buckets+b*hdr.bucketSize(), state); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// header reads and checks the map header.
+func (m *HashMap) header() (mapHeader, error) {
+	data, err := m.mem.Read(context.Background(), m.addr, mapHeaderSize)
+	if err != nil {
+		return mapHeader{}, err
+	}
+	var hdr mapHeader
+	if _, err := binary.Decode(data, binary.LittleEndian, &hdr); err != nil {
+		return mapHeader{}, err
+	}
+	if hdr.Magic != hashMapMagic {
+		return mapHeader{}, fmt.Errorf("no hash map at 0x%x", m.addr)
+	}
+	return hdr, nil
+}
+
+// writeHeader writes the whole header. Only for maps nobody else can see yet.
+func (m *HashMap) writeHeader(hdr mapHeader) error {
+	data := make([]byte, mapHeaderSize)
+	if _, err := binary.Encode(data, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	return m.mem.Write(context.Background(), m.addr, data)
+}
+
+// writeLayout publishes the generation and bucket array of hdr in one write,
+// leaving the lock and counter words alone.
+func (m *HashMap) writeLayout(hdr mapHeader) error {
+	data := make([]byte, mapHeaderSize)
+	if _, err := binary.Encode(data, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	return m.mem.Write(context.Background(), m.addr+hdrGeneration, data[hdrGeneration:hdrGeneration+48])
+}
+
+// readBucket reads the bucket at addr, which the caller has locked.
+func (m *HashMap) readBucket(hdr mapHeader, addr uint64) (*bucket, error) {
+	data, err := m.mem.Read(context.Background(), addr+8, hdr.bucketSize()-8)
+	if err != nil {
+		return nil, err
+	}
+	return &bucket{m: m, hdr: hdr, addr: addr, data: data}, nil
+}
+
+// allocBuckets allocates a zeroed, striped array of n buckets after a link
+// word, published before it is striped. Returns the allocation and the
+// aligned address of the first bucket.
+func (hdr mapHeader) allocBuckets(mem MemoryManagerIface, n uint64) (uint64, uint64, error) {
+	owners := strings.Split(string(hdr.Owners[:hdr.OwnersLen]), ",")
+	v, err := newShared(8+n*hdr.bucketSize()+7, mem, owners)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bucket array allocation failed: %w", err)
+	}
+	return v.StartAddr, alignWord(v.StartAddr) + 8, nil
+}
+
+// newShared is NewStriped for memory other agents reach by address: the
+// allocation is published before its pages are striped, so every table
+// follows the moves. Free it with freeShared.
+func newShared(size uint64, mem MemoryManagerIface, owners []string) (*VMem, error) {
+	if len(owners) == 0 {
+		return nil, errors.New("no owners to stripe over")
+	}
+	region, err := mem.AllocRegion(size, owners[0])
+	if err != nil {
+		return nil, err
+	}
+	// Published before it is written, as the owner's table must hold it
+	if err := publish(mem, region.StartAddr); err != nil {
+		mem.FreeRegion(region.StartAddr)
+		return nil, err
+	}
+	v := &VMem{Size: region.Length, StartAddr: region.StartAddr, mem: mem, owner: owners[0]}
+	if err := zeroFill(mem, v.StartAddr, v.Size); err != nil {
+		freeShared(mem, v.StartAddr)
+		return nil, err
+	}
+	if err := stripe(v, mem, owners); err != nil {
+		freeShared(mem, v.StartAddr)
+		return nil, err
+	}
+	return v, nil
+}
+
+// publish records the allocation holding addr in the tables of the other
+// agents, if they keep their own.
+func publish(mem MemoryManagerIface, addr uint64) error {
+	if pub, ok := mem.(RegionPublisher); ok {
+		return pub.PublishRegion(addr)
+	}
+	return nil
+}
+
+// unpublish drops a publication made with publish.
+func unpublish(mem MemoryManagerIface, addr uint64) error {
+	if pub, ok := mem.(RegionPublisher); ok {
+		return pub.UnpublishRegion(addr)
+	}
+	return nil
+}
+
+// freeShared frees a region published with publish, on every agent.
+func freeShared(mem MemoryManagerIface, addr uint64) error {
+	if pub, ok := mem.(RegionPublisher); ok {
+		return pub.FreePublished(addr)
+	}
+	return mem.FreeRegion(addr)
+}
+
+// alignWord rounds addr up to a multiple of 8, where atomics can work.
+func alignWord(addr uint64) uint64 {
+	return (addr + 7) &^ 7
+}
+
+func (hdr mapHeader) slotSize() uint64 {
+	return slotHeaderSize + uint64(hdr.KeySize) + uint64(hdr.ValueSize)
+}
+
+// bucketSize is the size of a bucket, padded so lock words stay aligned.
+func (hdr mapHeader) bucketSize() uint64 {
+	return (8 + uint64(hdr.Slots)*hdr.slotSize() + 7) &^ 7
+}
+
+// bucket is a locked bucket read into memory. Changes are written through.
+type bucket struct {
+	m    *HashMap
+	hdr  mapHeader
+	addr uint64
+	data []byte // the slots, without the lock word
+}
+
+func (b *bucket) slot(i int) []byte {
+	size := b.hdr.slotSize()
+	return b.data[uint64(i)*size : uint64(i+1)*size]
+}
+
+func (b *bucket) used(i int) bool {
+	return b.slot(i)[0] != 0
+}
+
+func (b *bucket) key(i int) []byte {
+	s := b.slot(i)
+	n := binary.LittleEndian.Uint16(s[2:4])
+	return s[slotHeaderSize : slotHeaderSize+uint64(n)]
+}
+
+func (b *bucket) value(i int) []byte {
+	s := b.slot(i)
+	n := binary.LittleEndian.Uint32(s[4:8])
+	start := slotHeaderSize + uint64(b.hdr.KeySize)
+	return append([]byte(nil), s[start:start+uint64(n)]...)
+}
+
+// find returns the slot holding key, or -1.
+func (b *bucket) find(key []byte) int {
+	for i := 0; i < int(b.hdr.Slots); i++ {
+		if b.used(i) && bytes.Equal(b.key(i), key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// free returns an unused slot, or -1.
+func (b *bucket) free() int {
+	for i := 0; i < int(b.hdr.Slots); i++ {
+		if !b.used(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *bucket) store(i int, key []byte, value []byte) error {
+	s := b.slot(i)
+	clear(s)
+	s[0] = 1
+	binary.LittleEndian.PutUint16(s[2:4], uint16(len(key)))
+	binary.LittleEndian.PutUint32(s[4:8], uint32(len(value)))
+	copy(s[slotHeaderSize:], key)
+	copy(s[slotHeaderSize+uint64(b.hdr.KeySize):], value)
+	return b.m.mem.Write(context.Background(), b.slotAddr(i), s)
+}
+
+func (b *bucket) clear(i int) error {
+	s := b.slot(i)
+	s[0] = 0
+	return b.m.mem.Write(context.Background(), b.slotAddr(i), s[:1])
+}
+
+func (b *bucket) slotAddr(i int) uint64 {
+	return b.addr + 8 + uint64(i)*b.hdr.slotSize()
+}
+
+// allocAligned allocates size bytes starting at an 8-byte aligned address.
+// Small objects come from the slab allocator if mem has one; slab slots are
+// aligned to their size class already. The allocation is published to the
+// other agents. Returns it and the agent whose slab holds it, empty for a
+// region of its own, to be released with freeAligned, and the aligned address.
+func allocAligned(mem MemoryManagerIface, size uint64, owner string) (uint64, string, uint64, error) {
+	if sa, ok := mem.(SmallAllocator); ok && size <= MaxSlabObject() {
+		addr, creator, err := sa.Malloc(size, owner)
+		if err != nil {
+			return 0, "", 0, err
+		}
+		if err := publish(mem, addr); err != nil {
+			sa.FreeSmall(creator, addr)
+			return 0, "", 0, err
+		}
+		return addr, creator, addr, nil
+	}
+	region, err := mem.AllocRegion(size+7, owner)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	if err := publish(mem, region.StartAddr); err != nil {
+		mem.FreeRegion(region.StartAddr)
+		return 0, "", 0, err
+	}
+	return region.StartAddr, "", alignWord(region.StartAddr), nil
+}
+
+// freeAligned releases an allocation made by allocAligned. Slab objects go
+// back to the slab of their creator, whichever agent frees them.
+func freeAligned(mem MemoryManagerIface, creator string, addr uint64) error {
+	if creator == "" {
+		return freeShared(mem, addr)
+	}
+	sa, ok := mem.(SmallAllocator)
+	if !ok {
+		return fmt.Errorf("slab object at 0x%x of %s cannot be freed without a slab allocator", addr, creator)
+	}
+	if err := unpublish(mem, addr); err != nil {
+		return err
+	}
+	return sa.FreeSmall(creator, addr)
+}
+
+// nameField copies name into a fixed-size header field.
+func nameField(dst []byte, name string) error {
+	if len(name) > len(dst) {
+		return fmt.Errorf("name %q too long", name)
+	}
+	copy(dst, name)
+	return nil
+}
+
+// fieldName returns the name stored in a fixed-size header field.
+func fieldName(field []byte) string {
+	return string(bytes.TrimRight(field, "\x00"))
+}
+
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// backoff sleeps a little longer on every spin, up to a millisecond.
+func backoff(ctx context.Context, spin int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(min(spin+1, 100)) * 10 * time.Microsecond):
+		return nil
+	}
+}
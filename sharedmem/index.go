@@ -0,0 +1,253 @@
+package sharedmem
+
+// RegionIndex is an ordered index of non-overlapping MemRegions keyed by
+// StartAddr, kept as an AVL tree. Because regions never overlap, the region
+// containing an address is the one with the greatest start <= addr, so lookups,
+// inserts and deletes are all O(log n).
+// RegionIndex is not safe for concurrent use; MemTable guards it with its locks.
+type RegionIndex struct {
+	root *indexNode
+	size int
+}
+
+type indexNode struct {
+	region      MemRegion
+	left, right *indexNode
+	height      int
+}
+
+// NewRegionIndex creates an index holding the given regions.
+func NewRegionIndex(regions ...MemRegion) *RegionIndex {
+	idx := &RegionIndex{}
+	for _, r := range regions {
+		idx.Insert(r)
+	}
+	return idx
+}
+
+// Len returns the number of regions in the index.
+func (idx *RegionIndex) Len() int {
+	return idx.size
+}
+
+// Insert adds r, replacing any region with the same StartAddr.
+func (idx *RegionIndex) Insert(r MemRegion) {
+	var added bool
+	idx.root, added = insertNode(idx.root, r)
+	if added {
+		idx.size++
+	}
+}
+
+// Delete removes the region starting at start. Returns false if there was none.
+func (idx *RegionIndex) Delete(start uint64) bool {
+	var removed bool
+	idx.root, removed = deleteNode(idx.root, start)
+	if removed {
+		idx.size--
+	}
+	return removed
+}
+
+// Get returns the region starting exactly at start.
+func (idx *RegionIndex) Get(start uint64) (MemRegion, bool) {
+	n := idx.root
+	for n != nil {
+		switch {
+		case start < n.region.StartAddr:
+			n = n.left
+		case start > n.region.StartAddr:
+			n = n.right
+		default:
+			return n.region, true
+		}
+	}
+	return MemRegion{}, false
+}
+
+// Floor returns the region with the greatest StartAddr <= addr.
+func (idx *RegionIndex) Floor(addr uint64) (MemRegion, bool) {
+	var best *indexNode
+	n := idx.root
+	for n != nil {
+		if n.region.StartAddr <= addr {
+			best = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	if best == nil {
+		return MemRegion{}, false
+	}
+	return best.region, true
+}
+
+// Ceil returns the region with the smallest StartAddr >= addr.
+func (idx *RegionIndex) Ceil(addr uint64) (MemRegion, bool) {
+	var best *indexNode
+	n := idx.root
+	for n != nil {
+		if n.region.StartAddr >= addr {
+			best = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	if best == nil {
+		return MemRegion{}, false
+	}
+	return best.region, true
+}
+
+// Find returns the region containing addr.
+func (idx *RegionIndex) Find(addr uint64) (MemRegion, bool) {
+	r, ok := idx.Floor(addr)
+	if !ok || addr >= r.StartAddr+r.Length {
+		return MemRegion{}, false
+	}
+	return r, true
+}
+
+// Overlapping returns a region overlapping [start, start+length), if any.
+func (idx *RegionIndex) Overlapping(start uint64, length uint64) (MemRegion, bool) {
+	if length == 0 {
+		return MemRegion{}, false
+	}
+	// The last region starting before the end of the range is the only candidate
+	r, ok := idx.Floor(start + length - 1)
+	if !ok || r.StartAddr+r.Length <= start {
+		return MemRegion{}, false
+	}
+	return r, true
+}
+
+// Ascend calls fn for every region in StartAddr order until fn returns false.
+func (idx *RegionIndex) Ascend(fn func(r MemRegion) bool) {
+	ascendNode(idx.root, 0, fn)
+}
+
+// AscendFrom is Ascend starting at the first region with StartAddr >= start.
+func (idx *RegionIndex) AscendFrom(start uint64, fn func(r MemRegion) bool) {
+	ascendNode(idx.root, start, fn)
+}
+
+// Slice returns all regions in StartAddr order.
+func (idx *RegionIndex) Slice() []MemRegion {
+	out := make([]MemRegion, 0, idx.size)
+	idx.Ascend(func(r MemRegion) bool {
+		out = append(out, r)
+		return true
+	})
+	return out
+}
+
+func ascendNode(n *indexNode, start uint64, fn func(r MemRegion) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.region.StartAddr >= start {
+		if !ascendNode(n.left, start, fn) {
+			return false
+		}
+		if !fn(n.region) {
+			return false
+		}
+	}
+	return ascendNode(n.right, start, fn)
+}
+
+func height(n *indexNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func (n *indexNode) fix() {
+	n.height = 1 + max(height(n.left), height(n.right))
+}
+
+func rotateRight(n *indexNode) *indexNode {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	n.fix()
+	l.fix()
+	return l
+}
+
+func rotateLeft(n *indexNode) *indexNode {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	n.fix()
+	r.fix()
+	return r
+}
+
+func rebalance(n *indexNode) *indexNode {
+	n.fix()
+	switch balance := height(n.left) - height(n.right); {
+	case balance > 1:
+		if height(n.left.left) < height(n.left.right) {
+			n.left = rotateLeft(n.left)
+		}
+		return rotateRight(n)
+	case balance < -1:
+		if height(n.right.right) < height(n.right.left) {
+			n.right = rotateRight(n.right)
+		}
+		return rotateLeft(n)
+	}
+	return n
+}
+
+func insertNode(n *indexNode, r MemRegion) (*indexNode, bool) {
+	if n == nil {
+		return &indexNode{region: r, height: 1}, true
+	}
+
+	var added bool
+	switch {
+	case r.StartAddr < n.region.StartAddr:
+		n.left, added = insertNode(n.left, r)
+	case r.StartAddr > n.region.StartAddr:
+		n.right, added = insertNode(n.right, r)
+	default:
+		n.region = r
+		return n, false
+	}
+	return rebalance(n), added
+}
+
+func deleteNode(n *indexNode, start uint64) (*indexNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	var removed bool
+	switch {
+	case start < n.region.StartAddr:
+		n.left, removed = deleteNode(n.left, start)
+	case start > n.region.StartAddr:
+		n.right, removed = deleteNode(n.right, start)
+	default:
+		if n.left == nil {
+			return n.right, true
+		}
+		if n.right == nil {
+			return n.left, true
+		}
+		// Replace with the in-order successor
+		succ := n.right
+		for succ.left != nil {
+			succ = succ.left
+		}
+		n.region = succ.region
+		n.right, _ = deleteNode(n.right, succ.region.StartAddr)
+		removed = true
+	}
+	return rebalance(n), removed
+}
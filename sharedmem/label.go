@@ -0,0 +1,100 @@
+package sharedmem
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Label is metadata attached to an allocation, to tell what is using memory.
+type Label struct {
+	Name    string
+	TaskID  string
+	Creator string // SoC that made the allocation
+	Created time.Time
+	Tags    []string
+}
+
+// LabeledRegion is an allocation with its label, as returned by QueryAllocations.
+type LabeledRegion struct {
+	Region MemRegion
+	Label  Label
+}
+
+// AllocQuery selects allocations for QueryAllocations. Empty fields match
+// everything; set fields must all match.
+type AllocQuery struct {
+	Owner   string
+	Tag     string
+	TaskID  string
+	MinSize uint64
+	MaxSize uint64 // 0 means no upper bound
+}
+
+// SetLabel attaches a label to the allocation at `addr`, replacing any
+// existing one. A zero Created is set to the current time.
+func (mt *MemTable) SetLabel(addr uint64, label Label) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	if _, ok := mt.Allocations[addr]; !ok {
+		return fmt.Errorf("no allocated region at address 0x%x", addr)
+	}
+	mt.setLabel(addr, label)
+	return nil
+}
+
+// setLabel is SetLabel without the checks.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) setLabel(addr uint64, label Label) {
+	if label.Created.IsZero() {
+		label.Created = time.Now()
+	}
+	label.Tags = slices.Clone(label.Tags)
+	mt.labels[addr] = label
+}
+
+// GetLabel returns the label of the allocation at `addr`, if it has one.
+func (mt *MemTable) GetLabel(addr uint64) (Label, bool) {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	label, ok := mt.labels[addr]
+	label.Tags = slices.Clone(label.Tags)
+	return label, ok
+}
+
+// QueryAllocations returns the allocations matching q, labeled or not, in
+// address order. Unlabeled allocations only match queries without a tag or
+// task ID.
+func (mt *MemTable) QueryAllocations(q AllocQuery) []LabeledRegion {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	var out []LabeledRegion
+	mt.Regions.Ascend(func(r MemRegion) bool {
+		label := mt.labels[r.StartAddr]
+		if q.matches(r, label) {
+			label.Tags = slices.Clone(label.Tags)
+			out = append(out, LabeledRegion{Region: r, Label: label})
+		}
+		return true
+	})
+	return out
+}
+
+func (q AllocQuery) matches(r MemRegion, label Label) bool {
+	if q.Owner != "" && r.Owner != q.Owner {
+		return false
+	}
+	if q.TaskID != "" && label.TaskID != q.TaskID {
+		return false
+	}
+	if q.Tag != "" && !slices.Contains(label.Tags, q.Tag) {
+		return false
+	}
+	if r.Length < q.MinSize || (q.MaxSize != 0 && r.Length > q.MaxSize) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+package sharedmem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// SlotSize is the stride of the sparse layout. Every SoC without an explicit
+// base address gets its own SlotSize-aligned slot, so its memory may grow up
+// to SlotSize bytes without touching its neighbours.
+const SlotSize = uint64(1) << 36
+
+// Layout remembers the base address assigned to each SoC name, so addresses
+// stay put when SoCs join or leave the cluster. Names that left keep their
+// slot until Forget is called, so their addresses are never handed to
+// another SoC by accident.
+type Layout struct {
+	Bases map[string]uint64 `json:"bases"`
+}
+
+// NewLayout returns an empty layout.
+func NewLayout() *Layout {
+	return &Layout{Bases: make(map[string]uint64)}
+}
+
+// LoadLayout reads a layout written by Save. A missing file is an empty layout.
+func LoadLayout(path string) (*Layout, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewLayout(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read layout %s: %w", path, err)
+	}
+	l := NewLayout()
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("failed to parse layout %s: %w", path, err)
+	}
+	if l.Bases == nil {
+		l.Bases = make(map[string]uint64)
+	}
+	return l, nil
+}
+
+// Save writes the layout to path, replacing the file atomically.
+func (l *Layout) Save(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write layout %s: %w", path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Forget releases the slot of a SoC that left the cluster for good.
+func (l *Layout) Forget(name string) {
+	delete(l.Bases, name)
+}
+
+// Assign returns the region of every SoC in socs, sorted by StartAddr.
+// An explicit BaseAddr wins and is recorded; otherwise the base already in
+// the layout is reused; new SoCs take the lowest free slot, in name order.
+// Regions of different SoCs must not overlap and slotted SoCs must fit in
+// SlotSize bytes. The layout is only updated if the assignment succeeds.
+func (l *Layout) Assign(socs []SoCMemInfo) ([]MemRegion, error) {
+	sorted := append([]SoCMemInfo(nil), socs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	bases := make(map[string]uint64, len(l.Bases))
+	for name, base := range l.Bases {
+		bases[name] = base
+	}
+	lengths := make(map[string]uint64, len(sorted))
+	for _, soc := range sorted {
+		if soc.MemoryMB == 0 {
+			return nil, errors.New("SoC " + soc.Name + " has zero memory size")
+		}
+		if _, dup := lengths[soc.Name]; dup {
+			return nil, errors.New("SoC " + soc.Name + " is listed twice")
+		}
+		lengths[soc.Name] = soc.MemoryMB * 1024 * 1024
+		if soc.BaseAddr != nil {
+			bases[soc.Name] = *soc.BaseAddr
+		}
+	}
+
+	// Place the newcomers in the first slots nobody holds
+	next := uint64(0)
+	for _, soc := range sorted {
+		if _, ok := bases[soc.Name]; ok {
+			continue
+		}
+		if lengths[soc.Name] > SlotSize {
+			return nil, fmt.Errorf("SoC %s has more memory than a %d-byte slot, give it a base_addr", soc.Name, SlotSize)
+		}
+		for slotTaken(bases, lengths, next) {
+			next += SlotSize
+		}
+		if next+SlotSize > MaxVirtAddr {
+			return nil, errors.New("no free slot left in the address space")
+		}
+		bases[soc.Name] = next
+	}
+
+	regions := make([]MemRegion, 0, len(sorted))
+	for _, soc := range sorted {
+		regions = append(regions, MemRegion{StartAddr: bases[soc.Name], Length: lengths[soc.Name], Owner: soc.Name})
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].StartAddr < regions[j].StartAddr
+	})
+	for i, r := range regions {
+		if r.StartAddr+r.Length > MaxVirtAddr || r.StartAddr+r.Length < r.StartAddr {
+			return nil, fmt.Errorf("SoC %s at 0x%x runs past the address space", r.Owner, r.StartAddr)
+		}
+		if i > 0 && regions[i-1].StartAddr+regions[i-1].Length > r.StartAddr {
+			return nil, fmt.Errorf("SoCs %s and %s overlap at 0x%x", regions[i-1].Owner, r.Owner, r.StartAddr)
+		}
+	}
+	// Departed SoCs keep their slot, but must not collide with the live ones
+	for name, base := range bases {
+		if _, live := lengths[name]; live {
+			continue
+		}
+		for _, r := range regions {
+			if base < r.StartAddr+r.Length && r.StartAddr < base+SlotSize {
+				return nil, fmt.Errorf("SoC %s at 0x%x overlaps the slot kept for %s", r.Owner, r.StartAddr, name)
+			}
+		}
+	}
+
+	l.Bases = bases
+	return regions, nil
+}
+
+// CheckLayout checks regions handed out by the master against the SoCs an
+// agent was configured with: every SoC must have a region of its configured
+// size, at its base address if it has one, and no two regions may overlap.
+// An agent whose configuration disagrees with the master must not join.
+func CheckLayout(regions []MemRegion, socs []SoCMemInfo) error {
+	for i := 1; i < len(regions); i++ {
+		if regions[i-1].StartAddr+regions[i-1].Length > regions[i].StartAddr {
+			return fmt.Errorf("SoCs %s and %s overlap at 0x%x", regions[i-1].Owner, regions[i].Owner, regions[i].StartAddr)
+		}
+	}
+	for _, soc := range socs {
+		var region *MemRegion
+		for i := range regions {
+			if regions[i].Owner == soc.Name {
+				region = &regions[i]
+				break
+			}
+		}
+		switch {
+		case region == nil:
+			return fmt.Errorf("SoC %s has no region in the layout", soc.Name)
+		case region.Length != soc.MemoryMB*1024*1024:
+			return fmt.Errorf("SoC %s has %d bytes in the layout but %d MB configured", soc.Name, region.Length, soc.MemoryMB)
+		case soc.BaseAddr != nil && region.StartAddr != *soc.BaseAddr:
+			return fmt.Errorf("SoC %s is at 0x%x in the layout but configured at 0x%x", soc.Name, region.StartAddr, *soc.BaseAddr)
+		}
+	}
+	return nil
+}
+
+// slotTaken reports whether the slot at base overlaps memory or a slot held
+// by any SoC in bases. SoCs that are not live hold a whole slot.
+func slotTaken(bases map[string]uint64, lengths map[string]uint64, base uint64) bool {
+	for name, b := range bases {
+		length := max(lengths[name], SlotSize)
+		if b < base+SlotSize && base < b+length {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package sharedmem
+
+import (
+	"fmt"
+	"time"
+)
+
+// Lease ties an allocation to a holder that has to renew it periodically.
+// Regions whose lease ran out, or whose holder SoC died, can be reclaimed.
+type Lease struct {
+	Holder  string        // SoC that holds the allocation
+	TaskID  string        // optional task on the holder
+	TTL     time.Duration // how long a renewal keeps the lease alive
+	Expires time.Time
+}
+
+// ReclaimReason says why a leased region is eligible for reclamation.
+type ReclaimReason string
+
+const (
+	ReclaimExpired    ReclaimReason = "lease expired"
+	ReclaimHolderDead ReclaimReason = "holder dead"
+)
+
+// LeasedRegion is a region returned by ExpiredLeases.
+type LeasedRegion struct {
+	Region MemRegion
+	Lease  Lease
+	Reason ReclaimReason
+}
+
+// SetLease attaches a lease to the allocation at `addr`, replacing any existing one.
+func (mt *MemTable) SetLease(addr uint64, holder string, taskID string, ttl time.Duration) (Lease, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	if _, ok := mt.Allocations[addr]; !ok {
+		return Lease{}, fmt.Errorf("no allocated region at address 0x%x", addr)
+	}
+	if ttl <= 0 {
+		return Lease{}, fmt.Errorf("invalid lease TTL %s", ttl)
+	}
+
+	lease := Lease{
+		Holder:  holder,
+		TaskID:  taskID,
+		TTL:     ttl,
+		Expires: time.Now().Add(ttl),
+	}
+	mt.leases[addr] = lease
+	return lease, nil
+}
+
+// RenewLease extends the lease on `addr` by its TTL. Only the holder may renew.
+func (mt *MemTable) RenewLease(addr uint64, holder string) (Lease, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	lease, ok := mt.leases[addr]
+	if !ok {
+		return Lease{}, fmt.Errorf("no lease on address 0x%x", addr)
+	}
+	if lease.Holder != holder {
+		return Lease{}, fmt.Errorf("lease on 0x%x is held by %s, not %s", addr, lease.Holder, holder)
+	}
+
+	lease.Expires = time.Now().Add(lease.TTL)
+	mt.leases[addr] = lease
+	return lease, nil
+}
+
+// ReleaseLease removes the lease on `addr`, making the allocation permanent again.
+func (mt *MemTable) ReleaseLease(addr uint64) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+	delete(mt.leases, addr)
+}
+
+// GetLease returns the lease on `addr`, if any.
+func (mt *MemTable) GetLease(addr uint64) (Lease, bool) {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	lease, ok := mt.leases[addr]
+	return lease, ok
+}
+
+// ExpiredLeases lists leased regions whose lease expired before `now` or whose
+// holder is in `dead`. Nothing is freed here.
+func (mt *MemTable) ExpiredLeases(now time.Time, dead map[string]bool) []LeasedRegion {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	var expired []LeasedRegion
+	for addr, lease := range mt.leases {
+		region, ok := mt.Allocations[addr]
+		if !ok {
+			continue
+		}
+		switch {
+		case dead[lease.Holder]:
+			expired = append(expired, LeasedRegion{Region: region, Lease: lease, Reason: ReclaimHolderDead})
+		case now.After(lease.Expires):
+			expired = append(expired, LeasedRegion{Region: region, Lease: lease, Reason: ReclaimExpired})
+		}
+	}
+	return expired
+}
@@ -3,7 +3,6 @@ package sharedmem
 import (
 	"errors"
 	"fmt"
-	"sort"
 	"sync"
 )
 
@@ -18,9 +17,37 @@ type MemRegion struct {
 type MemTable struct {
 	OwnershipLock sync.RWMutex
 	Mu            sync.RWMutex
-	Regions       []MemRegion          // all allocated memory regions owned by SoCs
-	FreeRegions   []MemRegion          // free regions available for allocation (owned by SoCs)
+	Regions       *RegionIndex         // all allocated memory regions owned by SoCs
+	FreeRegions   *RegionIndex         // free regions available for allocation (owned by SoCs)
 	Allocations   map[uint64]MemRegion // allocated regions startAddr -> region
+	Slots         []MemRegion          // home range of each SoC, as passed to NewMemTable
+	added         []MemRegion          // ranges added later through AddRegion
+	reservations  *RegionIndex         // reserved ranges; committed parts are also in Regions
+	loans         map[uint64]Loan      // lent range start -> loan
+	loanRanges    *RegionIndex         // lent ranges, Owner is the borrower
+
+	moveLock    sync.RWMutex      // held exclusively while the compactor relocates blocks
+	handles     map[Handle]uint64 // movable handle -> current start address
+	handleAddrs map[uint64]Handle // current start address -> movable handle
+	nextHandle  Handle
+	leases      map[uint64]Lease // allocation start address -> lease, if any
+	labels      map[uint64]Label // allocation start address -> label, if any
+
+	segments     map[uint64]*NamedSegment // segment ID -> named segment, unlinked ones included
+	segmentNames map[string]uint64        // name -> segment ID, linked segments only
+	nextSegment  uint64
+
+	// cowLock is a leaf lock: it is taken last, after OwnershipLock, moveLock
+	// and Mu, and nothing else is locked or called through the memory manager
+	// while it is held.
+	cowLock sync.Mutex
+	cow     map[uint64]*cowImage // image start address -> copy-on-write sharing state
+
+	pageBackend PageBackend
+	buddies     map[string]*buddyAllocator // owner -> buddy arenas, for PageBackendBuddy
+
+	Pages  *PageTable       // explicit placements of virtual pages
+	frames map[Frame]uint64 // frames handed out by AllocFrame -> address of their slot page
 }
 
 // NewMemTable creates a MemTable from a list of MemRegions.
@@ -36,40 +63,47 @@ func NewMemTable(regions []MemRegion) (*MemTable, error) {
 	}
 
 	// Initially, all regions are free and owned by their respective SoCs.
-	freeRegions := make([]MemRegion, len(regions))
-	copy(freeRegions, regions)
+	slots := make([]MemRegion, len(regions))
+	copy(slots, regions)
 
 	return &MemTable{
-		Regions:     []MemRegion{}, // start with no allocations
-		FreeRegions: freeRegions,
-		Allocations: make(map[uint64]MemRegion),
+		Regions:      NewRegionIndex(), // start with no allocations
+		FreeRegions:  NewRegionIndex(regions...),
+		Allocations:  make(map[uint64]MemRegion),
+		Slots:        slots,
+		reservations: NewRegionIndex(),
+		loans:        make(map[uint64]Loan),
+		loanRanges:   NewRegionIndex(),
+		handles:      make(map[Handle]uint64),
+		handleAddrs:  make(map[uint64]Handle),
+		leases:       make(map[uint64]Lease),
+		labels:       make(map[uint64]Label),
+		segments:     make(map[uint64]*NamedSegment),
+		segmentNames: make(map[string]uint64),
+		cow:          make(map[uint64]*cowImage),
+		buddies:      make(map[string]*buddyAllocator),
+		Pages:        NewPageTable(),
+		frames:       make(map[Frame]uint64),
 	}, nil
 }
 
-// sortRegions sorts both allocated and free regions by StartAddr ascending
-func (mt *MemTable) sortRegions() {
-	sort.Slice(mt.Regions, func(i, j int) bool {
-		return mt.Regions[i].StartAddr < mt.Regions[j].StartAddr
-	})
-	sort.Slice(mt.FreeRegions, func(i, j int) bool {
-		return mt.FreeRegions[i].StartAddr < mt.FreeRegions[j].StartAddr
-	})
-}
-
 // MergeFreeRegions merges contiguous free regions with the same Owner.
 // Do not call without locking the mu lock, there is no safeguards.
 func (mt *MemTable) MergeFreeRegions() {
-	if len(mt.FreeRegions) < 2 {
+	if mt.FreeRegions.Len() < 2 {
 		return
 	}
 
-	mt.sortRegions()
-
 	merged := []MemRegion{}
-	prev := mt.FreeRegions[0]
+	var prev MemRegion
+	first := true
 
-	for i := 1; i < len(mt.FreeRegions); i++ {
-		curr := mt.FreeRegions[i]
+	mt.FreeRegions.Ascend(func(curr MemRegion) bool {
+		if first {
+			prev = curr
+			first = false
+			return true
+		}
 		if prev.Owner == curr.Owner && prev.StartAddr+prev.Length == curr.StartAddr {
 			// Merge contiguous free regions owned by the same SoC
 			prev.Length += curr.Length
@@ -77,43 +111,58 @@ func (mt *MemTable) MergeFreeRegions() {
 			merged = append(merged, prev)
 			prev = curr
 		}
-	}
+		return true
+	})
 	merged = append(merged, prev)
 
-	mt.FreeRegions = merged
+	mt.FreeRegions = NewRegionIndex(merged...)
 }
 
-// AllocRegion finds a free region with at least 'size' bytes and allocates it to 'owner'.
-// Returns the allocated MemRegion or error if no suitable free region.
-func (mt *MemTable) AllocRegion(size uint64, owner string) (MemRegion, error) {
-	mt.Mu.Lock()
-	defer mt.Mu.Unlock()
-
-	for i, free := range mt.FreeRegions {
-		if free.Owner == owner && free.Length >= size {
-			allocRegion := MemRegion{
-				StartAddr: free.StartAddr,
-				Length:    size,
-				Owner:     owner,
-			}
-			mt.Allocations[allocRegion.StartAddr] = allocRegion
-			mt.Regions = append(mt.Regions, allocRegion)
-
-			if free.Length == size {
-				// Exact fit: remove free region
-				mt.FreeRegions = append(mt.FreeRegions[:i], mt.FreeRegions[i+1:]...)
-			} else {
-				// Shrink free region
-				mt.FreeRegions[i].StartAddr += size
-				mt.FreeRegions[i].Length -= size
-			}
-
-			mt.sortRegions()
-			return allocRegion, nil
+// insertFree adds a free region and merges it with contiguous free neighbours
+// of the same owner. Unlike MergeFreeRegions this only touches the neighbours.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) insertFree(r MemRegion) {
+	if r.Length == 0 {
+		return
+	}
+	if r.StartAddr > 0 {
+		if prev, ok := mt.FreeRegions.Floor(r.StartAddr - 1); ok &&
+			prev.Owner == r.Owner && prev.StartAddr+prev.Length == r.StartAddr {
+			mt.FreeRegions.Delete(prev.StartAddr)
+			r.StartAddr = prev.StartAddr
+			r.Length += prev.Length
 		}
 	}
+	if next, ok := mt.FreeRegions.Get(r.StartAddr + r.Length); ok && next.Owner == r.Owner {
+		mt.FreeRegions.Delete(next.StartAddr)
+		r.Length += next.Length
+	}
+	mt.FreeRegions.Insert(r)
+}
+
+// insertAlloc records an allocated region.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) insertAlloc(r MemRegion) {
+	mt.Allocations[r.StartAddr] = r
+	mt.Regions.Insert(r)
+}
+
+// removeAlloc drops an allocated region from the map and the index.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) removeAlloc(startAddr uint64) {
+	delete(mt.Allocations, startAddr)
+	mt.Regions.Delete(startAddr)
+}
 
-	return MemRegion{}, errors.New("no free region large enough to allocate for owner " + owner)
+// AllocRegion finds a free region with at least 'size' bytes and allocates it to 'owner'.
+// Returns the allocated MemRegion or error if no suitable free region.
+func (mt *MemTable) AllocRegion(size uint64, owner string) (MemRegion, error) {
+	return mt.Alloc(AllocRequest{
+		Size:      size,
+		Owner:     owner,
+		OwnerOnly: true,
+		Fit:       FirstFit,
+	})
 }
 
 // FreeRegion frees a previously allocated region starting at 'startAddr'.
@@ -126,24 +175,48 @@ func (mt *MemTable) FreeRegion(startAddr uint64) error {
 		return fmt.Errorf("no allocated region at address 0x%x", startAddr)
 	}
 
-	// Remove from allocated map and from regions slice
-	delete(mt.Allocations, startAddr)
-	for i, r := range mt.Regions {
-		if r.StartAddr == startAddr {
-			mt.Regions = append(mt.Regions[:i], mt.Regions[i+1:]...)
-			break
-		}
-	}
+	// Remove from allocated map and from regions index
+	mt.removeAlloc(startAddr)
+	mt.forget(alloc)
 
 	// Add freed region back to freeRegions with original owner
-	mt.FreeRegions = append(mt.FreeRegions, MemRegion{
+	mt.release(MemRegion{
 		StartAddr: alloc.StartAddr,
 		Length:    alloc.Length,
 		Owner:     alloc.Owner,
 	})
 
-	mt.MergeFreeRegions()
+	return nil
+}
 
+// TransferRange hands the first `size` bytes of the allocation at addr over to
+// newOwner as free memory. What is left of the allocation past the range stays
+// allocated to its owner and keeps its handle, lease, label and segment; if
+// nothing is left, these are dropped as on FreeRegion.
+// Do not call without holding the OwnershipLock.
+func (mt *MemTable) TransferRange(addr uint64, size uint64, newOwner string) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	alloc, ok := mt.Allocations[addr]
+	if !ok {
+		return fmt.Errorf("no allocated region at address 0x%x to update ownership", addr)
+	}
+	if alloc.Length < size {
+		return fmt.Errorf("allocated region too small for requested ownership update")
+	}
+
+	transferred := MemRegion{StartAddr: addr, Length: size, Owner: newOwner}
+	if alloc.Length > size {
+		// Shrink the entry to the rest, then move it and its bookkeeping behind the range
+		mt.insertAlloc(MemRegion{StartAddr: addr, Length: alloc.Length - size, Owner: alloc.Owner})
+		mt.relocate(addr, addr+size)
+		mt.unplaceRange(transferred)
+	} else {
+		mt.removeAlloc(addr)
+		mt.forget(alloc)
+	}
+	mt.insertFree(transferred)
 	return nil
 }
 
@@ -153,25 +226,57 @@ func (mt *MemTable) FindSoCWithFreeMemory(size uint64) (string, error) {
 	mt.Mu.RLock()
 	defer mt.Mu.RUnlock()
 
-	for _, free := range mt.FreeRegions {
+	owner := ""
+	mt.FreeRegions.Ascend(func(free MemRegion) bool {
 		if free.Length >= size {
-			return free.Owner, nil
+			owner = free.Owner
+			return false
 		}
+		return true
+	})
+	if owner == "" {
+		return "", errors.New("no SoC with enough free memory")
 	}
+	return owner, nil
+}
 
-	return "", errors.New("no SoC with enough free memory")
+// TotalFreeBytes returns the number of free bytes across all SoCs.
+func (mt *MemTable) TotalFreeBytes() uint64 {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	return sumLengths(mt.FreeRegions)
+}
+
+// Capacity returns the size of the whole address space the table manages.
+func (mt *MemTable) Capacity() uint64 {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	total := sumLengths(mt.FreeRegions) + sumLengths(mt.Regions)
+	total += sumLengths(mt.reservations) - mt.committedBytes()
+	for _, r := range mt.buddyFreeRanges() {
+		total += r.Length
+	}
+	return total
+}
+
+func sumLengths(idx *RegionIndex) uint64 {
+	var total uint64
+	idx.Ascend(func(r MemRegion) bool {
+		total += r.Length
+		return true
+	})
+	return total
 }
 
 // FindRegion returns the MemRegion that contains the given address, or nil if none.
 func (mt *MemTable) FindRegion(addr uint64) *MemRegion {
 	mt.Mu.RLock()
 	defer mt.Mu.RUnlock()
-	for _, region := range mt.Regions {
-		if addr >= region.StartAddr && addr < region.StartAddr+region.Length {
-			return &region
-		}
+	region, ok := mt.Regions.Find(addr)
+	if !ok {
+		return nil
 	}
-	return nil
+	return &region
 }
 
 // AddRegion adds a new free memory region owned by 'owner'.
@@ -181,27 +286,18 @@ func (mt *MemTable) AddRegion(newRegion MemRegion) error {
 	defer mt.Mu.Unlock()
 
 	// Check overlap with allocated regions
-	for _, alloc := range mt.Regions {
-		if !(newRegion.StartAddr+newRegion.Length <= alloc.StartAddr ||
-			newRegion.StartAddr >= alloc.StartAddr+alloc.Length) {
-			return fmt.Errorf("new region overlaps allocated region at 0x%x", alloc.StartAddr)
-		}
+	if alloc, ok := mt.Regions.Overlapping(newRegion.StartAddr, newRegion.Length); ok {
+		return fmt.Errorf("new region overlaps allocated region at 0x%x", alloc.StartAddr)
 	}
 
 	// Check overlap with free regions
-	for _, free := range mt.FreeRegions {
-		if !(newRegion.StartAddr+newRegion.Length <= free.StartAddr ||
-			newRegion.StartAddr >= free.StartAddr+free.Length) {
-			return fmt.Errorf("new region overlaps free region at 0x%x", free.StartAddr)
-		}
+	if free, ok := mt.FreeRegions.Overlapping(newRegion.StartAddr, newRegion.Length); ok {
+		return fmt.Errorf("new region overlaps free region at 0x%x", free.StartAddr)
 	}
 
-	// Add new region as free region
-	mt.FreeRegions = append(mt.FreeRegions, newRegion)
-
-	// Sort and merge free regions to keep data consistent
-	mt.sortRegions()
-	mt.MergeFreeRegions()
+	// Add new region as free region, merging with its neighbours
+	mt.insertFree(newRegion)
+	mt.added = append(mt.added, newRegion)
 
 	return nil
 }
@@ -211,17 +307,25 @@ func (mt *MemTable) AddRegion(newRegion MemRegion) error {
 func (mt *MemTable) GetFreeRegionsForTesting() []MemRegion {
 	mt.Mu.RLock()
 	defer mt.Mu.RUnlock()
-	cpy := make([]MemRegion, len(mt.FreeRegions))
-	copy(cpy, mt.FreeRegions)
-	return cpy
+	return mt.FreeRegions.Slice()
 }
 
 // TranslateAddr returns the owner SoC and offset within that SoC's memory for a global address.
+// The address is resolved through the page table, so the SoC is wherever the
+// page is placed, which need not be the SoC whose slot the address is in.
+//
+// Offsets are relative to the start of the SoC's slot, not to the start of the
+// allocation. Two blocks in one slot therefore never share local memory, which
+// is what lets the compactor slide a block down with a plain local copy. Only
+// ranges outside every slot (added through AddRegion) are region-relative.
 func (mt *MemTable) TranslateAddr(addr uint64) (owner string, offset uint64, err error) {
-	region := mt.FindRegion(addr)
-	if region == nil {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	region, ok := mt.Regions.Find(addr)
+	if !ok {
 		return "", 0, fmt.Errorf("address 0x%x not in any allocated memory region", addr)
 	}
-	offset = addr - region.StartAddr
-	return region.Owner, offset, nil
+	owner, offset = mt.physAddr(addr, region)
+	return owner, offset, nil
 }
@@ -0,0 +1,152 @@
+package sharedmem
+
+import (
+	"fmt"
+)
+
+// PagePlacement is the frame a virtual page was placed on.
+type PagePlacement struct {
+	VAddr uint64
+	Frame Frame
+}
+
+// MirrorRegion records an allocation made in another SoC's table, with the
+// placements of its pages, so this table can reach it. The range must be
+// free memory of its owner here, as for MirrorSegment. An allocation this
+// table already holds is left alone. Returns whether the region was recorded.
+func (mt *MemTable) MirrorRegion(region MemRegion, creator string, placements []PagePlacement) (bool, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	if cur, ok := mt.Allocations[region.StartAddr]; ok && cur == region {
+		return false, nil
+	}
+	carved, err := mt.carve(AllocRequest{
+		Size:      region.Length,
+		MinAddr:   region.StartAddr,
+		MaxAddr:   region.StartAddr + region.Length,
+		Owner:     region.Owner,
+		OwnerOnly: true,
+	})
+	if err != nil {
+		return false, fmt.Errorf("region 0x%x of %s is not free memory of %s here: %w", region.StartAddr, creator, region.Owner, err)
+	}
+	mt.insertAlloc(carved)
+	mt.setLabel(carved.StartAddr, Label{Creator: creator, Tags: []string{"mirror"}})
+	if err := mt.mirrorPlacements(placements); err != nil {
+		mt.removeAlloc(carved.StartAddr)
+		mt.forget(carved)
+		mt.release(carved)
+		return false, err
+	}
+	return true, nil
+}
+
+// MirrorPlacements places pages of region the way another SoC's table placed
+// them, reserving their frames here. Nothing changes if this table does not
+// hold region.
+func (mt *MemTable) MirrorPlacements(region MemRegion, placements []PagePlacement) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	if cur, ok := mt.Allocations[region.StartAddr]; !ok || cur != region {
+		return nil
+	}
+	return mt.mirrorPlacements(placements)
+}
+
+// mirrorPlacements is MirrorPlacements without the locking.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) mirrorPlacements(placements []PagePlacement) error {
+	for _, p := range placements {
+		if cur, ok := mt.Pages.Lookup(p.VAddr); ok && cur == p.Frame {
+			continue
+		}
+		home, ok := mt.homeFrame(p.VAddr &^ pageOffsMask)
+		atHome := ok && home == p.Frame
+		if !atHome {
+			if err := mt.reserveFrame(p.Frame); err != nil {
+				return fmt.Errorf("page 0x%x: %w", p.VAddr, err)
+			}
+		}
+		if err := mt.placePage(p.VAddr, p.Frame); err != nil {
+			if !atHome {
+				mt.releaseFrame(p.Frame)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Placements returns the explicit placements of the pages of region.
+func (mt *MemTable) Placements(region MemRegion) []PagePlacement {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	var out []PagePlacement
+	if mt.Pages.Len() == 0 || region.Length == 0 {
+		return out
+	}
+	for page := region.StartAddr &^ pageOffsMask; page < region.StartAddr+region.Length; page += PageSize {
+		if frame, ok := mt.Pages.Lookup(page); ok {
+			out = append(out, PagePlacement{VAddr: page, Frame: frame})
+		}
+	}
+	return out
+}
+
+// AllocationsIn returns the allocations overlapping [addr, addr+length) in
+// address order.
+func (mt *MemTable) AllocationsIn(addr uint64, length uint64) []MemRegion {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	return overlappingIn(mt.Regions, addr, length)
+}
+
+// ReserveFrame records frame, handed out by another SoC's table, as taken
+// here, so this table neither hands it out nor refuses physical access to
+// it. Reserving a frame that backs no page yet again is a no-op. Give it
+// back with ReleaseFrame if it is not placed.
+func (mt *MemTable) ReserveFrame(frame Frame) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+	return mt.reserveFrame(frame)
+}
+
+// reserveFrame is ReserveFrame without the locking.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) reserveFrame(frame Frame) error {
+	if _, ok := mt.frames[frame]; ok {
+		if mt.frameMapped(frame) {
+			return fmt.Errorf("frame %s/%d backs another page here", frame.SoC, frame.Number)
+		}
+		return nil
+	}
+
+	var slot MemRegion
+	found := false
+	for _, s := range mt.Slots {
+		if s.Owner == frame.SoC {
+			slot, found = s, true
+			break
+		}
+	}
+	if !found || frame.Offset() >= slot.Length {
+		return fmt.Errorf("frame %s/%d is outside the memory of %s", frame.SoC, frame.Number, frame.SoC)
+	}
+	home := slot.StartAddr + frame.Offset()
+
+	// The home frame of a page placed elsewhere backs nothing
+	if _, placed := mt.Pages.Lookup(home); placed {
+		mt.frames[frame] = home
+		return nil
+	}
+	region, err := mt.carve(AllocRequest{Size: PageSize, MinAddr: home, MaxAddr: home + PageSize, Owner: frame.SoC, OwnerOnly: true})
+	if err != nil {
+		return fmt.Errorf("frame %s/%d is not free here: %w", frame.SoC, frame.Number, err)
+	}
+	mt.insertAlloc(region)
+	mt.frames[frame] = region.StartAddr
+	return nil
+}
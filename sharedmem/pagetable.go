@@ -0,0 +1,545 @@
+package sharedmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Page table geometry: four levels of 9 bits above the 12-bit page offset,
+// covering a 48-bit virtual address space like x86-64.
+const (
+	ptLevels     = 4
+	ptBitsLevel  = 9
+	ptEntries    = 1 << ptBitsLevel
+	pageShift    = 12
+	MaxVirtAddr  = uint64(1) << (pageShift + ptLevels*ptBitsLevel)
+	ptLevelMask  = ptEntries - 1
+	pageOffsMask = PageSize - 1
+)
+
+// Frame is a physical page: the SoC holding it and the page number inside
+// that SoC's local memory.
+type Frame struct {
+	SoC    string
+	Number uint64
+}
+
+// Offset returns the byte offset of the frame in its SoC's local memory.
+func (f Frame) Offset() uint64 {
+	return f.Number * PageSize
+}
+
+// PageTable maps virtual pages to frames with a multi-level radix tree.
+// Only pages placed explicitly have entries; the rest of the address space
+// keeps its default placement in the slot it belongs to.
+// PageTable is not safe for concurrent use; MemTable guards it with its locks.
+type PageTable struct {
+	tree radix[Frame]
+}
+
+func NewPageTable() *PageTable {
+	return &PageTable{tree: newRadix[Frame]()}
+}
+
+// Len returns the number of mapped pages.
+func (pt *PageTable) Len() int {
+	return pt.tree.count
+}
+
+// Map points the page containing vaddr at frame, replacing any existing entry.
+func (pt *PageTable) Map(vaddr uint64, frame Frame) error {
+	return pt.tree.set(vaddr, frame)
+}
+
+// Lookup returns the frame the page containing vaddr is mapped to.
+func (pt *PageTable) Lookup(vaddr uint64) (Frame, bool) {
+	return pt.tree.get(vaddr)
+}
+
+// Unmap removes the entry for the page containing vaddr and frees empty
+// table levels. Returns the frame it was mapped to.
+func (pt *PageTable) Unmap(vaddr uint64) (Frame, bool) {
+	return pt.tree.remove(vaddr)
+}
+
+// Walk calls fn for every mapped page in virtual address order until fn returns false.
+func (pt *PageTable) Walk(fn func(vaddr uint64, frame Frame) bool) {
+	pt.tree.walk(fn)
+}
+
+// radix is the tree behind page tables: one entry of type V per virtual page.
+type radix[V any] struct {
+	root  *radixNode[V]
+	count int
+}
+
+// radixNode is one level of the tree. Interior nodes use next, the last level
+// holds the entries.
+type radixNode[V any] struct {
+	next    [ptEntries]*radixNode[V]
+	entries *[ptEntries]radixEntry[V]
+	used    int
+}
+
+type radixEntry[V any] struct {
+	val     V
+	present bool
+}
+
+func newRadix[V any]() radix[V] {
+	return radix[V]{root: &radixNode[V]{}}
+}
+
+func ptIndex(vaddr uint64, level int) int {
+	shift := pageShift + (ptLevels-1-level)*ptBitsLevel
+	return int((vaddr >> shift) & ptLevelMask)
+}
+
+func (t *radix[V]) set(vaddr uint64, val V) error {
+	if vaddr >= MaxVirtAddr {
+		return fmt.Errorf("virtual address 0x%x outside the %d-bit address space", vaddr, pageShift+ptLevels*ptBitsLevel)
+	}
+
+	n := t.root
+	for level := 0; level < ptLevels-1; level++ {
+		i := ptIndex(vaddr, level)
+		if n.next[i] == nil {
+			n.next[i] = &radixNode[V]{}
+			n.used++
+		}
+		n = n.next[i]
+	}
+	if n.entries == nil {
+		n.entries = &[ptEntries]radixEntry[V]{}
+	}
+
+	e := &n.entries[ptIndex(vaddr, ptLevels-1)]
+	if !e.present {
+		n.used++
+		t.count++
+	}
+	*e = radixEntry[V]{val: val, present: true}
+	return nil
+}
+
+func (t *radix[V]) get(vaddr uint64) (V, bool) {
+	var zero V
+	if vaddr >= MaxVirtAddr || t.count == 0 {
+		return zero, false
+	}
+
+	n := t.root
+	for level := 0; level < ptLevels-1; level++ {
+		n = n.next[ptIndex(vaddr, level)]
+		if n == nil {
+			return zero, false
+		}
+	}
+	if n.entries == nil {
+		return zero, false
+	}
+	e := n.entries[ptIndex(vaddr, ptLevels-1)]
+	return e.val, e.present
+}
+
+func (t *radix[V]) remove(vaddr uint64) (V, bool) {
+	var zero V
+	if vaddr >= MaxVirtAddr {
+		return zero, false
+	}
+
+	var path [ptLevels]*radixNode[V]
+	n := t.root
+	for level := 0; level < ptLevels-1; level++ {
+		path[level] = n
+		n = n.next[ptIndex(vaddr, level)]
+		if n == nil {
+			return zero, false
+		}
+	}
+	path[ptLevels-1] = n
+	if n.entries == nil {
+		return zero, false
+	}
+
+	e := &n.entries[ptIndex(vaddr, ptLevels-1)]
+	if !e.present {
+		return zero, false
+	}
+	val := e.val
+	*e = radixEntry[V]{}
+	n.used--
+	t.count--
+
+	// Prune levels that became empty
+	for level := ptLevels - 1; level > 0 && path[level].used == 0; level-- {
+		parent := path[level-1]
+		parent.next[ptIndex(vaddr, level-1)] = nil
+		parent.used--
+	}
+	return val, true
+}
+
+func (t *radix[V]) walk(fn func(uint64, V) bool) {
+	walkNode(t.root, 0, 0, fn)
+}
+
+func walkNode[V any](n *radixNode[V], level int, base uint64, fn func(uint64, V) bool) bool {
+	shift := pageShift + (ptLevels-1-level)*ptBitsLevel
+	if level == ptLevels-1 {
+		if n.entries == nil {
+			return true
+		}
+		for i, e := range n.entries {
+			if e.present && !fn(base|uint64(i)<<shift, e.val) {
+				return false
+			}
+		}
+		return true
+	}
+	for i, child := range n.next {
+		if child != nil && !walkNode(child, level+1, base|uint64(i)<<shift, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// Segment is a piece of a virtual range that is physically contiguous.
+type Segment struct {
+	VAddr  uint64 // virtual start of the piece
+	Length uint64
+	SoC    string // SoC holding the memory
+	Offset uint64 // offset in that SoC's local memory
+}
+
+// homeFrame returns the default placement of vaddr: the frame at the same
+// position inside the slot that contains it.
+// Do not call without holding the mu lock.
+func (mt *MemTable) homeFrame(vaddr uint64) (Frame, bool) {
+	for _, slot := range mt.Slots {
+		if vaddr >= slot.StartAddr && vaddr < slot.StartAddr+slot.Length {
+			return Frame{SoC: slot.Owner, Number: (vaddr - slot.StartAddr) / PageSize}, true
+		}
+	}
+	return Frame{}, false
+}
+
+// physAddr resolves an allocated virtual address to the SoC and offset holding
+// it: the page table entry if the page was placed explicitly, otherwise the
+// home frame. Ranges outside every slot (added through AddRegion) stay
+// relative to their region.
+// Do not call without holding the mu lock.
+func (mt *MemTable) physAddr(vaddr uint64, region MemRegion) (string, uint64) {
+	if frame, ok := mt.Pages.Lookup(vaddr); ok {
+		return frame.SoC, frame.Offset() + vaddr&pageOffsMask
+	}
+	if frame, ok := mt.homeFrame(vaddr); ok {
+		return frame.SoC, frame.Offset() + vaddr&pageOffsMask
+	}
+	return region.Owner, vaddr - region.StartAddr
+}
+
+// TranslateRange splits [addr, addr+size) into physically contiguous segments.
+// The whole range must be allocated.
+func (mt *MemTable) TranslateRange(addr uint64, size uint64) ([]Segment, error) {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	var segs []Segment
+	end := addr + size
+	for cur := addr; cur < end || (size == 0 && cur == addr); {
+		region, ok := mt.Regions.Find(cur)
+		if !ok {
+			return nil, fmt.Errorf("address 0x%x not in any allocated memory region", cur)
+		}
+		if size == 0 {
+			soc, off := mt.physAddr(cur, region)
+			return []Segment{{VAddr: cur, SoC: soc, Offset: off}}, nil
+		}
+
+		// Walk page by page up to the end of this region or of the range
+		stop := min(end, region.StartAddr+region.Length)
+		for cur < stop {
+			n := min(stop-cur, PageSize-cur&pageOffsMask)
+			soc, off := mt.physAddr(cur, region)
+
+			last := len(segs) - 1
+			if last >= 0 && segs[last].SoC == soc &&
+				segs[last].VAddr+segs[last].Length == cur && segs[last].Offset+segs[last].Length == off {
+				segs[last].Length += n
+			} else {
+				segs = append(segs, Segment{VAddr: cur, Length: n, SoC: soc, Offset: off})
+			}
+			cur += n
+		}
+	}
+	return segs, nil
+}
+
+// AllocFrame reserves a free physical page on soc for explicit placement.
+// Home frames of pages that were moved off soc are handed out first; other
+// frames are taken out of the SoC's slot so nothing else can land on them.
+func (mt *MemTable) AllocFrame(soc string) (Frame, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+	return mt.allocFrame(soc)
+}
+
+// FrameFor reserves a frame on soc for the page containing vaddr: the page's
+// own home frame if it lies on soc and backs nothing else, otherwise a frame
+// from AllocFrame. Release it with ReleaseFrame if it is not placed.
+func (mt *MemTable) FrameFor(vaddr uint64, soc string) (Frame, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	page := vaddr &^ pageOffsMask
+	if home, ok := mt.homeFrame(page); ok && home.SoC == soc {
+		if _, placed := mt.Pages.Lookup(page); placed {
+			if _, lent := mt.frames[home]; !lent {
+				mt.frames[home] = page
+				return home, nil
+			}
+		}
+	}
+	return mt.allocFrame(soc)
+}
+
+// allocFrame is AllocFrame without the locking.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) allocFrame(soc string) (Frame, error) {
+	if frame, page, ok := mt.vacantFrame(soc); ok {
+		mt.frames[frame] = page
+		return frame, nil
+	}
+
+	// A free page that is still placed elsewhere has its home frame lent out
+	var skipped []MemRegion
+	defer func() {
+		for _, r := range skipped {
+			mt.insertFree(r)
+		}
+	}()
+	for {
+		region, err := mt.carve(AllocRequest{Size: PageSize, Align: PageSize, Owner: soc, OwnerOnly: true})
+		if err != nil {
+			return Frame{}, fmt.Errorf("no free frame on %s: %w", soc, err)
+		}
+		if _, placed := mt.Pages.Lookup(region.StartAddr); placed {
+			skipped = append(skipped, region)
+			continue
+		}
+		frame, ok := mt.homeFrame(region.StartAddr)
+		if !ok || frame.SoC != soc {
+			skipped = append(skipped, region)
+			return Frame{}, fmt.Errorf("free memory of %s at 0x%x is outside its slot", soc, region.StartAddr)
+		}
+
+		mt.insertAlloc(region)
+		mt.frames[frame] = region.StartAddr
+		return frame, nil
+	}
+}
+
+// vacantFrame finds a home frame on soc whose page was placed on another
+// frame, so the home frame backs nothing. Returns it with its page.
+// Do not call without holding the mu lock.
+func (mt *MemTable) vacantFrame(soc string) (Frame, uint64, bool) {
+	var vacant Frame
+	var page uint64
+	found := false
+	mt.Pages.Walk(func(vaddr uint64, _ Frame) bool {
+		home, ok := mt.homeFrame(vaddr)
+		if !ok || home.SoC != soc {
+			return true
+		}
+		if _, lent := mt.frames[home]; lent {
+			return true
+		}
+		vacant, page, found = home, vaddr, true
+		return false
+	})
+	return vacant, page, found
+}
+
+// homeLent reports whether page lives on another frame while its home frame
+// was handed out by AllocFrame to back a different page.
+// Do not call without holding the mu lock.
+func (mt *MemTable) homeLent(page uint64) bool {
+	if _, placed := mt.Pages.Lookup(page); !placed {
+		return false
+	}
+	home, ok := mt.homeFrame(page)
+	if !ok {
+		return false
+	}
+	addr, lent := mt.frames[home]
+	return lent && addr == page
+}
+
+// frameMapped reports whether a page is placed on frame.
+// Do not call without holding the mu lock.
+func (mt *MemTable) frameMapped(frame Frame) bool {
+	mapped := false
+	mt.Pages.Walk(func(_ uint64, f Frame) bool {
+		mapped = f == frame
+		return !mapped
+	})
+	return mapped
+}
+
+// PlacePage maps the virtual page containing vaddr to frame. The frame must
+// come from AllocFrame, or be the page's own home frame while that backs no
+// other page. The frame previously backing the page is released; a home
+// frame becomes free for AllocFrame. Moving the data is up to the caller.
+func (mt *MemTable) PlacePage(vaddr uint64, frame Frame) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+	return mt.placePage(vaddr, frame)
+}
+
+// placePage is PlacePage without the locking.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) placePage(vaddr uint64, frame Frame) error {
+	page := vaddr &^ pageOffsMask
+	if _, ok := mt.Regions.Overlapping(page, PageSize); !ok {
+		return fmt.Errorf("page 0x%x is not allocated", page)
+	}
+
+	home, hasHome := mt.homeFrame(page)
+	atHome := hasHome && frame == home
+	if atHome {
+		if mt.frameMapped(home) {
+			return fmt.Errorf("home frame %s/%d of page 0x%x backs another page", home.SoC, home.Number, page)
+		}
+		delete(mt.frames, home)
+	} else if _, ok := mt.frames[frame]; !ok {
+		return fmt.Errorf("frame %s/%d was not allocated with AllocFrame", frame.SoC, frame.Number)
+	}
+
+	if old, ok := mt.Pages.Lookup(page); ok && old != frame {
+		mt.releaseFrame(old)
+	}
+	if atHome {
+		mt.Pages.Unmap(page)
+		return nil
+	}
+	return mt.Pages.Map(page, frame)
+}
+
+// Placement returns where the page containing vaddr currently lives.
+func (mt *MemTable) Placement(vaddr uint64) (Frame, error) {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	if frame, ok := mt.Pages.Lookup(vaddr); ok {
+		return frame, nil
+	}
+	if frame, ok := mt.homeFrame(vaddr); ok {
+		return frame, nil
+	}
+	return Frame{}, errors.New("address outside every SoC slot")
+}
+
+// PhysBacked checks that every page of [offset, offset+length) in the local
+// memory of soc backs allocated memory: it is a frame handed out by
+// AllocFrame, or the home frame of an allocated page of the SoC's slot that
+// was not moved elsewhere.
+func (mt *MemTable) PhysBacked(soc string, offset uint64, length uint64) error {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	var slot MemRegion
+	found := false
+	for _, s := range mt.Slots {
+		if s.Owner == soc {
+			slot, found = s, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("SoC %s has no slot", soc)
+	}
+
+	end := offset + length
+	if end < offset || end > slot.Length {
+		return fmt.Errorf("range 0x%x+%d is outside the memory of %s", offset, length, soc)
+	}
+	for page := offset &^ pageOffsMask; page < end; page += PageSize {
+		if _, ok := mt.frames[Frame{SoC: soc, Number: page / PageSize}]; ok {
+			continue
+		}
+		_, moved := mt.Pages.Lookup(slot.StartAddr + page)
+		if _, ok := mt.Regions.Overlapping(slot.StartAddr+page, PageSize); ok && !moved {
+			continue
+		}
+		return fmt.Errorf("offset 0x%x of %s does not back allocated memory", page, soc)
+	}
+	return nil
+}
+
+// ReleaseFrame gives back a frame from AllocFrame that was never placed.
+func (mt *MemTable) ReleaseFrame(frame Frame) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+	mt.releaseFrame(frame)
+}
+
+// releaseFrame gives a frame from AllocFrame back to its slot. A lent home
+// frame becomes vacant again, or backs its own page once more if that page
+// was freed while it was lent.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) releaseFrame(frame Frame) {
+	addr, ok := mt.frames[frame]
+	if !ok {
+		return
+	}
+	lent := mt.homeLent(addr)
+	delete(mt.frames, frame)
+	if lent {
+		if _, ok := mt.Regions.Overlapping(addr, PageSize); !ok {
+			if moved, ok := mt.Pages.Unmap(addr); ok {
+				mt.releaseFrame(moved)
+			}
+		}
+		return
+	}
+	if region, ok := mt.Allocations[addr]; ok {
+		mt.removeAlloc(addr)
+		mt.insertFree(region)
+	}
+}
+
+// unplaceRange drops explicit placements of pages in region that no other
+// allocation still covers, releasing their frames. A page whose home frame
+// is lent keeps its placement until the home frame is released.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) unplaceRange(region MemRegion) {
+	if mt.Pages.Len() == 0 || region.Length == 0 {
+		return
+	}
+	first := region.StartAddr &^ pageOffsMask
+	for page := first; page < region.StartAddr+region.Length; page += PageSize {
+		if _, ok := mt.Regions.Overlapping(page, PageSize); ok || mt.homeLent(page) {
+			continue
+		}
+		if frame, ok := mt.Pages.Unmap(page); ok {
+			mt.releaseFrame(frame)
+		}
+	}
+}
+
+// placedIn reports whether any page of region has an explicit placement.
+// Do not call without holding the mu lock.
+func (mt *MemTable) placedIn(region MemRegion) bool {
+	if mt.Pages.Len() == 0 || region.Length == 0 {
+		return false
+	}
+	first := region.StartAddr &^ pageOffsMask
+	for page := first; page < region.StartAddr+region.Length; page += PageSize {
+		if _, ok := mt.Pages.Lookup(page); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package sharedmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CopyFunc copies the first `length` bytes of src into dst. It is called by
+// Realloc when a block has to move; dst may belong to another SoC.
+type CopyFunc func(src MemRegion, dst MemRegion, length uint64) error
+
+// Realloc resizes the allocation at addr to newSize bytes and returns the
+// resulting region. Shrinking and growing into an adjacent free region of the
+// same owner happen in place. Otherwise a new block is allocated, preferably
+// on the same owner, the contents are copied with copyFn, and the old block
+// is freed. Handles, leases and labels follow the block.
+func (mt *MemTable) Realloc(addr uint64, newSize uint64, copyFn CopyFunc) (MemRegion, error) {
+	if newSize == 0 {
+		return MemRegion{}, errors.New("cannot resize to zero bytes, free the region instead")
+	}
+
+	// Keep the compactor and handle users out while the block may move
+	mt.moveLock.Lock()
+	defer mt.moveLock.Unlock()
+
+	old, moved, err := mt.resizeInPlace(addr, newSize)
+	if err != nil || !moved {
+		return old, err
+	}
+
+	mt.Mu.Lock()
+	region, err := mt.carve(AllocRequest{Size: newSize, Owner: old.Owner})
+	if err == nil {
+		mt.insertAlloc(region)
+	}
+	mt.Mu.Unlock()
+	if err != nil {
+		return MemRegion{}, fmt.Errorf("realloc of 0x%x failed: %w", addr, err)
+	}
+
+	// The copy may go through RPC, so it runs without the table lock
+	if err := copyFn(old, region, old.Length); err != nil {
+		mt.Mu.Lock()
+		mt.removeAlloc(region.StartAddr)
+		mt.insertFree(region)
+		mt.Mu.Unlock()
+		return MemRegion{}, fmt.Errorf("realloc copy from 0x%x failed: %w", addr, err)
+	}
+
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	mt.removeAlloc(region.StartAddr)
+	if cur, ok := mt.Allocations[old.StartAddr]; !ok || cur != old {
+		// Freed or resized by raw address while we were copying, the copy is stale
+		mt.insertFree(region)
+		return MemRegion{}, fmt.Errorf("region 0x%x changed during realloc", addr)
+	}
+	mt.relocate(old.StartAddr, region.StartAddr)
+	mt.insertAlloc(region)
+	mt.unplaceRange(old)
+	mt.release(old)
+	return region, nil
+}
+
+// resizeInPlace shrinks or grows the allocation at addr without moving it if
+// it can. Returns the current region, and whether the block has to move.
+func (mt *MemTable) resizeInPlace(addr uint64, newSize uint64) (MemRegion, bool, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	old, ok := mt.Allocations[addr]
+	if !ok {
+		return MemRegion{}, false, fmt.Errorf("no allocated region at address 0x%x", addr)
+	}
+	if mt.inBuddyArena(addr) {
+		return MemRegion{}, false, fmt.Errorf("region at 0x%x belongs to a buddy arena and cannot be resized", addr)
+	}
+	mt.cowLock.Lock()
+	_, shared := mt.cow[addr]
+	mt.cowLock.Unlock()
+	if shared {
+		return MemRegion{}, false, fmt.Errorf("region at 0x%x is a copy-on-write image and cannot be resized", addr)
+	}
+
+	switch {
+	case newSize == old.Length:
+		return old, false, nil
+
+	case newSize < old.Length:
+		tail := MemRegion{StartAddr: addr + newSize, Length: old.Length - newSize, Owner: old.Owner}
+		old.Length = newSize
+		mt.insertAlloc(old)
+		mt.unplaceRange(tail)
+		mt.release(tail)
+		return old, false, nil
+	}
+
+	// Grow into the free region right behind the block
+	need := newSize - old.Length
+	if next, ok := mt.FreeRegions.Get(addr + old.Length); ok && next.Owner == old.Owner && next.Length >= need {
+		mt.FreeRegions.Delete(next.StartAddr)
+		if next.Length > need {
+			mt.FreeRegions.Insert(MemRegion{StartAddr: next.StartAddr + need, Length: next.Length - need, Owner: next.Owner})
+		}
+		old.Length = newSize
+		mt.insertAlloc(old)
+		return old, false, nil
+	}
+	return old, true, nil
+}
+
+// inBuddyArena reports whether addr lies inside a buddy arena.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) inBuddyArena(addr uint64) bool {
+	for _, ba := range mt.buddies {
+		for _, arena := range ba.arenas {
+			if arena.contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
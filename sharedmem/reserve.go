@@ -0,0 +1,195 @@
+package sharedmem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reserve takes a page-aligned range of at least size bytes out of the free
+// list without committing any memory to it, like mmap with PROT_NONE. The
+// range belongs to whichever SoC owned the free region it came from. Pages
+// become usable once committed with Commit.
+func (mt *MemTable) Reserve(size uint64) (MemRegion, error) {
+	return mt.ReserveOn("", size)
+}
+
+// ReserveOn is Reserve restricted to memory owned by owner.
+func (mt *MemTable) ReserveOn(owner string, size uint64) (MemRegion, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	region, err := mt.carve(AllocRequest{
+		Size:      roundUpPage(size),
+		Align:     PageSize,
+		Owner:     owner,
+		OwnerOnly: owner != "",
+	})
+	if err != nil {
+		return MemRegion{}, fmt.Errorf("reservation failed: %w", err)
+	}
+	mt.reservations.Insert(region)
+	return region, nil
+}
+
+// Unreserve gives the reservation starting at addr back to the free list,
+// dropping whatever is still committed inside it.
+func (mt *MemTable) Unreserve(addr uint64) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	res, ok := mt.reservations.Get(addr)
+	if !ok {
+		return fmt.Errorf("no reservation at address 0x%x", addr)
+	}
+	for _, alloc := range mt.committedIn(res, res.StartAddr, res.Length) {
+		mt.removeAlloc(alloc.StartAddr)
+		mt.forget(alloc)
+	}
+	mt.reservations.Delete(addr)
+	mt.insertFree(res)
+	return nil
+}
+
+// Commit makes the pages of [addr, addr+length) usable. The range is widened
+// to whole pages and must lie inside one reservation; pages already committed
+// are left alone. Each uncommitted run becomes an allocation.
+func (mt *MemTable) Commit(addr uint64, length uint64) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	res, start, end, err := mt.reservedRange(addr, length)
+	if err != nil {
+		return err
+	}
+
+	cur := start
+	for _, alloc := range mt.committedIn(res, start, end-start) {
+		if alloc.StartAddr > cur {
+			mt.insertAlloc(MemRegion{StartAddr: cur, Length: alloc.StartAddr - cur, Owner: res.Owner})
+		}
+		cur = max(cur, alloc.StartAddr+alloc.Length)
+	}
+	if cur < end {
+		mt.insertAlloc(MemRegion{StartAddr: cur, Length: end - cur, Owner: res.Owner})
+	}
+	return nil
+}
+
+// Decommit returns the pages of [addr, addr+length) to their reservation.
+// The range is widened to whole pages and must lie inside one reservation.
+// Committed allocations crossing the range edges are split.
+func (mt *MemTable) Decommit(addr uint64, length uint64) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	res, start, end, err := mt.reservedRange(addr, length)
+	if err != nil {
+		return err
+	}
+
+	for _, alloc := range mt.committedIn(res, start, end-start) {
+		allocEnd := alloc.StartAddr + alloc.Length
+		mt.removeAlloc(alloc.StartAddr)
+		if alloc.StartAddr < start {
+			// The head keeps the allocation's key and its bookkeeping
+			mt.insertAlloc(MemRegion{StartAddr: alloc.StartAddr, Length: start - alloc.StartAddr, Owner: alloc.Owner})
+		} else {
+			// Zero length: drop what is keyed by the start address only
+			mt.forget(MemRegion{StartAddr: alloc.StartAddr, Owner: alloc.Owner})
+		}
+		if allocEnd > end {
+			mt.insertAlloc(MemRegion{StartAddr: end, Length: allocEnd - end, Owner: alloc.Owner})
+		}
+		lo, hi := max(alloc.StartAddr, start), min(allocEnd, end)
+		mt.unplaceRange(MemRegion{StartAddr: lo, Length: hi - lo, Owner: alloc.Owner})
+	}
+	return nil
+}
+
+// Reservations returns the reserved ranges in address order.
+func (mt *MemTable) Reservations() []MemRegion {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	return mt.reservations.Slice()
+}
+
+// ReservedBytes returns the number of reserved bytes not committed.
+func (mt *MemTable) ReservedBytes() uint64 {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	return sumLengths(mt.reservations) - mt.committedBytes()
+}
+
+// CommittedBytes returns the number of committed bytes inside reservations.
+func (mt *MemTable) CommittedBytes() uint64 {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	return mt.committedBytes()
+}
+
+// committedBytes is CommittedBytes without locking.
+// Do not call without holding the mu lock.
+func (mt *MemTable) committedBytes() uint64 {
+	var total uint64
+	mt.reservations.Ascend(func(res MemRegion) bool {
+		for _, alloc := range mt.committedIn(res, res.StartAddr, res.Length) {
+			total += alloc.Length
+		}
+		return true
+	})
+	return total
+}
+
+// reservedRange widens [addr, addr+length) to whole pages and returns the
+// reservation containing it.
+// Do not call without holding the mu lock.
+func (mt *MemTable) reservedRange(addr uint64, length uint64) (MemRegion, uint64, uint64, error) {
+	if length == 0 {
+		return MemRegion{}, 0, 0, errors.New("empty range")
+	}
+	start := addr &^ pageOffsMask
+	end := roundUpPage(addr + length)
+
+	res, ok := mt.reservations.Find(start)
+	if !ok {
+		return MemRegion{}, 0, 0, fmt.Errorf("address 0x%x is not reserved", addr)
+	}
+	if end > res.StartAddr+res.Length {
+		return MemRegion{}, 0, 0, fmt.Errorf("range 0x%x+%d runs past the reservation at 0x%x", addr, length, res.StartAddr)
+	}
+	return res, start, end, nil
+}
+
+// committedIn returns the allocations of reservation res overlapping
+// [start, start+length), in address order.
+// Do not call without holding the mu lock.
+func (mt *MemTable) committedIn(res MemRegion, start uint64, length uint64) []MemRegion {
+	var out []MemRegion
+	if first, ok := mt.Regions.Floor(start); ok && first.StartAddr >= res.StartAddr && first.StartAddr+first.Length > start {
+		out = append(out, first)
+	}
+	mt.Regions.AscendFrom(start, func(r MemRegion) bool {
+		if r.StartAddr >= start+length {
+			return false
+		}
+		if len(out) == 0 || out[len(out)-1].StartAddr != r.StartAddr {
+			out = append(out, r)
+		}
+		return true
+	})
+	return out
+}
+
+// release returns a region that is no longer allocated to the free list, or
+// to its reservation if it was committed memory.
+// Do not call without locking the mu lock, there is no safeguards.
+func (mt *MemTable) release(r MemRegion) {
+	if _, ok := mt.reservations.Overlapping(r.StartAddr, r.Length); ok {
+		return
+	}
+	mt.insertFree(r)
+}
+
+func roundUpPage(n uint64) uint64 {
+	return (n + pageOffsMask) &^ pageOffsMask
+}
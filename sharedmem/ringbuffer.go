@@ -0,0 +1,465 @@
+package sharedmem
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RingBuffer layout
+//
+// A RingBuffer is a bounded multi-producer multi-consumer queue in a VMem.
+// The header is a ringHeader at an 8-byte aligned address, which is the
+// queue's address, followed by Capacity slots:
+//
+//	slot = sequence word (8 bytes) + item length (4) + pad (4) + ItemSize bytes
+//
+// Head and Tail count the items ever claimed by producers and consumers.
+// A slot's sequence word tells whose turn it is: a producer at position p may
+// fill slot p%Capacity when it reads p, a consumer may empty it when it reads
+// p+1. Claims are compare-and-swaps on Head and Tail, hand-overs are
+// compare-and-swaps on the sequence word, so no lock is held across the copy
+// of an item.
+//
+// The allocation holding the queue is published when made, so agents with
+// their own tables can reach it.
+//
+// A claimed slot is always handed on, or every caller behind it would wait
+// forever. Steps are retried, and a producer that cannot write its item sets
+// the item length word to ringPoisoned with the atomics; consumers skip such
+// slots.
+//
+// Blocked callers poll with a backoff, or, for queues created with Notify,
+// sleep on the queue's home SoC until an agent that moved an item wakes them.
+
+const ringBufferMagic = 0x53465542474e4952 // "RINGBUFS" little endian
+
+// ringPoisoned in a slot's item length word marks a slot without an item.
+const ringPoisoned = ^uint64(0)
+
+// handOnTries is how often a step handing a claimed slot on is tried.
+const handOnTries = 5
+
+// Header word offsets
+const (
+	ringHead    = 8
+	ringTail    = 16
+	ringWaiters = 24
+)
+
+// NoGeneration makes QueueNotifier.WaitQueue return at once.
+const NoGeneration = ^uint64(0)
+
+// RingBufferConfig describes a new RingBuffer.
+type RingBufferConfig struct {
+	Capacity uint64 // number of items the queue holds, at least 2
+	ItemSize uint32 // maximum item length in bytes
+	Owner    string // SoC holding the queue and, with Notify, waking its waiters
+	Notify   bool   // wake blocked callers through the owner instead of polling
+}
+
+// ringHeader is the header of a RingBuffer in global memory.
+type ringHeader struct {
+	Magic    uint64
+	Head     uint64
+	Tail     uint64
+	Waiters  uint64 // callers sleeping on a notification
+	Capacity uint64
+	ItemSize uint32
+	Notify   uint32 // 1 if waiters sleep on the home SoC
+	Self     uint64 // allocation holding the queue
+	Home     [64]byte
+	Creator  [64]byte // agent whose slab holds the queue; empty if it has its own region
+}
+
+var ringHeaderSize = uint64(binary.Size(ringHeader{}))
+
+// RingBuffer is a bounded MPMC queue of byte strings in global memory.
+type RingBuffer struct {
+	mem      MemoryManagerIface
+	at       Atomics
+	notifier QueueNotifier // nil if the queue polls
+	addr     uint64
+	capacity uint64
+	itemSize uint64
+	home     string
+}
+
+// NewRingBuffer allocates an empty RingBuffer on cfg.Owner.
+func NewRingBuffer(mem MemoryManagerIface, cfg RingBufferConfig) (*RingBuffer, error) {
+	if _, ok := mem.(Atomics); !ok {
+		return nil, errors.New("memory manager does not support atomic operations")
+	}
+	// With one slot its full and empty sequence numbers coincide
+	if cfg.Capacity < 2 {
+		return nil, errors.New("ring buffer capacity must be at least 2")
+	}
+	if len(cfg.Owner) > len(ringHeader{}.Home) {
+		return nil, fmt.Errorf("owner name %q too long", cfg.Owner)
+	}
+
+	hdr := ringHeader{Magic: ringBufferMagic, Capacity: cfg.Capacity, ItemSize: cfg.ItemSize}
+	if cfg.Notify {
+		hdr.Notify = 1
+	}
+	copy(hdr.Home[:], cfg.Owner)
+
+	slotSize := ringSlotSize(cfg.ItemSize)
+	size := ringHeaderSize + cfg.Capacity*slotSize
+	self, creator, addr, err := allocAligned(mem, size, cfg.Owner)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Self = self
+	if err := nameField(hdr.Creator[:], creator); err != nil {
+		freeAligned(mem, creator, self)
+		return nil, err
+	}
+
+	// Slot i waits for the producer at position i
+	data := make([]byte, size)
+	if _, err := binary.Encode(data, binary.LittleEndian, hdr); err != nil {
+		freeAligned(mem, creator, self)
+		return nil, err
+	}
+	for i := uint64(0); i < cfg.Capacity; i++ {
+		binary.LittleEndian.PutUint64(data[ringHeaderSize+i*slotSize:], i)
+	}
+	if err := mem.Write(context.Background(), addr, data); err != nil {
+		freeAligned(mem, creator, self)
+		return nil, err
+	}
+	return OpenRingBuffer(mem, addr)
+}
+
+// OpenRingBuffer attaches to the RingBuffer at addr, created by any agent.
+func OpenRingBuffer(mem MemoryManagerIface, addr uint64) (*RingBuffer, error) {
+	at, ok := mem.(Atomics)
+	if !ok {
+		return nil, errors.New("memory manager does not support atomic operations")
+	}
+	data, err := mem.Read(context.Background(), addr, ringHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	var hdr ringHeader
+	if _, err := binary.Decode(data, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Magic != ringBufferMagic {
+		return nil, fmt.Errorf("no ring buffer at 0x%x", addr)
+	}
+
+	q := &RingBuffer{
+		mem:      mem,
+		at:       at,
+		addr:     addr,
+		capacity: hdr.Capacity,
+		itemSize: uint64(hdr.ItemSize),
+		home:     fieldName(hdr.Home[:]),
+	}
+	if n, ok := mem.(QueueNotifier); ok && hdr.Notify != 0 {
+		q.notifier = n
+	}
+	return q, nil
+}
+
+// Addr returns the address other agents open the queue with.
+func (q *RingBuffer) Addr() uint64 {
+	return q.addr
+}
+
+// Cap returns the number of items the queue holds.
+func (q *RingBuffer) Cap() uint64 {
+	return q.capacity
+}
+
+// Len returns the number of items queued. Items being added or removed
+// while it runs may or may not be counted.
+func (q *RingBuffer) Len(ctx context.Context) (uint64, error) {
+	tail, err := q.load(ctx, q.addr+ringTail)
+	if err != nil {
+		return 0, err
+	}
+	head, err := q.load(ctx, q.addr+ringHead)
+	if err != nil || head < tail {
+		return 0, err
+	}
+	return min(head-tail, q.capacity), nil
+}
+
+// Enqueue adds item at the back of the queue, waiting for room until ctx
+// is done.
+func (q *RingBuffer) Enqueue(ctx context.Context, item []byte) error {
+	for spin := 0; ; spin++ {
+		ok, err := q.TryEnqueue(ctx, item)
+		if err != nil || ok {
+			return err
+		}
+		if err := q.wait(ctx, spin, q.hasRoom); err != nil {
+			return err
+		}
+	}
+}
+
+// Dequeue removes the item at the front of the queue, waiting for one until
+// ctx is done.
+func (q *RingBuffer) Dequeue(ctx context.Context) ([]byte, error) {
+	for spin := 0; ; spin++ {
+		item, ok, err := q.TryDequeue(ctx)
+		if err != nil || ok {
+			return item, err
+		}
+		if err := q.wait(ctx, spin, q.hasItem); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// TryEnqueue adds item at the back of the queue. Returns false if the queue
+// is full.
+func (q *RingBuffer) TryEnqueue(ctx context.Context, item []byte) (bool, error) {
+	if uint64(len(item)) > q.itemSize {
+		return false, fmt.Errorf("item length %d exceeds %d", len(item), q.itemSize)
+	}
+	pos, err := q.load(ctx, q.addr+ringHead)
+	if err != nil {
+		return false, err
+	}
+	for {
+		slot := q.slotAddr(pos)
+		seq, err := q.load(ctx, slot)
+		if err != nil {
+			return false, err
+		}
+		switch diff := int64(seq - pos); {
+		case diff < 0:
+			// The consumer a lap behind has not emptied the slot
+			return false, nil
+		case diff == 0:
+			ok, err := q.at.CompareAndSwap(ctx, q.addr+ringHead, pos, pos+1)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, q.fill(ctx, slot, pos, item)
+			}
+		}
+		// Another producer took the position
+		if pos, err = q.load(ctx, q.addr+ringHead); err != nil {
+			return false, err
+		}
+	}
+}
+
+// TryDequeue removes the item at the front of the queue. Returns false if the
+// queue is empty.
+func (q *RingBuffer) TryDequeue(ctx context.Context) ([]byte, bool, error) {
+	pos, err := q.load(ctx, q.addr+ringTail)
+	if err != nil {
+		return nil, false, err
+	}
+	for {
+		slot := q.slotAddr(pos)
+		seq, err := q.load(ctx, slot)
+		if err != nil {
+			return nil, false, err
+		}
+		switch diff := int64(seq - (pos + 1)); {
+		case diff < 0:
+			// The producer has not filled the slot
+			return nil, false, nil
+		case diff == 0:
+			ok, err := q.at.CompareAndSwap(ctx, q.addr+ringTail, pos, pos+1)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				item, filled, err := q.empty(ctx, slot, pos)
+				if err != nil || filled {
+					return item, filled, err
+				}
+				// The producer could not write its item
+			}
+		}
+		// Another consumer took the position
+		if pos, err = q.load(ctx, q.addr+ringTail); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// Free releases the queue's memory. No agent may use the queue afterwards.
+func (q *RingBuffer) Free() error {
+	data, err := q.mem.Read(context.Background(), q.addr, ringHeaderSize)
+	if err != nil {
+		return err
+	}
+	var hdr ringHeader
+	if _, err := binary.Decode(data, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	// The header may stay readable in a cached slab, so stale opens must fail
+	if err := q.mem.Write(context.Background(), q.addr, make([]byte, 8)); err != nil {
+		return err
+	}
+	return freeAligned(q.mem, fieldName(hdr.Creator[:]), hdr.Self)
+}
+
+// fill copies item into the claimed slot at position pos and hands the slot
+// to consumers. If the item cannot be written the slot is handed on
+// poisoned, and the error returned.
+func (q *RingBuffer) fill(ctx context.Context, slot uint64, pos uint64, item []byte) error {
+	data := make([]byte, 8+len(item))
+	binary.LittleEndian.PutUint32(data, uint32(len(item)))
+	copy(data[8:], item)
+	werr := handOn(func(ctx context.Context) error {
+		return q.mem.Write(ctx, slot+8, data)
+	})
+	if werr != nil {
+		if err := handOn(func(ctx context.Context) error { return q.poison(ctx, slot) }); err != nil {
+			return fmt.Errorf("slot %d of queue 0x%x is stuck: %w", pos%q.capacity, q.addr, err)
+		}
+	}
+	if err := handOn(func(ctx context.Context) error { return q.handOver(ctx, slot, pos, pos+1) }); err != nil {
+		return fmt.Errorf("slot %d of queue 0x%x is stuck: %w", pos%q.capacity, q.addr, err)
+	}
+	if werr != nil {
+		return fmt.Errorf("writing slot %d of queue 0x%x failed: %w", pos%q.capacity, q.addr, werr)
+	}
+	return q.notify(ctx)
+}
+
+// empty copies the item out of the claimed slot at position pos and hands
+// the slot to the producer one lap ahead. Returns false for a poisoned slot.
+// If the item cannot be read it is lost, and the error returned.
+func (q *RingBuffer) empty(ctx context.Context, slot uint64, pos uint64) ([]byte, bool, error) {
+	var data []byte
+	rerr := handOn(func(ctx context.Context) (err error) {
+		data, err = q.mem.Read(ctx, slot+8, 8+q.itemSize)
+		return err
+	})
+	if err := handOn(func(ctx context.Context) error { return q.handOver(ctx, slot, pos+1, pos+q.capacity) }); err != nil {
+		return nil, false, fmt.Errorf("slot %d of queue 0x%x is stuck: %w", pos%q.capacity, q.addr, err)
+	}
+	if rerr != nil {
+		return nil, false, fmt.Errorf("reading slot %d of queue 0x%x failed: %w", pos%q.capacity, q.addr, rerr)
+	}
+	if binary.LittleEndian.Uint64(data) == ringPoisoned {
+		return nil, false, nil
+	}
+	n := min(uint64(binary.LittleEndian.Uint32(data)), q.itemSize)
+	item := append([]byte(nil), data[8:8+n]...)
+	return item, true, q.notify(ctx)
+}
+
+// handOver moves the sequence word of a claimed slot from `from` to `to`.
+// It may be retried: finding `to` already there is success.
+func (q *RingBuffer) handOver(ctx context.Context, slot uint64, from uint64, to uint64) error {
+	ok, err := q.at.CompareAndSwap(ctx, slot, from, to)
+	if err != nil || ok {
+		return err
+	}
+	if seq, err := q.load(ctx, slot); err != nil || seq == to {
+		return err
+	}
+	return fmt.Errorf("sequence word of a claimed slot of queue 0x%x changed", q.addr)
+}
+
+// poison sets the item length word of a claimed slot to ringPoisoned.
+func (q *RingBuffer) poison(ctx context.Context, slot uint64) error {
+	old, err := q.load(ctx, slot+8)
+	if err != nil || old == ringPoisoned {
+		return err
+	}
+	ok, err := q.at.CompareAndSwap(ctx, slot+8, old, ringPoisoned)
+	if err == nil && !ok {
+		err = errors.New("item length word changed")
+	}
+	return err
+}
+
+// handOn runs step until it succeeds, at most handOnTries times. The caller's
+// context is not used, so a claimed slot is handed on after the caller gives up.
+func handOn(step func(ctx context.Context) error) error {
+	var err error
+	for try := 0; try < handOnTries; try++ {
+		if err = step(context.Background()); err == nil {
+			return nil
+		}
+		time.Sleep(time.Duration(1<<try) * time.Millisecond)
+	}
+	return err
+}
+
+// notify wakes the callers sleeping on the queue, if any.
+func (q *RingBuffer) notify(ctx context.Context) error {
+	if q.notifier == nil {
+		return nil
+	}
+	waiters, err := q.load(ctx, q.addr+ringWaiters)
+	if err != nil || waiters == 0 {
+		return err
+	}
+	return q.notifier.NotifyQueue(ctx, q.home, q.addr)
+}
+
+// wait blocks until ready may have become true. Polling queues back off;
+// notifying ones register as waiters, check ready once more so an item moved
+// meanwhile is not missed, and sleep until the next notification.
+func (q *RingBuffer) wait(ctx context.Context, spin int, ready func(ctx context.Context) (bool, error)) error {
+	if q.notifier == nil {
+		return backoff(ctx, spin)
+	}
+
+	if _, err := q.at.FetchAdd(ctx, q.addr+ringWaiters, 1); err != nil {
+		return err
+	}
+	defer q.at.FetchAdd(context.Background(), q.addr+ringWaiters, ^uint64(0))
+
+	gen, err := q.notifier.WaitQueue(ctx, q.home, q.addr, NoGeneration)
+	if err != nil {
+		return err
+	}
+	if ok, err := ready(ctx); err != nil || ok {
+		return err
+	}
+	_, err = q.notifier.WaitQueue(ctx, q.home, q.addr, gen)
+	return err
+}
+
+// hasItem reports whether the slot at the front of the queue is filled.
+func (q *RingBuffer) hasItem(ctx context.Context) (bool, error) {
+	pos, err := q.load(ctx, q.addr+ringTail)
+	if err != nil {
+		return false, err
+	}
+	seq, err := q.load(ctx, q.slotAddr(pos))
+	return seq == pos+1, err
+}
+
+// hasRoom reports whether the slot at the back of the queue is empty.
+func (q *RingBuffer) hasRoom(ctx context.Context) (bool, error) {
+	pos, err := q.load(ctx, q.addr+ringHead)
+	if err != nil {
+		return false, err
+	}
+	seq, err := q.load(ctx, q.slotAddr(pos))
+	return seq == pos, err
+}
+
+// load reads the word at addr atomically.
+func (q *RingBuffer) load(ctx context.Context, addr uint64) (uint64, error) {
+	return q.at.FetchAdd(ctx, addr, 0)
+}
+
+func (q *RingBuffer) slotAddr(pos uint64) uint64 {
+	return q.addr + ringHeaderSize + (pos%q.capacity)*ringSlotSize(uint32(q.itemSize))
+}
+
+// ringSlotSize is the size of a slot, padded so sequence words stay aligned.
+func ringSlotSize(itemSize uint32) uint64 {
+	return (16 + uint64(itemSize) + 7) &^ 7
+}
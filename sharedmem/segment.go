@@ -0,0 +1,432 @@
+package sharedmem
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Named segments
+//
+// A segment is an allocation registered under a name, so tasks anywhere in
+// the cluster can share it without passing addresses around, like POSIX
+// shm_open. Open creates or opens a segment and returns a VMem holding one
+// reference; Free on that VMem drops the reference. Unlink removes the name
+// at once, and the memory is freed when the last reference is dropped.
+//
+// Names live in a SegmentRegistry. A MemTable is one, for the SoCs sharing
+// it; agents with a table each share the master's registry instead.
+
+// SegmentPerm says what openers of a segment may do with it.
+type SegmentPerm uint8
+
+const (
+	SegmentRead SegmentPerm = 1 << iota
+	SegmentWrite
+)
+
+func (p SegmentPerm) String() string {
+	s := []byte("--")
+	if p&SegmentRead != 0 {
+		s[0] = 'r'
+	}
+	if p&SegmentWrite != 0 {
+		s[1] = 'w'
+	}
+	return string(s)
+}
+
+var (
+	// ErrSegmentNotFound is returned when no segment has the requested name.
+	ErrSegmentNotFound = errors.New("no such segment")
+	// ErrSegmentExists is returned when creating a segment whose name is taken.
+	ErrSegmentExists = errors.New("segment already exists")
+)
+
+// NamedSegment is a shared allocation registered under a name.
+type NamedSegment struct {
+	ID       uint64 // never reused, survives unlinking
+	Name     string
+	Region   MemRegion // the allocation holding the segment
+	Size     uint64    // usable bytes, at most Region.Length
+	Perm     SegmentPerm
+	Refs     int    // open references
+	Unlinked bool   // name removed; freed with the last reference
+	Creator  string // SoC whose table holds the allocation, when tables are not shared
+}
+
+// SegmentRegistry keeps the names and references of segments. Close and
+// Unlink report last when the caller has to free the segment's region.
+type SegmentRegistry interface {
+	CreateSegment(name string, region MemRegion, size uint64, perm SegmentPerm) (NamedSegment, error)
+	OpenSegment(name string, access SegmentPerm, minSize uint64) (NamedSegment, error)
+	CloseSegment(id uint64) (region MemRegion, last bool, err error)
+	UnlinkSegment(name string) (region MemRegion, last bool, err error)
+}
+
+// SegmentRegistryProvider is implemented by memory managers whose segments
+// are not registered in their own MemTable.
+type SegmentRegistryProvider interface {
+	SegmentRegistry() SegmentRegistry
+}
+
+// OpenOptions control Open.
+type OpenOptions struct {
+	Create    bool        // create the segment if the name is free
+	Exclusive bool        // with Create, fail if the segment exists
+	Size      uint64      // size of a new segment; an existing one must be at least this big
+	Perm      SegmentPerm // permissions of a new segment; 0 means read and write
+	ReadOnly  bool        // open for reading only
+	Owner     string      // SoC to allocate a new segment from
+}
+
+// Open opens the segment called name, creating it if asked to. The returned
+// VMem holds a reference to the segment until it is freed; it is read-only
+// if opened so. The memory manager must provide a segment registry or expose
+// its MemTable.
+func Open(mem MemoryManagerIface, name string, opts OpenOptions) (*VMem, error) {
+	reg, err := registryOf(mem)
+	if err != nil {
+		return nil, err
+	}
+	access := SegmentRead | SegmentWrite
+	if opts.ReadOnly {
+		access = SegmentRead
+	}
+
+	for {
+		if !opts.Exclusive || !opts.Create {
+			seg, err := reg.OpenSegment(name, access, opts.Size)
+			if err == nil {
+				return segmentVMem(mem, seg, access), nil
+			}
+			if !errors.Is(err, ErrSegmentNotFound) || !opts.Create {
+				return nil, err
+			}
+		}
+
+		seg, err := createSegment(mem, reg, name, access, opts)
+		if errors.Is(err, ErrSegmentExists) && !opts.Exclusive {
+			// Created by someone else meanwhile, open theirs
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return segmentVMem(mem, seg, access), nil
+	}
+}
+
+// Unlink removes the name of a segment. Open VMems keep working; the memory
+// is freed once they are all freed.
+func Unlink(mem MemoryManagerIface, name string) error {
+	reg, err := registryOf(mem)
+	if err != nil {
+		return err
+	}
+	region, last, err := reg.UnlinkSegment(name)
+	if err != nil || !last {
+		return err
+	}
+	return mem.FreeRegion(region.StartAddr)
+}
+
+// registryOf returns the registry segments of mem are named in.
+func registryOf(mem MemoryManagerIface) (SegmentRegistry, error) {
+	if rp, ok := mem.(SegmentRegistryProvider); ok {
+		return rp.SegmentRegistry(), nil
+	}
+	if tp, ok := mem.(TableProvider); ok {
+		return tp.MemTable(), nil
+	}
+	return nil, errors.New("memory manager has no segment registry")
+}
+
+// createSegment allocates and zeroes a segment, then registers it. The name
+// is only taken once the memory is ready, so openers never see stale bytes.
+func createSegment(mem MemoryManagerIface, reg SegmentRegistry, name string, access SegmentPerm, opts OpenOptions) (NamedSegment, error) {
+	perm := opts.Perm
+	if perm == 0 {
+		perm = SegmentRead | SegmentWrite
+	}
+	if access&^perm != 0 {
+		return NamedSegment{}, fmt.Errorf("segment %q would not allow %s access", name, access)
+	}
+	if opts.Owner == "" {
+		return NamedSegment{}, errors.New("no owner to allocate the segment from")
+	}
+
+	region, err := mem.AllocRegion(opts.Size, opts.Owner)
+	if err != nil {
+		return NamedSegment{}, err
+	}
+	if err := zeroFill(mem, region.StartAddr, region.Length); err != nil {
+		mem.FreeRegion(region.StartAddr)
+		return NamedSegment{}, err
+	}
+	seg, err := reg.CreateSegment(name, region, opts.Size, perm)
+	if err != nil {
+		mem.FreeRegion(region.StartAddr)
+		return NamedSegment{}, err
+	}
+	return seg, nil
+}
+
+func segmentVMem(mem MemoryManagerIface, seg NamedSegment, access SegmentPerm) *VMem {
+	return &VMem{
+		Size:      seg.Size,
+		StartAddr: seg.Region.StartAddr,
+		mem:       mem,
+		owner:     seg.Region.Owner,
+		segment:   seg.ID,
+		readOnly:  access&SegmentWrite == 0,
+	}
+}
+
+// closeSegment drops the reference v holds and frees the segment if it was
+// the last one of an unlinked segment.
+func (v *VMem) closeSegment() error {
+	reg, err := registryOf(v.mem)
+	if err != nil {
+		return err
+	}
+	region, last, err := reg.CloseSegment(v.segment)
+	if err != nil || !last {
+		return err
+	}
+	return v.mem.FreeRegion(region.StartAddr)
+}
+
+// CreateSegment registers the allocation region as a segment called name,
+// with one reference held by the caller.
+func (mt *MemTable) CreateSegment(name string, region MemRegion, size uint64, perm SegmentPerm) (NamedSegment, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	alloc, ok := mt.Allocations[region.StartAddr]
+	if !ok {
+		return NamedSegment{}, fmt.Errorf("no allocated region at address 0x%x", region.StartAddr)
+	}
+	seg, err := registerSegment(mt.segments, mt.segmentNames, &mt.nextSegment,
+		NamedSegment{Name: name, Region: alloc, Size: size, Perm: perm})
+	if err != nil {
+		return NamedSegment{}, err
+	}
+	mt.setLabel(alloc.StartAddr, Label{Name: name, Tags: []string{"segment"}})
+	return seg, nil
+}
+
+// OpenSegment adds a reference to the segment called name. access must be
+// allowed by the segment's permissions and the segment must hold at least
+// minSize bytes.
+func (mt *MemTable) OpenSegment(name string, access SegmentPerm, minSize uint64) (NamedSegment, error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+	return openSegment(mt.segments, mt.segmentNames, name, access, minSize)
+}
+
+// CloseSegment drops a reference to segment id. When the last reference of
+// an unlinked segment is dropped the segment is forgotten and last is true;
+// freeing its region is then up to the caller.
+func (mt *MemTable) CloseSegment(id uint64) (region MemRegion, last bool, err error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	seg, last, err := closeSegment(mt.segments, id)
+	return seg.Region, last, err
+}
+
+// UnlinkSegment removes the name of a segment. If nothing references the
+// segment it is forgotten and last is true; freeing its region is then up to
+// the caller.
+func (mt *MemTable) UnlinkSegment(name string) (region MemRegion, last bool, err error) {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	seg, last, err := unlinkSegment(mt.segments, mt.segmentNames, name)
+	return seg.Region, last, err
+}
+
+// MirrorSegment records the allocation of a segment created in another
+// SoC's table, so this table can reach it. The range must be free here;
+// FreeRegion drops the record again.
+func (mt *MemTable) MirrorSegment(seg NamedSegment) error {
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	region, err := mt.carve(AllocRequest{
+		Size:      seg.Region.Length,
+		MinAddr:   seg.Region.StartAddr,
+		MaxAddr:   seg.Region.StartAddr + seg.Region.Length,
+		Owner:     seg.Region.Owner,
+		OwnerOnly: true,
+	})
+	if err != nil {
+		return fmt.Errorf("segment %q at 0x%x is not free memory of %s here: %w", seg.Name, seg.Region.StartAddr, seg.Region.Owner, err)
+	}
+	mt.insertAlloc(region)
+	mt.setLabel(region.StartAddr, Label{Name: seg.Name, Tags: []string{"segment"}})
+	return nil
+}
+
+// LookupSegment returns the segment called name without opening it.
+func (mt *MemTable) LookupSegment(name string) (NamedSegment, bool) {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	id, ok := mt.segmentNames[name]
+	if !ok {
+		return NamedSegment{}, false
+	}
+	return *mt.segments[id], true
+}
+
+// Segments returns every segment, unlinked ones included, in ID order.
+func (mt *MemTable) Segments() []NamedSegment {
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+	return mt.sortedSegments()
+}
+
+// sortedSegments returns the segments in ID order.
+// Do not call without holding the mu lock.
+func (mt *MemTable) sortedSegments() []NamedSegment {
+	out := make([]NamedSegment, 0, len(mt.segments))
+	for _, seg := range mt.segments {
+		out = append(out, *seg)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// segmentAt returns the segment held in the allocation at addr, if any.
+// Do not call without holding the mu lock.
+func (mt *MemTable) segmentAt(addr uint64) (*NamedSegment, bool) {
+	for _, seg := range mt.segments {
+		if seg.Region.StartAddr == addr {
+			return seg, true
+		}
+	}
+	return nil, false
+}
+
+// SegmentDirectory is a segment registry without memory, kept by the master
+// for agents that have a table each. Segments are recorded with the SoC
+// whose table holds their allocation.
+type SegmentDirectory struct {
+	mu       sync.Mutex
+	segments map[uint64]*NamedSegment // segment ID -> named segment, unlinked ones included
+	names    map[string]uint64        // name -> segment ID, linked segments only
+	next     uint64
+}
+
+// NewSegmentDirectory returns an empty directory.
+func NewSegmentDirectory() *SegmentDirectory {
+	return &SegmentDirectory{
+		segments: make(map[uint64]*NamedSegment),
+		names:    make(map[string]uint64),
+	}
+}
+
+// CreateSegment registers region, allocated in creator's table, as a segment
+// called name, with one reference held by the caller.
+func (d *SegmentDirectory) CreateSegment(name string, region MemRegion, size uint64, perm SegmentPerm, creator string) (NamedSegment, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return registerSegment(d.segments, d.names, &d.next,
+		NamedSegment{Name: name, Region: region, Size: size, Perm: perm, Creator: creator})
+}
+
+// OpenSegment adds a reference to the segment called name, like
+// MemTable.OpenSegment.
+func (d *SegmentDirectory) OpenSegment(name string, access SegmentPerm, minSize uint64) (NamedSegment, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return openSegment(d.segments, d.names, name, access, minSize)
+}
+
+// CloseSegment drops a reference to segment id, like MemTable.CloseSegment.
+func (d *SegmentDirectory) CloseSegment(id uint64) (NamedSegment, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return closeSegment(d.segments, id)
+}
+
+// UnlinkSegment removes the name of a segment, like MemTable.UnlinkSegment.
+func (d *SegmentDirectory) UnlinkSegment(name string) (NamedSegment, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return unlinkSegment(d.segments, d.names, name)
+}
+
+// registerSegment adds seg to a registry under a fresh ID, with one
+// reference held by the caller.
+func registerSegment(segments map[uint64]*NamedSegment, names map[string]uint64, next *uint64, seg NamedSegment) (NamedSegment, error) {
+	if seg.Name == "" {
+		return NamedSegment{}, errors.New("segment name is empty")
+	}
+	if _, ok := names[seg.Name]; ok {
+		return NamedSegment{}, fmt.Errorf("%w: %q", ErrSegmentExists, seg.Name)
+	}
+	if seg.Size > seg.Region.Length {
+		return NamedSegment{}, fmt.Errorf("segment size %d exceeds its allocation of %d bytes", seg.Size, seg.Region.Length)
+	}
+
+	*next++
+	seg.ID, seg.Refs, seg.Unlinked = *next, 1, false
+	segments[seg.ID] = &seg
+	names[seg.Name] = seg.ID
+	return seg, nil
+}
+
+// openSegment adds a reference to the segment called name in a registry.
+func openSegment(segments map[uint64]*NamedSegment, names map[string]uint64, name string, access SegmentPerm, minSize uint64) (NamedSegment, error) {
+	id, ok := names[name]
+	if !ok {
+		return NamedSegment{}, fmt.Errorf("%w: %q", ErrSegmentNotFound, name)
+	}
+	seg := segments[id]
+	if access&^seg.Perm != 0 {
+		return NamedSegment{}, fmt.Errorf("segment %q allows %s, not %s", name, seg.Perm, access)
+	}
+	if minSize > seg.Size {
+		return NamedSegment{}, fmt.Errorf("segment %q holds %d bytes, not %d", name, seg.Size, minSize)
+	}
+	seg.Refs++
+	return *seg, nil
+}
+
+// closeSegment drops a reference to segment id in a registry, forgetting the
+// segment if it was the last one of an unlinked segment.
+func closeSegment(segments map[uint64]*NamedSegment, id uint64) (NamedSegment, bool, error) {
+	seg, ok := segments[id]
+	if !ok {
+		return NamedSegment{}, false, fmt.Errorf("unknown segment %d", id)
+	}
+	if seg.Refs > 0 {
+		seg.Refs--
+	}
+	if seg.Refs > 0 || !seg.Unlinked {
+		return *seg, false, nil
+	}
+	delete(segments, id)
+	return *seg, true, nil
+}
+
+// unlinkSegment removes the name of a segment in a registry, forgetting the
+// segment if nothing references it.
+func unlinkSegment(segments map[uint64]*NamedSegment, names map[string]uint64, name string) (NamedSegment, bool, error) {
+	id, ok := names[name]
+	if !ok {
+		return NamedSegment{}, false, fmt.Errorf("%w: %q", ErrSegmentNotFound, name)
+	}
+	seg := segments[id]
+	delete(names, name)
+	seg.Unlinked = true
+	if seg.Refs > 0 {
+		return *seg, false, nil
+	}
+	delete(segments, id)
+	return *seg, true, nil
+}
@@ -0,0 +1,133 @@
+package sharedmem
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SharedHandle identifies a region that several tasks hold references to.
+type SharedHandle uint64
+
+// SharedRegion is a reference-counted region. Refs maps task ID to the number
+// of references that task holds.
+type SharedRegion struct {
+	Region MemRegion
+	Refs   map[string]int
+}
+
+// Share turns one of taskID's allocations into a shared region and returns its
+// handle. The task keeps one reference; the region is no longer freed by
+// FreeTaskPages until every reference has been dropped.
+func (t *TaskMemoryTracker) Share(taskID string, startAddr uint64) (SharedHandle, error) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+	return t.share(taskID, startAddr)
+}
+
+// share is Share without locking.
+func (t *TaskMemoryTracker) share(taskID string, startAddr uint64) (SharedHandle, error) {
+	r, ok := t.removeTaskRegion(taskID, startAddr)
+	if !ok {
+		return 0, fmt.Errorf("task %s has no allocation at 0x%x", taskID, startAddr)
+	}
+
+	t.nextShared++
+	h := t.nextShared
+	t.Shared[h] = &SharedRegion{
+		Region: r,
+		Refs:   map[string]int{taskID: 1},
+	}
+	if as, ok := t.Spaces[taskID]; ok {
+		as.markShared(startAddr, h)
+	}
+	return h, nil
+}
+
+// Attach adds a reference to a shared region for taskID and returns the region.
+func (t *TaskMemoryTracker) Attach(taskID string, h SharedHandle) (MemRegion, error) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+	return t.attach(taskID, h)
+}
+
+// attach is Attach without locking.
+func (t *TaskMemoryTracker) attach(taskID string, h SharedHandle) (MemRegion, error) {
+	sr, ok := t.Shared[h]
+	if !ok {
+		return MemRegion{}, fmt.Errorf("unknown shared handle %d", h)
+	}
+	sr.Refs[taskID]++
+	return sr.Region, nil
+}
+
+// Detach drops one of taskID's references to a shared region. When the last
+// reference is dropped the handle is forgotten and last is true; freeing the
+// region is then up to the caller.
+func (t *TaskMemoryTracker) Detach(taskID string, h SharedHandle) (region MemRegion, last bool, err error) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+	return t.detach(taskID, h, false)
+}
+
+// DetachAll drops every reference taskID holds to a shared region.
+func (t *TaskMemoryTracker) DetachAll(taskID string, h SharedHandle) (region MemRegion, last bool, err error) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+	return t.detach(taskID, h, true)
+}
+
+// detach is Detach without locking. If all is set every reference the task
+// holds is dropped instead of one.
+func (t *TaskMemoryTracker) detach(taskID string, h SharedHandle, all bool) (MemRegion, bool, error) {
+	sr, ok := t.Shared[h]
+	if !ok {
+		return MemRegion{}, false, fmt.Errorf("unknown shared handle %d", h)
+	}
+	if sr.Refs[taskID] == 0 {
+		return MemRegion{}, false, fmt.Errorf("task %s holds no reference to shared handle %d", taskID, h)
+	}
+
+	sr.Refs[taskID]--
+	if all || sr.Refs[taskID] == 0 {
+		delete(sr.Refs, taskID)
+		// The task can no longer reach the region
+		if as, ok := t.Spaces[taskID]; ok {
+			as.unmapGlobal(sr.Region.StartAddr)
+		}
+	}
+	if len(sr.Refs) > 0 {
+		return sr.Region, false, nil
+	}
+
+	delete(t.Shared, h)
+	return sr.Region, true, nil
+}
+
+// Holders returns the IDs of the tasks holding references to a shared region.
+func (t *TaskMemoryTracker) Holders(h SharedHandle) ([]string, error) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+
+	sr, ok := t.Shared[h]
+	if !ok {
+		return nil, fmt.Errorf("unknown shared handle %d", h)
+	}
+	holders := make([]string, 0, len(sr.Refs))
+	for taskID := range sr.Refs {
+		holders = append(holders, taskID)
+	}
+	sort.Strings(holders)
+	return holders, nil
+}
+
+// sharesOf returns the shared handles taskID holds references to.
+// Do not call without locking AllocLock.
+func (t *TaskMemoryTracker) sharesOf(taskID string) []SharedHandle {
+	var handles []SharedHandle
+	for h, sr := range t.Shared {
+		if sr.Refs[taskID] > 0 {
+			handles = append(handles, h)
+		}
+	}
+	return handles
+}
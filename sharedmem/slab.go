@@ -0,0 +1,237 @@
+package sharedmem
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// SlabSizeClasses are the object sizes served from slabs. Bigger requests get
+// their own MemTable region.
+var SlabSizeClasses = []uint64{16, 32, 64, 128, 256, 512, 1024, 2048}
+
+// ErrNotSlabObject is returned for addresses the slab allocator did not hand out.
+var ErrNotSlabObject = errors.New("not allocated by the slab allocator")
+
+// SlabAllocator serves small objects out of pages allocated from a MemTable.
+// Each page is carved into fixed-size slots of one size class, so a 32-byte
+// object costs a slot instead of a whole MemTable entry. Slabs are cached per
+// SoC; Malloc allocates on Self, MallocOn on any SoC.
+type SlabAllocator struct {
+	mt   *MemTable
+	Self string
+
+	lock   sync.Mutex
+	caches map[string]*slabCache // owner -> slab cache
+	slabs  *RegionIndex          // pages used as slabs, for Free lookups
+	bySlab map[uint64]*slab      // slab start -> slab
+	large  map[uint64]MemRegion  // objects too big for a size class
+}
+
+// slabCache holds the slabs of one SoC, one list per size class.
+type slabCache struct {
+	owner   string
+	classes []*slabClass
+}
+
+type slabClass struct {
+	size    uint64
+	partial []*slab // slabs with at least one free slot
+}
+
+type slab struct {
+	page  MemRegion
+	class *slabClass
+	used  []bool
+	free  []uint64 // stack of free slot indices
+}
+
+func NewSlabAllocator(mt *MemTable, self string) *SlabAllocator {
+	return &SlabAllocator{
+		mt:     mt,
+		Self:   self,
+		caches: make(map[string]*slabCache),
+		slabs:  NewRegionIndex(),
+		bySlab: make(map[uint64]*slab),
+		large:  make(map[uint64]MemRegion),
+	}
+}
+
+// Malloc allocates `size` bytes on the local SoC and returns its global address.
+func (sa *SlabAllocator) Malloc(size uint64) (uint64, error) {
+	return sa.MallocOn(sa.Self, size)
+}
+
+// MallocOn allocates `size` bytes in memory owned by `owner`.
+func (sa *SlabAllocator) MallocOn(owner string, size uint64) (uint64, error) {
+	if size == 0 {
+		return 0, errors.New("cannot allocate zero bytes")
+	}
+
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+
+	class := sa.cache(owner).classFor(size)
+	if class == nil {
+		region, err := sa.mt.AllocRegion(size, owner)
+		if err != nil {
+			return 0, err
+		}
+		sa.large[region.StartAddr] = region
+		return region.StartAddr, nil
+	}
+
+	if len(class.partial) == 0 {
+		pages, err := sa.mt.AllocPages(1, owner)
+		if err != nil {
+			return 0, fmt.Errorf("slab page allocation failed: %w", err)
+		}
+		s := newSlab(pages[0], class)
+		sa.slabs.Insert(s.page)
+		sa.bySlab[s.page.StartAddr] = s
+		class.partial = append(class.partial, s)
+	}
+
+	s := class.partial[len(class.partial)-1]
+	slot := s.free[len(s.free)-1]
+	s.free = s.free[:len(s.free)-1]
+	s.used[slot] = true
+	if len(s.free) == 0 {
+		class.partial = class.partial[:len(class.partial)-1]
+	}
+
+	return s.page.StartAddr + slot*class.size, nil
+}
+
+// Free releases an address returned by Malloc or MallocOn. Empty slabs are
+// returned to the MemTable as long as the class keeps another partial slab.
+func (sa *SlabAllocator) Free(ptr uint64) error {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+
+	if region, ok := sa.large[ptr]; ok {
+		if err := sa.mt.FreeRegion(region.StartAddr); err != nil {
+			return err
+		}
+		delete(sa.large, ptr)
+		return nil
+	}
+
+	page, ok := sa.slabs.Find(ptr)
+	if !ok {
+		return fmt.Errorf("address 0x%x: %w", ptr, ErrNotSlabObject)
+	}
+	s := sa.bySlab[page.StartAddr]
+	off := ptr - page.StartAddr
+	if off%s.class.size != 0 {
+		return fmt.Errorf("address 0x%x is not the start of a slab object", ptr)
+	}
+	slot := off / s.class.size
+	if !s.used[slot] {
+		return fmt.Errorf("double free of slab object at 0x%x", ptr)
+	}
+
+	s.used[slot] = false
+	s.free = append(s.free, slot)
+	if len(s.free) == 1 {
+		s.class.partial = append(s.class.partial, s)
+	}
+
+	if len(s.free) == len(s.used) && len(s.class.partial) > 1 {
+		return sa.release(s)
+	}
+	return nil
+}
+
+// Trim returns every empty slab to the MemTable, including the one each size
+// class keeps cached. Returns the number of bytes released.
+func (sa *SlabAllocator) Trim() (uint64, error) {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+
+	var released uint64
+	for _, c := range sa.caches {
+		for _, class := range c.classes {
+			for _, s := range append([]*slab(nil), class.partial...) {
+				if len(s.free) != len(s.used) {
+					continue
+				}
+				if err := sa.release(s); err != nil {
+					return released, err
+				}
+				released += s.page.Length
+			}
+		}
+	}
+	return released, nil
+}
+
+// SlotSize returns the usable size of the object at ptr.
+func (sa *SlabAllocator) SlotSize(ptr uint64) (uint64, error) {
+	sa.lock.Lock()
+	defer sa.lock.Unlock()
+
+	if region, ok := sa.large[ptr]; ok {
+		return region.Length, nil
+	}
+	page, ok := sa.slabs.Find(ptr)
+	if !ok {
+		return 0, fmt.Errorf("address 0x%x: %w", ptr, ErrNotSlabObject)
+	}
+	return sa.bySlab[page.StartAddr].class.size, nil
+}
+
+// release gives an empty slab's page back to the MemTable.
+func (sa *SlabAllocator) release(s *slab) error {
+	for i, p := range s.class.partial {
+		if p == s {
+			s.class.partial = append(s.class.partial[:i], s.class.partial[i+1:]...)
+			break
+		}
+	}
+	sa.slabs.Delete(s.page.StartAddr)
+	delete(sa.bySlab, s.page.StartAddr)
+	return sa.mt.FreePages([]MemRegion{s.page})
+}
+
+// MaxSlabObject returns the largest size served from a slab.
+func MaxSlabObject() uint64 {
+	return SlabSizeClasses[len(SlabSizeClasses)-1]
+}
+
+func (sa *SlabAllocator) cache(owner string) *slabCache {
+	c, ok := sa.caches[owner]
+	if !ok {
+		c = &slabCache{owner: owner}
+		for _, size := range SlabSizeClasses {
+			c.classes = append(c.classes, &slabClass{size: size})
+		}
+		sa.caches[owner] = c
+	}
+	return c
+}
+
+// classFor returns the smallest size class holding size bytes, or nil.
+func (c *slabCache) classFor(size uint64) *slabClass {
+	for _, class := range c.classes {
+		if size <= class.size {
+			return class
+		}
+	}
+	return nil
+}
+
+func newSlab(page MemRegion, class *slabClass) *slab {
+	slots := page.Length / class.size
+	s := &slab{
+		page:  page,
+		class: class,
+		used:  make([]bool, slots),
+		free:  make([]uint64, 0, slots),
+	}
+	// Push in reverse so slots are handed out in address order
+	for i := slots; i > 0; i-- {
+		s.free = append(s.free, i-1)
+	}
+	return s
+}
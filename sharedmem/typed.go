@@ -0,0 +1,221 @@
+package sharedmem
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+// Typed views
+//
+// Array and Value read and write Go values in a VMem with a fixed layout:
+// little endian, fields packed in declaration order without padding, as
+// encoding/binary lays them out. The same bytes decode identically on every
+// SoC, whatever its architecture.
+//
+// NewArray and NewValue only accept Scalar types, so pointers, slices, maps,
+// strings and the platform-sized int and uint are rejected at compile time.
+// Go has no constraint for "a struct without pointers", so NewStructArray and
+// NewStructValue compile for any type and do their checking at run time: they
+// return an error for anything but a struct, such as a pointer to one, and
+// for structs without a fixed size or with unexported fields.
+
+// Scalar is the set of fixed-size numeric types.
+type Scalar interface {
+	~bool | ~int8 | ~uint8 | ~int16 | ~uint16 | ~int32 | ~uint32 | ~int64 | ~uint64 |
+		~float32 | ~float64 | ~complex64 | ~complex128
+}
+
+// Array is a view of n consecutive values of type T in a VMem.
+type Array[T any] struct {
+	v        *VMem
+	offset   uint64
+	n        uint64
+	elemSize uint64
+}
+
+// NewArray returns a view of n values of type T starting at offset in v.
+func NewArray[T Scalar](v *VMem, offset uint64, n uint64) (*Array[T], error) {
+	return newArray[T](v, offset, n)
+}
+
+// NewStructArray is NewArray for struct types. T must be a struct of fixed
+// size: only exported Scalar fields, arrays and nested structs of them. Blank
+// (_) fields are padding. T is checked when called, not at compile time, so a
+// pointer or any other non-struct T is an error.
+func NewStructArray[T any](v *VMem, offset uint64, n uint64) (*Array[T], error) {
+	if err := structOnly[T](); err != nil {
+		return nil, err
+	}
+	return newArray[T](v, offset, n)
+}
+
+// structOnly rejects every T that is not a struct type.
+func structOnly[T any]() error {
+	if t := reflect.TypeFor[T](); t.Kind() != reflect.Struct {
+		return fmt.Errorf("type %s is not a struct", t)
+	}
+	return nil
+}
+
+func newArray[T any](v *VMem, offset uint64, n uint64) (*Array[T], error) {
+	var zero T
+	size := binary.Size(zero)
+	if size <= 0 {
+		return nil, fmt.Errorf("type %T has no fixed size", zero)
+	}
+	if err := exportedOnly(reflect.TypeOf(zero)); err != nil {
+		return nil, err
+	}
+	elemSize := uint64(size)
+	if n > (v.Size-min(offset, v.Size))/elemSize {
+		return nil, fmt.Errorf("%d values of %d bytes at offset %d do not fit in %d bytes", n, elemSize, offset, v.Size)
+	}
+	return &Array[T]{v: v, offset: offset, n: n, elemSize: elemSize}, nil
+}
+
+// exportedOnly rejects struct types with unexported fields, which
+// encoding/binary cannot decode into.
+func exportedOnly(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Array:
+		return exportedOnly(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Name != "_" && !f.IsExported() {
+				return fmt.Errorf("field %s of %s is unexported", f.Name, t)
+			}
+			if err := exportedOnly(f.Type); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Len returns the number of values in the array.
+func (a *Array[T]) Len() uint64 {
+	return a.n
+}
+
+// ElemSize returns the encoded size of one value in bytes.
+func (a *Array[T]) ElemSize() uint64 {
+	return a.elemSize
+}
+
+// Get returns the value at index i.
+func (a *Array[T]) Get(i uint64) (T, error) {
+	var out [1]T
+	err := a.GetRange(i, out[:])
+	return out[0], err
+}
+
+// Set stores x at index i.
+func (a *Array[T]) Set(i uint64, x T) error {
+	return a.SetRange(i, []T{x})
+}
+
+// GetRange fills dst with the values starting at index i.
+func (a *Array[T]) GetRange(i uint64, dst []T) error {
+	if err := a.check(i, uint64(len(dst))); err != nil {
+		return err
+	}
+	if len(dst) == 0 {
+		return nil
+	}
+	data := make([]byte, uint64(len(dst))*a.elemSize)
+	if _, err := a.v.ReadAt(data, int64(a.offset+i*a.elemSize)); err != nil {
+		return err
+	}
+	_, err := binary.Decode(data, binary.LittleEndian, dst)
+	return err
+}
+
+// SetRange stores src at the indexes starting at i.
+func (a *Array[T]) SetRange(i uint64, src []T) error {
+	if err := a.check(i, uint64(len(src))); err != nil {
+		return err
+	}
+	if len(src) == 0 {
+		return nil
+	}
+	data := make([]byte, uint64(len(src))*a.elemSize)
+	if _, err := binary.Encode(data, binary.LittleEndian, src); err != nil {
+		return err
+	}
+	_, err := a.v.WriteAt(data, int64(a.offset+i*a.elemSize))
+	return err
+}
+
+// Range calls fn for the values at indexes [start, end) in order, until fn
+// returns false. Values are fetched in chunks of about IOChunkSize bytes.
+func (a *Array[T]) Range(start uint64, end uint64, fn func(i uint64, x T) bool) error {
+	if start > end {
+		return fmt.Errorf("invalid range [%d, %d)", start, end)
+	}
+	if err := a.check(start, end-start); err != nil {
+		return err
+	}
+
+	batch := max(IOChunkSize/a.elemSize, 1)
+	buf := make([]T, min(batch, end-start))
+	for i := start; i < end; {
+		chunk := buf[:min(batch, end-i)]
+		if err := a.GetRange(i, chunk); err != nil {
+			return err
+		}
+		for j, x := range chunk {
+			if !fn(i+uint64(j), x) {
+				return nil
+			}
+		}
+		i += uint64(len(chunk))
+	}
+	return nil
+}
+
+// check validates the index range [i, i+count).
+func (a *Array[T]) check(i uint64, count uint64) error {
+	if i > a.n || count > a.n-i {
+		return fmt.Errorf("index range [%d, %d) out of bounds for length %d", i, i+count, a.n)
+	}
+	return nil
+}
+
+// Value is a view of a single value of type T in a VMem.
+type Value[T any] struct {
+	a *Array[T]
+}
+
+// NewValue returns a view of the value of type T at offset in v.
+func NewValue[T Scalar](v *VMem, offset uint64) (*Value[T], error) {
+	return newValue[T](v, offset)
+}
+
+// NewStructValue is NewValue for struct types, with the same rules and the
+// same run-time checks as NewStructArray.
+func NewStructValue[T any](v *VMem, offset uint64) (*Value[T], error) {
+	if err := structOnly[T](); err != nil {
+		return nil, err
+	}
+	return newValue[T](v, offset)
+}
+
+func newValue[T any](v *VMem, offset uint64) (*Value[T], error) {
+	a, err := newArray[T](v, offset, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &Value[T]{a: a}, nil
+}
+
+// Get reads the value.
+func (val *Value[T]) Get() (T, error) {
+	return val.a.Get(0)
+}
+
+// Set stores x.
+func (val *Value[T]) Set(x T) error {
+	return val.a.Set(0, x)
+}
@@ -0,0 +1,277 @@
+package sharedmem
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VerifyError lists every inconsistency Verify found.
+type VerifyError struct {
+	Problems []string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("memtable inconsistent (%d problems): %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+// coverItem is a range the table accounts for, tagged with where it came from.
+type coverItem struct {
+	MemRegion
+	kind string
+}
+
+// Verify checks the table's structures against each other, fsck style:
+//   - allocated and free regions are non-empty and do not overlap or repeat
+//   - the Allocations map and the Regions index hold the same regions
+//   - contiguous free regions of one owner have been merged
+//   - allocated, free, reserved and buddy arena space together cover exactly the
+//     address space the table was built with, without gaps
+//   - loans lie in their lender's slot, do not overlap each other and are all
+//     in the loan index
+//   - handles, leases, labels and copy-on-write images point at live allocations
+//   - segments hold live allocations, are referenced if unlinked and have
+//     IDs below the next one to hand out
+//   - page table entries map allocated pages, or freed pages whose home frame
+//     is lent, to frames from AllocFrame
+//
+// Locks are taken in the table's order, OwnershipLock, then Mu, then briefly the
+// cowLock, so Verify can run alongside copy-on-write writers.
+// Returns nil or a *VerifyError listing every problem.
+func (mt *MemTable) Verify() error {
+	mt.OwnershipLock.RLock()
+	defer mt.OwnershipLock.RUnlock()
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
+
+	var problems []string
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	var items []coverItem
+	mt.Regions.Ascend(func(r MemRegion) bool {
+		items = append(items, coverItem{r, "allocated"})
+		return true
+	})
+	mt.FreeRegions.Ascend(func(r MemRegion) bool {
+		items = append(items, coverItem{r, "free"})
+		return true
+	})
+	for _, r := range mt.buddyFreeRanges() {
+		items = append(items, coverItem{r, "buddy free"})
+	}
+	mt.reservations.Ascend(func(res MemRegion) bool {
+		for _, r := range subtractRanges([]MemRegion{res}, mt.committedIn(res, res.StartAddr, res.Length)) {
+			r.Owner = res.Owner
+			items = append(items, coverItem{r, "reserved"})
+		}
+		return true
+	})
+
+	// Empty, overlapping and duplicate ranges
+	sort.SliceStable(items, func(i, j int) bool { return items[i].StartAddr < items[j].StartAddr })
+	var reach uint64
+	var reachItem coverItem
+	for i, it := range items {
+		if it.Length == 0 {
+			report("%s region at 0x%x has zero length", it.kind, it.StartAddr)
+			continue
+		}
+		if i > 0 && it.StartAddr < reach {
+			if it.StartAddr == reachItem.StartAddr && it.Length == reachItem.Length {
+				report("duplicate region 0x%x+%d (%s and %s)", it.StartAddr, it.Length, reachItem.kind, it.kind)
+			} else {
+				report("%s region 0x%x+%d overlaps %s region 0x%x+%d",
+					it.kind, it.StartAddr, it.Length, reachItem.kind, reachItem.StartAddr, reachItem.Length)
+			}
+		}
+		if end := it.StartAddr + it.Length; end > reach {
+			reach = end
+			reachItem = it
+		}
+	}
+
+	// Map against index
+	if len(mt.Allocations) != mt.Regions.Len() {
+		report("Allocations has %d entries but Regions has %d", len(mt.Allocations), mt.Regions.Len())
+	}
+	for addr, alloc := range mt.Allocations {
+		if alloc.StartAddr != addr {
+			report("Allocations key 0x%x holds region starting at 0x%x", addr, alloc.StartAddr)
+		}
+		if r, ok := mt.Regions.Get(addr); !ok {
+			report("allocation 0x%x missing from Regions", addr)
+		} else if r != alloc {
+			report("allocation 0x%x differs: map %+v, index %+v", addr, alloc, r)
+		}
+	}
+	mt.Regions.Ascend(func(r MemRegion) bool {
+		if _, ok := mt.Allocations[r.StartAddr]; !ok {
+			report("region 0x%x in Regions but not in Allocations", r.StartAddr)
+		}
+		return true
+	})
+
+	// Unmerged free neighbours
+	var prev MemRegion
+	first := true
+	mt.FreeRegions.Ascend(func(r MemRegion) bool {
+		if !first && prev.Owner == r.Owner && prev.StartAddr+prev.Length == r.StartAddr {
+			report("free regions 0x%x and 0x%x of %s are contiguous but not merged", prev.StartAddr, r.StartAddr, r.Owner)
+		}
+		prev, first = r, false
+		return true
+	})
+
+	// Coverage of the known address space
+	space := append(append([]MemRegion{}, mt.Slots...), mt.added...)
+	covered := make([]MemRegion, 0, len(items))
+	for _, it := range items {
+		covered = append(covered, it.MemRegion)
+	}
+	for _, gap := range subtractRanges(space, covered) {
+		report("gap 0x%x+%d is neither allocated nor free", gap.StartAddr, gap.Length)
+	}
+	for _, stray := range subtractRanges(covered, space) {
+		report("region 0x%x+%d lies outside the managed address space", stray.StartAddr, stray.Length)
+	}
+
+	// Committed memory stays inside its reservation
+	mt.reservations.Ascend(func(res MemRegion) bool {
+		for _, r := range mt.committedIn(res, res.StartAddr, res.Length) {
+			if r.StartAddr < res.StartAddr || r.StartAddr+r.Length > res.StartAddr+res.Length {
+				report("allocation 0x%x+%d straddles the reservation at 0x%x", r.StartAddr, r.Length, res.StartAddr)
+			}
+		}
+		return true
+	})
+
+	// Loans
+	if len(mt.loans) != mt.loanRanges.Len() {
+		report("loans has %d entries but the loan index has %d", len(mt.loans), mt.loanRanges.Len())
+	}
+	for addr, loan := range mt.loans {
+		if r, ok := mt.loanRanges.Get(addr); !ok || r != loan.Region {
+			report("loan 0x%x is missing from or misplaced in the loan index", addr)
+		}
+	}
+	var prevLoan Loan
+	for i, loan := range mt.sortedLoans() {
+		if i > 0 && overlaps(prevLoan.Region, loan.Region) {
+			report("loan 0x%x+%d overlaps loan 0x%x+%d", loan.Region.StartAddr, loan.Region.Length, prevLoan.Region.StartAddr, prevLoan.Region.Length)
+		}
+		if !mt.isHome(loan.Lender, MemRegion{StartAddr: loan.Region.StartAddr + loan.Region.Length - 1}) || !mt.isHome(loan.Lender, loan.Region) {
+			report("loan 0x%x+%d lies outside the slot of its lender %s", loan.Region.StartAddr, loan.Region.Length, loan.Lender)
+		}
+		prevLoan = loan
+	}
+
+	// Per-allocation bookkeeping
+	for h, addr := range mt.handles {
+		if _, ok := mt.Allocations[addr]; !ok {
+			report("handle %d points to unallocated address 0x%x", h, addr)
+		}
+		if mt.handleAddrs[addr] != h {
+			report("handle %d is not in the reverse handle map", h)
+		}
+	}
+	for addr := range mt.leases {
+		if _, ok := mt.Allocations[addr]; !ok {
+			report("lease on unallocated address 0x%x", addr)
+		}
+	}
+	for addr := range mt.labels {
+		if _, ok := mt.Allocations[addr]; !ok {
+			report("label on unallocated address 0x%x", addr)
+		}
+	}
+	for _, seg := range mt.sortedSegments() {
+		if alloc, ok := mt.Allocations[seg.Region.StartAddr]; !ok || alloc.Length < seg.Size {
+			report("segment %q is not backed by an allocation at 0x%x of %d bytes", seg.Name, seg.Region.StartAddr, seg.Size)
+		}
+		if seg.Unlinked && seg.Refs <= 0 {
+			report("unlinked segment %q has no references left", seg.Name)
+		}
+		if seg.ID == 0 || seg.ID > mt.nextSegment {
+			report("segment %q has ID %d beyond %d", seg.Name, seg.ID, mt.nextSegment)
+		}
+		if id, ok := mt.segmentNames[seg.Name]; ok != !seg.Unlinked || (ok && id != seg.ID) {
+			report("segment %q is missing from or misplaced in the name index", seg.Name)
+		}
+	}
+	for _, img := range mt.cowStates() {
+		if _, ok := mt.Allocations[img.Region.StartAddr]; !ok {
+			report("copy-on-write image at 0x%x is not allocated", img.Region.StartAddr)
+		}
+		if img.Refs < 1 {
+			report("copy-on-write image at 0x%x has %d references", img.Region.StartAddr, img.Refs)
+		}
+	}
+
+	// Page table entries and the frames behind them
+	mt.Pages.Walk(func(vaddr uint64, frame Frame) bool {
+		if _, ok := mt.Regions.Overlapping(vaddr, PageSize); !ok && !mt.homeLent(vaddr) {
+			report("page table maps unallocated page 0x%x", vaddr)
+		}
+		if _, ok := mt.frames[frame]; !ok {
+			report("page 0x%x is mapped to unknown frame %s/%d", vaddr, frame.SoC, frame.Number)
+		}
+		return true
+	})
+	for frame, addr := range mt.frames {
+		if _, ok := mt.Allocations[addr]; !ok && !mt.homeLent(addr) {
+			report("frame %s/%d at 0x%x is not allocated", frame.SoC, frame.Number, addr)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &VerifyError{Problems: problems}
+	}
+	return nil
+}
+
+// unionRanges sorts ranges and merges overlapping or touching ones, ignoring owners.
+func unionRanges(ranges []MemRegion) []MemRegion {
+	sorted := append([]MemRegion{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].StartAddr < sorted[j].StartAddr })
+
+	var out []MemRegion
+	for _, r := range sorted {
+		if r.Length == 0 {
+			continue
+		}
+		if n := len(out); n > 0 && r.StartAddr <= out[n-1].StartAddr+out[n-1].Length {
+			if end := r.StartAddr + r.Length; end > out[n-1].StartAddr+out[n-1].Length {
+				out[n-1].Length = end - out[n-1].StartAddr
+			}
+			continue
+		}
+		out = append(out, MemRegion{StartAddr: r.StartAddr, Length: r.Length})
+	}
+	return out
+}
+
+// subtractRanges returns the parts of a not covered by b.
+func subtractRanges(a []MemRegion, b []MemRegion) []MemRegion {
+	a, b = unionRanges(a), unionRanges(b)
+
+	var out []MemRegion
+	j := 0
+	for _, r := range a {
+		start, end := r.StartAddr, r.StartAddr+r.Length
+		for j < len(b) && b[j].StartAddr+b[j].Length <= start {
+			j++
+		}
+		for k := j; k < len(b) && b[k].StartAddr < end; k++ {
+			if b[k].StartAddr > start {
+				out = append(out, MemRegion{StartAddr: start, Length: b[k].StartAddr - start})
+			}
+			start = max(start, b[k].StartAddr+b[k].Length)
+		}
+		if start < end {
+			out = append(out, MemRegion{StartAddr: start, Length: end - start})
+		}
+	}
+	return out
+}
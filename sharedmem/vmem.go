@@ -3,14 +3,25 @@ package sharedmem
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
 )
 
 type VMem struct {
 	Size      uint64
 	StartAddr uint64
 	mem       MemoryManagerIface
+	owner     string
+	cow       *cowView // nil unless this VMem takes part in copy-on-write sharing
+	parent    *VMem    // VMem this one is a slice of, nil if it owns its memory
+	base      uint64   // offset of the slice in parent
+	readOnly  bool
+	segment   uint64 // ID of the named segment this VMem references, 0 if none
 }
 
+// ErrReadOnly is returned by writes to a read-only VMem slice.
+var ErrReadOnly = errors.New("VMem is read-only")
+
 type MemoryManagerIface interface {
 	Write(ctx context.Context, addr uint64, data []byte) error
 	Read(ctx context.Context, addr uint64, length uint64) ([]byte, error)
@@ -18,6 +29,70 @@ type MemoryManagerIface interface {
 	FreeRegion(startAddr uint64) error
 }
 
+// TableProvider is implemented by memory managers that expose their MemTable.
+// VMem features that need the page bookkeeping (e.g. Clone) require it.
+type TableProvider interface {
+	MemTable() *MemTable
+}
+
+// Reallocator is implemented by memory managers that can resize allocations.
+// VMem.Resize requires it.
+type Reallocator interface {
+	Realloc(ctx context.Context, addr uint64, newSize uint64) (MemRegion, error)
+}
+
+// Atomics is implemented by memory managers offering atomic operations on
+// 8-byte little-endian words of global memory, wherever the word lives.
+// HashMap and RingBuffer require it.
+type Atomics interface {
+	CompareAndSwap(ctx context.Context, addr uint64, old uint64, new uint64) (bool, error)
+	FetchAdd(ctx context.Context, addr uint64, delta uint64) (uint64, error)
+}
+
+// QueueNotifier is implemented by memory managers that can put callers of a
+// RingBuffer to sleep on the queue's home SoC and wake them. WaitQueue returns
+// the queue's notification generation once it differs from seen, or when the
+// wait times out; NotifyQueue advances it. Without it, blocked callers poll.
+type QueueNotifier interface {
+	NotifyQueue(ctx context.Context, home string, queue uint64) error
+	WaitQueue(ctx context.Context, home string, queue uint64, seen uint64) (uint64, error)
+}
+
+// SmallAllocator is implemented by memory managers that serve small objects
+// from slabs instead of giving each its own MemTable region. The memory is not
+// zeroed. HashMap and RingBuffer use it for allocations that fit a size class.
+// Slabs are kept per agent, so Malloc returns the name of the agent whose slab
+// holds the object, and FreeSmall hands the object back to that agent.
+type SmallAllocator interface {
+	Malloc(size uint64, owner string) (addr uint64, creator string, err error)
+	FreeSmall(creator string, addr uint64) error
+}
+
+// RegionPublisher is implemented by memory managers whose agents each keep
+// their own table. HashMap and RingBuffer publish the allocations other
+// agents reach by address, so every table records them and the placements
+// of their pages. UnpublishRegion drops one publication of the allocation
+// holding addr; FreePublished frees a published region on the agent that
+// made it and drops it from every table. Either may be called on any agent.
+type RegionPublisher interface {
+	PublishRegion(addr uint64) error
+	UnpublishRegion(addr uint64) error
+	FreePublished(addr uint64) error
+}
+
+// PageMover is implemented by memory managers that can move the backing of a
+// page to another SoC. NewStriped requires it for more than one owner.
+type PageMover interface {
+	MovePage(ctx context.Context, vaddr uint64, toSoC string) error
+}
+
+// cowView is a VMem's view of a copy-on-write image. Pages it has written to
+// since sharing live in private pages; everything else is read from the image.
+type cowView struct {
+	image   uint64            // start address of the shared image
+	private map[uint64]uint64 // page index -> start address of the private copy
+}
+
 // New allocates a virtual memory block of `size` bytes from the global pool using MemTable allocator.
 func New(size uint64, mem MemoryManagerIface, owner string) (*VMem, error) {
 	region, err := mem.AllocRegion(size, owner)
@@ -25,35 +100,95 @@ func New(size uint64, mem MemoryManagerIface, owner string) (*VMem, error) {
 		return nil, err
 	}
 
-	// Zero-init the memory block in chunks
-	ctx := context.Background()
-	chunkSize := uint64(1024 * 1024) // 1MB chunks
-	zeroChunk := make([]byte, chunkSize)
-	for i := uint64(0); i < region.Length; i += chunkSize {
-		sz := chunkSize
-		if i+sz > region.Length {
-			sz = region.Length - i
-		}
-		err := mem.Write(ctx, region.StartAddr+i, zeroChunk[:sz])
-		if err != nil {
-			// On error, free allocated region to avoid leak
-			mem.FreeRegion(region.StartAddr)
-			return nil, err
-		}
+	if err := zeroFill(mem, region.StartAddr, region.Length); err != nil {
+		// On error, free allocated region to avoid leak
+		mem.FreeRegion(region.StartAddr)
+		return nil, err
 	}
 
 	return &VMem{
 		Size:      region.Length,
 		StartAddr: region.StartAddr,
 		mem:       mem,
+		owner:     owner,
 	}, nil
 }
 
+// NewStriped allocates a VMem of `size` bytes whose pages are spread
+// round-robin over owners, so its memory and traffic are shared by several
+// SoCs. Addresses stay contiguous; only the frames behind them are striped.
+// The first and last page may be shared with neighbouring allocations and
+// are moved along with them.
+func NewStriped(size uint64, mem MemoryManagerIface, owners []string) (*VMem, error) {
+	if len(owners) == 0 {
+		return nil, errors.New("no owners to stripe over")
+	}
+	v, err := New(size, mem, owners[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := stripe(v, mem, owners); err != nil {
+		v.Free()
+		return nil, err
+	}
+	return v, nil
+}
+
+// stripe moves the pages of v round-robin over owners, starting with the
+// first, which holds them already.
+func stripe(v *VMem, mem MemoryManagerIface, owners []string) error {
+	if len(owners) == 1 {
+		return nil
+	}
+	mover, ok := mem.(PageMover)
+	if !ok {
+		return errors.New("memory manager cannot move pages between SoCs")
+	}
+
+	first := v.StartAddr &^ pageOffsMask
+	for page := first; page < v.StartAddr+v.Size; page += PageSize {
+		owner := owners[(page-first)/PageSize%uint64(len(owners))]
+		if owner == owners[0] {
+			continue
+		}
+		if err := mover.MovePage(context.Background(), max(page, v.StartAddr), owner); err != nil {
+			return fmt.Errorf("striping page 0x%x to %s failed: %w", page, owner, err)
+		}
+	}
+	return nil
+}
+
+// zeroFill zeroes `length` bytes at `addr` in chunks.
+func zeroFill(mem MemoryManagerIface, addr uint64, length uint64) error {
+	ctx := context.Background()
+	chunkSize := uint64(IOChunkSize)
+	zeroChunk := make([]byte, min(chunkSize, length))
+	for i := uint64(0); i < length; i += chunkSize {
+		sz := chunkSize
+		if i+sz > length {
+			sz = length - i
+		}
+		if err := mem.Write(ctx, addr+i, zeroChunk[:sz]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Write writes data to offset from the virtual memory block
 func (v *VMem) Write(offset uint64, data []byte) error {
 	if offset+uint64(len(data)) > v.Size {
 		return errors.New("write out of bounds")
 	}
+	if v.readOnly {
+		return ErrReadOnly
+	}
+	if v.parent != nil {
+		return v.parent.Write(v.base+offset, data)
+	}
+	if v.cow != nil {
+		return v.cowWrite(offset, data)
+	}
 	return v.mem.Write(context.Background(), v.StartAddr+offset, data)
 }
 
@@ -62,10 +197,320 @@ func (v *VMem) Read(offset uint64, length uint64) ([]byte, error) {
 	if offset+length > v.Size {
 		return nil, errors.New("read out of bounds")
 	}
+	if v.parent != nil {
+		return v.parent.Read(v.base+offset, length)
+	}
+	if v.cow != nil {
+		return v.cowRead(offset, length)
+	}
 	return v.mem.Read(context.Background(), v.StartAddr+offset, length)
 }
 
 // Free releases this VMem back to the allocator.
+// A VMem sharing pages with clones only frees its image once the last sharer is gone.
+// Slices do not own their memory and cannot be freed. Freeing a VMem returned
+// by Open drops its reference to the segment.
 func (v *VMem) Free() error {
-	return v.mem.FreeRegion(v.StartAddr)
+	if v.segment != 0 {
+		return v.closeSegment()
+	}
+	if v.parent != nil {
+		return errors.New("cannot free a VMem slice, free the VMem it was sliced from")
+	}
+	if v.cow == nil {
+		return v.mem.FreeRegion(v.StartAddr)
+	}
+
+	mt, err := v.table()
+	if err != nil {
+		return err
+	}
+
+	// Drop the reference first, the frees below go through the memory manager
+	mt.cowLock.Lock()
+	private := v.cow.private
+	diverged := sortedPages(private)
+	v.cow.private = nil
+	last := mt.cowRelease(v.cow.image, diverged)
+	mt.cowLock.Unlock()
+
+	var firstErr error
+	for _, page := range diverged {
+		if err := v.mem.FreeRegion(private[page]); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to free private page %d: %w", page, err)
+		}
+	}
+	if last {
+		if err := v.mem.FreeRegion(v.cow.image); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Resize changes the size of v to newSize bytes, keeping its contents up to
+// the smaller of the two sizes. The block grows in place when it can and is
+// moved otherwise, so StartAddr may change. New bytes read as zero.
+func (v *VMem) Resize(newSize uint64) error {
+	if v.parent != nil {
+		return errors.New("cannot resize a VMem slice")
+	}
+	if v.segment != 0 {
+		return errors.New("cannot resize a named segment")
+	}
+	if v.cow != nil {
+		return errors.New("cannot resize a VMem that shares pages copy-on-write")
+	}
+	r, ok := v.mem.(Reallocator)
+	if !ok {
+		return errors.New("memory manager does not support resizing")
+	}
+
+	region, err := r.Realloc(context.Background(), v.StartAddr, newSize)
+	if err != nil {
+		return err
+	}
+	oldSize := v.Size
+	v.StartAddr = region.StartAddr
+	v.Size = region.Length
+	if v.Size > oldSize {
+		return zeroFill(v.mem, v.StartAddr+oldSize, v.Size-oldSize)
+	}
+	return nil
+}
+
+// Clone returns a new VMem with the same contents that shares pages with v.
+// A page is copied only when either side writes to it, so a clone costs
+// nothing until it diverges. Pages v already copied privately are copied
+// for the clone straight away.
+// The clone reports the same StartAddr as v; always access it through the VMem.
+func (v *VMem) Clone() (*VMem, error) {
+	if v.parent != nil {
+		return nil, errors.New("cannot clone a VMem slice")
+	}
+	if v.segment != 0 {
+		return nil, errors.New("cannot clone a named segment")
+	}
+	mt, err := v.table()
+	if err != nil {
+		return nil, err
+	}
+	mt.cowLock.Lock()
+	if v.cow == nil {
+		v.cow = &cowView{image: v.StartAddr, private: make(map[uint64]uint64)}
+	}
+	mt.cowRetain(MemRegion{StartAddr: v.cow.image, Length: v.Size, Owner: v.owner})
+	private := make(map[uint64]uint64, len(v.cow.private))
+	for page, addr := range v.cow.private {
+		private[page] = addr
+	}
+	mt.cowLock.Unlock()
+
+	clone := &VMem{
+		Size:      v.Size,
+		StartAddr: v.StartAddr,
+		mem:       v.mem,
+		owner:     v.owner,
+		cow:       &cowView{image: v.cow.image, private: make(map[uint64]uint64)},
+	}
+
+	for _, page := range sortedPages(private) {
+		data, err := v.mem.Read(context.Background(), private[page], v.pageLen(page))
+		if err == nil {
+			_, err = clone.privatize(mt, page, data)
+		}
+		if err != nil {
+			// Drops the image reference and the pages copied so far
+			clone.Free()
+			return nil, err
+		}
+	}
+
+	return clone, nil
+}
+
+// Slice returns a VMem for the `length` bytes at `offset` in v. It shares v's
+// memory: writes through either are seen by both, including copy-on-write
+// and resizing of v. The slice is bounds-checked against its own length, so a
+// task given a slice cannot reach the rest of v. A slice of a slice is a
+// slice of the same VMem, and a slice of a read-only VMem is read-only.
+// StartAddr of a slice is its address when it was made.
+func (v *VMem) Slice(offset uint64, length uint64) (*VMem, error) {
+	if offset > v.Size || length > v.Size-offset {
+		return nil, fmt.Errorf("slice [%d, %d) out of bounds for size %d", offset, offset+length, v.Size)
+	}
+	root, base := v, offset
+	if v.parent != nil {
+		root, base = v.parent, v.base+offset
+	}
+	return &VMem{
+		Size:      length,
+		StartAddr: v.StartAddr + offset,
+		mem:       v.mem,
+		owner:     v.owner,
+		parent:    root,
+		base:      base,
+		readOnly:  v.readOnly,
+	}, nil
+}
+
+// ReadOnly returns a slice of the whole of v whose writes fail with
+// ErrReadOnly. Slice it further to hand out a read-only window.
+func (v *VMem) ReadOnly() *VMem {
+	s, _ := v.Slice(0, v.Size)
+	s.readOnly = true
+	return s
+}
+
+// IsReadOnly reports whether writes to v fail with ErrReadOnly.
+func (v *VMem) IsReadOnly() bool {
+	return v.readOnly
+}
+
+// table returns the MemTable behind v.mem.
+func (v *VMem) table() (*MemTable, error) {
+	tp, ok := v.mem.(TableProvider)
+	if !ok {
+		return nil, errors.New("memory manager does not expose its MemTable")
+	}
+	return tp.MemTable(), nil
+}
+
+// pageLen returns the length of page `page` of v; the last page may be short.
+func (v *VMem) pageLen(page uint64) uint64 {
+	if (page+1)*PageSize > v.Size {
+		return v.Size - page*PageSize
+	}
+	return PageSize
+}
+
+// cowRead reads through the page map, coalescing runs of image pages.
+func (v *VMem) cowRead(offset uint64, length uint64) ([]byte, error) {
+	mt, err := v.table()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	out := make([]byte, 0, length)
+
+	for length > 0 {
+		page := offset / PageSize
+		inPage := offset % PageSize
+
+		var addr, n uint64
+		mt.cowLock.Lock()
+		if priv, ok := v.cow.private[page]; ok {
+			addr = priv + inPage
+			n = min(length, v.pageLen(page)-inPage)
+		} else {
+			// Extend over following pages that are still read from the image
+			addr = v.cow.image + offset
+			n = v.pageLen(page) - inPage
+			for next := page + 1; n < length; next++ {
+				if _, ok := v.cow.private[next]; ok || next*PageSize >= v.Size {
+					break
+				}
+				n += v.pageLen(next)
+			}
+			n = min(n, length)
+		}
+		mt.cowLock.Unlock()
+
+		data, err := v.mem.Read(ctx, addr, n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data...)
+		offset += n
+		length -= n
+	}
+
+	return out, nil
+}
+
+// cowWrite writes page by page, copying shared pages before modifying them.
+// The page state is looked up under the cowLock, the I/O runs without it.
+func (v *VMem) cowWrite(offset uint64, data []byte) error {
+	mt, err := v.table()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for len(data) > 0 {
+		page := offset / PageSize
+		inPage := offset % PageSize
+		n := min(uint64(len(data)), v.pageLen(page)-inPage)
+
+		mt.cowLock.Lock()
+		addr, ok := v.cow.private[page]
+		shared := !ok && mt.cowShared(v.cow.image, page)
+		mt.cowLock.Unlock()
+
+		switch {
+		case ok:
+			addr += inPage
+		case shared:
+			// Copy the page away before the first write
+			current, err := v.mem.Read(ctx, v.cow.image+page*PageSize, v.pageLen(page))
+			if err != nil {
+				return err
+			}
+			copy(current[inPage:], data[:n])
+			done, err := v.privatize(mt, page, current)
+			if err != nil {
+				return err
+			}
+			if done {
+				offset += n
+				data = data[n:]
+			}
+			// Otherwise another writer privatized the page first, go again
+			continue
+		default:
+			// Last sharer of this page, write in place
+			addr = v.cow.image + offset
+		}
+
+		if err := v.mem.Write(ctx, addr, data[:n]); err != nil {
+			return err
+		}
+		offset += n
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// privatize gives v its own copy of `page` filled with contents. The copy is
+// made without the cowLock and only published under it. Returns false, with
+// the copy dropped, if v already had a private page there by then.
+func (v *VMem) privatize(mt *MemTable, page uint64, contents []byte) (bool, error) {
+	region, err := v.mem.AllocRegion(v.pageLen(page), v.owner)
+	if err != nil {
+		return false, fmt.Errorf("copy-on-write page allocation failed: %w", err)
+	}
+	if err := v.mem.Write(context.Background(), region.StartAddr, contents); err != nil {
+		v.mem.FreeRegion(region.StartAddr)
+		return false, err
+	}
+
+	mt.cowLock.Lock()
+	if _, ok := v.cow.private[page]; ok {
+		mt.cowLock.Unlock()
+		return false, v.mem.FreeRegion(region.StartAddr)
+	}
+	v.cow.private[page] = region.StartAddr
+	mt.cowDiverge(v.cow.image, page)
+	mt.cowLock.Unlock()
+	return true, nil
+}
+
+func sortedPages(pages map[uint64]uint64) []uint64 {
+	keys := make([]uint64, 0, len(pages))
+	for page := range pages {
+		keys = append(keys, page)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
 }
@@ -0,0 +1,122 @@
+package sharedmem
+
+import (
+	"errors"
+	"io"
+)
+
+// IOChunkSize caps the bytes moved per memory manager call by the io methods
+// of VMem, so large copies do not turn into huge RPC messages.
+const IOChunkSize = 1 << 20
+
+var (
+	_ io.ReaderAt = (*VMem)(nil)
+	_ io.WriterAt = (*VMem)(nil)
+
+	_ io.ReadWriteSeeker = (*Cursor)(nil)
+)
+
+// ReadAt implements io.ReaderAt. Reads stopping at the end of the VMem
+// return io.EOF.
+func (v *VMem) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if uint64(off) >= v.Size {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	n := min(uint64(len(p)), v.Size-uint64(off))
+	for done := uint64(0); done < n; {
+		chunk := min(n-done, IOChunkSize)
+		data, err := v.Read(uint64(off)+done, chunk)
+		if err != nil {
+			return int(done), err
+		}
+		copy(p[done:], data)
+		done += chunk
+	}
+	if n < uint64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// WriteAt implements io.WriterAt. A VMem does not grow; writes running past
+// its end write what fits and return io.ErrShortWrite.
+func (v *VMem) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if uint64(off) > v.Size {
+		return 0, io.ErrShortWrite
+	}
+
+	n := min(uint64(len(p)), v.Size-uint64(off))
+	for done := uint64(0); done < n; {
+		chunk := min(n-done, IOChunkSize)
+		if err := v.Write(uint64(off)+done, p[done:done+chunk]); err != nil {
+			return int(done), err
+		}
+		done += chunk
+	}
+	if n < uint64(len(p)) {
+		return int(n), io.ErrShortWrite
+	}
+	return int(n), nil
+}
+
+// Cursor reads and writes a VMem sequentially, like a file. It implements
+// io.Reader, io.Writer and io.Seeker. A Cursor is not safe for concurrent use;
+// give each goroutine its own.
+type Cursor struct {
+	v   *VMem
+	pos int64
+}
+
+// Cursor returns a cursor positioned at the start of v.
+func (v *VMem) Cursor() *Cursor {
+	return &Cursor{v: v}
+}
+
+// Read implements io.Reader.
+func (c *Cursor) Read(p []byte) (int, error) {
+	n, err := c.v.ReadAt(p, c.pos)
+	c.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		// Report EOF on the next call, as most readers do
+		err = nil
+	}
+	return n, err
+}
+
+// Write implements io.Writer.
+func (c *Cursor) Write(p []byte) (int, error) {
+	n, err := c.v.WriteAt(p, c.pos)
+	c.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker. Seeking past the end is allowed; reads there
+// return io.EOF and writes fail.
+func (c *Cursor) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = c.pos + offset
+	case io.SeekEnd:
+		pos = int64(c.v.Size) + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	c.pos = pos
+	return pos, nil
+}
@@ -8,9 +8,27 @@ import (
 const PageSize = 4096 // 4KB
 
 // AllocPages tries to allocate `numPages` worth of memory for `owner`.
+// With the buddy backend the pages come from one power-of-two block.
 func (mt *MemTable) AllocPages(numPages uint64, owner string) ([]MemRegion, error) {
+	mt.Mu.RLock()
+	backend := mt.pageBackend
+	mt.Mu.RUnlock()
+
+	if backend == PageBackendBuddy {
+		mt.OwnershipLock.Lock()
+		defer mt.OwnershipLock.Unlock()
+		mt.Mu.Lock()
+		defer mt.Mu.Unlock()
+		return mt.allocBuddyPages(numPages, owner)
+	}
+
 	totalSize := numPages * PageSize
-	region, err := mt.AllocRegion(totalSize, owner)
+	region, err := mt.Alloc(AllocRequest{
+		Size:      totalSize,
+		Align:     PageSize,
+		Owner:     owner,
+		OwnerOnly: true,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -27,9 +45,12 @@ func (mt *MemTable) AllocPages(numPages uint64, owner string) ([]MemRegion, erro
 
 	mt.OwnershipLock.Lock()
 	defer mt.OwnershipLock.Unlock()
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
+
+	// Each page replaces the region it was carved from; the first page reuses its key
 	for _, p := range pages {
-		mt.Allocations[p.StartAddr] = p
-		mt.Regions = append(mt.Regions, p)
+		mt.insertAlloc(p)
 	}
 
 	return pages, nil
@@ -39,16 +60,25 @@ func (mt *MemTable) AllocPages(numPages uint64, owner string) ([]MemRegion, erro
 func (mt *MemTable) FreePages(pages []MemRegion) error {
 	mt.OwnershipLock.Lock()
 	defer mt.OwnershipLock.Unlock()
+	mt.Mu.Lock()
+	defer mt.Mu.Unlock()
 
 	for _, p := range pages {
+		if buddy, err := mt.freeBuddyPage(p.StartAddr); buddy {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		if _, ok := mt.Allocations[p.StartAddr]; !ok {
 			return fmt.Errorf("page at 0x%x not allocated", p.StartAddr)
 		}
-		delete(mt.Allocations, p.StartAddr)
-		mt.FreeRegions = append(mt.FreeRegions, p)
+		mt.removeAlloc(p.StartAddr)
+		mt.forget(p)
+		mt.release(p)
 	}
 
-	mt.MergeFreeRegions()
 	return nil
 }
 
@@ -56,12 +86,15 @@ func (mt *MemTable) FreePages(pages []MemRegion) error {
 func (mt *MemTable) TranslatePage(addr uint64) (string, uint64, error) {
 	mt.OwnershipLock.RLock()
 	defer mt.OwnershipLock.RUnlock()
+	mt.Mu.RLock()
+	defer mt.Mu.RUnlock()
 
-	region, ok := mt.Allocations[addr-(addr%PageSize)]
+	region, ok := mt.Regions.Find(addr)
 	if !ok {
 		return "", 0, errors.New("address not mapped to a valid page")
 	}
 
-	offset := addr - region.StartAddr
-	return region.Owner, offset, nil
+	// Resolve through the page table; the offset is within the page
+	owner, _ := mt.physAddr(addr, region)
+	return owner, addr & pageOffsMask, nil
 }
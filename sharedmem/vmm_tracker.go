@@ -12,6 +12,11 @@ type TaskMemoryTracker struct {
 	AllocLock sync.Mutex
 	// Map taskID -> list of allocated regions
 	TaskAllocations map[string][]MemRegion
+	// Map shared handle -> region and the tasks referencing it
+	Shared     map[SharedHandle]*SharedRegion
+	nextShared SharedHandle
+	// Map taskID -> isolated address space
+	Spaces map[string]*AddressSpace
 }
 
 // NewTaskMemoryTracker creates a new tracker with given MemTable
@@ -19,6 +24,8 @@ func NewTaskMemoryTracker(mt *MemTable) *TaskMemoryTracker {
 	return &TaskMemoryTracker{
 		mt:              mt,
 		TaskAllocations: make(map[string][]MemRegion),
+		Shared:          make(map[SharedHandle]*SharedRegion),
+		Spaces:          make(map[string]*AddressSpace),
 	}
 }
 
@@ -39,25 +46,66 @@ func (t *TaskMemoryTracker) AllocPagesForTask(taskID string, size uint64, owner
 
 // FreeTaskPages frees all memory regions allocated for a task.
 func (t *TaskMemoryTracker) FreeTaskPages(taskID string) error {
-	t.AllocLock.Lock()
-	defer t.AllocLock.Unlock()
+	return t.FreeTaskWith(taskID, t.mt.FreeRegion)
+}
 
+// FreeTaskWith is FreeTaskPages with every region released through free, for
+// callers whose frees have to go beyond the local table. AllocLock is not held
+// while free runs, so it may take as long as it needs.
+func (t *TaskMemoryTracker) FreeTaskWith(taskID string, free func(startAddr uint64) error) error {
+	t.AllocLock.Lock()
 	regions, ok := t.TaskAllocations[taskID]
-	if !ok {
+	regions = append([]MemRegion(nil), regions...)
+	shared := t.sharesOf(taskID)
+	_, hasSpace := t.Spaces[taskID]
+	t.AllocLock.Unlock()
+	if !ok && len(shared) == 0 {
+		if hasSpace {
+			t.closeSpace(taskID)
+			return nil
+		}
 		return fmt.Errorf("no allocations found for task %s", taskID)
 	}
 
 	for _, region := range regions {
-		err := t.mt.FreeRegion(region.StartAddr)
+		err := free(region.StartAddr)
 		if err != nil {
 			return fmt.Errorf("failed to free region at 0x%x: %w", region.StartAddr, err)
 		}
+		// Drop each region as it goes, so a retry after a failure frees only the rest
+		t.AllocLock.Lock()
+		t.removeTaskRegion(taskID, region.StartAddr)
+		if as, ok := t.Spaces[taskID]; ok {
+			as.unmapGlobal(region.StartAddr)
+		}
+		t.AllocLock.Unlock()
+	}
+
+	// Shared regions only go away with their last reference
+	for _, h := range shared {
+		region, last, err := t.DetachAll(taskID, h)
+		if err != nil {
+			return err
+		}
+		if last {
+			if err := free(region.StartAddr); err != nil {
+				return fmt.Errorf("failed to free shared region at 0x%x: %w", region.StartAddr, err)
+			}
+		}
 	}
 
-	delete(t.TaskAllocations, taskID)
+	// The space goes last, so memory that failed to free stays reachable through it
+	t.closeSpace(taskID)
 	return nil
 }
 
+// closeSpace drops taskID's address space.
+func (t *TaskMemoryTracker) closeSpace(taskID string) {
+	t.AllocLock.Lock()
+	delete(t.Spaces, taskID)
+	t.AllocLock.Unlock()
+}
+
 // GetTaskAllocations returns the allocated regions for a task.
 func (t *TaskMemoryTracker) GetTaskAllocations(taskID string) ([]MemRegion, bool) {
 	t.AllocLock.Lock()
@@ -66,3 +114,51 @@ func (t *TaskMemoryTracker) GetTaskAllocations(taskID string) ([]MemRegion, bool
 	regions, ok := t.TaskAllocations[taskID]
 	return regions, ok
 }
+
+// ForgetRegion removes the region starting at startAddr from whichever task
+// recorded it, without freeing it. Returns the task ID it belonged to.
+func (t *TaskMemoryTracker) ForgetRegion(startAddr uint64) (string, bool) {
+	t.AllocLock.Lock()
+	defer t.AllocLock.Unlock()
+
+	for taskID := range t.TaskAllocations {
+		if _, ok := t.removeTaskRegion(taskID, startAddr); ok {
+			if as, ok := t.Spaces[taskID]; ok {
+				as.unmapGlobal(startAddr)
+			}
+			return taskID, true
+		}
+	}
+	for h, sr := range t.Shared {
+		if sr.Region.StartAddr == startAddr {
+			for holder := range sr.Refs {
+				if as, ok := t.Spaces[holder]; ok {
+					as.unmapGlobal(startAddr)
+				}
+			}
+			delete(t.Shared, h)
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// removeTaskRegion drops the region starting at startAddr from taskID's
+// allocations and returns it.
+// Do not call without locking AllocLock.
+func (t *TaskMemoryTracker) removeTaskRegion(taskID string, startAddr uint64) (MemRegion, bool) {
+	regions := t.TaskAllocations[taskID]
+	for i, r := range regions {
+		if r.StartAddr != startAddr {
+			continue
+		}
+		regions = append(regions[:i], regions[i+1:]...)
+		if len(regions) == 0 {
+			delete(t.TaskAllocations, taskID)
+		} else {
+			t.TaskAllocations[taskID] = regions
+		}
+		return r, true
+	}
+	return MemRegion{}, false
+}
@@ -0,0 +1,277 @@
+package tests
+
+import (
+	"bigLITTLE/agent"
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc/jsonrpc"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTaskAddressSpacesAreIsolated(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 4 << 20, Owner: "local"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	tracker := sharedmem.NewTaskMemoryTracker(mt)
+
+	a, err := tracker.AllocForTask("a", 3*sharedmem.PageSize, "local")
+	if err != nil {
+		t.Fatalf("AllocForTask(a) failed: %v", err)
+	}
+	b, err := tracker.AllocForTask("b", 100, "local")
+	if err != nil {
+		t.Fatalf("AllocForTask(b) failed: %v", err)
+	}
+	if a != sharedmem.TaskBase || b != sharedmem.TaskBase {
+		t.Fatalf("task addresses = 0x%x, 0x%x, want both at 0x%x", a, b, sharedmem.TaskBase)
+	}
+
+	spaceA, _ := tracker.Space("a")
+	spaceB, _ := tracker.Space("b")
+	extA, err := spaceA.Resolve(a, 10)
+	if err != nil {
+		t.Fatalf("Resolve(a) failed: %v", err)
+	}
+	extB, err := spaceB.Resolve(b, 10)
+	if err != nil {
+		t.Fatalf("Resolve(b) failed: %v", err)
+	}
+	if extA[0].Global == extB[0].Global {
+		t.Fatalf("tasks share global address 0x%x", extA[0].Global)
+	}
+
+	// b only mapped one page; a's second page is not reachable from b
+	if _, err := spaceB.Resolve(b+sharedmem.PageSize, 1); err == nil {
+		t.Fatalf("task b reached past its mapping")
+	}
+
+	// Share a's region with b
+	h, err := tracker.ShareForTask("a", a)
+	if err != nil {
+		t.Fatalf("ShareForTask failed: %v", err)
+	}
+	shared, err := tracker.MapShared("b", h)
+	if err != nil {
+		t.Fatalf("MapShared failed: %v", err)
+	}
+	extShared, err := spaceB.Resolve(shared+sharedmem.PageSize, 10)
+	if err != nil {
+		t.Fatalf("Resolve(shared) failed: %v", err)
+	}
+	if extShared[0].Global != extA[0].Global+sharedmem.PageSize {
+		t.Fatalf("shared mapping resolves to 0x%x, want 0x%x", extShared[0].Global, extA[0].Global+sharedmem.PageSize)
+	}
+
+	// The shared region outlives a, and goes away with b's last reference
+	if err := tracker.FreeTaskPages("a"); err != nil {
+		t.Fatalf("FreeTaskPages(a) failed: %v", err)
+	}
+	if _, ok := tracker.Space("a"); ok {
+		t.Fatalf("address space of a still open")
+	}
+	if _, err := spaceB.Resolve(shared, 1); err != nil {
+		t.Fatalf("shared mapping lost with its creator: %v", err)
+	}
+	if err := tracker.FreeForTask("b", shared); err != nil {
+		t.Fatalf("FreeForTask(shared) failed: %v", err)
+	}
+	if err := tracker.FreeForTask("b", b); err != nil {
+		t.Fatalf("FreeForTask(b) failed: %v", err)
+	}
+	if len(spaceB.Mappings()) != 0 {
+		t.Fatalf("mappings left in b: %+v", spaceB.Mappings())
+	}
+	if free := mt.TotalFreeBytes(); free != 4<<20 {
+		t.Fatalf("TotalFreeBytes = %d, want %d", free, 4<<20)
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
+
+func TestFreeTaskKeepsSpaceUntilFreed(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "local"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	tracker := sharedmem.NewTaskMemoryTracker(mt)
+
+	first, _ := tracker.AllocForTask("a", 100, "local")
+	second, err := tracker.AllocForTask("a", 100, "local")
+	if err != nil {
+		t.Fatalf("AllocForTask failed: %v", err)
+	}
+	space, _ := tracker.Space("a")
+	ext, _ := space.Resolve(second, 1)
+	stuck := ext[0].Global &^ (sharedmem.PageSize - 1)
+
+	failing := func(addr uint64) error {
+		if addr == stuck {
+			return errors.New("owner unreachable")
+		}
+		return mt.FreeRegion(addr)
+	}
+	if err := tracker.FreeTaskWith("a", failing); err == nil {
+		t.Fatalf("FreeTaskWith succeeded with a failing free")
+	}
+
+	// What was freed is unmapped, what was not stays reachable
+	if _, ok := tracker.Space("a"); !ok {
+		t.Fatalf("address space dropped with memory still in it")
+	}
+	if _, err := space.Resolve(first, 1); err == nil {
+		t.Fatalf("freed region still mapped")
+	}
+	if _, err := space.Resolve(second, 1); err != nil {
+		t.Fatalf("region that failed to free is unreachable: %v", err)
+	}
+
+	if err := tracker.FreeTaskPages("a"); err != nil {
+		t.Fatalf("FreeTaskPages failed on retry: %v", err)
+	}
+	if _, ok := tracker.Space("a"); ok {
+		t.Fatalf("address space still open after its memory was freed")
+	}
+	if free := mt.TotalFreeBytes(); free != 1<<20 {
+		t.Fatalf("TotalFreeBytes = %d, want %d", free, 1<<20)
+	}
+}
+
+// stubRunner stands in for the Python interpreter. It runs fn for every
+// call and answers like python_exec does.
+type stubRunner struct {
+	calls []string
+	fn    func() error
+}
+
+func (r *stubRunner) Exec(code string) (string, error) {
+	r.calls = append(r.calls, code)
+	if err := r.fn(); err != nil {
+		return "ERROR: " + err.Error() + "\n", nil
+	}
+	return "OK\n", nil
+}
+
+func TestRunTaskInsideAddressSpace(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	tracker := sharedmem.NewTaskMemoryTracker(mem.Table)
+	tasks := agent.NewTaskMemoryManager(mem, tracker)
+	ctx := context.Background()
+
+	// The task allocates and writes through its space, as TaskMemory would
+	var runner *stubRunner
+	runner = &stubRunner{fn: func() error {
+		token := taskToken(t, runner.calls[len(runner.calls)-1])
+		if id, ok := tasks.TaskForToken(token); !ok || id != "job" {
+			return fmt.Errorf("token names %q, %v while the task runs", id, ok)
+		}
+		addr, err := tasks.AllocTask("job", 64, "")
+		if err != nil {
+			return err
+		}
+		return tasks.WriteTask(ctx, "job", addr, []byte("scratch"))
+	}}
+	tasks.Runner = runner
+
+	out, err := tasks.RunTask(ctx, "job", "python", "x = 1\nprint(x)")
+	if err != nil || out != "OK" {
+		t.Fatalf("RunTask = %q, %v", out, err)
+	}
+	if len(runner.calls) != 1 || strings.Contains(runner.calls[0], "\n") {
+		t.Fatalf("runner got %q, want one line binding the task's space", runner.calls)
+	}
+	if _, ok := tasks.TaskForToken(taskToken(t, runner.calls[0])); ok {
+		t.Fatalf("task token still valid after the task returned")
+	}
+	if _, ok := tracker.Space("job"); ok {
+		t.Fatalf("address space left open after the task returned")
+	}
+	if free := mem.Table.TotalFreeBytes(); free != 1<<20 {
+		t.Fatalf("task memory not freed: TotalFreeBytes = %d", free)
+	}
+
+	runner.fn = func() error { return errors.New("boom") }
+	if _, err := tasks.RunTask(ctx, "job", "python", "raise"); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("RunTask of a failing task = %v, want the task's error", err)
+	}
+	if _, err := tasks.RunTask(ctx, "job", "bin", "/bin/true"); err == nil {
+		t.Fatalf("RunTask accepted an unsupported task type")
+	}
+}
+
+// taskToken returns the token RunTask bound `task` to in a runner call.
+func taskToken(t *testing.T, call string) string {
+	m := regexp.MustCompile(`TaskMemory\(agent, "([0-9a-f]+)"\)`).FindStringSubmatch(call)
+	if m == nil {
+		t.Fatalf("runner call %q binds no task token", call)
+	}
+	return m[1]
+}
+
+func TestJSONRPCOnlyReachesTaskAddresses(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	tasks := agent.NewTaskMemoryManager(mem, sharedmem.NewTaskMemoryTracker(mem.Table))
+	tasks.OpenSpace("job")
+	token, err := tasks.IssueToken("job")
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go rpc.ServeJSONRPC(listener, mem, tasks)
+
+	client, err := jsonrpc.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	var alloc rpc.TaskAllocResponse
+	if err := client.Call("RPCServer.TaskAlloc", &rpc.TaskAllocRequest{Token: token, Size: 16}, &alloc); err != nil {
+		t.Fatalf("TaskAlloc failed: %v", err)
+	}
+	var resp rpc.MemoryResponse
+	write := &rpc.TaskWriteRequest{Token: token, Address: alloc.Address, Data: []byte("task data")}
+	if err := client.Call("RPCServer.TaskWrite", write, &resp); err != nil {
+		t.Fatalf("TaskWrite failed: %v", err)
+	}
+	if err := client.Call("RPCServer.TaskRead", &rpc.TaskMemoryRequest{Token: token, Address: alloc.Address, Size: 9}, &resp); err != nil {
+		t.Fatalf("TaskRead failed: %v", err)
+	}
+	if string(resp.Data) != "task data" {
+		t.Fatalf("TaskRead = %q", resp.Data)
+	}
+
+	// A task is named by its token; a TaskID in the request is not trusted
+	forged := &rpc.TaskMemoryRequest{TaskID: "job", Address: alloc.Address, Size: 9}
+	if err := client.Call("RPCServer.TaskRead", forged, &resp); err == nil {
+		t.Fatalf("TaskRead served a request naming the task by TaskID")
+	}
+	tasks.RevokeToken(token)
+	if err := client.Call("RPCServer.TaskRead", &rpc.TaskMemoryRequest{Token: token, Address: alloc.Address, Size: 9}, &resp); err == nil {
+		t.Fatalf("TaskRead served a revoked token")
+	}
+
+	// Global and physical addresses are not served to tasks at all
+	if err := client.Call("RPCServer.ReadMemory", &rpc.MemoryRequest{Address: 0, Size: 9}, &resp); err == nil {
+		t.Fatalf("ReadMemory served over JSON-RPC")
+	}
+	if err := client.Call("RPCServer.WritePhys", &rpc.PhysWriteRequest{Offset: 0, Data: []byte("x")}, &resp); err == nil {
+		t.Fatalf("WritePhys served over JSON-RPC")
+	}
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"testing"
+)
+
+func TestAlignedConstrainedAlloc(t *testing.T) {
+	memTable, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 64 * 1024, Owner: "a"},
+		{StartAddr: 64 * 1024, Length: 64 * 1024, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create MemTable: %v", err)
+	}
+
+	// Knock the free region off alignment
+	if _, err := memTable.AllocRegion(100, "a"); err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+
+	region, err := memTable.Alloc(sharedmem.AllocRequest{Size: 1000, Align: 4096, Owner: "a", OwnerOnly: true})
+	if err != nil {
+		t.Fatalf("Aligned Alloc failed: %v", err)
+	}
+	if region.StartAddr != 4096 {
+		t.Errorf("Expected aligned start 0x1000, got 0x%x", region.StartAddr)
+	}
+
+	// Padding below and the tail above stay free and separate
+	free := memTable.GetFreeRegionsForTesting()
+	want := []sharedmem.MemRegion{
+		{StartAddr: 100, Length: 4096 - 100, Owner: "a"},
+		{StartAddr: 4096 + 1000, Length: 64*1024 - 4096 - 1000, Owner: "a"},
+		{StartAddr: 64 * 1024, Length: 64 * 1024, Owner: "b"},
+	}
+	if len(free) != len(want) {
+		t.Fatalf("Free regions = %+v, want %+v", free, want)
+	}
+	for i := range want {
+		if free[i] != want[i] {
+			t.Errorf("Free region %d = %+v, want %+v", i, free[i], want[i])
+		}
+	}
+
+	// Freeing merges everything back together
+	if err := memTable.FreeRegion(region.StartAddr); err != nil {
+		t.Fatalf("FreeRegion failed: %v", err)
+	}
+	if free := memTable.GetFreeRegionsForTesting(); len(free) != 2 || free[0].StartAddr != 100 {
+		t.Errorf("Fragments were not merged: %+v", free)
+	}
+
+	// Address constraints and owner fallback
+	region, err = memTable.Alloc(sharedmem.AllocRequest{Size: 512, MinAddr: 100 * 1024, Owner: "a"})
+	if err != nil {
+		t.Fatalf("Constrained Alloc failed: %v", err)
+	}
+	if region.Owner != "b" || region.StartAddr != 100*1024 {
+		t.Errorf("Expected fallback to b at 0x%x, got %+v", 100*1024, region)
+	}
+	if _, err := memTable.Alloc(sharedmem.AllocRequest{Size: 512, MinAddr: 100 * 1024, Owner: "a", OwnerOnly: true}); err == nil {
+		t.Errorf("OwnerOnly request outside a's range should fail")
+	}
+	if _, err := memTable.Alloc(sharedmem.AllocRequest{Size: 512, MaxAddr: 100, Owner: "a"}); err == nil {
+		t.Errorf("Request below MaxAddr 100 should fail")
+	}
+}
+
+func TestFitStrategies(t *testing.T) {
+	memTable, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 3000, Owner: "a"},
+		{StartAddr: 10000, Length: 1000, Owner: "b"},
+		{StartAddr: 20000, Length: 2000, Owner: "c"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create MemTable: %v", err)
+	}
+
+	cases := []struct {
+		fit   sharedmem.FitStrategy
+		owner string
+	}{
+		{sharedmem.FirstFit, "a"},
+		{sharedmem.BestFit, "b"},
+		{sharedmem.WorstFit, "a"},
+	}
+	for _, c := range cases {
+		region, err := memTable.Alloc(sharedmem.AllocRequest{Size: 500, Fit: c.fit})
+		if err != nil {
+			t.Fatalf("Alloc with fit %d failed: %v", c.fit, err)
+		}
+		if region.Owner != c.owner {
+			t.Errorf("Fit %d picked %s, want %s", c.fit, region.Owner, c.owner)
+		}
+		memTable.FreeRegion(region.StartAddr)
+	}
+}
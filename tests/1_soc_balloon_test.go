@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"bigLITTLE/agent"
+	"bigLITTLE/sharedmem"
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestLendAndReclaim(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "big"},
+		{StartAddr: 1 << 20, Length: 64 << 10, Owner: "little"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	mem := agent.NewMemoryManager("big", mt, 1<<20, "big")
+	ctx := context.Background()
+
+	// The little SoC cannot fit this until the big one lends it memory
+	if _, err := mt.AllocRegion(100<<10, "little"); err == nil {
+		t.Fatalf("little SoC allocated more than it has")
+	}
+	loan, err := mem.Lend("little", 256<<10)
+	if err != nil {
+		t.Fatalf("Lend failed: %v", err)
+	}
+	if loan.Region.Owner != "little" || loan.Lender != "big" || loan.Region.Length != 256<<10 {
+		t.Fatalf("loan = %+v", loan)
+	}
+	h, err := mt.AllocMovable(100<<10, "little")
+	if err != nil {
+		t.Fatalf("allocation in borrowed memory failed: %v", err)
+	}
+	region, _ := mt.Resolve(h)
+	if region.Owner != "little" {
+		t.Fatalf("borrowed allocation owned by %s", region.Owner)
+	}
+	pattern := bytes.Repeat([]byte("balloon!"), 1024)
+	if err := mem.Write(ctx, region.StartAddr, pattern); err != nil {
+		t.Fatalf("Write to borrowed memory failed: %v", err)
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify with a loan failed: %v", err)
+	}
+
+	// Reclaiming moves the borrower's block out, the handle follows it
+	if err := mem.Reclaim(loan.Region.StartAddr); err != nil {
+		t.Fatalf("Reclaim failed: %v", err)
+	}
+	moved, err := mt.Resolve(h)
+	if err != nil || (moved.StartAddr < loan.Region.StartAddr+loan.Region.Length && loan.Region.StartAddr < moved.StartAddr+moved.Length) {
+		t.Fatalf("block still inside the reclaimed range: %+v, %v", moved, err)
+	}
+	got, err := mem.Read(ctx, moved.StartAddr, uint64(len(pattern)))
+	if err != nil || !bytes.Equal(got, pattern) {
+		t.Fatalf("contents lost on reclaim: %v", err)
+	}
+	if len(mt.Loans()) != 0 {
+		t.Fatalf("loan still recorded after reclaim")
+	}
+	if err := mem.Reclaim(loan.Region.StartAddr); err == nil {
+		t.Fatalf("second Reclaim succeeded")
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify after reclaim failed: %v", err)
+	}
+	if err := mem.FreeHandle(h); err != nil {
+		t.Fatalf("FreeHandle failed: %v", err)
+	}
+	if free := mt.TotalFreeBytes(); free != 1<<20+64<<10 {
+		t.Fatalf("TotalFreeBytes = %d after reclaim", free)
+	}
+}
+
+func TestReclaimStaysOnBorrowerAndLender(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "big"},
+		{StartAddr: 1 << 20, Length: 64 << 10, Owner: "little"},
+		{StartAddr: 2 << 20, Length: 1 << 20, Owner: "other"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	mem := agent.NewMemoryManager("big", mt, 1<<20, "big")
+	mem.SoftLimit = 1 << 40
+
+	loan, err := mem.Lend("little", 256<<10)
+	if err != nil {
+		t.Fatalf("Lend failed: %v", err)
+	}
+	borrowed, err := mt.Alloc(sharedmem.AllocRequest{Size: 100 << 10, Owner: "little", OwnerOnly: true})
+	if err != nil {
+		t.Fatalf("allocation in borrowed memory failed: %v", err)
+	}
+	filler, err := mt.Alloc(sharedmem.AllocRequest{Size: mt.FreeBytes("big"), Owner: "big", OwnerOnly: true})
+	if err != nil {
+		t.Fatalf("filling the lender failed: %v", err)
+	}
+	noCopy := func(src, dst sharedmem.MemRegion, length uint64) error { return nil }
+
+	// Neither the borrower nor the lender has room, and a third SoC is no place for it
+	if err := mt.Reclaim(loan.Region.StartAddr, noCopy); err == nil {
+		t.Fatalf("Reclaim moved the borrower's block onto another SoC")
+	}
+	if free := mt.FreeBytes("other"); free != 1<<20 {
+		t.Fatalf("other SoC has %d free bytes, want all of it", free)
+	}
+	if err := mt.FreeRegion(filler.StartAddr); err != nil {
+		t.Fatalf("FreeRegion failed: %v", err)
+	}
+
+	// A block freed by raw address during its copy is not published
+	freeing := func(src, dst sharedmem.MemRegion, length uint64) error {
+		return mt.FreeRegion(src.StartAddr)
+	}
+	if err := mt.Reclaim(loan.Region.StartAddr, freeing); err != nil {
+		t.Fatalf("Reclaim failed: %v", err)
+	}
+	if _, ok := mt.Allocations[borrowed.StartAddr]; ok {
+		t.Fatalf("freed block still allocated after reclaim")
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify after reclaim failed: %v", err)
+	}
+	if free := mt.TotalFreeBytes(); free != 2<<20+64<<10 {
+		t.Fatalf("TotalFreeBytes = %d after reclaim", free)
+	}
+}
+
+func TestLoanLookupAndPinnedImages(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "big"},
+		{StartAddr: 1 << 20, Length: 64 << 10, Owner: "little"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	mem := agent.NewMemoryManager("big", mt, 1<<20, "big")
+	mem.SoftLimit = 1 << 40
+
+	var loans []sharedmem.Loan
+	for i := 0; i < 3; i++ {
+		loan, err := mem.Lend("little", 128<<10)
+		if err != nil {
+			t.Fatalf("Lend failed: %v", err)
+		}
+		loans = append(loans, loan)
+	}
+	for _, loan := range loans {
+		for _, addr := range []uint64{loan.Region.StartAddr, loan.Region.StartAddr + loan.Region.Length - 1} {
+			if got, ok := mt.LoanAt(addr); !ok || got != loan {
+				t.Fatalf("LoanAt(0x%x) = %+v, %v, want %+v", addr, got, ok, loan)
+			}
+		}
+	}
+	if got, ok := mt.LoanAt(1 << 20); ok {
+		t.Fatalf("LoanAt in the borrower's own slot = %+v", got)
+	}
+
+	// The index survives a round trip through a snapshot
+	restored, err := sharedmem.TableFromSnapshot(mt.Snapshot())
+	if err != nil {
+		t.Fatalf("TableFromSnapshot failed: %v", err)
+	}
+	if got, ok := restored.LoanAt(loans[1].Region.StartAddr + 10); !ok || got != loans[1] {
+		t.Fatalf("restored LoanAt = %+v, %v", got, ok)
+	}
+
+	// A copy-on-write image in borrowed memory pins its loan
+	v, err := sharedmem.New(100<<10, mem, "little")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	pinned, ok := mt.LoanAt(v.StartAddr)
+	if !ok {
+		t.Fatalf("VMem at 0x%x is not in borrowed memory", v.StartAddr)
+	}
+	clone, err := v.Clone()
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	if err := mem.Reclaim(pinned.Region.StartAddr); err == nil {
+		t.Fatalf("Reclaim moved a copy-on-write image")
+	}
+	if err := clone.Free(); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if err := v.Free(); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+
+	for _, loan := range loans {
+		if err := mem.Reclaim(loan.Region.StartAddr); err != nil {
+			t.Fatalf("Reclaim failed: %v", err)
+		}
+		if _, ok := mt.LoanAt(loan.Region.StartAddr); ok {
+			t.Fatalf("loan at 0x%x still found after Reclaim", loan.Region.StartAddr)
+		}
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"testing"
+)
+
+func TestBuddyPagesSplitAndCoalesce(t *testing.T) {
+	memTable, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 16 * 1024 * 1024, Owner: "local"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create MemTable: %v", err)
+	}
+	memTable.SetPageBackend(sharedmem.PageBackendBuddy)
+
+	// 3 pages round up to a 4 page block, 1 page splits off the next block
+	a, err := memTable.AllocPages(3, "local")
+	if err != nil {
+		t.Fatalf("AllocPages(3) failed: %v", err)
+	}
+	b, err := memTable.AllocPages(1, "local")
+	if err != nil {
+		t.Fatalf("AllocPages(1) failed: %v", err)
+	}
+	if len(a) != 3 || len(b) != 1 {
+		t.Fatalf("Unexpected page counts %d and %d", len(a), len(b))
+	}
+	if b[0].StartAddr != a[0].StartAddr+4*sharedmem.PageSize {
+		t.Errorf("Expected 1-page block right after the 4-page block, got 0x%x", b[0].StartAddr)
+	}
+	if len(memTable.Allocations) != 2 {
+		t.Errorf("Expected one allocation per block, got %d", len(memTable.Allocations))
+	}
+
+	owner, offset, err := memTable.TranslatePage(a[2].StartAddr + 7)
+	if err != nil || owner != "local" || offset != 7 {
+		t.Errorf("TranslatePage = %s,%d,%v want local,7,nil", owner, offset, err)
+	}
+
+	if err := memTable.FreePages(a); err != nil {
+		t.Fatalf("FreePages(a) failed: %v", err)
+	}
+	if err := memTable.FreePages(a[:1]); err == nil {
+		t.Errorf("Double free was not detected")
+	}
+	if err := memTable.FreePages(b); err != nil {
+		t.Fatalf("FreePages(b) failed: %v", err)
+	}
+
+	// Everything coalesced and the arena went back to the free list
+	free := memTable.GetFreeRegionsForTesting()
+	if len(free) != 1 || free[0].Length != 16*1024*1024 {
+		t.Errorf("Arena was not returned: %+v", free)
+	}
+}
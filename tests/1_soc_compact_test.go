@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"bigLITTLE/agent"
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestCompactMovableBlocks(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	ctx := context.Background()
+
+	h1, _ := mem.AllocMovable(4096, "local")
+	h2, _ := mem.AllocMovable(4096, "local")
+	h3, err := mem.AllocMovable(8192, "local")
+	if err != nil {
+		t.Fatalf("AllocMovable failed: %v", err)
+	}
+	p2 := bytes.Repeat([]byte{0x22}, 4096)
+	p3 := bytes.Repeat([]byte{0x33, 0x34}, 4096)
+	if err := mem.WriteHandle(ctx, h2, 0, p2); err != nil {
+		t.Fatalf("WriteHandle failed: %v", err)
+	}
+	if err := mem.WriteHandle(ctx, h3, 0, p3); err != nil {
+		t.Fatalf("WriteHandle failed: %v", err)
+	}
+	if err := mem.FreeHandle(h1); err != nil {
+		t.Fatalf("FreeHandle failed: %v", err)
+	}
+
+	c := agent.NewCompactor(mem)
+	if moved := c.RunOnce(); moved != 4096+8192 {
+		t.Fatalf("RunOnce moved %d bytes, want %d", moved, 4096+8192)
+	}
+
+	// The handles follow their blocks down to the bottom of the range
+	if r, err := mem.Table.Resolve(h2); err != nil || r.StartAddr != 0 {
+		t.Fatalf("h2 resolves to %+v, %v, want address 0", r, err)
+	}
+	if r, err := mem.Table.Resolve(h3); err != nil || r.StartAddr != 4096 {
+		t.Fatalf("h3 resolves to %+v, %v, want address 4096", r, err)
+	}
+	if got, err := mem.ReadHandle(ctx, h2, 0, 4096); err != nil || !bytes.Equal(got, p2) {
+		t.Fatalf("h2 contents lost in the move: %v", err)
+	}
+	if got, err := mem.ReadHandle(ctx, h3, 0, 8192); err != nil || !bytes.Equal(got, p3) {
+		t.Fatalf("h3 contents lost in the move: %v", err)
+	}
+	if largest, free := mem.Table.LargestFreeRegion("local"), mem.Table.FreeBytes("local"); largest != free {
+		t.Fatalf("free space still fragmented: largest %d of %d", largest, free)
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
+
+func TestCompactSkipsPinnedBlocks(t *testing.T) {
+	mem := localManager(t, 1<<20)
+
+	a, _ := mem.AllocRegion(4096, "local")
+	b, err := mem.AllocRegion(4096, "local")
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	if err := mem.FreeRegion(a.StartAddr); err != nil {
+		t.Fatalf("FreeRegion failed: %v", err)
+	}
+
+	// b was handed out as a raw address, so it must stay where it is
+	if moved := agent.NewCompactor(mem).RunOnce(); moved != 0 {
+		t.Fatalf("RunOnce moved %d bytes of a pinned block", moved)
+	}
+	if _, ok := mem.Table.Allocations[b.StartAddr]; !ok {
+		t.Fatalf("pinned block at 0x%x was moved", b.StartAddr)
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
+
+func TestCompactRespectsBudget(t *testing.T) {
+	mem := localManager(t, 1<<20)
+
+	h1, _ := mem.AllocMovable(4096, "local")
+	h2, err := mem.AllocMovable(16384, "local")
+	if err != nil {
+		t.Fatalf("AllocMovable failed: %v", err)
+	}
+	before, _ := mem.Table.Resolve(h2)
+	if err := mem.FreeHandle(h1); err != nil {
+		t.Fatalf("FreeHandle failed: %v", err)
+	}
+
+	// A block larger than the budget is left for a pass that can afford it
+	c := agent.NewCompactor(mem)
+	c.BytesPerTick = 8192
+	if moved := c.RunOnce(); moved != 0 {
+		t.Fatalf("RunOnce moved %d bytes with a budget of %d", moved, c.BytesPerTick)
+	}
+	if r, _ := mem.Table.Resolve(h2); r.StartAddr != before.StartAddr {
+		t.Fatalf("block moved from 0x%x to 0x%x past the budget", before.StartAddr, r.StartAddr)
+	}
+
+	c.BytesPerTick = 16384
+	if moved := c.RunOnce(); moved != 16384 {
+		t.Fatalf("RunOnce moved %d bytes, want 16384", moved)
+	}
+	if r, _ := mem.Table.Resolve(h2); r.StartAddr != 0 {
+		t.Fatalf("h2 at 0x%x after compaction, want 0", r.StartAddr)
+	}
+}
@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestCloneWriteDiverges(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	free := mem.Table.TotalFreeBytes()
+
+	v, err := sharedmem.New(3*sharedmem.PageSize, mem, "local")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	orig := bytes.Repeat([]byte{0x11}, int(v.Size))
+	if err := v.Write(0, orig); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	clone, err := v.Clone()
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	if refs := mem.Table.CowRefs(v.StartAddr); refs != 2 {
+		t.Fatalf("CowRefs = %d, want 2", refs)
+	}
+	if got, _ := clone.Read(0, clone.Size); !bytes.Equal(got, orig) {
+		t.Fatalf("clone does not start with the original contents")
+	}
+
+	// A write straddling pages 0 and 1 copies both for the clone only
+	patch := []byte("diverged")
+	at := uint64(sharedmem.PageSize - 4)
+	if err := clone.Write(at, patch); err != nil {
+		t.Fatalf("clone Write failed: %v", err)
+	}
+	got, _ := clone.Read(at, uint64(len(patch)))
+	if !bytes.Equal(got, patch) {
+		t.Fatalf("clone reads %q, want %q", got, patch)
+	}
+	if got, _ := v.Read(0, v.Size); !bytes.Equal(got, orig) {
+		t.Fatalf("original changed by a write to the clone")
+	}
+
+	// Writing the original now diverges it from the clone in turn
+	if err := v.Write(at, []byte("original")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got, _ := clone.Read(at, uint64(len(patch))); !bytes.Equal(got, patch) {
+		t.Fatalf("clone changed by a write to the original: %q", got)
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	// The image outlives the first side freed and goes with the second
+	if err := v.Free(); err != nil {
+		t.Fatalf("Free of the original failed: %v", err)
+	}
+	if refs := mem.Table.CowRefs(clone.StartAddr); refs != 1 {
+		t.Fatalf("CowRefs after one Free = %d, want 1", refs)
+	}
+	if got, _ := clone.Read(0, 4); !bytes.Equal(got, orig[:4]) {
+		t.Fatalf("clone lost its image when the original was freed")
+	}
+	if err := clone.Free(); err != nil {
+		t.Fatalf("Free of the clone failed: %v", err)
+	}
+	if refs := mem.Table.CowRefs(clone.StartAddr); refs != 0 {
+		t.Fatalf("CowRefs after both Frees = %d, want 0", refs)
+	}
+	if got := mem.Table.TotalFreeBytes(); got != free {
+		t.Fatalf("TotalFreeBytes = %d after freeing both sides, want %d", got, free)
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
+
+func TestCloneCopiesPrivatePages(t *testing.T) {
+	mem := localManager(t, 1<<20)
+
+	v, _ := sharedmem.New(2*sharedmem.PageSize, mem, "local")
+	first, err := v.Clone()
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	if err := first.Write(10, []byte("private")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// A clone of a clone sees the pages its source already copied away
+	second, err := first.Clone()
+	if err != nil {
+		t.Fatalf("Clone of a clone failed: %v", err)
+	}
+	if got, _ := second.Read(10, 7); string(got) != "private" {
+		t.Fatalf("second clone reads %q, want %q", got, "private")
+	}
+	if got, _ := v.Read(10, 7); !bytes.Equal(got, make([]byte, 7)) {
+		t.Fatalf("original reads %q, want zeroes", got)
+	}
+
+	for _, m := range []*sharedmem.VMem{second, v, first} {
+		if err := m.Free(); err != nil {
+			t.Fatalf("Free failed: %v", err)
+		}
+	}
+	if got := mem.Table.TotalFreeBytes(); got != 1<<20 {
+		t.Fatalf("TotalFreeBytes = %d, want %d", got, 1<<20)
+	}
+}
+
+func TestCloneConcurrentWithVerifyAndSnapshot(t *testing.T) {
+	mem := localManager(t, 4<<20)
+	mem.SoftLimit = 1 << 40
+
+	stop := make(chan struct{})
+	verified := make(chan struct{})
+	go func() {
+		defer close(verified)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := mem.Table.Verify(); err != nil {
+				t.Errorf("Verify failed: %v", err)
+				return
+			}
+			// Snapshots taken meanwhile must be consistent on their own
+			if _, err := sharedmem.TableFromSnapshot(mem.Table.Snapshot()); err != nil {
+				t.Errorf("TableFromSnapshot failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	// Clone, write and free from several goroutines while Verify and Snapshot loop
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := sharedmem.New(4*sharedmem.PageSize, mem, "local")
+			if err != nil {
+				t.Errorf("New failed: %v", err)
+				return
+			}
+			defer v.Free()
+			for i := 0; i < 50; i++ {
+				clone, err := v.Clone()
+				if err != nil {
+					t.Errorf("Clone failed: %v", err)
+					return
+				}
+				if err := clone.Write(uint64(i)*100, []byte{byte(i)}); err != nil {
+					t.Errorf("Write failed: %v", err)
+					return
+				}
+				if err := v.Write(uint64(i)*100+1, []byte{byte(i)}); err != nil {
+					t.Errorf("Write failed: %v", err)
+					return
+				}
+				if err := clone.Free(); err != nil {
+					t.Errorf("Free failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-verified
+
+	if got := mem.Table.TotalFreeBytes(); got != 4<<20 {
+		t.Fatalf("TotalFreeBytes = %d after all VMems were freed, want %d", got, 4<<20)
+	}
+}
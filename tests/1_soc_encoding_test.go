@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// busyTable returns a table with allocations, buddy pages, a handle, a lease,
+// a label, a loan and a placed page, so a round trip exercises every part of
+// the snapshot.
+func busyTable(t *testing.T) *sharedmem.MemTable {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 8 << 20, Owner: "a"},
+		{StartAddr: 8 << 20, Length: 8 << 20, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+
+	region, err := mt.AllocRegion(3000, "a")
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	if _, err := mt.SetLease(region.StartAddr, "b", "task-1", time.Minute); err != nil {
+		t.Fatalf("SetLease failed: %v", err)
+	}
+	if err := mt.SetLabel(region.StartAddr, sharedmem.Label{Name: "buf", TaskID: "task-1", Tags: []string{"io"}}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	if _, err := mt.AllocMovable(5000, "b"); err != nil {
+		t.Fatalf("AllocMovable failed: %v", err)
+	}
+	pages, err := mt.AllocPages(2, "a")
+	if err != nil {
+		t.Fatalf("AllocPages failed: %v", err)
+	}
+	frame, err := mt.AllocFrame("b")
+	if err != nil {
+		t.Fatalf("AllocFrame failed: %v", err)
+	}
+	if err := mt.PlacePage(pages[1].StartAddr, frame); err != nil {
+		t.Fatalf("PlacePage failed: %v", err)
+	}
+
+	if _, err := mt.Lend("a", "b", 8192); err != nil {
+		t.Fatalf("Lend failed: %v", err)
+	}
+
+	// A linked segment and an unlinked one still referenced
+	for _, name := range []string{"shm-a", "shm-b"} {
+		region, err := mt.AllocRegion(4096, "b")
+		if err != nil {
+			t.Fatalf("AllocRegion failed: %v", err)
+		}
+		if _, err := mt.CreateSegment(name, region, 4000, sharedmem.SegmentRead); err != nil {
+			t.Fatalf("CreateSegment failed: %v", err)
+		}
+	}
+	if _, _, err := mt.UnlinkSegment("shm-b"); err != nil {
+		t.Fatalf("UnlinkSegment failed: %v", err)
+	}
+
+	mt.SetPageBackend(sharedmem.PageBackendBuddy)
+	buddyPages, err := mt.AllocPages(3, "b")
+	if err != nil {
+		t.Fatalf("buddy AllocPages failed: %v", err)
+	}
+	if err := mt.FreePages(buddyPages[2:]); err != nil {
+		t.Fatalf("FreePages failed: %v", err)
+	}
+	return mt
+}
+
+func TestMemTableRoundTrip(t *testing.T) {
+	mt := busyTable(t)
+	want, err := json.Marshal(mt)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+
+	bin, err := mt.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	var fromBin sharedmem.MemTable
+	if err := fromBin.UnmarshalBinary(bin); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+
+	var fromJSON sharedmem.MemTable
+	if err := json.Unmarshal(want, &fromJSON); err != nil {
+		t.Fatalf("UnmarshalJSON failed: %v", err)
+	}
+
+	for name, restored := range map[string]*sharedmem.MemTable{"binary": &fromBin, "json": &fromJSON} {
+		got, _ := json.Marshal(restored)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s round trip changed the table:\n got %s\nwant %s", name, got, want)
+		}
+		// The restored table keeps working
+		region, err := restored.AllocRegion(100, "b")
+		if err != nil {
+			t.Fatalf("%s: AllocRegion after restore failed: %v", name, err)
+		}
+		if err := restored.FreeRegion(region.StartAddr); err != nil {
+			t.Fatalf("%s: FreeRegion after restore failed: %v", name, err)
+		}
+		if err := restored.Verify(); err != nil {
+			t.Fatalf("%s: Verify after restore failed: %v", name, err)
+		}
+	}
+}
+
+func TestMemTableEncodingCompatibility(t *testing.T) {
+	bin, err := busyTable(t).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	// Newer versions are refused
+	future := append([]byte(nil), bin...)
+	binary.LittleEndian.PutUint16(future[4:6], sharedmem.TableFormatVersion+1)
+	var mt sharedmem.MemTable
+	if err := mt.UnmarshalBinary(future); !errors.Is(err, sharedmem.ErrTableVersion) {
+		t.Fatalf("future version: got %v, want ErrTableVersion", err)
+	}
+	if err := mt.UnmarshalBinary([]byte("not a table")); err == nil {
+		t.Fatalf("garbage decoded without error")
+	}
+	if err := json.Unmarshal([]byte(`{"Version": 99, "Slots": []}`), &mt); !errors.Is(err, sharedmem.ErrTableVersion) {
+		t.Fatalf("future JSON version: got %v, want ErrTableVersion", err)
+	}
+
+	// A version 1 document as written by the first release must keep loading
+	v1 := `{
+		"Version": 1,
+		"Slots": [{"StartAddr": 0, "Length": 65536, "Owner": "a"}],
+		"Allocations": [{"StartAddr": 0, "Length": 4096, "Owner": "a"}],
+		"Free": [{"StartAddr": 4096, "Length": 61440, "Owner": "a"}],
+		"PageBackend": 0,
+		"NextHandle": 1,
+		"Handles": [{"Handle": 1, "Addr": 0}]
+	}`
+	if err := json.Unmarshal([]byte(v1), &mt); err != nil {
+		t.Fatalf("version 1 document rejected: %v", err)
+	}
+	if region, err := mt.Resolve(1); err != nil || region.Length != 4096 {
+		t.Fatalf("handle from version 1 document = %+v, %v", region, err)
+	}
+
+	// Inconsistent snapshots are rejected rather than loaded
+	broken := `{
+		"Version": 1,
+		"Slots": [{"StartAddr": 0, "Length": 65536, "Owner": "a"}],
+		"Allocations": [{"StartAddr": 0, "Length": 8192, "Owner": "a"}],
+		"Free": [{"StartAddr": 4096, "Length": 61440, "Owner": "a"}]
+	}`
+	if err := json.Unmarshal([]byte(broken), &mt); err == nil {
+		t.Fatalf("overlapping snapshot loaded without error")
+	}
+}
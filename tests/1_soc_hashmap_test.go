@@ -0,0 +1,313 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc/jsonrpc"
+	"sync"
+	"testing"
+
+	"bigLITTLE/agent"
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+)
+
+func TestHashMapConcurrentGrowth(t *testing.T) {
+	mem := localManager(t, 16<<20)
+	mem.SoftLimit = 1 << 40
+	ctx := context.Background()
+
+	hm, err := sharedmem.NewHashMap(mem, sharedmem.HashMapConfig{
+		KeySize:   16,
+		ValueSize: 16,
+		Buckets:   2,
+		Owners:    []string{"local"},
+	})
+	if err != nil {
+		t.Fatalf("NewHashMap failed: %v", err)
+	}
+
+	const workers, perWorker = 4, 100
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				key := fmt.Sprintf("w%d-k%d", w, i)
+				if err := hm.Put(ctx, []byte(key), []byte("v"+key)); err != nil {
+					errs <- fmt.Errorf("Put %s: %w", key, err)
+					return
+				}
+				if _, ok, err := hm.Get(ctx, []byte(key)); err != nil || !ok {
+					errs <- fmt.Errorf("Get %s right after Put: found=%v err=%v", key, ok, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Another handle on the same address sees everything
+	other, err := sharedmem.OpenHashMap(mem, hm.Addr())
+	if err != nil {
+		t.Fatalf("OpenHashMap failed: %v", err)
+	}
+	if n, err := other.Len(ctx); err != nil || n != workers*perWorker {
+		t.Fatalf("Len = %d, %v; want %d", n, err, workers*perWorker)
+	}
+	for w := 0; w < workers; w++ {
+		for i := 0; i < perWorker; i++ {
+			key := fmt.Sprintf("w%d-k%d", w, i)
+			got, ok, err := other.Get(ctx, []byte(key))
+			if err != nil || !ok || string(got) != "v"+key {
+				t.Fatalf("Get %s = %q, %v, %v", key, got, ok, err)
+			}
+		}
+	}
+
+	// Overwrite, delete, oversized entries
+	if err := other.Put(ctx, []byte("w0-k0"), []byte("new")); err != nil {
+		t.Fatalf("overwrite failed: %v", err)
+	}
+	if got, _, _ := hm.Get(ctx, []byte("w0-k0")); string(got) != "new" {
+		t.Fatalf("overwritten value = %q", got)
+	}
+	if ok, err := hm.Delete(ctx, []byte("w0-k1")); err != nil || !ok {
+		t.Fatalf("Delete = %v, %v", ok, err)
+	}
+	if _, ok, _ := hm.Get(ctx, []byte("w0-k1")); ok {
+		t.Fatalf("deleted key still found")
+	}
+	if ok, _ := hm.Delete(ctx, []byte("w0-k1")); ok {
+		t.Fatalf("second Delete reported a removal")
+	}
+	if err := hm.Put(ctx, make([]byte, 17), nil); err == nil {
+		t.Fatalf("Put accepted a key longer than KeySize")
+	}
+	if n, _ := hm.Len(ctx); n != workers*perWorker-1 {
+		t.Fatalf("Len after delete = %d", n)
+	}
+
+	if err := hm.Free(); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if _, err := sharedmem.OpenHashMap(mem, hm.Addr()); err == nil {
+		t.Fatalf("OpenHashMap succeeded on a freed map")
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	// The header lives in a slab, which stays cached until trimmed
+	if _, err := mem.Slab.Trim(); err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if got := len(mem.Table.Allocations); got != 0 {
+		t.Fatalf("%d allocations left after Free", got)
+	}
+}
+
+func TestHashMapJSONRPC(t *testing.T) {
+	mem := localManager(t, 4<<20)
+	mem.SoftLimit = 1 << 40
+	free := mem.Table.TotalFreeBytes()
+	tasks := agent.NewTaskMemoryManager(mem, sharedmem.NewTaskMemoryTracker(mem.Table))
+	tasks.OpenSpace("job")
+	token, err := tasks.IssueToken("job")
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go rpc.ServeJSONRPC(listener, mem, tasks)
+
+	client, err := jsonrpc.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	var created rpc.HashMapResponse
+	err = client.Call("RPCServer.HashMapCreate", &rpc.HashMapCreateRequest{KeySize: 8, ValueSize: 32, Token: token}, &created)
+	if err != nil {
+		t.Fatalf("HashMapCreate failed: %v", err)
+	}
+	var resp rpc.HashMapResponse
+	put := &rpc.HashMapRequest{Token: token, Map: created.Map, Key: []byte("answer"), Value: []byte{0, 42, 0xff}}
+	if err := client.Call("RPCServer.HashMapPut", put, &resp); err != nil {
+		t.Fatalf("HashMapPut failed: %v", err)
+	}
+
+	// Go callers see what JSON-RPC clients stored, at the map's global address
+	global, err := tasks.TaskMap("job", created.Map)
+	if err != nil {
+		t.Fatalf("TaskMap failed: %v", err)
+	}
+	hm, err := sharedmem.OpenHashMap(mem, global)
+	if err != nil {
+		t.Fatalf("OpenHashMap failed: %v", err)
+	}
+	got, ok, err := hm.Get(context.Background(), []byte("answer"))
+	if err != nil || !ok || string(got) != "\x00\x2a\xff" {
+		t.Fatalf("Get = % x, %v, %v", got, ok, err)
+	}
+
+	resp = rpc.HashMapResponse{}
+	if err := client.Call("RPCServer.HashMapGet", &rpc.HashMapRequest{Token: token, Map: created.Map, Key: []byte("answer")}, &resp); err != nil {
+		t.Fatalf("HashMapGet failed: %v", err)
+	}
+	if !resp.Found || string(resp.Value) != "\x00\x2a\xff" {
+		t.Fatalf("HashMapGet = %+v", resp)
+	}
+	resp = rpc.HashMapResponse{}
+	if err := client.Call("RPCServer.HashMapLen", &rpc.HashMapRequest{Token: token, Map: created.Map}, &resp); err != nil || resp.Len != 1 {
+		t.Fatalf("HashMapLen = %d, %v", resp.Len, err)
+	}
+
+	// The map's address names it, and nothing can be read through it
+	var mr rpc.MemoryResponse
+	if err := client.Call("RPCServer.TaskRead", &rpc.TaskMemoryRequest{Token: token, Address: created.Map, Size: 8}, &mr); err == nil {
+		t.Fatalf("TaskRead served the header of a map")
+	}
+	// Global addresses, other tasks and unknown owners are refused
+	if err := client.Call("RPCServer.HashMapLen", &rpc.HashMapRequest{Token: token, Map: global}, &resp); err == nil {
+		t.Fatalf("HashMapLen served a global map address")
+	}
+	tasks.OpenSpace("other")
+	other, err := tasks.IssueToken("other")
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+	if err := client.Call("RPCServer.HashMapLen", &rpc.HashMapRequest{Token: other, Map: created.Map}, &resp); err == nil {
+		t.Fatalf("HashMapLen served another task's map")
+	}
+	bad := &rpc.HashMapCreateRequest{KeySize: 8, ValueSize: 8, Owners: []string{"nowhere"}, Token: token}
+	if err := client.Call("RPCServer.HashMapCreate", bad, &resp); err == nil {
+		t.Fatalf("HashMapCreate accepted an unknown owner")
+	}
+
+	if err := client.Call("RPCServer.HashMapFree", &rpc.HashMapRequest{Token: token, Map: created.Map}, &resp); err != nil {
+		t.Fatalf("HashMapFree failed: %v", err)
+	}
+	if err := client.Call("RPCServer.HashMapLen", &rpc.HashMapRequest{Token: token, Map: created.Map}, &resp); err == nil {
+		t.Fatalf("HashMapLen served a freed map")
+	}
+
+	// Maps the task leaves behind are freed with it
+	if err := client.Call("RPCServer.HashMapCreate", &rpc.HashMapCreateRequest{KeySize: 8, ValueSize: 8, Token: token}, &created); err != nil {
+		t.Fatalf("HashMapCreate failed: %v", err)
+	}
+	tasks.RevokeToken(token)
+	if err := tasks.FreeTask("job"); err != nil {
+		t.Fatalf("FreeTask failed: %v", err)
+	}
+	if _, err := mem.Slab.Trim(); err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if got := mem.Table.TotalFreeBytes(); got != free {
+		t.Fatalf("%d free bytes after the task ended, want %d", got, free)
+	}
+}
+
+func TestHashMapFreedByAnotherAgent(t *testing.T) {
+	a, b, _ := pairedManagers(t)
+	ctx := context.Background()
+
+	// b's slab holds the header, a frees the map
+	hm, err := sharedmem.NewHashMap(b, sharedmem.HashMapConfig{KeySize: 8, ValueSize: 8, Owners: []string{"b"}})
+	if err != nil {
+		t.Fatalf("NewHashMap failed: %v", err)
+	}
+	if _, err := b.Slab.SlotSize(hm.Addr()); err != nil {
+		t.Fatalf("header at 0x%x is not a slab object of b: %v", hm.Addr(), err)
+	}
+	other, err := sharedmem.OpenHashMap(a, hm.Addr())
+	if err != nil {
+		t.Fatalf("OpenHashMap failed: %v", err)
+	}
+	if err := other.Put(ctx, []byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := other.Free(); err != nil {
+		t.Fatalf("Free from a failed: %v", err)
+	}
+
+	// The slot went back to b's slab, which still owns its page
+	freed, err := b.Slab.Trim()
+	if err != nil || freed != sharedmem.PageSize {
+		t.Fatalf("Trim = %d, %v, want the emptied slab page back", freed, err)
+	}
+	if err := a.Table.Verify(); err != nil {
+		t.Fatalf("table inconsistent after Free: %v", err)
+	}
+}
+
+func TestHashMapAcrossSeparateTables(t *testing.T) {
+	a, b := masterAgents(t)
+	ctx := context.Background()
+	free := map[*agent.MemoryManager]uint64{a: a.Table.TotalFreeBytes(), b: b.Table.TotalFreeBytes()}
+
+	// Enough buckets to stripe several pages over both SoCs
+	hm, err := sharedmem.NewHashMap(a, sharedmem.HashMapConfig{
+		KeySize:   16,
+		ValueSize: 16,
+		Buckets:   256,
+		Owners:    []string{"a", "b"},
+	})
+	if err != nil {
+		t.Fatalf("NewHashMap failed: %v", err)
+	}
+
+	// b reaches the map through its own table, and grows it
+	other, err := sharedmem.OpenHashMap(b, hm.Addr())
+	if err != nil {
+		t.Fatalf("OpenHashMap on b failed: %v", err)
+	}
+	const n = 1000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err := other.Put(ctx, []byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("Put %s from b failed: %v", key, err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%d", i)
+		value, ok, err := hm.Get(ctx, []byte(key))
+		if err != nil || !ok || string(value) != "v"+key {
+			t.Fatalf("Get %s on a = %q, %v, %v", key, value, ok, err)
+		}
+	}
+	for _, m := range []*agent.MemoryManager{a, b} {
+		if err := m.Table.Verify(); err != nil {
+			t.Fatalf("table of %s inconsistent: %v", m.LocalSoCName, err)
+		}
+	}
+
+	// Freeing from b drops the map from both tables
+	if err := other.Free(); err != nil {
+		t.Fatalf("Free from b failed: %v", err)
+	}
+	for _, m := range []*agent.MemoryManager{a, b} {
+		if _, err := m.Slab.Trim(); err != nil {
+			t.Fatalf("Trim on %s failed: %v", m.LocalSoCName, err)
+		}
+	}
+	for _, m := range []*agent.MemoryManager{a, b} {
+		if err := m.Table.Verify(); err != nil {
+			t.Fatalf("table of %s inconsistent after Free: %v", m.LocalSoCName, err)
+		}
+		if got := m.Table.TotalFreeBytes(); got != free[m] {
+			t.Errorf("%s has %d free bytes after Free, want %d", m.LocalSoCName, got, free[m])
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"math/rand"
+	"testing"
+)
+
+// linearFind is how MemTable.FindRegion used to translate addresses: a scan
+// over every allocated region.
+func linearFind(regions []sharedmem.MemRegion, addr uint64) (sharedmem.MemRegion, bool) {
+	for _, region := range regions {
+		if addr >= region.StartAddr && addr < region.StartAddr+region.Length {
+			return region, true
+		}
+	}
+	return sharedmem.MemRegion{}, false
+}
+
+// pagedTable returns a table with a 100MB page allocation (25,600 pages).
+func pagedTable(tb testing.TB) (*sharedmem.MemTable, []sharedmem.MemRegion) {
+	memTable, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 256 * 1024 * 1024, Owner: "local"},
+	})
+	if err != nil {
+		tb.Fatalf("Failed to create MemTable: %v", err)
+	}
+	pages, err := memTable.AllocPages(100*1024*1024/sharedmem.PageSize, "local")
+	if err != nil {
+		tb.Fatalf("AllocPages failed: %v", err)
+	}
+	return memTable, pages
+}
+
+func TestRegionIndexMatchesLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	idx := sharedmem.NewRegionIndex()
+	live := map[uint64]sharedmem.MemRegion{}
+
+	// Random non-overlapping 4KB slots, inserted and deleted in random order
+	for i := 0; i < 5000; i++ {
+		start := uint64(rng.Intn(2000)) * 4096
+		if _, ok := live[start]; ok && rng.Intn(2) == 0 {
+			idx.Delete(start)
+			delete(live, start)
+			continue
+		}
+		r := sharedmem.MemRegion{StartAddr: start, Length: uint64(1 + rng.Intn(4096)), Owner: "local"}
+		idx.Insert(r)
+		live[start] = r
+	}
+
+	if idx.Len() != len(live) {
+		t.Fatalf("Len mismatch: got %d want %d", idx.Len(), len(live))
+	}
+	all := idx.Slice()
+	for i := 1; i < len(all); i++ {
+		if all[i-1].StartAddr >= all[i].StartAddr {
+			t.Fatalf("Slice not sorted at %d", i)
+		}
+	}
+
+	for i := 0; i < 10000; i++ {
+		addr := uint64(rng.Intn(2001 * 4096))
+		got, gotOK := idx.Find(addr)
+		want, wantOK := linearFind(all, addr)
+		if gotOK != wantOK || got != want {
+			t.Fatalf("Find(0x%x) = %+v,%v want %+v,%v", addr, got, gotOK, want, wantOK)
+		}
+	}
+}
+
+func TestAllocPagesTranslate(t *testing.T) {
+	memTable, pages := pagedTable(t)
+
+	last := pages[len(pages)-1]
+	owner, offset, err := memTable.TranslatePage(last.StartAddr + 123)
+	if err != nil {
+		t.Fatalf("TranslatePage failed: %v", err)
+	}
+	if owner != "local" || offset != 123 {
+		t.Errorf("TranslatePage = %s,%d want local,123", owner, offset)
+	}
+
+	if err := memTable.FreePages(pages); err != nil {
+		t.Fatalf("FreePages failed: %v", err)
+	}
+	if free := memTable.GetFreeRegionsForTesting(); len(free) != 1 {
+		t.Errorf("Free regions not merged back: %+v", free)
+	}
+}
+
+func BenchmarkTranslateLinearScan(b *testing.B) {
+	memTable, pages := pagedTable(b)
+	regions := memTable.Regions.Slice()
+	addr := pages[len(pages)-1].StartAddr + 10
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := linearFind(regions, addr); !ok {
+			b.Fatal("address not found")
+		}
+	}
+}
+
+func BenchmarkTranslateIndexed(b *testing.B) {
+	memTable, pages := pagedTable(b)
+	addr := pages[len(pages)-1].StartAddr + 10
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := memTable.TranslateAddr(addr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"testing"
+)
+
+func TestQueryAllocationsByLabel(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "a"},
+		{StartAddr: 1 << 20, Length: 1 << 20, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+
+	alloc := func(size uint64, owner string, label *sharedmem.Label) sharedmem.MemRegion {
+		region, err := mt.Alloc(sharedmem.AllocRequest{Size: size, Owner: owner, OwnerOnly: true, Label: label})
+		if err != nil {
+			t.Fatalf("Alloc failed: %v", err)
+		}
+		return region
+	}
+	cache := alloc(64<<10, "a", &sharedmem.Label{Name: "cache", TaskID: "t1", Creator: "a", Tags: []string{"hot", "io"}})
+	alloc(100, "a", &sharedmem.Label{Name: "ctl", TaskID: "t2", Creator: "a", Tags: []string{"io"}})
+	alloc(8<<10, "b", nil)
+
+	count := func(q sharedmem.AllocQuery) int { return len(mt.QueryAllocations(q)) }
+	cases := []struct {
+		name string
+		q    sharedmem.AllocQuery
+		want int
+	}{
+		{"all", sharedmem.AllocQuery{}, 3},
+		{"owner", sharedmem.AllocQuery{Owner: "a"}, 2},
+		{"tag", sharedmem.AllocQuery{Tag: "io"}, 2},
+		{"tag and task", sharedmem.AllocQuery{Tag: "io", TaskID: "t1"}, 1},
+		{"size range", sharedmem.AllocQuery{MinSize: 1 << 10, MaxSize: 16 << 10}, 1},
+		{"no match", sharedmem.AllocQuery{Tag: "cold"}, 0},
+	}
+	for _, c := range cases {
+		if got := count(c.q); got != c.want {
+			t.Errorf("%s: got %d allocations, want %d", c.name, got, c.want)
+		}
+	}
+
+	label, ok := mt.GetLabel(cache.StartAddr)
+	if !ok || label.Name != "cache" || label.Created.IsZero() {
+		t.Fatalf("GetLabel = %+v, %v", label, ok)
+	}
+
+	// Labels go away with their allocation
+	if err := mt.FreeRegion(cache.StartAddr); err != nil {
+		t.Fatalf("FreeRegion failed: %v", err)
+	}
+	if _, ok := mt.GetLabel(cache.StartAddr); ok {
+		t.Fatalf("label outlived its allocation")
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
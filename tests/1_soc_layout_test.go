@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLayoutStableAcrossMembership(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "layout.json")
+	layout, err := sharedmem.LoadLayout(path)
+	if err != nil {
+		t.Fatalf("LoadLayout of a missing file failed: %v", err)
+	}
+
+	regions, err := layout.Assign([]sharedmem.SoCMemInfo{
+		{Name: "orangepizero2w", MemoryMB: 1024},
+		{Name: "raspberrypi-worker1", MemoryMB: 256},
+	})
+	if err != nil {
+		t.Fatalf("Assign failed: %v", err)
+	}
+	before := make(map[string]uint64)
+	for _, r := range regions {
+		before[r.Owner] = r.StartAddr
+	}
+	if err := layout.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// A newcomer that sorts first must not renumber the others, and a
+	// departed SoC keeps its slot
+	layout, err = sharedmem.LoadLayout(path)
+	if err != nil {
+		t.Fatalf("LoadLayout failed: %v", err)
+	}
+	fixed := uint64(1) << 40
+	regions, err = layout.Assign([]sharedmem.SoCMemInfo{
+		{Name: "raspberrypi-worker0", MemoryMB: 256},
+		{Name: "raspberrypi-worker1", MemoryMB: 512},
+		{Name: "board-with-base", MemoryMB: 64, BaseAddr: &fixed},
+	})
+	if err != nil {
+		t.Fatalf("Assign after membership change failed: %v", err)
+	}
+	after := make(map[string]uint64)
+	for _, r := range regions {
+		after[r.Owner] = r.StartAddr
+	}
+	if after["raspberrypi-worker1"] != before["raspberrypi-worker1"] {
+		t.Fatalf("worker1 moved from 0x%x to 0x%x", before["raspberrypi-worker1"], after["raspberrypi-worker1"])
+	}
+	if after["board-with-base"] != fixed {
+		t.Fatalf("base_addr ignored: 0x%x", after["board-with-base"])
+	}
+	w0 := after["raspberrypi-worker0"]
+	if w0 == before["orangepizero2w"] || w0 == before["raspberrypi-worker1"] || w0%sharedmem.SlotSize != 0 {
+		t.Fatalf("newcomer got 0x%x, which is not a fresh slot", w0)
+	}
+	if _, err := sharedmem.NewMemTable(regions); err != nil {
+		t.Fatalf("NewMemTable rejected the sparse layout: %v", err)
+	}
+
+	// Colliding explicit bases are refused
+	clash := before["raspberrypi-worker1"]
+	if _, err := layout.Assign([]sharedmem.SoCMemInfo{
+		{Name: "raspberrypi-worker1", MemoryMB: 256},
+		{Name: "intruder", MemoryMB: 16, BaseAddr: &clash},
+	}); err == nil {
+		t.Fatalf("overlapping base_addr accepted")
+	}
+}
+
+func TestAgentsFetchLayoutFromMaster(t *testing.T) {
+	socs := []sharedmem.SoCMemInfo{
+		{Name: "orangepizero2w", MemoryMB: 1024},
+		{Name: "raspberrypi-worker1", MemoryMB: 256},
+	}
+	regions, err := sharedmem.NewLayout().Assign(socs)
+	if err != nil {
+		t.Fatalf("Assign failed: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go rpc.ServeMaster(listener, &rpc.MasterServer{Regions: regions})
+
+	// Every agent gets the master's layout, whatever it would assign itself
+	var fetched [][]sharedmem.MemRegion
+	for _, soc := range socs {
+		got, err := rpc.FetchLayout(listener.Addr().String(), soc.Name)
+		if err != nil {
+			t.Fatalf("FetchLayout(%s) failed: %v", soc.Name, err)
+		}
+		if err := sharedmem.CheckLayout(got, socs); err != nil {
+			t.Fatalf("CheckLayout failed: %v", err)
+		}
+		fetched = append(fetched, got)
+	}
+	if !reflect.DeepEqual(fetched[0], regions) || !reflect.DeepEqual(fetched[1], regions) {
+		t.Fatalf("agents got %+v, master has %+v", fetched, regions)
+	}
+
+	// SoCs the master does not know are refused outright
+	if _, err := rpc.FetchLayout(listener.Addr().String(), "stranger"); err == nil {
+		t.Fatalf("FetchLayout succeeded for a SoC outside the layout")
+	}
+
+	// An agent configured differently from the master must not join
+	resized := []sharedmem.SoCMemInfo{{Name: "orangepizero2w", MemoryMB: 2048}}
+	if err := sharedmem.CheckLayout(regions, resized); err == nil {
+		t.Fatalf("CheckLayout accepted a SoC whose memory size disagrees")
+	}
+	base := uint64(1) << 40
+	moved := []sharedmem.SoCMemInfo{{Name: "raspberrypi-worker1", MemoryMB: 256, BaseAddr: &base}}
+	if err := sharedmem.CheckLayout(regions, moved); err == nil {
+		t.Fatalf("CheckLayout accepted a SoC whose base address disagrees")
+	}
+	missing := append(socs, sharedmem.SoCMemInfo{Name: "raspberrypi-worker2", MemoryMB: 256})
+	if err := sharedmem.CheckLayout(regions, missing); err == nil {
+		t.Fatalf("CheckLayout accepted a SoC missing from the layout")
+	}
+}
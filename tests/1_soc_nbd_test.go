@@ -0,0 +1,260 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"bigLITTLE/agent"
+	"bigLITTLE/sharedmem"
+)
+
+// nbdClient is a minimal NBD client speaking the fixed newstyle handshake
+// and simple replies, written from the protocol description rather than the
+// server code.
+type nbdClient struct {
+	conn   net.Conn
+	size   uint64
+	flags  uint16
+	handle uint64
+}
+
+const (
+	nbdTestOptMagic = 0x49484156454f5054
+	nbdTestRepMagic = 0x0003e889045565a9
+)
+
+func nbdDial(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	var greeting [18]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		t.Fatalf("reading greeting failed: %v", err)
+	}
+	if string(greeting[:8]) != "NBDMAGIC" || string(greeting[8:16]) != "IHAVEOPT" {
+		t.Fatalf("bad greeting % x", greeting)
+	}
+	if binary.BigEndian.Uint16(greeting[16:])&1 == 0 {
+		t.Fatalf("server is not fixed newstyle")
+	}
+	// Fixed newstyle, no zeroes
+	binary.Write(conn, binary.BigEndian, uint32(3))
+	return conn
+}
+
+func nbdSendOpt(conn net.Conn, opt uint32, data []byte) {
+	hdr := binary.BigEndian.AppendUint64(nil, nbdTestOptMagic)
+	hdr = binary.BigEndian.AppendUint32(hdr, opt)
+	hdr = binary.BigEndian.AppendUint32(hdr, uint32(len(data)))
+	conn.Write(append(hdr, data...))
+}
+
+// nbdReadRep reads one option reply.
+func nbdReadRep(t *testing.T, conn net.Conn, opt uint32) (uint32, []byte) {
+	var hdr [20]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		t.Fatalf("reading option reply failed: %v", err)
+	}
+	if binary.BigEndian.Uint64(hdr[0:]) != nbdTestRepMagic || binary.BigEndian.Uint32(hdr[8:]) != opt {
+		t.Fatalf("bad option reply % x", hdr)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(hdr[16:]))
+	io.ReadFull(conn, data)
+	return binary.BigEndian.Uint32(hdr[12:]), data
+}
+
+func nbdList(t *testing.T, conn net.Conn) []string {
+	nbdSendOpt(conn, 3, nil)
+	var names []string
+	for {
+		rep, data := nbdReadRep(t, conn, 3)
+		if rep == 1 {
+			return names
+		}
+		if rep != 2 {
+			t.Fatalf("LIST reply type %d", rep)
+		}
+		names = append(names, string(data[4:4+binary.BigEndian.Uint32(data)]))
+	}
+}
+
+// nbdGo selects an export with NBD_OPT_GO. Returns the error reply type if
+// the server refused.
+func nbdGo(t *testing.T, conn net.Conn, name string) (*nbdClient, uint32) {
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+	data = append(data, name...)
+	data = binary.BigEndian.AppendUint16(data, 0)
+	nbdSendOpt(conn, 7, data)
+
+	c := &nbdClient{conn: conn}
+	for {
+		rep, info := nbdReadRep(t, conn, 7)
+		switch {
+		case rep == 1:
+			return c, 0
+		case rep == 3 && binary.BigEndian.Uint16(info) == 0:
+			c.size = binary.BigEndian.Uint64(info[2:])
+			c.flags = binary.BigEndian.Uint16(info[10:])
+		case rep >= 1<<31:
+			return nil, rep
+		}
+	}
+}
+
+// do sends a request and returns the error of its reply.
+func (c *nbdClient) do(t *testing.T, cmd uint16, offset uint64, length uint32, payload []byte, out []byte) uint32 {
+	c.handle++
+	req := binary.BigEndian.AppendUint32(nil, 0x25609513)
+	req = binary.BigEndian.AppendUint16(req, 0)
+	req = binary.BigEndian.AppendUint16(req, cmd)
+	req = binary.BigEndian.AppendUint64(req, c.handle)
+	req = binary.BigEndian.AppendUint64(req, offset)
+	req = binary.BigEndian.AppendUint32(req, length)
+	if _, err := c.conn.Write(append(req, payload...)); err != nil {
+		t.Fatalf("sending command %d failed: %v", cmd, err)
+	}
+	if cmd == 2 {
+		return 0
+	}
+
+	var reply [16]byte
+	if _, err := io.ReadFull(c.conn, reply[:]); err != nil {
+		t.Fatalf("reading reply to command %d failed: %v", cmd, err)
+	}
+	if binary.BigEndian.Uint32(reply[0:]) != 0x67446698 || binary.BigEndian.Uint64(reply[8:]) != c.handle {
+		t.Fatalf("bad reply % x", reply)
+	}
+	errno := binary.BigEndian.Uint32(reply[4:])
+	if errno == 0 && out != nil {
+		if _, err := io.ReadFull(c.conn, out); err != nil {
+			t.Fatalf("reading data failed: %v", err)
+		}
+	}
+	return errno
+}
+
+func (c *nbdClient) read(t *testing.T, offset uint64, n int) ([]byte, uint32) {
+	out := make([]byte, n)
+	errno := c.do(t, 0, offset, uint32(n), nil, out)
+	return out, errno
+}
+
+func (c *nbdClient) write(t *testing.T, offset uint64, data []byte) uint32 {
+	return c.do(t, 1, offset, uint32(len(data)), data, nil)
+}
+
+func TestNBDExport(t *testing.T) {
+	mem := localManager(t, 8<<20)
+	mem.SoftLimit = 1 << 40
+	disk, err := sharedmem.New(1<<20, mem, "local")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	server := agent.NewNBDServer()
+	server.Export("disk", disk)
+	server.Export("rom", disk.ReadOnly())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+	addr := listener.Addr().String()
+
+	conn := nbdDial(t, addr)
+	defer conn.Close()
+	if names := nbdList(t, conn); fmt.Sprint(names) != "[disk rom]" {
+		t.Fatalf("LIST = %v", names)
+	}
+	if _, rep := nbdGo(t, conn, "missing"); rep != 1<<31+6 {
+		t.Fatalf("GO on a missing export replied %x", rep)
+	}
+	c, _ := nbdGo(t, conn, "disk")
+	if c == nil || c.size != 1<<20 {
+		t.Fatalf("GO = %+v", c)
+	}
+	if c.flags&(1<<2) == 0 || c.flags&(1<<5) == 0 || c.flags&(1<<1) != 0 {
+		t.Fatalf("transmission flags %b", c.flags)
+	}
+
+	// Writes land in the VMem and read back, across chunk boundaries
+	block := bytes.Repeat([]byte("cluster memory! "), 4096) // 64 KiB
+	if errno := c.write(t, 4096, block); errno != 0 {
+		t.Fatalf("WRITE errno %d", errno)
+	}
+	if got, _ := disk.Read(4096, 16); string(got) != "cluster memory! " {
+		t.Fatalf("VMem holds %q", got)
+	}
+	if got, errno := c.read(t, 4096, len(block)); errno != 0 || !bytes.Equal(got, block) {
+		t.Fatalf("READ errno %d, data matches: %v", errno, bytes.Equal(got, block))
+	}
+	if errno := c.do(t, 3, 0, 0, nil, nil); errno != 0 {
+		t.Fatalf("FLUSH errno %d", errno)
+	}
+
+	// Trim zeroes the range
+	if errno := c.do(t, 4, 8192, 4096, nil, nil); errno != 0 {
+		t.Fatalf("TRIM errno %d", errno)
+	}
+	got, _ := c.read(t, 8192-4, 4104)
+	if !bytes.Equal(got[4:4100], make([]byte, 4096)) || string(got[:4]) != "ry! " || string(got[4100:]) != "clus" {
+		t.Fatalf("TRIM touched the wrong bytes")
+	}
+
+	// Out of bounds requests fail without breaking the connection
+	if _, errno := c.read(t, 1<<20-10, 20); errno != 22 {
+		t.Fatalf("READ past the end errno %d", errno)
+	}
+	if errno := c.write(t, 1<<20-10, make([]byte, 20)); errno != 28 {
+		t.Fatalf("WRITE past the end errno %d", errno)
+	}
+	if got, errno := c.read(t, 1<<20-4, 4); errno != 0 || !bytes.Equal(got, make([]byte, 4)) {
+		t.Fatalf("READ at the end = %q, errno %d", got, errno)
+	}
+	c.do(t, 2, 0, 0, nil, nil)
+
+	// Read-only exports refuse writes and trims
+	conn2 := nbdDial(t, addr)
+	defer conn2.Close()
+	ro, _ := nbdGo(t, conn2, "rom")
+	if ro == nil || ro.flags&(1<<1) == 0 {
+		t.Fatalf("read-only export not flagged: %+v", ro)
+	}
+	if errno := ro.write(t, 0, []byte("x")); errno != 1 {
+		t.Fatalf("WRITE to a read-only export errno %d", errno)
+	}
+	if errno := ro.do(t, 4, 0, 10, nil, nil); errno != 1 {
+		t.Fatalf("TRIM on a read-only export errno %d", errno)
+	}
+	if got, _ := ro.read(t, 4096, 7); string(got) != "cluster" {
+		t.Fatalf("read-only export reads %q", got)
+	}
+	ro.do(t, 2, 0, 0, nil, nil)
+
+	// Old-style NBD_OPT_EXPORT_NAME, with the padding
+	conn3, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn3.Close()
+	io.ReadFull(conn3, make([]byte, 18))
+	binary.Write(conn3, binary.BigEndian, uint32(1))
+	nbdSendOpt(conn3, 1, []byte("disk"))
+	reply := make([]byte, 10+124)
+	if _, err := io.ReadFull(conn3, reply); err != nil {
+		t.Fatalf("EXPORT_NAME reply failed: %v", err)
+	}
+	if binary.BigEndian.Uint64(reply) != 1<<20 {
+		t.Fatalf("EXPORT_NAME size %d", binary.BigEndian.Uint64(reply))
+	}
+	old := &nbdClient{conn: conn3}
+	if got, _ := old.read(t, 4096, 7); string(got) != "cluster" {
+		t.Fatalf("EXPORT_NAME connection reads %q", got)
+	}
+}
@@ -0,0 +1,199 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"testing"
+)
+
+func TestPageTableMapLookupUnmap(t *testing.T) {
+	pt := sharedmem.NewPageTable()
+	addrs := []uint64{0, 0x1000, 0x200000, 0x7fff_ffff_f000}
+	for i, addr := range addrs {
+		if err := pt.Map(addr+123, sharedmem.Frame{SoC: "b", Number: uint64(i)}); err != nil {
+			t.Fatalf("Map(0x%x) failed: %v", addr, err)
+		}
+	}
+	if pt.Len() != len(addrs) {
+		t.Fatalf("Len = %d, want %d", pt.Len(), len(addrs))
+	}
+	if err := pt.Map(sharedmem.MaxVirtAddr, sharedmem.Frame{}); err == nil {
+		t.Fatalf("Map beyond the address space succeeded")
+	}
+
+	var walked []uint64
+	pt.Walk(func(vaddr uint64, frame sharedmem.Frame) bool {
+		walked = append(walked, vaddr)
+		return true
+	})
+	for i, addr := range addrs {
+		if walked[i] != addr {
+			t.Fatalf("Walk[%d] = 0x%x, want 0x%x", i, walked[i], addr)
+		}
+		frame, ok := pt.Lookup(addr + 4000)
+		if !ok || frame.Number != uint64(i) {
+			t.Fatalf("Lookup(0x%x) = %v, %v", addr, frame, ok)
+		}
+	}
+
+	for _, addr := range addrs {
+		if _, ok := pt.Unmap(addr); !ok {
+			t.Fatalf("Unmap(0x%x) found nothing", addr)
+		}
+		if _, ok := pt.Lookup(addr); ok {
+			t.Fatalf("page 0x%x still mapped after Unmap", addr)
+		}
+	}
+	if pt.Len() != 0 {
+		t.Fatalf("Len = %d after unmapping everything", pt.Len())
+	}
+}
+
+func TestPlacedPageTranslation(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "a"},
+		{StartAddr: 1 << 20, Length: 1 << 20, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+
+	region, err := mt.Alloc(sharedmem.AllocRequest{Size: 3 * sharedmem.PageSize, Align: sharedmem.PageSize, Owner: "a", OwnerOnly: true})
+	if err != nil {
+		t.Fatalf("Alloc failed: %v", err)
+	}
+	frame, err := mt.AllocFrame("b")
+	if err != nil {
+		t.Fatalf("AllocFrame failed: %v", err)
+	}
+	middle := region.StartAddr + sharedmem.PageSize
+	if err := mt.PlacePage(middle, frame); err != nil {
+		t.Fatalf("PlacePage failed: %v", err)
+	}
+
+	segs, err := mt.TranslateRange(region.StartAddr+100, 3*sharedmem.PageSize-200)
+	if err != nil {
+		t.Fatalf("TranslateRange failed: %v", err)
+	}
+	if len(segs) != 3 || segs[0].SoC != "a" || segs[1].SoC != "b" || segs[2].SoC != "a" {
+		t.Fatalf("unexpected segments: %+v", segs)
+	}
+	if segs[1].VAddr != middle || segs[1].Offset != frame.Offset() || segs[1].Length != sharedmem.PageSize {
+		t.Fatalf("placed segment = %+v, want frame offset 0x%x", segs[1], frame.Offset())
+	}
+	soc, _, err := mt.TranslateAddr(middle + 5)
+	if err != nil || soc != "b" {
+		t.Fatalf("TranslateAddr of placed page = %q, %v", soc, err)
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify after placement: %v", err)
+	}
+
+	// Freeing the allocation drops the placement and releases the frame
+	if err := mt.FreeRegion(region.StartAddr); err != nil {
+		t.Fatalf("FreeRegion failed: %v", err)
+	}
+	if mt.Pages.Len() != 0 {
+		t.Fatalf("%d pages still placed after free", mt.Pages.Len())
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify after free: %v", err)
+	}
+	if free := mt.TotalFreeBytes(); free != 2<<20 {
+		t.Fatalf("TotalFreeBytes = %d, want %d", free, 2<<20)
+	}
+}
+
+func TestTranslateAddrIsSlotRelative(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "a"},
+		{StartAddr: 1 << 20, Length: 1 << 20, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	first, _ := mt.AllocRegion(4096, "b")
+	second, err := mt.AllocRegion(4096, "b")
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+
+	// Offsets count from the slot base, so the two blocks do not alias in b's memory
+	for _, r := range []sharedmem.MemRegion{first, second} {
+		soc, off, err := mt.TranslateAddr(r.StartAddr + 7)
+		if err != nil || soc != "b" || off != r.StartAddr-(1<<20)+7 {
+			t.Fatalf("TranslateAddr(0x%x) = %q, %d, %v", r.StartAddr+7, soc, off, err)
+		}
+	}
+}
+
+func TestMovedPageLendsItsHomeFrame(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "a"},
+		{StartAddr: 1 << 20, Length: 1 << 20, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	freeA, freeB := mt.FreeBytes("a"), mt.FreeBytes("b")
+	page := func(owner string) sharedmem.MemRegion {
+		r, err := mt.Alloc(sharedmem.AllocRequest{Size: sharedmem.PageSize, Align: sharedmem.PageSize, Owner: owner, OwnerOnly: true})
+		if err != nil {
+			t.Fatalf("Alloc on %s failed: %v", owner, err)
+		}
+		return r
+	}
+	verify := func(when string) {
+		t.Helper()
+		if err := mt.Verify(); err != nil {
+			t.Fatalf("Verify %s: %v", when, err)
+		}
+	}
+
+	// p moves to b, leaving its home frame on a vacant
+	p := page("a")
+	home, _ := mt.Placement(p.StartAddr)
+	away, err := mt.AllocFrame("b")
+	if err != nil {
+		t.Fatalf("AllocFrame(b) failed: %v", err)
+	}
+	if err := mt.PlacePage(p.StartAddr, away); err != nil {
+		t.Fatalf("PlacePage failed: %v", err)
+	}
+	if err := mt.PhysBacked("a", home.Offset(), 8); err == nil {
+		t.Fatalf("vacant home frame %+v still counts as backing memory", home)
+	}
+
+	// q of b takes it
+	q := page("b")
+	lent, err := mt.AllocFrame("a")
+	if err != nil || lent != home {
+		t.Fatalf("AllocFrame(a) = %+v, %v, want the vacant home frame %+v", lent, err, home)
+	}
+	if err := mt.PlacePage(q.StartAddr, lent); err != nil {
+		t.Fatalf("PlacePage onto the lent frame failed: %v", err)
+	}
+	if err := mt.PlacePage(p.StartAddr, home); err == nil {
+		t.Fatalf("p went home onto a frame backing q")
+	}
+	verify("with the home frame lent")
+
+	// Freeing p keeps its page off the lent frame, even when it is reused
+	if err := mt.FreeRegion(p.StartAddr); err != nil {
+		t.Fatalf("FreeRegion(p) failed: %v", err)
+	}
+	verify("after freeing p")
+	again := page("a")
+	if frame, _ := mt.Placement(again.StartAddr); frame == home {
+		t.Fatalf("reused page 0x%x lands on the frame backing q", again.StartAddr)
+	}
+	for _, r := range []sharedmem.MemRegion{q, again} {
+		if err := mt.FreeRegion(r.StartAddr); err != nil {
+			t.Fatalf("FreeRegion(0x%x) failed: %v", r.StartAddr, err)
+		}
+		verify("after freeing everything")
+	}
+	if mt.Pages.Len() != 0 || mt.FreeBytes("a") != freeA || mt.FreeBytes("b") != freeB {
+		t.Fatalf("%d pages placed, free a %d b %d, want none and %d, %d",
+			mt.Pages.Len(), mt.FreeBytes("a"), mt.FreeBytes("b"), freeA, freeB)
+	}
+}
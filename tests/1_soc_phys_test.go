@@ -0,0 +1,256 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	nrpc "net/rpc"
+	"strings"
+	"sync"
+	"testing"
+
+	"bigLITTLE/agent"
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+)
+
+// pairedManagers returns managers for SoCs "a" and "b" over one table, each
+// reaching the other through its RPC server. The client is a's client of b.
+func pairedManagers(t *testing.T) (*agent.MemoryManager, *agent.MemoryManager, *nrpc.Client) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "a"},
+		{StartAddr: 1 << 20, Length: 1 << 20, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	a := agent.NewMemoryManager("a", mt, 1<<20, "a")
+	b := agent.NewMemoryManager("b", mt, 1<<20, "b")
+	a.SoftLimit, b.SoftLimit = 1<<40, 1<<40
+
+	client := serveManager(t, b)
+	a.RegisterRPCClient("b", client)
+	b.RegisterRPCClient("a", serveManager(t, a))
+	return a, b, client
+}
+
+// serveManager serves mem over net/rpc and returns a client of it.
+func serveManager(t *testing.T, mem *agent.MemoryManager) *nrpc.Client {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := nrpc.NewServer()
+	if err := server.Register(&rpc.RPCServer{MemManager: mem}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	go server.Accept(listener)
+
+	client, err := nrpc.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestPhysAccessLimitedToAllocatedFrames(t *testing.T) {
+	a, b, client := pairedManagers(t)
+	ctx := context.Background()
+
+	region, err := a.AllocRegion(sharedmem.PageSize, "a")
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	if err := a.MovePage(ctx, region.StartAddr, "b"); err != nil {
+		t.Fatalf("MovePage failed: %v", err)
+	}
+	frame, err := a.Table.Placement(region.StartAddr)
+	if err != nil || frame.SoC != "b" {
+		t.Fatalf("Placement = %+v, %v, want a frame on b", frame, err)
+	}
+
+	var resp rpc.MemoryResponse
+	ok := &rpc.PhysWriteRequest{Offset: frame.Offset(), Data: []byte("placed")}
+	if err := client.Call("RPCServer.WritePhys", ok, &resp); err != nil {
+		t.Fatalf("WritePhys to a placed frame failed: %v", err)
+	}
+
+	// Free memory of b and offsets past its slot are refused
+	free := frame.Offset() + 16*sharedmem.PageSize
+	if err := b.CheckPhys(free, 8); err == nil {
+		t.Fatalf("CheckPhys accepted free offset 0x%x", free)
+	}
+	if err := client.Call("RPCServer.WritePhys", &rpc.PhysWriteRequest{Offset: free, Data: []byte("x")}, &resp); err == nil {
+		t.Fatalf("WritePhys to free offset 0x%x succeeded", free)
+	}
+	if err := client.Call("RPCServer.ReadPhys", &rpc.PhysRequest{Offset: 1 << 20, Size: 8}, &resp); err == nil {
+		t.Fatalf("ReadPhys past the slot succeeded")
+	}
+	copyReq := &rpc.PhysCopyRequest{SrcOffset: frame.Offset(), DstOffset: free, Length: 8}
+	if err := client.Call("RPCServer.CopyPhys", copyReq, &resp); err == nil {
+		t.Fatalf("CopyPhys into free memory succeeded")
+	}
+
+	got, err := a.Read(ctx, region.StartAddr, 6)
+	if err != nil || string(got) != "placed" {
+		t.Fatalf("Read = %q, %v", got, err)
+	}
+}
+
+func TestMovePageKeepsConcurrentWrites(t *testing.T) {
+	a, _, _ := pairedManagers(t)
+	ctx := context.Background()
+
+	region, err := a.AllocRegion(sharedmem.PageSize, "a")
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var last uint64
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 8)
+		for i := uint64(1); ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			binary.LittleEndian.PutUint64(buf, i)
+			if err := a.Write(ctx, region.StartAddr, buf); err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+			last = i
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		to := "b"
+		if i%2 == 1 {
+			to = "a"
+		}
+		if err := a.MovePage(ctx, region.StartAddr, to); err != nil {
+			t.Fatalf("MovePage to %s failed: %v", to, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	got, err := a.Read(ctx, region.StartAddr, 8)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	want := make([]byte, 8)
+	binary.LittleEndian.PutUint64(want, last)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("page holds %d after migration, last write was %d", binary.LittleEndian.Uint64(got), last)
+	}
+	if err := a.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
+
+// plainMemory serves reads and writes and no optional RPC feature.
+type plainMemory struct{}
+
+func (plainMemory) Read(ctx context.Context, addr uint64, size uint64) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func (plainMemory) Write(ctx context.Context, addr uint64, data []byte) error {
+	return nil
+}
+
+func TestRPCFeaturesAreOptional(t *testing.T) {
+	// The agent's manager serves every feature
+	var mem any = localManager(t, 1<<20)
+	for name, ok := range map[string]bool{
+		"LeaseHolder":       is[rpc.LeaseHolder](mem),
+		"PressurePublisher": is[rpc.PressurePublisher](mem),
+		"TableInspector":    is[rpc.TableInspector](mem),
+		"PhysMemory":        is[rpc.PhysMemory](mem),
+		"QueueHome":         is[rpc.QueueHome](mem),
+		"HashMapHost":       is[rpc.HashMapHost](mem),
+		"LoanTaker":         is[rpc.LoanTaker](mem),
+		"SegmentHolder":     is[rpc.SegmentHolder](mem),
+		"SlabHolder":        is[rpc.SlabHolder](mem),
+		"PageHolder":        is[rpc.PageHolder](mem),
+		"RegionMirror":      is[rpc.RegionMirror](mem),
+	} {
+		if !ok {
+			t.Errorf("MemoryManager does not serve %s", name)
+		}
+	}
+
+	// A manager without a feature refuses its calls instead of panicking
+	server := &rpc.RPCServer{MemManager: plainMemory{}}
+	var resp rpc.MemoryResponse
+	if err := server.ReadMemory(&rpc.MemoryRequest{Size: 4}, &resp); err != nil || len(resp.Data) != 4 {
+		t.Fatalf("ReadMemory = %v, %v", resp.Data, err)
+	}
+	if err := server.ReadPhys(&rpc.PhysRequest{Size: 4}, &resp); err == nil || !strings.Contains(err.Error(), "PhysMemory") {
+		t.Fatalf("ReadPhys on a manager without physical access returned %v", err)
+	}
+}
+
+func is[T any](v any) bool {
+	_, ok := v.(T)
+	return ok
+}
+
+func TestMovePageKeepsRemoteAtomics(t *testing.T) {
+	a, b, _ := pairedManagers(t)
+	ctx := context.Background()
+
+	region, err := a.AllocRegion(sharedmem.PageSize, "a")
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+
+	// b adds through the frame holder while a moves the page back and forth.
+	// An add sent to a frame the page has left fails instead of getting lost.
+	var wg sync.WaitGroup
+	var added uint64
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := b.FetchAdd(ctx, region.StartAddr, 1); err == nil {
+				added++
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		to := "b"
+		if i%2 == 1 {
+			to = "a"
+		}
+		if err := a.MovePage(ctx, region.StartAddr, to); err != nil {
+			t.Fatalf("MovePage to %s failed: %v", to, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	got, err := a.FetchAdd(ctx, region.StartAddr, 0)
+	if err != nil || got != added {
+		t.Fatalf("word = %d, %v after %d successful adds", got, err, added)
+	}
+	if err := a.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
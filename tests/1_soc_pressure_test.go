@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"bigLITTLE/agent"
+	"context"
+	"testing"
+)
+
+// stubPressureSource reports fixed figures instead of walking a table.
+type stubPressureSource struct {
+	allocated uint64
+	free      uint64
+	capacity  uint64
+}
+
+func (s *stubPressureSource) AllocatedBytes(owner string) uint64 { return s.allocated }
+func (s *stubPressureSource) TotalFreeBytes() uint64             { return s.free }
+func (s *stubPressureSource) Capacity() uint64                   { return s.capacity }
+
+func TestPressureLevelTransitions(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	mem.SoftLimit = 1000
+	src := &stubPressureSource{free: 1000, capacity: 1000}
+	pm := agent.NewPressureMonitor(mem)
+	pm.Source = src
+
+	events, unsubscribe := mem.Subscribe()
+	defer unsubscribe()
+	<-events // current state
+
+	steps := []struct {
+		allocated, free uint64
+		want            agent.PressureLevel
+	}{
+		{100, 900, agent.PressureNormal},
+		{760, 900, agent.PressureWarning},  // local warning
+		{960, 900, agent.PressureCritical}, // local critical
+		{500, 900, agent.PressureNormal},   // well clear of both thresholds
+		{100, 150, agent.PressureWarning},  // cluster warning
+		{100, 40, agent.PressureCritical},  // cluster critical
+		{100, 1000, agent.PressureNormal},
+	}
+	prev := agent.PressureNormal
+	for i, s := range steps {
+		src.allocated, src.free = s.allocated, s.free
+		if got := pm.RunOnce(); got != s.want {
+			t.Fatalf("step %d: level %s, want %s", i, got, s.want)
+		}
+		if ev := mem.Pressure(); ev.Level != s.want {
+			t.Fatalf("step %d: published level %s, want %s", i, ev.Level, s.want)
+		}
+		if s.want == prev {
+			continue
+		}
+		if got := <-events; got.Level != s.want || got.Usage != s.allocated {
+			t.Fatalf("step %d: subscriber got %+v", i, got)
+		}
+		prev = s.want
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %+v", ev)
+	default:
+	}
+}
+
+func TestPressureHysteresis(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	mem.SoftLimit = 1000
+	src := &stubPressureSource{free: 1000, capacity: 1000}
+	pm := agent.NewPressureMonitor(mem)
+	pm.Source = src
+
+	src.allocated = 760
+	if got := pm.RunOnce(); got != agent.PressureWarning {
+		t.Fatalf("level %s at 76%%, want warning", got)
+	}
+	seq := mem.Pressure().Seq
+
+	// Dropping just below the threshold keeps the level and publishes nothing
+	src.allocated = 720
+	if got := pm.RunOnce(); got != agent.PressureWarning {
+		t.Fatalf("level %s at 72%%, want warning to hold", got)
+	}
+	if mem.Pressure().Seq != seq {
+		t.Fatalf("event published while inside the hysteresis band")
+	}
+
+	// Past the margin it steps down
+	src.allocated = 690
+	if got := pm.RunOnce(); got != agent.PressureNormal {
+		t.Fatalf("level %s at 69%%, want normal", got)
+	}
+
+	// Critical steps down to warning, not straight to normal, inside warning's band
+	src.allocated = 960
+	pm.RunOnce()
+	src.allocated = 920
+	if got := pm.RunOnce(); got != agent.PressureCritical {
+		t.Fatalf("level %s at 92%%, want critical to hold", got)
+	}
+	src.allocated = 720
+	if got := pm.RunOnce(); got != agent.PressureWarning {
+		t.Fatalf("level %s at 72%% after critical, want warning", got)
+	}
+}
+
+func TestPressureCountsAllocationsNotWrites(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	mem.SoftLimit = 1 << 40
+	pm := agent.NewPressureMonitor(mem)
+
+	region, err := mem.AllocRegion(4096, "local")
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	buf := make([]byte, 4096)
+	for i := 0; i < 100; i++ {
+		if err := mem.Write(context.Background(), region.StartAddr, buf); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// Rewriting one buffer leaves usage at what is allocated
+	mem.SoftLimit = 8192
+	if got := pm.RunOnce(); got != agent.PressureNormal {
+		t.Fatalf("level %s after rewriting one buffer, want normal", got)
+	}
+
+	if _, err := mem.AllocRegion(4096, "local"); err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	if got := pm.RunOnce(); got != agent.PressureCritical {
+		t.Fatalf("level %s with the soft limit allocated, want critical", got)
+	}
+	if ev := mem.Pressure(); ev.Usage != 8192 {
+		t.Fatalf("Usage = %d, want 8192", ev.Usage)
+	}
+}
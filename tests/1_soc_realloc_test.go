@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"bigLITTLE/agent"
+	"bigLITTLE/sharedmem"
+	"bytes"
+	"context"
+	"testing"
+)
+
+// localManager returns a single-SoC memory manager over a fresh table.
+func localManager(t *testing.T, size uint64) *agent.MemoryManager {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{{StartAddr: 0, Length: size, Owner: "local"}})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	return agent.NewMemoryManager("local", mt, size, "local")
+}
+
+func TestReallocInPlaceAndRelocate(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	ctx := context.Background()
+
+	h, err := mem.AllocMovable(4096, "local")
+	if err != nil {
+		t.Fatalf("AllocMovable failed: %v", err)
+	}
+	a, _ := mem.Table.Resolve(h)
+	if err := mem.Table.SetLabel(a.StartAddr, sharedmem.Label{Name: "buf"}); err != nil {
+		t.Fatalf("SetLabel failed: %v", err)
+	}
+	blocker, err := mem.AllocRegion(4096, "local")
+	if err != nil {
+		t.Fatalf("AllocRegion failed: %v", err)
+	}
+	pattern := bytes.Repeat([]byte{0xab, 0xcd}, 2048)
+	if err := mem.Write(ctx, a.StartAddr, pattern); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// The blocker sits right behind a, so growing has to move it
+	moved, err := mem.Realloc(ctx, a.StartAddr, 8192)
+	if err != nil {
+		t.Fatalf("Realloc failed: %v", err)
+	}
+	if moved.StartAddr == a.StartAddr || moved.Length != 8192 {
+		t.Fatalf("Realloc = %+v, expected a moved 8192-byte block", moved)
+	}
+	got, err := mem.Read(ctx, moved.StartAddr, uint64(len(pattern)))
+	if err != nil || !bytes.Equal(got, pattern) {
+		t.Fatalf("contents not copied on relocation: %v", err)
+	}
+	if r, err := mem.Table.Resolve(h); err != nil || r.StartAddr != moved.StartAddr {
+		t.Fatalf("handle not moved with the block: %+v, %v", r, err)
+	}
+	if label, ok := mem.Table.GetLabel(moved.StartAddr); !ok || label.Name != "buf" {
+		t.Fatalf("label not moved with the block: %+v, %v", label, ok)
+	}
+
+	// Nothing behind the moved block now, so it grows and shrinks in place
+	grown, err := mem.Realloc(ctx, moved.StartAddr, 64<<10)
+	if err != nil || grown.StartAddr != moved.StartAddr || grown.Length != 64<<10 {
+		t.Fatalf("in-place growth = %+v, %v", grown, err)
+	}
+	shrunk, err := mem.Realloc(ctx, grown.StartAddr, 100)
+	if err != nil || shrunk.StartAddr != grown.StartAddr || shrunk.Length != 100 {
+		t.Fatalf("shrink = %+v, %v", shrunk, err)
+	}
+
+	if err := mem.FreeRegion(blocker.StartAddr); err != nil {
+		t.Fatalf("FreeRegion failed: %v", err)
+	}
+	if err := mem.FreeHandle(h); err != nil {
+		t.Fatalf("FreeHandle failed: %v", err)
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if free := mem.Table.TotalFreeBytes(); free != 1<<20 {
+		t.Fatalf("TotalFreeBytes = %d, want %d", free, 1<<20)
+	}
+}
+
+func TestReallocOfBlockFreedDuringCopy(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "local"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	a, err := mt.Alloc(sharedmem.AllocRequest{Size: 4096, Owner: "local"})
+	if err != nil {
+		t.Fatalf("Alloc failed: %v", err)
+	}
+	if _, err := mt.Alloc(sharedmem.AllocRequest{Size: 4096, Owner: "local"}); err != nil {
+		t.Fatalf("Alloc failed: %v", err)
+	}
+
+	// The block is freed by raw address while its contents are being copied
+	freeing := func(src, dst sharedmem.MemRegion, length uint64) error {
+		return mt.FreeRegion(src.StartAddr)
+	}
+	if _, err := mt.Realloc(a.StartAddr, 8192, freeing); err == nil {
+		t.Fatalf("Realloc published a block freed during the copy")
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if free := mt.TotalFreeBytes(); free != 1<<20-4096 {
+		t.Fatalf("TotalFreeBytes = %d, want only the blocker allocated", free)
+	}
+}
+
+func TestVMemResize(t *testing.T) {
+	mem := localManager(t, 1<<20)
+
+	v, err := sharedmem.New(3000, mem, "local")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	other, err := sharedmem.New(100, mem, "local")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := v.Write(0, []byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// Dirty the free memory the grown block will land on; the table starts at
+	// offset 0 of local memory
+	if err := mem.WritePhys(other.StartAddr+100, bytes.Repeat([]byte{0xff}, 8192)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	if err := v.Resize(10000); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	if v.Size != 10000 {
+		t.Fatalf("Size = %d after Resize", v.Size)
+	}
+	data, err := v.Read(0, v.Size)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(data[:5]) != "hello" {
+		t.Fatalf("contents lost on Resize: %q", data[:5])
+	}
+	if !bytes.Equal(data[3000:], make([]byte, 7000)) {
+		t.Fatalf("grown part of the VMem is not zeroed")
+	}
+
+	if err := v.Resize(5); err != nil {
+		t.Fatalf("shrinking Resize failed: %v", err)
+	}
+	if _, err := v.Read(0, 6); err == nil {
+		t.Fatalf("read past the shrunk size succeeded")
+	}
+	if err := v.Free(); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if err := other.Free(); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"bigLITTLE/agent"
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+	"errors"
+	"net"
+	nrpc "net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReaperFreesExpiredLeases(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	tracker := sharedmem.NewTaskMemoryTracker(mem.Table)
+	reaper := agent.NewReaper(mem, tracker)
+
+	short, err := mem.AllocLeased(4096, "local", "peer", "t1", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("AllocLeased failed: %v", err)
+	}
+	long, err := mem.AllocLeased(4096, "local", "peer", "t1", time.Hour)
+	if err != nil {
+		t.Fatalf("AllocLeased failed: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	reclaimed := reaper.RunOnce()
+	if len(reclaimed) != 1 || reclaimed[0].Region.StartAddr != short.StartAddr || reclaimed[0].Reason != sharedmem.ReclaimExpired {
+		t.Fatalf("RunOnce reclaimed %+v, want only the expired lease at 0x%x", reclaimed, short.StartAddr)
+	}
+	if _, ok := mem.Table.Allocations[short.StartAddr]; ok {
+		t.Fatalf("expired region 0x%x still allocated", short.StartAddr)
+	}
+	if _, ok := mem.Table.Allocations[long.StartAddr]; !ok {
+		t.Fatalf("live lease at 0x%x was reclaimed", long.StartAddr)
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
+
+func TestReaperRenewedLeaseSurvives(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	reaper := agent.NewReaper(mem, nil)
+
+	region, err := mem.AllocLeased(4096, "local", "peer", "t1", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("AllocLeased failed: %v", err)
+	}
+	if _, err := mem.RenewLease(region.StartAddr, "other"); err == nil {
+		t.Fatalf("RenewLease by a foreign holder succeeded")
+	}
+
+	// Renew twice across what would have been the original expiry
+	for i := 0; i < 2; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if _, err := mem.RenewLease(region.StartAddr, "peer"); err != nil {
+			t.Fatalf("RenewLease failed: %v", err)
+		}
+		if reclaimed := reaper.RunOnce(); len(reclaimed) != 0 {
+			t.Fatalf("renewed lease reclaimed: %+v", reclaimed)
+		}
+	}
+	if _, ok := mem.Table.Allocations[region.StartAddr]; !ok {
+		t.Fatalf("renewed region 0x%x was freed", region.StartAddr)
+	}
+}
+
+func TestReaperReclaimsAfterHeartbeatDeclaresDead(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	reaper := agent.NewReaper(mem, nil)
+
+	region, err := mem.AllocLeased(4096, "local", "peer", "t1", time.Hour)
+	if err != nil {
+		t.Fatalf("AllocLeased failed: %v", err)
+	}
+
+	var down bool
+	hb := agent.NewHeartbeat(reaper, []string{"peer"}, func(soc string) error {
+		if down {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	hb.MissLimit = 2
+
+	hb.RunOnce()
+	down = true
+	hb.RunOnce()
+	if reaper.IsDead("peer") {
+		t.Fatalf("peer declared dead after a single missed ping")
+	}
+	if reclaimed := reaper.RunOnce(); len(reclaimed) != 0 {
+		t.Fatalf("lease reclaimed while holder alive: %+v", reclaimed)
+	}
+
+	hb.RunOnce()
+	if !reaper.IsDead("peer") {
+		t.Fatalf("peer not declared dead after %d missed pings", hb.MissLimit)
+	}
+	reclaimed := reaper.RunOnce()
+	if len(reclaimed) != 1 || reclaimed[0].Region.StartAddr != region.StartAddr || reclaimed[0].Reason != sharedmem.ReclaimHolderDead {
+		t.Fatalf("RunOnce reclaimed %+v, want the dead holder's lease", reclaimed)
+	}
+
+	// Answering again revives it
+	down = false
+	hb.RunOnce()
+	if reaper.IsDead("peer") {
+		t.Fatalf("peer still dead after answering a ping")
+	}
+}
+
+func TestHeartbeatIgnoresPeersNeverSeen(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	reaper := agent.NewReaper(mem, nil)
+	hb := agent.NewHeartbeat(reaper, []string{"peer"}, func(soc string) error {
+		return errors.New("no RPC client")
+	})
+	for i := 0; i < 2*hb.MissLimit; i++ {
+		hb.RunOnce()
+	}
+	if reaper.IsDead("peer") {
+		t.Fatalf("peer that never answered was declared dead")
+	}
+}
+
+// peerServer serves a memory manager's RPC handlers on a fixed address and
+// can go down with all its connections, like a SoC that is restarted.
+type peerServer struct {
+	t        *testing.T
+	addr     string
+	mem      *agent.MemoryManager
+	listener net.Listener
+
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func startPeer(t *testing.T, addr string, mem *agent.MemoryManager) *peerServer {
+	p := &peerServer{t: t, addr: addr, mem: mem}
+	p.start()
+	t.Cleanup(p.stop)
+	return p
+}
+
+func (p *peerServer) start() {
+	listener, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		p.t.Fatalf("Listen failed: %v", err)
+	}
+	p.listener, p.addr = listener, listener.Addr().String()
+	server := nrpc.NewServer()
+	if err := server.Register(&rpc.RPCServer{MemManager: p.mem}); err != nil {
+		p.t.Fatalf("Register failed: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			p.lock.Lock()
+			p.conns = append(p.conns, conn)
+			p.lock.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+}
+
+func (p *peerServer) stop() {
+	p.listener.Close()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func TestHeartbeatRevivesRestartedPeer(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	peerTable, err := sharedmem.NewMemTable([]sharedmem.MemRegion{{StartAddr: 1 << 20, Length: 1 << 20, Owner: "peer"}})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	peer := agent.NewMemoryManager("peer", peerTable, 1<<20, "peer")
+	reaper := agent.NewReaper(mem, nil)
+
+	local := startPeer(t, "127.0.0.1:0", mem)
+	remote := startPeer(t, "127.0.0.1:0", peer)
+	dial := func(addr string) func() (*nrpc.Client, error) {
+		return func() (*nrpc.Client, error) { return nrpc.Dial("tcp", addr) }
+	}
+	mem.RegisterRPCDialer("peer", dial(remote.addr))
+	peer.RegisterRPCDialer("local", dial(local.addr))
+
+	// The peer takes a lease in this SoC's table over RPC
+	if err := peer.Ping("local", time.Second); err != nil {
+		t.Fatalf("Ping from the peer failed: %v", err)
+	}
+	region, err := peer.AllocRemoteLeased("local", 4096, "local", "t1", time.Hour)
+	if err != nil {
+		t.Fatalf("AllocRemoteLeased failed: %v", err)
+	}
+	if _, err := peer.RenewRemoteLease("local", region.StartAddr); err != nil {
+		t.Fatalf("RenewRemoteLease failed: %v", err)
+	}
+
+	hb := agent.NewHeartbeat(reaper, []string{"peer"}, func(soc string) error {
+		return mem.Ping(soc, time.Second)
+	})
+	hb.MissLimit = 1
+	hb.RunOnce()
+	if reaper.IsDead("peer") {
+		t.Fatalf("peer declared dead while answering")
+	}
+
+	// The peer goes down, and its lease with it
+	remote.stop()
+	hb.RunOnce()
+	if !reaper.IsDead("peer") {
+		t.Fatalf("peer not declared dead after going down")
+	}
+	reclaimed := reaper.RunOnce()
+	if len(reclaimed) != 1 || reclaimed[0].Region.StartAddr != region.StartAddr {
+		t.Fatalf("RunOnce reclaimed %+v, want the peer's lease", reclaimed)
+	}
+
+	// Once restarted it is reached on a new connection and revived
+	remote.start()
+	hb.RunOnce()
+	if reaper.IsDead("peer") {
+		t.Fatalf("restarted peer still dead")
+	}
+}
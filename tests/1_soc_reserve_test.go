@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"encoding/json"
+	"testing"
+)
+
+func TestReserveCommitDecommit(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 512 << 10, Owner: "a"},
+		{StartAddr: 512 << 10, Length: 1 << 20, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+
+	res, err := mt.ReserveOn("b", 1<<20-100)
+	if err != nil {
+		t.Fatalf("ReserveOn failed: %v", err)
+	}
+	if res.Length != 1<<20 || res.Owner != "b" {
+		t.Fatalf("reservation = %+v, want all of b", res)
+	}
+	if mt.ReservedBytes() != 1<<20 || mt.CommittedBytes() != 0 {
+		t.Fatalf("reserved %d committed %d", mt.ReservedBytes(), mt.CommittedBytes())
+	}
+	// Reserved memory is not free memory
+	if _, err := mt.FindSoCWithFreeMemory(600 << 10); err == nil {
+		t.Fatalf("FindSoCWithFreeMemory found room inside a reservation")
+	}
+	if mt.TotalFreeBytes() != 512<<10 || mt.Capacity() != 1536<<10 {
+		t.Fatalf("free %d capacity %d", mt.TotalFreeBytes(), mt.Capacity())
+	}
+
+	// Uncommitted pages cannot be translated
+	if _, _, err := mt.TranslateAddr(res.StartAddr); err == nil {
+		t.Fatalf("uncommitted page translated")
+	}
+	if err := mt.Commit(res.StartAddr+10, 3*sharedmem.PageSize); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if got := mt.CommittedBytes(); got != 4*sharedmem.PageSize {
+		t.Fatalf("CommittedBytes = %d, want 4 pages", got)
+	}
+	if soc, _, err := mt.TranslateAddr(res.StartAddr + 5); err != nil || soc != "b" {
+		t.Fatalf("committed page translates to %q, %v", soc, err)
+	}
+	// Committing overlapping pages again only fills the gaps
+	if err := mt.Commit(res.StartAddr, 6*sharedmem.PageSize); err != nil {
+		t.Fatalf("second Commit failed: %v", err)
+	}
+	if got := mt.CommittedBytes(); got != 6*sharedmem.PageSize {
+		t.Fatalf("CommittedBytes = %d, want 6 pages", got)
+	}
+
+	// Punch a hole in the middle, splitting both commits
+	if err := mt.Decommit(res.StartAddr+3*sharedmem.PageSize, 2*sharedmem.PageSize); err != nil {
+		t.Fatalf("Decommit failed: %v", err)
+	}
+	if got := mt.CommittedBytes(); got != 4*sharedmem.PageSize {
+		t.Fatalf("CommittedBytes = %d after Decommit, want 4 pages", got)
+	}
+	if _, _, err := mt.TranslateAddr(res.StartAddr + 3*sharedmem.PageSize); err == nil {
+		t.Fatalf("decommitted page still translates")
+	}
+	if err := mt.Commit(res.StartAddr+(1<<20)-10, 20); err == nil {
+		t.Fatalf("Commit past the reservation succeeded")
+	}
+
+	// Freeing a committed block hands it back to the reservation, not the free list
+	if err := mt.FreeRegion(res.StartAddr); err != nil {
+		t.Fatalf("FreeRegion failed: %v", err)
+	}
+	if mt.TotalFreeBytes() != 512<<10 {
+		t.Fatalf("freed committed memory leaked into the free list")
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	// Reservations survive a round trip
+	data, err := json.Marshal(mt)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	var restored sharedmem.MemTable
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("UnmarshalJSON failed: %v", err)
+	}
+	if restored.ReservedBytes() != mt.ReservedBytes() {
+		t.Fatalf("restored ReservedBytes = %d, want %d", restored.ReservedBytes(), mt.ReservedBytes())
+	}
+
+	if err := mt.Unreserve(res.StartAddr); err != nil {
+		t.Fatalf("Unreserve failed: %v", err)
+	}
+	if mt.TotalFreeBytes() != 1536<<10 || mt.ReservedBytes() != 0 {
+		t.Fatalf("free %d reserved %d after Unreserve", mt.TotalFreeBytes(), mt.ReservedBytes())
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify after Unreserve failed: %v", err)
+	}
+}
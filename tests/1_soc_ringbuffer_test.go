@@ -0,0 +1,300 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bigLITTLE/agent"
+	"bigLITTLE/sharedmem"
+)
+
+func TestRingBufferBounds(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	mem.SoftLimit = 1 << 40
+	ctx := context.Background()
+
+	q, err := sharedmem.NewRingBuffer(mem, sharedmem.RingBufferConfig{Capacity: 3, ItemSize: 8, Owner: "local"})
+	if err != nil {
+		t.Fatalf("NewRingBuffer failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if ok, err := q.TryEnqueue(ctx, []byte{byte(i)}); err != nil || !ok {
+			t.Fatalf("TryEnqueue %d = %v, %v", i, ok, err)
+		}
+	}
+	if ok, err := q.TryEnqueue(ctx, []byte{9}); err != nil || ok {
+		t.Fatalf("TryEnqueue on a full queue = %v, %v", ok, err)
+	}
+	if n, _ := q.Len(ctx); n != 3 {
+		t.Fatalf("Len = %d, want 3", n)
+	}
+	if _, err := q.TryEnqueue(ctx, make([]byte, 9)); err == nil {
+		t.Fatalf("TryEnqueue accepted an item longer than ItemSize")
+	}
+	if _, err := sharedmem.NewRingBuffer(mem, sharedmem.RingBufferConfig{Capacity: 1, ItemSize: 8, Owner: "local"}); err == nil {
+		t.Fatalf("NewRingBuffer accepted a single slot")
+	}
+
+	// Wrap around a few laps, FIFO order
+	for i := 0; i < 10; i++ {
+		item, err := q.Dequeue(ctx)
+		if err != nil || len(item) != 1 || item[0] != byte(i) {
+			t.Fatalf("Dequeue %d = %v, %v", i, item, err)
+		}
+		if err := q.Enqueue(ctx, []byte{byte(i + 3)}); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+
+	// Blocked calls give up with their context
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := q.Enqueue(tctx, []byte{0}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Enqueue on a full queue returned %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		q.Dequeue(ctx)
+	}
+	if _, ok, err := q.TryDequeue(ctx); err != nil || ok {
+		t.Fatalf("TryDequeue on an empty queue = %v, %v", ok, err)
+	}
+	tctx, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Dequeue(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dequeue on an empty queue returned %v", err)
+	}
+
+	// So do callers sleeping on a notifying queue whose home is this SoC
+	nq, err := sharedmem.NewRingBuffer(mem, sharedmem.RingBufferConfig{Capacity: 2, ItemSize: 8, Owner: "local", Notify: true})
+	if err != nil {
+		t.Fatalf("NewRingBuffer failed: %v", err)
+	}
+	tctx, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := nq.Dequeue(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dequeue on an empty notifying queue returned %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := nq.Enqueue(ctx, []byte{byte(i)}); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+	tctx, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := nq.Enqueue(tctx, []byte{2}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Enqueue on a full notifying queue returned %v", err)
+	}
+	if err := nq.Free(); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+
+	if err := q.Free(); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	// A small queue lives in a slab, which stays cached until trimmed
+	if _, err := mem.Slab.Trim(); err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if len(mem.Table.Allocations) != 0 {
+		t.Fatalf("allocations left after Free")
+	}
+}
+
+func TestRingBufferProducersConsumers(t *testing.T) {
+	for _, notify := range []bool{false, true} {
+		t.Run(fmt.Sprintf("notify=%v", notify), func(t *testing.T) {
+			mem := localManager(t, 1<<20)
+			mem.SoftLimit = 1 << 40
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			q, err := sharedmem.NewRingBuffer(mem, sharedmem.RingBufferConfig{
+				Capacity: 4,
+				ItemSize: 16,
+				Owner:    "local",
+				Notify:   notify,
+			})
+			if err != nil {
+				t.Fatalf("NewRingBuffer failed: %v", err)
+			}
+
+			const producers, consumers, perProducer = 3, 3, 200
+			var wg sync.WaitGroup
+			errs := make(chan error, producers+consumers)
+			for p := 0; p < producers; p++ {
+				wg.Add(1)
+				go func(p int) {
+					defer wg.Done()
+					// A producer on another agent opens the queue by address
+					pq, err := sharedmem.OpenRingBuffer(mem, q.Addr())
+					if err != nil {
+						errs <- err
+						return
+					}
+					for i := 0; i < perProducer; i++ {
+						if err := pq.Enqueue(ctx, []byte(fmt.Sprintf("p%d-%d", p, i))); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(p)
+			}
+
+			var lock sync.Mutex
+			seen := make(map[string]int)
+			for c := 0; c < consumers; c++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < producers*perProducer/consumers; i++ {
+						item, err := q.Dequeue(ctx)
+						if err != nil {
+							errs <- err
+							return
+						}
+						lock.Lock()
+						seen[string(item)]++
+						lock.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			if len(seen) != producers*perProducer {
+				t.Fatalf("%d distinct items dequeued, want %d", len(seen), producers*perProducer)
+			}
+			for item, n := range seen {
+				if n != 1 {
+					t.Fatalf("item %s dequeued %d times", item, n)
+				}
+			}
+			if n, _ := q.Len(ctx); n != 0 {
+				t.Fatalf("Len = %d after draining", n)
+			}
+			if err := mem.Table.Verify(); err != nil {
+				t.Fatalf("Verify failed: %v", err)
+			}
+		})
+	}
+}
+
+// failingWrites is a memory manager whose next `fail` writes fail.
+type failingWrites struct {
+	*agent.MemoryManager
+	fail atomic.Int32
+}
+
+func (f *failingWrites) Write(ctx context.Context, addr uint64, data []byte) error {
+	if f.fail.Add(-1) >= 0 {
+		return errors.New("injected write failure")
+	}
+	return f.MemoryManager.Write(ctx, addr, data)
+}
+
+func TestRingBufferFailedFillIsSkipped(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	mem.SoftLimit = 1 << 40
+	ctx := context.Background()
+
+	q, err := sharedmem.NewRingBuffer(mem, sharedmem.RingBufferConfig{Capacity: 4, ItemSize: 8, Owner: "local"})
+	if err != nil {
+		t.Fatalf("NewRingBuffer failed: %v", err)
+	}
+	flaky := &failingWrites{MemoryManager: mem}
+	producer, err := sharedmem.OpenRingBuffer(flaky, q.Addr())
+	if err != nil {
+		t.Fatalf("OpenRingBuffer failed: %v", err)
+	}
+
+	// A write that fails a few times is retried
+	flaky.fail.Store(2)
+	if err := producer.Enqueue(ctx, []byte("a")); err != nil {
+		t.Fatalf("Enqueue with transient failures failed: %v", err)
+	}
+	// One that keeps failing hands the slot on poisoned
+	flaky.fail.Store(1000)
+	if err := producer.Enqueue(ctx, []byte("lost")); err == nil {
+		t.Fatalf("Enqueue reported success for an item it could not write")
+	}
+	flaky.fail.Store(0)
+	if err := producer.Enqueue(ctx, []byte("b")); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	// Consumers skip the poisoned slot and the queue keeps going
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for _, want := range []string{"a", "b"} {
+		item, err := q.Dequeue(tctx)
+		if err != nil || string(item) != want {
+			t.Fatalf("Dequeue = %q, %v, want %q", item, err, want)
+		}
+	}
+	if _, ok, err := q.TryDequeue(ctx); err != nil || ok {
+		t.Fatalf("TryDequeue on an empty queue = %v, %v", ok, err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := producer.Enqueue(tctx, []byte{byte(i)}); err != nil {
+			t.Fatalf("Enqueue after the poisoned slot failed: %v", err)
+		}
+		if item, err := q.Dequeue(tctx); err != nil || len(item) != 1 || item[0] != byte(i) {
+			t.Fatalf("Dequeue = %v, %v", item, err)
+		}
+	}
+	if err := q.Free(); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+}
+
+func TestRingBufferAcrossSeparateTables(t *testing.T) {
+	a, b := masterAgents(t)
+	ctx := context.Background()
+	free := map[*agent.MemoryManager]uint64{a: a.Table.TotalFreeBytes(), b: b.Table.TotalFreeBytes()}
+
+	// A small queue in a's slab and one with a region of its own, both on b
+	for _, capacity := range []uint64{4, 512} {
+		q, err := sharedmem.NewRingBuffer(a, sharedmem.RingBufferConfig{Capacity: capacity, ItemSize: 16, Owner: "b", Notify: true})
+		if err != nil {
+			t.Fatalf("NewRingBuffer failed: %v", err)
+		}
+		other, err := sharedmem.OpenRingBuffer(b, q.Addr())
+		if err != nil {
+			t.Fatalf("OpenRingBuffer on b failed: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := q.Enqueue(ctx, []byte{byte(i)}); err != nil {
+				t.Fatalf("Enqueue on a failed: %v", err)
+			}
+			item, err := other.Dequeue(ctx)
+			if err != nil || len(item) != 1 || item[0] != byte(i) {
+				t.Fatalf("Dequeue on b = %v, %v", item, err)
+			}
+		}
+		if err := other.Free(); err != nil {
+			t.Fatalf("Free from b failed: %v", err)
+		}
+	}
+
+	for _, m := range []*agent.MemoryManager{a, b} {
+		if _, err := m.Slab.Trim(); err != nil {
+			t.Fatalf("Trim on %s failed: %v", m.LocalSoCName, err)
+		}
+	}
+	for _, m := range []*agent.MemoryManager{a, b} {
+		if err := m.Table.Verify(); err != nil {
+			t.Fatalf("table of %s inconsistent after Free: %v", m.LocalSoCName, err)
+		}
+		if got := m.Table.TotalFreeBytes(); got != free[m] {
+			t.Errorf("%s has %d free bytes after Free, want %d", m.LocalSoCName, got, free[m])
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package tests
+
+import (
+	"errors"
+	"net"
+	nrpc "net/rpc"
+	"testing"
+
+	"bigLITTLE/agent"
+	"bigLITTLE/rpc"
+	"bigLITTLE/sharedmem"
+)
+
+func TestNamedSegments(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	mem.SoftLimit = 1 << 40
+
+	// Opening a missing segment without Create fails
+	if _, err := sharedmem.Open(mem, "frames", sharedmem.OpenOptions{}); !errors.Is(err, sharedmem.ErrSegmentNotFound) {
+		t.Fatalf("Open of a missing segment returned %v", err)
+	}
+
+	writer, err := sharedmem.Open(mem, "frames", sharedmem.OpenOptions{Create: true, Size: 10000, Owner: "local"})
+	if err != nil {
+		t.Fatalf("Open with Create failed: %v", err)
+	}
+	if writer.Size != 10000 {
+		t.Fatalf("segment size = %d", writer.Size)
+	}
+	if err := writer.Write(0, []byte("frame 1")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// A second task opens it by name, without knowing its address
+	reader, err := sharedmem.Open(mem, "frames", sharedmem.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open by name failed: %v", err)
+	}
+	if reader.StartAddr != writer.StartAddr {
+		t.Fatalf("opened 0x%x, created 0x%x", reader.StartAddr, writer.StartAddr)
+	}
+	if got, _ := reader.Read(0, 7); string(got) != "frame 1" {
+		t.Fatalf("reader reads %q", got)
+	}
+	if err := reader.Write(0, []byte("x")); !errors.Is(err, sharedmem.ErrReadOnly) {
+		t.Fatalf("write through a read-only open returned %v", err)
+	}
+
+	// Create without Exclusive opens the existing segment
+	again, err := sharedmem.Open(mem, "frames", sharedmem.OpenOptions{Create: true, Size: 10, Owner: "local"})
+	if err != nil || again.StartAddr != writer.StartAddr {
+		t.Fatalf("non-exclusive Create = 0x%x, %v", again.StartAddr, err)
+	}
+	if _, err := sharedmem.Open(mem, "frames", sharedmem.OpenOptions{Create: true, Exclusive: true, Size: 10, Owner: "local"}); !errors.Is(err, sharedmem.ErrSegmentExists) {
+		t.Fatalf("exclusive Create of an existing segment returned %v", err)
+	}
+	if _, err := sharedmem.Open(mem, "frames", sharedmem.OpenOptions{Size: 20000}); err == nil {
+		t.Fatalf("Open asking for more than the segment holds succeeded")
+	}
+	seg, _ := mem.Table.LookupSegment("frames")
+	if seg.Refs != 3 {
+		t.Fatalf("Refs = %d, want 3", seg.Refs)
+	}
+
+	// Permissions
+	if _, err := sharedmem.Open(mem, "config", sharedmem.OpenOptions{Create: true, Size: 100, Perm: sharedmem.SegmentRead, Owner: "local"}); err == nil {
+		t.Fatalf("creating a read-only segment for writing succeeded")
+	}
+	cfg, err := sharedmem.Open(mem, "config", sharedmem.OpenOptions{Create: true, Size: 100, Perm: sharedmem.SegmentRead, ReadOnly: true, Owner: "local"})
+	if err != nil {
+		t.Fatalf("creating a read-only segment failed: %v", err)
+	}
+	if _, err := sharedmem.Open(mem, "config", sharedmem.OpenOptions{}); err == nil {
+		t.Fatalf("opening a read-only segment for writing succeeded")
+	}
+
+	// Unlink frees the name at once, the memory with the last reference
+	if err := sharedmem.Unlink(mem, "frames"); err != nil {
+		t.Fatalf("Unlink failed: %v", err)
+	}
+	if _, err := sharedmem.Open(mem, "frames", sharedmem.OpenOptions{}); !errors.Is(err, sharedmem.ErrSegmentNotFound) {
+		t.Fatalf("Open after Unlink returned %v", err)
+	}
+	if got, _ := reader.Read(0, 7); string(got) != "frame 1" {
+		t.Fatalf("reader reads %q after Unlink", got)
+	}
+	allocs := len(mem.Table.Allocations)
+	writer.Free()
+	again.Free()
+	if len(mem.Table.Allocations) != allocs {
+		t.Fatalf("segment freed while still open")
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := reader.Free(); err != nil {
+		t.Fatalf("last Free failed: %v", err)
+	}
+	if len(mem.Table.Allocations) != allocs-1 {
+		t.Fatalf("segment not freed with its last reference")
+	}
+
+	// A name can be reused after unlinking
+	fresh, err := sharedmem.Open(mem, "frames", sharedmem.OpenOptions{Create: true, Size: 100, Owner: "local"})
+	if err != nil {
+		t.Fatalf("re-creating an unlinked name failed: %v", err)
+	}
+	if got, _ := fresh.Read(0, 7); string(got) == "frame 1" {
+		t.Fatalf("new segment sees the old one's bytes")
+	}
+
+	// Unlinking an unreferenced segment frees it at once
+	fresh.Free()
+	cfg.Free()
+	sharedmem.Unlink(mem, "frames")
+	sharedmem.Unlink(mem, "config")
+	if len(mem.Table.Allocations) != 0 || len(mem.Table.Segments()) != 0 {
+		t.Fatalf("%d allocations and %d segments left", len(mem.Table.Allocations), len(mem.Table.Segments()))
+	}
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
+
+// masterAgents returns managers for SoCs "a" and "b", each over its own
+// table, reaching each other through their RPC servers and naming segments
+// at a master.
+func masterAgents(t *testing.T) (*agent.MemoryManager, *agent.MemoryManager) {
+	regions := []sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "a"},
+		{StartAddr: 1 << 20, Length: 1 << 20, Owner: "b"},
+	}
+	listen := func() net.Listener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		return listener
+	}
+
+	masterListener := listen()
+	go rpc.ServeMaster(masterListener, &rpc.MasterServer{Regions: regions, Segments: sharedmem.NewSegmentDirectory()})
+
+	managers := make(map[string]*agent.MemoryManager)
+	addrs := make(map[string]string)
+	for _, name := range []string{"a", "b"} {
+		mt, err := sharedmem.NewMemTable(regions)
+		if err != nil {
+			t.Fatalf("NewMemTable failed: %v", err)
+		}
+		m := agent.NewMemoryManager(name, mt, 1<<20, name)
+		m.SoftLimit = 1 << 40
+		m.Master = rpc.NewMasterClient(masterListener.Addr().String())
+		managers[name] = m
+
+		listener := listen()
+		server := nrpc.NewServer()
+		if err := server.Register(&rpc.RPCServer{MemManager: m}); err != nil {
+			t.Fatalf("Register failed: %v", err)
+		}
+		go server.Accept(listener)
+		addrs[name] = listener.Addr().String()
+	}
+	for name, m := range managers {
+		for peer, addr := range addrs {
+			if peer == name {
+				continue
+			}
+			client, err := nrpc.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			t.Cleanup(func() { client.Close() })
+			m.RegisterRPCClient(peer, client)
+		}
+	}
+	return managers["a"], managers["b"]
+}
+
+func TestSegmentsSharedThroughMaster(t *testing.T) {
+	a, b := masterAgents(t)
+
+	writer, err := sharedmem.Open(a, "frames", sharedmem.OpenOptions{Create: true, Size: 10000, Owner: "a"})
+	if err != nil {
+		t.Fatalf("Open with Create on a failed: %v", err)
+	}
+	if err := writer.Write(0, []byte("frame 1")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// b finds the segment a created, though their tables are apart
+	if _, ok := b.Table.LookupSegment("frames"); ok {
+		t.Fatalf("segment registered in b's own table")
+	}
+	reader, err := sharedmem.Open(b, "frames", sharedmem.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open by name on b failed: %v", err)
+	}
+	if reader.StartAddr != writer.StartAddr {
+		t.Fatalf("b opened 0x%x, a created 0x%x", reader.StartAddr, writer.StartAddr)
+	}
+	if got, err := reader.Read(0, 7); err != nil || string(got) != "frame 1" {
+		t.Fatalf("b reads %q, %v", got, err)
+	}
+	if _, err := sharedmem.Open(b, "frames", sharedmem.OpenOptions{Create: true, Exclusive: true, Size: 10, Owner: "b"}); !errors.Is(err, sharedmem.ErrSegmentExists) {
+		t.Fatalf("exclusive Create on b of a's segment returned %v", err)
+	}
+
+	// An unlink on a is seen by b, and the memory outlives a's reference
+	if err := sharedmem.Unlink(a, "frames"); err != nil {
+		t.Fatalf("Unlink failed: %v", err)
+	}
+	if _, err := sharedmem.Open(b, "frames", sharedmem.OpenOptions{}); !errors.Is(err, sharedmem.ErrSegmentNotFound) {
+		t.Fatalf("Open on b of an unlinked segment returned %v", err)
+	}
+	if err := writer.Free(); err != nil {
+		t.Fatalf("Free on a failed: %v", err)
+	}
+	if got, err := reader.Read(0, 7); err != nil || string(got) != "frame 1" {
+		t.Fatalf("b reads %q, %v after a let go", got, err)
+	}
+
+	// b drops the last reference; both tables give the memory back
+	if err := reader.Free(); err != nil {
+		t.Fatalf("Free on b failed: %v", err)
+	}
+	for _, m := range []*agent.MemoryManager{a, b} {
+		if free := m.Table.TotalFreeBytes(); free != 2<<20 {
+			t.Fatalf("%s: TotalFreeBytes = %d, want %d", m.LocalSoCName, free, 2<<20)
+		}
+		if err := m.Table.Verify(); err != nil {
+			t.Fatalf("%s: Verify failed: %v", m.LocalSoCName, err)
+		}
+	}
+}
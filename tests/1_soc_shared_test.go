@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"testing"
+)
+
+func TestSharedRegionReleasedByLastHolder(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{{StartAddr: 0, Length: 1 << 20, Owner: "local"}})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	tracker := sharedmem.NewTaskMemoryTracker(mt)
+
+	region, err := tracker.AllocPagesForTask("a", 4096, "local")
+	if err != nil {
+		t.Fatalf("AllocPagesForTask failed: %v", err)
+	}
+	h, err := tracker.Share("a", region.StartAddr)
+	if err != nil {
+		t.Fatalf("Share failed: %v", err)
+	}
+	if _, err := tracker.Share("a", region.StartAddr); err == nil {
+		t.Fatalf("sharing an already shared region succeeded")
+	}
+	if got, err := tracker.Attach("b", h); err != nil || got != region {
+		t.Fatalf("Attach = %+v, %v, want %+v", got, err, region)
+	}
+	if holders, _ := tracker.Holders(h); len(holders) != 2 || holders[0] != "a" || holders[1] != "b" {
+		t.Fatalf("Holders = %v, want [a b]", holders)
+	}
+
+	// Freeing a drops its reference but leaves the region to b
+	if err := tracker.FreeTaskPages("a"); err != nil {
+		t.Fatalf("FreeTaskPages(a) failed: %v", err)
+	}
+	if _, ok := mt.Allocations[region.StartAddr]; !ok {
+		t.Fatalf("shared region freed while b still holds it")
+	}
+
+	_, last, err := tracker.Detach("b", h)
+	if err != nil || !last {
+		t.Fatalf("Detach by the last holder = %v, %v, want last", last, err)
+	}
+	if _, err := tracker.Holders(h); err == nil {
+		t.Fatalf("handle %d still known after its last reference", h)
+	}
+	if err := mt.FreeRegion(region.StartAddr); err != nil {
+		t.Fatalf("FreeRegion failed: %v", err)
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
+
+func TestSharedRegionDoubleRelease(t *testing.T) {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{{StartAddr: 0, Length: 1 << 20, Owner: "local"}})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	tracker := sharedmem.NewTaskMemoryTracker(mt)
+
+	region, _ := tracker.AllocPagesForTask("a", 4096, "local")
+	h, err := tracker.Share("a", region.StartAddr)
+	if err != nil {
+		t.Fatalf("Share failed: %v", err)
+	}
+	tracker.Attach("b", h)
+
+	if _, last, err := tracker.Detach("b", h); err != nil || last {
+		t.Fatalf("first Detach by b = %v, %v", last, err)
+	}
+	// b has nothing left to release, and a's reference must survive the attempt
+	if _, _, err := tracker.Detach("b", h); err == nil {
+		t.Fatalf("second Detach by b succeeded")
+	}
+	if holders, err := tracker.Holders(h); err != nil || len(holders) != 1 || holders[0] != "a" {
+		t.Fatalf("Holders after double release = %v, %v, want [a]", holders, err)
+	}
+
+	if _, last, err := tracker.Detach("a", h); err != nil || !last {
+		t.Fatalf("Detach by a = %v, %v, want last", last, err)
+	}
+	if _, _, err := tracker.Detach("a", h); err == nil {
+		t.Fatalf("Detach of a released handle succeeded")
+	}
+}
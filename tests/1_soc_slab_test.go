@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"errors"
+	"testing"
+)
+
+func newSlabTable(t *testing.T) *sharedmem.MemTable {
+	mt, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1 << 20, Owner: "a"},
+		{StartAddr: 1 << 20, Length: 1 << 20, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("NewMemTable failed: %v", err)
+	}
+	return mt
+}
+
+func TestSlabSizeClasses(t *testing.T) {
+	sa := sharedmem.NewSlabAllocator(newSlabTable(t), "a")
+
+	for _, tc := range []struct{ size, slot uint64 }{
+		{1, 16}, {16, 16}, {17, 32}, {100, 128}, {2048, 2048}, {2049, 2049},
+	} {
+		ptr, err := sa.Malloc(tc.size)
+		if err != nil {
+			t.Fatalf("Malloc(%d) failed: %v", tc.size, err)
+		}
+		if got, err := sa.SlotSize(ptr); err != nil || got != tc.slot {
+			t.Fatalf("SlotSize of Malloc(%d) = %d, %v, want %d", tc.size, got, err, tc.slot)
+		}
+		if tc.slot <= sharedmem.MaxSlabObject() && ptr%tc.slot != 0 {
+			t.Fatalf("Malloc(%d) = 0x%x, not aligned to its size class", tc.size, ptr)
+		}
+	}
+	if _, err := sa.Malloc(0); err == nil {
+		t.Fatalf("Malloc(0) succeeded")
+	}
+}
+
+func TestSlabPerSoCCaches(t *testing.T) {
+	mt := newSlabTable(t)
+	sa := sharedmem.NewSlabAllocator(mt, "a")
+
+	local, _ := sa.Malloc(64)
+	remote, err := sa.MallocOn("b", 64)
+	if err != nil {
+		t.Fatalf("MallocOn(b) failed: %v", err)
+	}
+	if owner, _, _ := mt.TranslateAddr(local); owner != "a" {
+		t.Fatalf("Malloc landed on %q, want a", owner)
+	}
+	if owner, _, _ := mt.TranslateAddr(remote); owner != "b" {
+		t.Fatalf("MallocOn(b) landed on %q, want b", owner)
+	}
+
+	// Each SoC's objects come from its own slab
+	next, _ := sa.MallocOn("b", 64)
+	if next != remote+64 {
+		t.Fatalf("second object on b at 0x%x, want 0x%x", next, remote+64)
+	}
+	if len(mt.Allocations) != 2 {
+		t.Fatalf("%d slab pages allocated, want one per SoC", len(mt.Allocations))
+	}
+}
+
+func TestSlabRefillAndFree(t *testing.T) {
+	mt := newSlabTable(t)
+	sa := sharedmem.NewSlabAllocator(mt, "a")
+	perSlab := uint64(sharedmem.PageSize / 16)
+
+	var ptrs []uint64
+	for i := uint64(0); i < perSlab; i++ {
+		ptr, err := sa.Malloc(16)
+		if err != nil {
+			t.Fatalf("Malloc failed: %v", err)
+		}
+		if i > 0 && ptr != ptrs[i-1]+16 {
+			t.Fatalf("object %d at 0x%x, want address order", i, ptr)
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	if len(mt.Allocations) != 1 {
+		t.Fatalf("%d slab pages for one full slab", len(mt.Allocations))
+	}
+
+	// A full slab is refilled with a new page
+	extra, err := sa.Malloc(16)
+	if err != nil {
+		t.Fatalf("Malloc after a full slab failed: %v", err)
+	}
+	if len(mt.Allocations) != 2 {
+		t.Fatalf("%d slab pages after refill, want 2", len(mt.Allocations))
+	}
+
+	if err := sa.Free(ptrs[0] + 1); err == nil {
+		t.Fatalf("Free of an address inside an object succeeded")
+	}
+	if err := sa.Free(1 << 19); !errors.Is(err, sharedmem.ErrNotSlabObject) {
+		t.Fatalf("Free of a foreign address = %v, want ErrNotSlabObject", err)
+	}
+	if err := sa.Free(extra); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+	if err := sa.Free(extra); err == nil {
+		t.Fatalf("double free succeeded")
+	}
+
+	// Emptying the first slab releases it, the second stays cached
+	for _, ptr := range ptrs {
+		if err := sa.Free(ptr); err != nil {
+			t.Fatalf("Free failed: %v", err)
+		}
+	}
+	if len(mt.Allocations) != 1 {
+		t.Fatalf("%d slab pages after freeing everything, want 1 cached", len(mt.Allocations))
+	}
+	if released, err := sa.Trim(); err != nil || released != sharedmem.PageSize {
+		t.Fatalf("Trim = %d, %v, want one page", released, err)
+	}
+	if len(mt.Allocations) != 0 {
+		t.Fatalf("%d allocations left after Trim", len(mt.Allocations))
+	}
+	if err := mt.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"bigLITTLE/sharedmem"
+	"encoding/binary"
+	"testing"
+)
+
+type particle struct {
+	X, Y  float32
+	Alive bool
+	ID    uint64
+}
+
+func TestTypedViews(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	v, err := sharedmem.New(64<<10, mem, "local")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	counter, err := sharedmem.NewValue[uint64](v, 0)
+	if err != nil {
+		t.Fatalf("NewValue failed: %v", err)
+	}
+	if err := counter.Set(0x0102030405060708); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	// Fixed little-endian layout
+	raw, _ := v.Read(0, 8)
+	if binary.LittleEndian.Uint64(raw) != 0x0102030405060708 {
+		t.Fatalf("value stored as % x", raw)
+	}
+
+	nums, err := sharedmem.NewArray[int32](v, 8, 1000)
+	if err != nil {
+		t.Fatalf("NewArray failed: %v", err)
+	}
+	src := make([]int32, 1000)
+	for i := range src {
+		src[i] = int32(i*i) - 5000
+	}
+	if err := nums.SetRange(0, src); err != nil {
+		t.Fatalf("SetRange failed: %v", err)
+	}
+	if err := nums.Range(10, 20, func(i uint64, x int32) bool {
+		if x != src[i] {
+			t.Fatalf("Range yielded %d at %d, want %d", x, i, src[i])
+		}
+		return true
+	}); err != nil {
+		t.Fatalf("Range failed: %v", err)
+	}
+	if x, err := nums.Get(999); err != nil || x != src[999] {
+		t.Fatalf("Get(999) = %d, %v", x, err)
+	}
+	if _, err := nums.Get(1000); err == nil {
+		t.Fatalf("Get past the end succeeded")
+	}
+	if _, err := sharedmem.NewArray[uint64](v, 8, 64<<10); err == nil {
+		t.Fatalf("array larger than the VMem accepted")
+	}
+
+	// Structs are packed: 4 + 4 + 1 + 8 bytes
+	ps, err := sharedmem.NewStructArray[particle](v, 8192, 3)
+	if err != nil {
+		t.Fatalf("NewStructArray failed: %v", err)
+	}
+	if ps.ElemSize() != 17 {
+		t.Fatalf("ElemSize = %d, want 17", ps.ElemSize())
+	}
+	want := particle{X: 1.5, Y: -2, Alive: true, ID: 42}
+	if err := ps.Set(2, want); err != nil {
+		t.Fatalf("struct Set failed: %v", err)
+	}
+	if got, err := ps.Get(2); err != nil || got != want {
+		t.Fatalf("struct Get = %+v, %v", got, err)
+	}
+
+	// Types without a fixed size are refused
+	type withPointer struct {
+		Next *particle
+	}
+	if _, err := sharedmem.NewStructValue[withPointer](v, 0); err == nil {
+		t.Fatalf("struct with a pointer accepted")
+	}
+	if _, err := sharedmem.NewStructValue[struct{ Name string }](v, 0); err == nil {
+		t.Fatalf("struct with a string accepted")
+	}
+	if _, err := sharedmem.NewStructValue[struct{ hidden uint32 }](v, 0); err == nil {
+		t.Fatalf("struct with an unexported field accepted")
+	}
+
+	// Struct views compile for any type, so pointers are refused when called
+	if _, err := sharedmem.NewStructValue[*particle](v, 0); err == nil {
+		t.Fatalf("pointer to a struct accepted")
+	}
+	if _, err := sharedmem.NewStructArray[*particle](v, 0, 1); err == nil {
+		t.Fatalf("array of pointers to a struct accepted")
+	}
+	if _, err := sharedmem.NewStructArray[[4]uint32](v, 0, 1); err == nil {
+		t.Fatalf("non-struct type accepted by NewStructArray")
+	}
+}
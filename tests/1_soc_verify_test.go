@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"bigLITTLE/agent"
+	"bigLITTLE/sharedmem"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifyAfterMixedOperations(t *testing.T) {
+	memTable, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 8 * 1024 * 1024, Owner: "a"},
+		{StartAddr: 8 * 1024 * 1024, Length: 8 * 1024 * 1024, Owner: "b"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create MemTable: %v", err)
+	}
+	mgr := agent.NewMemoryManager("a", memTable, 8*1024*1024, "a")
+
+	check := func(step string) {
+		t.Helper()
+		if err := memTable.Verify(); err != nil {
+			t.Fatalf("Verify after %s: %v", step, err)
+		}
+	}
+	check("creation")
+
+	r1, _ := mgr.AllocRegion(10000, "a")
+	r2, _ := mgr.AllocRegion(20000, "a")
+	pages, err := memTable.AllocPages(16, "b")
+	if err != nil {
+		t.Fatalf("AllocPages failed: %v", err)
+	}
+	check("allocations")
+
+	if err := mgr.UpdateOwnership(r2.StartAddr, 5000, "b"); err != nil {
+		t.Fatalf("UpdateOwnership failed: %v", err)
+	}
+	check("UpdateOwnership")
+
+	if err := memTable.FreePages(pages[4:]); err != nil {
+		t.Fatalf("FreePages failed: %v", err)
+	}
+	mgr.FreeRegion(r1.StartAddr)
+	check("frees")
+
+	memTable.SetPageBackend(sharedmem.PageBackendBuddy)
+	buddyPages, err := memTable.AllocPages(5, "a")
+	if err != nil {
+		t.Fatalf("Buddy AllocPages failed: %v", err)
+	}
+	check("buddy allocation")
+	memTable.FreePages(buddyPages)
+	check("buddy free")
+
+	if problems := mgr.VerifyTable(); len(problems) != 0 {
+		t.Errorf("VerifyTable reported %v", problems)
+	}
+}
+
+func TestVerifyDetectsDrift(t *testing.T) {
+	memTable, err := sharedmem.NewMemTable([]sharedmem.MemRegion{
+		{StartAddr: 0, Length: 1024 * 1024, Owner: "a"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create MemTable: %v", err)
+	}
+	region, _ := memTable.AllocRegion(4096, "a")
+
+	// Drop the allocation from the map only, leaving the index behind
+	delete(memTable.Allocations, region.StartAddr)
+	// And add a free region overlapping the allocation
+	memTable.FreeRegions.Insert(sharedmem.MemRegion{StartAddr: 100, Length: 10, Owner: "a"})
+
+	err = memTable.Verify()
+	var verr *sharedmem.VerifyError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected *VerifyError, got %v", err)
+	}
+	if len(verr.Problems) < 3 {
+		t.Errorf("Expected map mismatch, missing entry and overlap, got %v", verr.Problems)
+	}
+	for _, p := range verr.Problems {
+		t.Log(p)
+	}
+}
+
+func TestUpdateOwnershipKeepsBookkeepingConsistent(t *testing.T) {
+	mem := localManager(t, 1<<20)
+
+	// Part of a leased, labelled block changes hands; the rest keeps both
+	h, err := mem.AllocMovable(8192, "local")
+	if err != nil {
+		t.Fatalf("AllocMovable failed: %v", err)
+	}
+	split, _ := mem.Table.Resolve(h)
+	mem.Table.SetLabel(split.StartAddr, sharedmem.Label{Name: "split"})
+	if _, err := mem.Table.SetLease(split.StartAddr, "peer", "t1", time.Hour); err != nil {
+		t.Fatalf("SetLease failed: %v", err)
+	}
+	if err := mem.UpdateOwnership(split.StartAddr, 4096, "other"); err != nil {
+		t.Fatalf("UpdateOwnership failed: %v", err)
+	}
+	rest := split.StartAddr + 4096
+	if r, err := mem.Table.Resolve(h); err != nil || r.StartAddr != rest || r.Length != 4096 {
+		t.Fatalf("handle resolves to %+v, %v, want the remaining 4096 bytes at 0x%x", r, err, rest)
+	}
+	if label, ok := mem.Table.GetLabel(rest); !ok || label.Name != "split" {
+		t.Fatalf("label did not follow the rest of the block: %+v, %v", label, ok)
+	}
+	if _, ok := mem.Table.GetLease(rest); !ok {
+		t.Fatalf("lease did not follow the rest of the block")
+	}
+
+	// A block handed over whole loses its bookkeeping like a freed one
+	whole, _ := mem.AllocRegion(4096, "local")
+	mem.Table.SetLabel(whole.StartAddr, sharedmem.Label{Name: "whole"})
+	if err := mem.UpdateOwnership(whole.StartAddr, whole.Length, "other"); err != nil {
+		t.Fatalf("UpdateOwnership failed: %v", err)
+	}
+	if _, ok := mem.Table.GetLabel(whole.StartAddr); ok {
+		t.Fatalf("label left behind on a transferred block")
+	}
+
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
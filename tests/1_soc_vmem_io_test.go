@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"bigLITTLE/agent"
+	"bigLITTLE/sharedmem"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// chunkCounter records the largest single transfer reaching the manager.
+type chunkCounter struct {
+	*agent.MemoryManager
+	largest uint64
+}
+
+func (c *chunkCounter) Read(ctx context.Context, addr uint64, size uint64) ([]byte, error) {
+	c.largest = max(c.largest, size)
+	return c.MemoryManager.Read(ctx, addr, size)
+}
+
+func (c *chunkCounter) Write(ctx context.Context, addr uint64, data []byte) error {
+	c.largest = max(c.largest, uint64(len(data)))
+	return c.MemoryManager.Write(ctx, addr, data)
+}
+
+func TestVMemIO(t *testing.T) {
+	mem := &chunkCounter{MemoryManager: localManager(t, 8<<20)}
+	mem.SoftLimit = 8 << 20
+
+	v, err := sharedmem.New(3<<20, mem, "local")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	// io.Copy through a gzip stream, then back
+	payload := bytes.Repeat([]byte("0123456789abcdef"), (5<<20)/32)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(payload)
+	zw.Close()
+	zr, err := gzip.NewReader(&compressed)
+	if err != nil {
+		t.Fatalf("gzip.NewReader failed: %v", err)
+	}
+	w := v.Cursor()
+	if n, err := io.Copy(w, zr); err != nil || n != int64(len(payload)) {
+		t.Fatalf("io.Copy into VMem = %d, %v", n, err)
+	}
+
+	large := make([]byte, len(payload))
+	mem.largest = 0
+	if n, err := v.ReadAt(large, 0); err != nil || n != len(payload) || !bytes.Equal(large, payload) {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if mem.largest > sharedmem.IOChunkSize {
+		t.Fatalf("ReadAt moved %d bytes in one call, want at most %d", mem.largest, sharedmem.IOChunkSize)
+	}
+
+	// Seek and read to the end
+	r := v.Cursor()
+	if pos, err := r.Seek(-10, io.SeekEnd); err != nil || pos != int64(v.Size)-10 {
+		t.Fatalf("Seek = %d, %v", pos, err)
+	}
+	tail, err := io.ReadAll(r)
+	if err != nil || len(tail) != 10 {
+		t.Fatalf("ReadAll after Seek = %d bytes, %v", len(tail), err)
+	}
+
+	// The VMem does not grow
+	buf := make([]byte, 20)
+	if n, err := v.ReadAt(buf, int64(v.Size)-5); n != 5 || err != io.EOF {
+		t.Fatalf("ReadAt across the end = %d, %v", n, err)
+	}
+	if n, err := v.WriteAt(buf, int64(v.Size)-5); n != 5 || !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("WriteAt across the end = %d, %v", n, err)
+	}
+	if err := v.Free(); err != nil {
+		t.Fatalf("Free failed: %v", err)
+	}
+}
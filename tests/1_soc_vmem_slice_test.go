@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"bigLITTLE/sharedmem"
+)
+
+func TestVMemSlice(t *testing.T) {
+	mem := localManager(t, 1<<20)
+	mem.SoftLimit = 1 << 40
+	v, err := sharedmem.New(8192, mem, "local")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	s, err := v.Slice(4000, 200)
+	if err != nil {
+		t.Fatalf("Slice failed: %v", err)
+	}
+	if err := s.Write(0, []byte("window")); err != nil {
+		t.Fatalf("slice Write failed: %v", err)
+	}
+	if got, _ := v.Read(4000, 6); string(got) != "window" {
+		t.Fatalf("parent reads %q", got)
+	}
+	v.Write(4195, []byte("tail!"))
+	if got, _ := s.Read(195, 5); string(got) != "tail!" {
+		t.Fatalf("slice reads %q", got)
+	}
+
+	// Bounds are the slice's own
+	if err := s.Write(198, []byte("abc")); err == nil {
+		t.Fatalf("write past the slice end succeeded")
+	}
+	if _, err := s.Read(0, 201); err == nil {
+		t.Fatalf("read past the slice end succeeded")
+	}
+	if _, err := v.Slice(8000, 193); err == nil {
+		t.Fatalf("Slice past the parent end succeeded")
+	}
+	if _, err := v.Slice(^uint64(0), 2); err == nil {
+		t.Fatalf("overflowing Slice succeeded")
+	}
+
+	// Nested slices address the same memory
+	inner, err := s.Slice(100, 50)
+	if err != nil {
+		t.Fatalf("nested Slice failed: %v", err)
+	}
+	inner.Write(0, []byte("nested"))
+	if got, _ := v.Read(4100, 6); string(got) != "nested" {
+		t.Fatalf("parent reads %q through a nested slice", got)
+	}
+
+	// Read-only views
+	ro, err := v.ReadOnly().Slice(4000, 6)
+	if err != nil {
+		t.Fatalf("read-only Slice failed: %v", err)
+	}
+	if !ro.IsReadOnly() || s.IsReadOnly() {
+		t.Fatalf("read-only flags: ro=%v s=%v", ro.IsReadOnly(), s.IsReadOnly())
+	}
+	if err := ro.Write(0, []byte("x")); !errors.Is(err, sharedmem.ErrReadOnly) {
+		t.Fatalf("write to a read-only slice returned %v", err)
+	}
+	if _, err := ro.WriteAt([]byte("x"), 0); !errors.Is(err, sharedmem.ErrReadOnly) {
+		t.Fatalf("WriteAt to a read-only slice returned %v", err)
+	}
+	if got, _ := ro.Read(0, 6); string(got) != "window" {
+		t.Fatalf("read-only slice reads %q", got)
+	}
+
+	// Slices do not own memory
+	if err := s.Free(); err == nil {
+		t.Fatalf("Free on a slice succeeded")
+	}
+	if err := s.Resize(10); err == nil {
+		t.Fatalf("Resize on a slice succeeded")
+	}
+
+	// A slice follows its parent when it moves
+	blocker, _ := mem.AllocRegion(4096, "local")
+	if err := v.Resize(64 << 10); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	if got, _ := s.Read(0, 6); string(got) != "window" {
+		t.Fatalf("slice reads %q after the parent moved", got)
+	}
+
+	// And through the parent's copy-on-write view
+	clone, err := v.Clone()
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	cs, _ := clone.Slice(4000, 6)
+	cs.Write(0, []byte("cloned"))
+	if got, _ := s.Read(0, 6); string(got) != "window" {
+		t.Fatalf("original slice reads %q after the clone's slice wrote", got)
+	}
+	if got, _ := clone.Read(4000, 6); !bytes.Equal(got, []byte("cloned")) {
+		t.Fatalf("clone reads %q", got)
+	}
+
+	clone.Free()
+	v.Free()
+	mem.FreeRegion(blocker.StartAddr)
+	if err := mem.Table.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+}
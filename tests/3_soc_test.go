@@ -16,18 +16,14 @@ func TestLiveClusterOperations(t *testing.T) {
 	t.Log("=== Live Cluster Integration Test ===")
 	config.LoadConfig("config/socs.json")
 
-	// Initialize shared memory table with all SoC memory regions, spaced dynamically
-	var regions []sharedmem.MemRegion
-	var currentAddr uint64 = 0
-
+	// Initialize shared memory table with the sparse layout the master hands out
+	var memInfos []sharedmem.SoCMemInfo
 	for _, soc := range config.GlobalConfig.SoCs {
-		length := soc.MemoryMB * 1024 * 1024 // convert MB to bytes
-		regions = append(regions, sharedmem.MemRegion{
-			StartAddr: currentAddr,
-			Length:    length,
-			Owner:     soc.Name,
-		})
-		currentAddr += length
+		memInfos = append(memInfos, sharedmem.SoCMemInfo{Name: soc.Name, MemoryMB: soc.MemoryMB, BaseAddr: soc.BaseAddr})
+	}
+	regions, err := sharedmem.NewLayout().Assign(memInfos)
+	if err != nil {
+		t.Fatalf("Failed to assign the address layout: %v", err)
 	}
 
 	memTable, err := sharedmem.NewMemTable(regions)